@@ -0,0 +1,322 @@
+package cache
+
+import (
+	"container/list"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Cache is an in-memory LRU cache whose entries expire after a TTL. The TTL
+// of the cache can be overridden for every entry. Concurrent loads of the
+// same key are merged into a single load.
+type Cache[V any] struct {
+	ttl time.Duration
+	// size is the maximum number of entries. The size is not limited if it
+	// is 0.
+	size int
+	now  func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	// lru has the most recently used entry at the front
+	lru   *list.List
+	loads map[string]*load[V]
+	// generation is incremented by Purge. Loads that started in an earlier
+	// generation do not cache their value.
+	generation uint64
+
+	hits       atomic.Int64
+	misses     atomic.Int64
+	loadCount  atomic.Int64
+	loadErrors atomic.Int64
+	evictions  atomic.Int64
+}
+
+type entry[V any] struct {
+	key       string
+	value     V
+	expiresAt time.Time
+}
+
+// load is a load in progress. done is closed when it completes.
+type load[V any] struct {
+	done  chan struct{}
+	value V
+	err   error
+	// generation is the generation of the cache when the load started
+	generation uint64
+}
+
+// Loader loads the value of a key. The value is cached for ttl, or for the
+// TTL of the cache if ttl is not positive.
+type Loader[V any] func() (value V, ttl time.Duration, err error)
+
+// Stored is called with a loaded value and its TTL when the value is cached,
+// with the cache locked so that the key cannot be removed in between. It is
+// not called for values that are not cached because the key was removed or
+// the cache purged while loading. It must not call the cache.
+type Stored[V any] func(value V, ttl time.Duration)
+
+// Stats are the metrics of a cache since it was created. Misses are the
+// calls of Load that did not find the key.
+type Stats struct {
+	Size       int   `json:"size"`
+	Hits       int64 `json:"hits"`
+	Misses     int64 `json:"misses"`
+	Loads      int64 `json:"loads"`
+	LoadErrors int64 `json:"load_errors"`
+	Evictions  int64 `json:"evictions"`
+}
+
+// New returns a cache whose entries expire after ttl. At most size entries are
+// kept, the least recently used entry is evicted first. The size is not
+// limited if it is 0.
+func New[V any](ttl time.Duration, size int) *Cache[V] {
+	return &Cache[V]{
+		ttl:     ttl,
+		size:    size,
+		now:     time.Now,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+		loads:   make(map[string]*load[V]),
+	}
+}
+
+// Get returns the value of key if it is cached and has not expired. Only hits
+// are counted, misses are counted when the key is loaded.
+func (c *Cache[V]) Get(key string) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	value, found := c.get(key)
+	if found {
+		c.hits.Add(1)
+	}
+	return value, found
+}
+
+// Peek is like Get but does not count as a use of the entry
+func (c *Cache[V]) Peek(key string) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, found := c.entries[key]
+	if !found || !c.now().Before(element.Value.(*entry[V]).expiresAt) {
+		var zero V
+		return zero, false
+	}
+	return element.Value.(*entry[V]).value, true
+}
+
+// ExpiresAt returns the time at which the entry of key expires
+func (c *Cache[V]) ExpiresAt(key string) (time.Time, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, found := c.entries[key]
+	if !found || !c.now().Before(element.Value.(*entry[V]).expiresAt) {
+		return time.Time{}, false
+	}
+	return element.Value.(*entry[V]).expiresAt, true
+}
+
+func (c *Cache[V]) get(key string) (V, bool) {
+	var zero V
+	element, found := c.entries[key]
+	if !found {
+		return zero, false
+	}
+	e := element.Value.(*entry[V])
+	if !c.now().Before(e.expiresAt) {
+		c.removeElement(element)
+		return zero, false
+	}
+	c.lru.MoveToFront(element)
+	return e.value, true
+}
+
+// Set caches the value of key with the TTL of the cache
+func (c *Cache[V]) Set(key string, value V) {
+	c.SetWithTtl(key, value, 0)
+}
+
+// SetWithTtl caches the value of key for ttl, or for the TTL of the cache if
+// ttl is not positive
+func (c *Cache[V]) SetWithTtl(key string, value V, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.set(key, value, ttl)
+}
+
+func (c *Cache[V]) set(key string, value V, ttl time.Duration) {
+	if ttl <= 0 {
+		ttl = c.ttl
+	}
+	expiresAt := c.now().Add(ttl)
+	if element, found := c.entries[key]; found {
+		e := element.Value.(*entry[V])
+		e.value = value
+		e.expiresAt = expiresAt
+		c.lru.MoveToFront(element)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(&entry[V]{key: key, value: value, expiresAt: expiresAt})
+	if c.size > 0 && c.lru.Len() > c.size {
+		c.removeElement(c.lru.Back())
+		c.evictions.Add(1)
+	}
+}
+
+// Update replaces the value of key if it is cached, keeping its expiry.
+// Returns false if it was not cached.
+func (c *Cache[V]) Update(key string, value V) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, found := c.entries[key]
+	if !found || !c.now().Before(element.Value.(*entry[V]).expiresAt) {
+		return false
+	}
+	element.Value.(*entry[V]).value = value
+	return true
+}
+
+// Remove removes key from the cache. A load of the key in progress does not
+// cache its value and later calls load the key again. Returns false if it
+// was not cached.
+func (c *Cache[V]) Remove(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, found := c.entries[key]
+	if found {
+		c.removeElement(element)
+	}
+	delete(c.loads, key)
+	return found
+}
+
+// Purge removes all entries. Loads in progress do not cache their values and
+// later calls load the keys again.
+func (c *Cache[V]) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[string]*list.Element)
+	c.lru.Init()
+	c.loads = make(map[string]*load[V])
+	c.generation++
+}
+
+func (c *Cache[V]) removeElement(element *list.Element) {
+	c.lru.Remove(element)
+	delete(c.entries, element.Value.(*entry[V]).key)
+}
+
+// Keys returns the sorted keys of the entries that have not expired
+func (c *Cache[V]) Keys() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.removeExpired()
+	keys := make([]string, 0, len(c.entries))
+	for key := range c.entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Len returns the number of entries that have not expired
+func (c *Cache[V]) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.removeExpired()
+	return len(c.entries)
+}
+
+func (c *Cache[V]) removeExpired() {
+	now := c.now()
+	for _, element := range c.entries {
+		if !now.Before(element.Value.(*entry[V]).expiresAt) {
+			c.removeElement(element)
+		}
+	}
+}
+
+// Load returns the cached value of key, or loads and caches it. Errors are
+// not cached. A load of the key that is already in progress is waited for
+// instead of loading again.
+func (c *Cache[V]) Load(key string, loader Loader[V]) (value V, cacheHit bool, err error) {
+	return c.LoadNotify(key, loader, nil)
+}
+
+// LoadNotify is like Load and calls stored if the loaded value is cached, eg.
+// to keep state alongside the cache that must not outlive a removal
+func (c *Cache[V]) LoadNotify(key string, loader Loader[V], stored Stored[V]) (value V, cacheHit bool, err error) {
+	c.mu.Lock()
+	if value, found := c.get(key); found {
+		c.mu.Unlock()
+		c.hits.Add(1)
+		return value, true, nil
+	}
+	c.misses.Add(1)
+	value, err = c.load(key, loader, stored)
+	return value, false, err
+}
+
+// Reload loads and caches the value of key even if it is cached. A load of
+// the key that is already in progress is waited for instead of loading again.
+func (c *Cache[V]) Reload(key string, loader Loader[V]) (V, error) {
+	return c.ReloadNotify(key, loader, nil)
+}
+
+// ReloadNotify is like Reload and calls stored if the loaded value is cached
+func (c *Cache[V]) ReloadNotify(key string, loader Loader[V], stored Stored[V]) (V, error) {
+	c.mu.Lock()
+	return c.load(key, loader, stored)
+}
+
+// load must be called with c.mu locked and unlocks it
+func (c *Cache[V]) load(key string, loader Loader[V], stored Stored[V]) (V, error) {
+	if inProgress, found := c.loads[key]; found {
+		c.mu.Unlock()
+		<-inProgress.done
+		return inProgress.value, inProgress.err
+	}
+	l := &load[V]{done: make(chan struct{}), generation: c.generation}
+	c.loads[key] = l
+	c.mu.Unlock()
+
+	c.loadCount.Add(1)
+	var ttl time.Duration
+	l.value, ttl, l.err = loader()
+
+	c.mu.Lock()
+	// the load is no longer registered if the key was removed while loading
+	current := c.loads[key] == l && l.generation == c.generation
+	if current {
+		delete(c.loads, key)
+	}
+	if l.err != nil {
+		c.loadErrors.Add(1)
+	} else if current {
+		if ttl <= 0 {
+			ttl = c.ttl
+		}
+		c.set(key, l.value, ttl)
+		if stored != nil {
+			stored(l.value, ttl)
+		}
+	}
+	c.mu.Unlock()
+	close(l.done)
+	return l.value, l.err
+}
+
+// Stats returns the metrics of the cache
+func (c *Cache[V]) Stats() Stats {
+	return Stats{
+		Size:       c.Len(),
+		Hits:       c.hits.Load(),
+		Misses:     c.misses.Load(),
+		Loads:      c.loadCount.Load(),
+		LoadErrors: c.loadErrors.Load(),
+		Evictions:  c.evictions.Load(),
+	}
+}
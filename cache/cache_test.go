@@ -0,0 +1,232 @@
+package cache
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestCache(ttl time.Duration, size int) (*Cache[string], *time.Time) {
+	c := New[string](ttl, size)
+	now := time.Now()
+	c.now = func() time.Time { return now }
+	return c, &now
+}
+
+func TestCache_Expiry(t *testing.T) {
+	c, now := newTestCache(time.Minute, 0)
+	c.Set("a", "1")
+	c.SetWithTtl("b", "2", 10*time.Second)
+	if value, found := c.Get("a"); !found || value != "1" {
+		t.Errorf("Expected 'a' to be cached but got %q, %t", value, found)
+	}
+	*now = now.Add(10 * time.Second)
+	if _, found := c.Get("b"); found {
+		t.Errorf("Expected 'b' to expire after its own ttl")
+	}
+	if _, found := c.Peek("a"); !found {
+		t.Errorf("Expected 'a' to be cached")
+	}
+	*now = now.Add(time.Minute)
+	if _, found := c.Get("a"); found {
+		t.Errorf("Expected 'a' to expire after the ttl of the cache")
+	}
+	if c.Len() != 0 {
+		t.Errorf("Expected expired entries to be removed but got %d entries", c.Len())
+	}
+}
+
+func TestCache_Eviction(t *testing.T) {
+	c, _ := newTestCache(time.Minute, 2)
+	c.Set("a", "1")
+	c.Set("b", "2")
+	// 'a' is now the most recently used entry
+	c.Get("a")
+	c.Set("c", "3")
+	if keys := c.Keys(); !reflect.DeepEqual(keys, []string{"a", "c"}) {
+		t.Errorf("Expected the least recently used entry to be evicted but got keys %v", keys)
+	}
+	if evictions := c.Stats().Evictions; evictions != 1 {
+		t.Errorf("Expected 1 eviction but got %d", evictions)
+	}
+}
+
+func TestCache_RemoveAndPurge(t *testing.T) {
+	c, _ := newTestCache(time.Minute, 0)
+	c.Set("a", "1")
+	c.Set("b", "2")
+	if !c.Remove("a") || c.Remove("a") {
+		t.Errorf("Expected only the first removal of 'a' to succeed")
+	}
+	c.Purge()
+	if c.Len() != 0 {
+		t.Errorf("Expected cache to be empty but got %d entries", c.Len())
+	}
+}
+
+func TestCache_Update(t *testing.T) {
+	c, now := newTestCache(time.Minute, 0)
+	if c.Update("a", "1") {
+		t.Errorf("Expected update of a missing entry to fail")
+	}
+	c.Set("a", "1")
+	*now = now.Add(30 * time.Second)
+	if !c.Update("a", "2") {
+		t.Errorf("Expected update of 'a' to succeed")
+	}
+	if value, found := c.Get("a"); !found || value != "2" {
+		t.Errorf("Expected 'a' to be updated but got %q, %t", value, found)
+	}
+	*now = now.Add(30 * time.Second)
+	if _, found := c.Get("a"); found {
+		t.Errorf("Expected 'a' to expire after the ttl it was set with")
+	}
+}
+
+func TestCache_Load(t *testing.T) {
+	c, _ := newTestCache(time.Minute, 0)
+	loadErr := errors.New("store unavailable")
+	failing := true
+	loader := func() (string, time.Duration, error) {
+		if failing {
+			return "", 0, loadErr
+		}
+		return "1", 0, nil
+	}
+	if _, _, err := c.Load("a", loader); err != loadErr {
+		t.Errorf("Expected load error but got %v", err)
+	}
+	failing = false
+	if value, cacheHit, err := c.Load("a", loader); err != nil || cacheHit || value != "1" {
+		t.Errorf("Expected errors not to be cached but got %q, %t, %v", value, cacheHit, err)
+	}
+	if value, cacheHit, err := c.Load("a", loader); err != nil || !cacheHit || value != "1" {
+		t.Errorf("Expected cache hit but got %q, %t, %v", value, cacheHit, err)
+	}
+	expected := Stats{Size: 1, Hits: 1, Misses: 2, Loads: 2, LoadErrors: 1}
+	if stats := c.Stats(); stats != expected {
+		t.Errorf("Expected stats %+v but got %+v", expected, stats)
+	}
+}
+
+func TestCache_ConcurrentLoads(t *testing.T) {
+	c, _ := newTestCache(time.Minute, 0)
+	var loads atomic.Int64
+	release := make(chan struct{})
+	loader := func() (string, time.Duration, error) {
+		loads.Add(1)
+		<-release
+		return "1", 0, nil
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if value, _, err := c.Load("a", loader); err != nil || value != "1" {
+				t.Errorf("Unexpected load result %q, %v", value, err)
+			}
+		}()
+	}
+	for i := 0; loads.Load() == 0 && i < 100; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if loads.Load() != 1 {
+		t.Errorf("Expected concurrent loads to be merged but got %d loads", loads.Load())
+	}
+}
+
+func TestCache_Reload(t *testing.T) {
+	c, _ := newTestCache(time.Minute, 0)
+	c.Set("a", "1")
+	value, err := c.Reload("a", func() (string, time.Duration, error) {
+		return "2", time.Second, nil
+	})
+	if err != nil || value != "2" {
+		t.Errorf("Unexpected reload result %q, %v", value, err)
+	}
+	if value, _ := c.Get("a"); value != "2" {
+		t.Errorf("Expected reloaded value to be cached but got %q", value)
+	}
+	if expiresAt, _ := c.ExpiresAt("a"); expiresAt != c.now().Add(time.Second) {
+		t.Errorf("Expected reloaded value to be cached with the ttl of the loader")
+	}
+}
+
+func TestCache_FlushDuringLoad(t *testing.T) {
+	flushes := map[string]func(c *Cache[string]){
+		"remove": func(c *Cache[string]) { c.Remove("a") },
+		"purge":  func(c *Cache[string]) { c.Purge() },
+	}
+	for name, flush := range flushes {
+		c, _ := newTestCache(time.Minute, 0)
+		started := make(chan struct{})
+		release := make(chan struct{})
+		done := make(chan string)
+		go func() {
+			value, _, _ := c.Load("a", func() (string, time.Duration, error) {
+				close(started)
+				<-release
+				return "old", 0, nil
+			})
+			done <- value
+		}()
+		<-started
+		flush(c)
+		close(release)
+		if value := <-done; value != "old" {
+			t.Errorf("%s: Expected the load in progress to return its value but got %q", name, value)
+		}
+		if _, found := c.Get("a"); found {
+			t.Errorf("%s: Expected the value loaded before the flush not to be cached", name)
+		}
+		value, _, err := c.Load("a", func() (string, time.Duration, error) {
+			return "new", 0, nil
+		})
+		if err != nil || value != "new" {
+			t.Errorf("%s: Expected the key to be loaded again but got %q, %v", name, value, err)
+		}
+	}
+}
+
+func TestCache_LoadNotify(t *testing.T) {
+	c, _ := newTestCache(time.Minute, 0)
+	stored := make(map[string]time.Duration)
+	store := func(key string) Stored[string] {
+		return func(value string, ttl time.Duration) { stored[key+"="+value] = ttl }
+	}
+	c.LoadNotify("a", func() (string, time.Duration, error) { return "1", 0, nil }, store("a"))
+	c.ReloadNotify("b", func() (string, time.Duration, error) { return "2", time.Second, nil }, store("b"))
+	c.LoadNotify("c", func() (string, time.Duration, error) { return "", 0, errors.New("load failed") }, store("c"))
+	// hits are not stored again
+	c.LoadNotify("a", func() (string, time.Duration, error) { return "3", 0, nil }, store("a"))
+	expected := map[string]time.Duration{"a=1": time.Minute, "b=2": time.Second}
+	if !reflect.DeepEqual(stored, expected) {
+		t.Errorf("Expected stored values %v but got %v", expected, stored)
+	}
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		c.LoadNotify("d", func() (string, time.Duration, error) {
+			close(started)
+			<-release
+			return "4", 0, nil
+		}, store("d"))
+		close(done)
+	}()
+	<-started
+	c.Remove("d")
+	close(release)
+	<-done
+	if _, found := stored["d=4"]; found {
+		t.Errorf("Expected a value loaded while the key was removed not to be stored")
+	}
+}
@@ -0,0 +1,52 @@
+// Command csi-provider serves the file providers as a provider of the Secrets
+// Store CSI driver on a Unix socket. It runs as a DaemonSet next to the
+// driver, see the README for the config and the SecretProviderClass
+// parameters.
+//
+// Usage:
+//
+//	csi-provider -config /etc/csi-provider/config.yaml -socket /var/run/secrets-store-csi-providers/hasura-secret-refresh.sock
+package main
+
+import (
+	"flag"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/hasura/hasura-secret-refresh/csi"
+	"github.com/rs/zerolog"
+)
+
+func main() {
+	socket := flag.String("socket", csi.DefaultSocket, "path of the Unix socket the driver connects to")
+	configPath := flag.String("config", "./config.yaml", "path of the config with the namespaces and stores")
+	flag.Parse()
+
+	logger := zerolog.New(os.Stderr).With().Timestamp().Logger()
+	config, err := csi.ReadConfig(*configPath)
+	if err != nil {
+		logger.Fatal().Err(err).Str("config_file_path", *configPath).Msg("Unable to read CSI provider config")
+	}
+
+	p, err := csi.NewProvider(config, logger)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Unable to create CSI provider")
+	}
+	lis, err := csi.Listen(*socket)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Unable to listen on socket")
+	}
+	server := csi.NewServer(p)
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		<-signals
+		server.GracefulStop()
+	}()
+
+	logger.Info().Str("socket", *socket).Strs("namespaces", config.Namespaces).Msg("Serving CSI provider")
+	if err := server.Serve(lis); err != nil {
+		logger.Fatal().Err(err).Msg("Error from CSI provider")
+	}
+}
@@ -0,0 +1,55 @@
+// Command decrypt-secret decrypts a secret file written by a file provider
+// configured with output encryption and prints the plaintext to stdout.
+//
+// Usage:
+//
+//	decrypt-secret -key /keys/secret.key /secret/dbsecret.txt
+//
+// The encrypted secret is read from stdin when no file is given.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/hasura/hasura-secret-refresh/encryption"
+)
+
+func main() {
+	keyPath := flag.String("key", "", "path to the file holding the AES-256 key")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s -key <key file> [encrypted file]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if *keyPath == "" || flag.NArg() > 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	key, err := encryption.LoadKey(*keyPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	var ciphertext []byte
+	if flag.NArg() == 1 {
+		ciphertext, err = os.ReadFile(flag.Arg(0))
+	} else {
+		ciphertext, err = io.ReadAll(os.Stdin)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	plaintext, err := encryption.Decrypt(key, ciphertext)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Stdout.Write(plaintext)
+}
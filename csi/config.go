@@ -0,0 +1,133 @@
+package csi
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the config of the provider, set by the operator. Stores hold the
+// connection and auth configs of the file providers, so a SecretProviderClass
+// can only name a store and the secret to fetch from it:
+//
+//	namespaces: [apps]
+//	stores:
+//	  aws:
+//	    type: file_aws_secrets_manager
+//	    region: us-east-1
+//	    role_arn: arn:aws:iam::123456789012:role/apps
+//	  vault:
+//	    type: file_hashicorp_vault
+//	    vault_addr: https://vault.example.com:8200
+//	    auth:
+//	      role: apps
+type Config struct {
+	// Namespaces whose pods can mount secrets, at least one is required
+	Namespaces []string `yaml:"namespaces"`
+	// Stores by name, with the type and config of a file provider
+	Stores map[string]map[string]interface{} `yaml:"stores"`
+}
+
+// store is a file provider config of the operator, objects of a
+// SecretProviderClass add the configs in objectConfigs of its type to it
+type store struct {
+	name         string
+	providerType string
+	// audience of the service account token of the pod that secrets are
+	// fetched with
+	audience string
+	config   map[string]interface{}
+}
+
+// objectConfigs are the configs of a file provider that a SecretProviderClass
+// can set, all other configs are taken from the store
+var objectConfigs = map[string][]string{
+	awsSmFile:          {"secret_id", "template", "transform"},
+	azureKeyVaultFile:  {"secret_name", "secret_version", "template", "transform"},
+	hashicorpVaultFile: {"path", "mount", "version", "field", "template", "transform"},
+}
+
+// defaultAudiences are the audiences the token of the pod is exchanged with
+// by default, see the README for the tokenRequests of the CSIDriver
+var defaultAudiences = map[string]string{
+	awsSmFile:          "sts.amazonaws.com",
+	azureKeyVaultFile:  "api://AzureADTokenExchange",
+	hashicorpVaultFile: "",
+}
+
+// internalConfigs are set by the provider and cannot be set by a store
+var internalConfigs = []string{"path", "path_on_disk", "refresh", "output"}
+
+// ReadConfig reads the YAML config of the provider
+func ReadConfig(path string) (Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Config{}, fmt.Errorf("unable to read config: %w", err)
+	}
+	var config Config
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return Config{}, fmt.Errorf("unable to parse config: %w", err)
+	}
+	return config, nil
+}
+
+func parseStores(config Config) (map[string]store, error) {
+	if len(config.Stores) == 0 {
+		return nil, fmt.Errorf("config not valid: 'stores' not found")
+	}
+	stores := make(map[string]store, len(config.Stores))
+	for name, storeConfig := range config.Stores {
+		providerType, _ := storeConfig["type"].(string)
+		if _, found := objectConfigs[providerType]; !found {
+			return nil, fmt.Errorf("config not valid: type of store %s must be one of %s, %s or %s",
+				name, awsSmFile, azureKeyVaultFile, hashicorpVaultFile)
+		}
+		audience := defaultAudiences[providerType]
+		if audienceI, found := storeConfig["audience"]; found {
+			var ok bool
+			if audience, ok = audienceI.(string); !ok {
+				return nil, fmt.Errorf("config not valid: 'audience' of store %s must be a string", name)
+			}
+		}
+		for _, key := range internalConfigs {
+			if _, found := storeConfig[key]; found {
+				return nil, fmt.Errorf("config not valid: '%s' of store %s is set by the provider", key, name)
+			}
+		}
+		providerConfig := make(map[string]interface{}, len(storeConfig))
+		for k, v := range storeConfig {
+			if k != "type" && k != "audience" {
+				providerConfig[k] = v
+			}
+		}
+		stores[name] = store{name: name, providerType: providerType, audience: audience, config: providerConfig}
+	}
+	return stores, nil
+}
+
+// objectConfig returns the file provider config of an object of the store, or
+// an error if the object sets a config it is not allowed to
+func (s store) objectConfig(fileName string, object map[string]interface{}) (map[string]interface{}, error) {
+	allowed := objectConfigs[s.providerType]
+	config := make(map[string]interface{}, len(s.config)+len(object))
+	for k, v := range s.config {
+		config[k] = v
+	}
+	for k, v := range object {
+		if k == "fileName" || k == "store" {
+			continue
+		}
+		if !slices.Contains(allowed, k) {
+			return nil, fmt.Errorf("'%s' of object %s is not supported, objects of store %s can set %s",
+				k, fileName, s.name, strings.Join(allowed, ", "))
+		}
+		if _, found := s.config[k]; found {
+			return nil, fmt.Errorf("'%s' of object %s is set by store %s", k, fileName, s.name)
+		}
+		config[k] = v
+	}
+	return config, nil
+}
@@ -0,0 +1,286 @@
+// Package csi implements a provider of the Secrets Store CSI driver. The
+// objects of a SecretProviderClass are fetched with the file providers from a
+// store of the operator config (see Config), with the service account token
+// of the pod mounting them:
+//
+//	apiVersion: secrets-store.csi.x-k8s.io/v1
+//	kind: SecretProviderClass
+//	spec:
+//	  provider: hasura-secret-refresh
+//	  parameters:
+//	    objects: |
+//	      - fileName: db-url
+//	        store: aws
+//	        secret_id: prod/db
+//	        template: "postgres://##secret.username##:##secret.password##@db/app"
+package csi
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/hasura/hasura-secret-refresh/provider"
+	awsSm "github.com/hasura/hasura-secret-refresh/provider/aws_secrets_manager"
+	azureKv "github.com/hasura/hasura-secret-refresh/provider/azure_key_vault"
+	hashicorpVault "github.com/hasura/hasura-secret-refresh/provider/hashicorp_vault"
+	"github.com/rs/zerolog"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gopkg.in/yaml.v3"
+	"sigs.k8s.io/secrets-store-csi-driver/provider/v1alpha1"
+)
+
+const (
+	// DefaultSocket is where the driver looks for the provider named
+	// hasura-secret-refresh in a SecretProviderClass
+	DefaultSocket = "/var/run/secrets-store-csi-providers/hasura-secret-refresh.sock"
+
+	apiVersion  = "v1alpha1"
+	runtimeName = "hasura-secret-refresh"
+
+	objectsAttribute        = "objects"
+	podNameAttribute        = "csi.storage.k8s.io/pod.name"
+	podNamespaceAttribute   = "csi.storage.k8s.io/pod.namespace"
+	serviceAccountAttribute = "csi.storage.k8s.io/serviceAccount.name"
+	tokensAttribute         = "csi.storage.k8s.io/serviceAccount.tokens"
+
+	awsSmFile          = "file_aws_secrets_manager"
+	azureKeyVaultFile  = "file_azure_key_vault"
+	hashicorpVaultFile = "file_hashicorp_vault"
+)
+
+// RuntimeVersion is reported to the driver, it can be set at build time with
+// -ldflags "-X github.com/hasura/hasura-secret-refresh/csi.RuntimeVersion=..."
+var RuntimeVersion = "dev"
+
+// pathConfigs are the configs of the file providers holding the path of the
+// file. They are set from 'fileName' since the driver writes the files.
+var pathConfigs = map[string]string{
+	awsSmFile:          "path",
+	azureKeyVaultFile:  "path",
+	hashicorpVaultFile: "path_on_disk",
+}
+
+type createRendererFunc func(
+	providerType string, config map[string]interface{}, token provider.ServiceAccountToken, logger zerolog.Logger,
+) (provider.SecretRenderer, error)
+
+// Provider serves the provider API of the Secrets Store CSI driver. Secrets
+// are fetched with the service account token of the pod mounting them, which
+// the driver passes when the CSIDriver has tokenRequests for the audiences of
+// the stores. File providers are created for every mount and not reused, since
+// they hold the identity of the pod.
+type Provider struct {
+	v1alpha1.UnimplementedCSIDriverProviderServer
+	// namespaces that can mount secrets
+	namespaces     map[string]bool
+	stores         map[string]store
+	createRenderer createRendererFunc
+	// versionKey hides the secrets in the object versions reported to the
+	// driver, which are stored in the status of the pod
+	versionKey []byte
+	logger     zerolog.Logger
+}
+
+// mountObject is an object of a SecretProviderClass
+type mountObject struct {
+	fileName string
+	store    store
+	config   map[string]interface{}
+}
+
+// serviceAccountToken is a token of the tokensAttribute
+type serviceAccountToken struct {
+	Token string `json:"token"`
+}
+
+func NewProvider(config Config, logger zerolog.Logger) (*Provider, error) {
+	allowedNamespaces := make(map[string]bool, len(config.Namespaces))
+	for _, namespace := range config.Namespaces {
+		if namespace != "" {
+			allowedNamespaces[namespace] = true
+		}
+	}
+	if len(allowedNamespaces) == 0 {
+		return nil, fmt.Errorf("config not valid: 'namespaces' not found, the namespaces that can mount secrets are required")
+	}
+	stores, err := parseStores(config)
+	if err != nil {
+		return nil, err
+	}
+	versionKey := make([]byte, 32)
+	if _, err := rand.Read(versionKey); err != nil {
+		return nil, fmt.Errorf("unable to generate object version key: %w", err)
+	}
+	return &Provider{
+		namespaces:     allowedNamespaces,
+		stores:         stores,
+		createRenderer: createRenderer,
+		versionKey:     versionKey,
+		logger:         logger,
+	}, nil
+}
+
+// NewServer returns a gRPC server serving the provider
+func NewServer(p *Provider) *grpc.Server {
+	server := grpc.NewServer()
+	v1alpha1.RegisterCSIDriverProviderServer(server, p)
+	return server
+}
+
+// Listen listens on the Unix socket, replacing the socket of a previous run
+func Listen(socket string) (net.Listener, error) {
+	if err := os.Remove(socket); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("unable to remove socket %s: %w", socket, err)
+	}
+	return net.Listen("unix", socket)
+}
+
+func (p *Provider) Version(ctx context.Context, req *v1alpha1.VersionRequest) (*v1alpha1.VersionResponse, error) {
+	return &v1alpha1.VersionResponse{Version: apiVersion, RuntimeName: runtimeName, RuntimeVersion: RuntimeVersion}, nil
+}
+
+func (p *Provider) Mount(ctx context.Context, req *v1alpha1.MountRequest) (*v1alpha1.MountResponse, error) {
+	var attributes map[string]string
+	if err := json.Unmarshal([]byte(req.Attributes), &attributes); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "unable to parse attributes: %s", err)
+	}
+	var mode int32
+	if err := json.Unmarshal([]byte(req.Permission), &mode); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "unable to parse permission: %s", err)
+	}
+	namespace := attributes[podNamespaceAttribute]
+	logger := p.logger.With().
+		Str("pod_namespace", namespace).
+		Str("pod_name", attributes[podNameAttribute]).
+		Str("service_account", attributes[serviceAccountAttribute]).
+		Logger()
+	if !p.namespaces[namespace] {
+		logger.Error().Msg("csi: Namespace is not allowed to mount secrets")
+		return nil, status.Errorf(codes.PermissionDenied, "namespace %s is not allowed to mount secrets", namespace)
+	}
+	objects, err := parseObjects(attributes[objectsAttribute], p.stores)
+	if err != nil {
+		logger.Err(err).Msg("csi: Invalid objects in SecretProviderClass")
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	tokens := make(map[string]serviceAccountToken)
+	if tokensJson := attributes[tokensAttribute]; tokensJson != "" {
+		if err := json.Unmarshal([]byte(tokensJson), &tokens); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "unable to parse service account tokens: %s", err)
+		}
+	}
+	response := &v1alpha1.MountResponse{
+		ObjectVersion: make([]*v1alpha1.ObjectVersion, 0, len(objects)),
+		Files:         make([]*v1alpha1.File, 0, len(objects)),
+	}
+	for _, object := range objects {
+		objectLogger := logger.With().Str("file_name", object.fileName).Str("store", object.store.name).Logger()
+		token, found := tokens[object.store.audience]
+		if !found || token.Token == "" {
+			objectLogger.Error().Str("audience", object.store.audience).Msg("csi: Service account token not found")
+			return nil, status.Errorf(codes.FailedPrecondition,
+				"object %s: no service account token for audience '%s', add it to the tokenRequests of the CSIDriver",
+				object.fileName, object.store.audience)
+		}
+		renderer, err := p.createRenderer(
+			object.store.providerType, object.config,
+			func() (string, error) { return token.Token, nil },
+			objectLogger,
+		)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "object %s: %s", object.fileName, err)
+		}
+		secret, err := renderer.RenderSecret()
+		if err != nil {
+			objectLogger.Err(err).Msg("csi: Unable to fetch secret")
+			return nil, status.Errorf(codes.Unavailable, "object %s: unable to fetch secret: %s", object.fileName, err)
+		}
+		response.Files = append(response.Files, &v1alpha1.File{Path: object.fileName, Mode: mode, Contents: []byte(secret)})
+		response.ObjectVersion = append(response.ObjectVersion, &v1alpha1.ObjectVersion{Id: object.fileName, Version: p.version(secret)})
+	}
+	logger.Info().Int("objects", len(objects)).Msg("csi: Mounted secrets")
+	return response, nil
+}
+
+func (p *Provider) version(secret string) string {
+	mac := hmac.New(sha256.New, p.versionKey)
+	mac.Write([]byte(secret))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// parseObjects parses the 'objects' parameter of a SecretProviderClass, a YAML
+// list of objects with the name of the file in 'fileName', the name of the
+// store in 'store' and the configs of the store type in objectConfigs
+func parseObjects(objectsYaml string, stores map[string]store) ([]mountObject, error) {
+	if objectsYaml == "" {
+		return nil, fmt.Errorf("parameter '%s' not found", objectsAttribute)
+	}
+	var objectConfigs []map[string]interface{}
+	if err := yaml.Unmarshal([]byte(objectsYaml), &objectConfigs); err != nil {
+		return nil, fmt.Errorf("unable to parse '%s': %w", objectsAttribute, err)
+	}
+	objects := make([]mountObject, 0, len(objectConfigs))
+	fileNames := make(map[string]bool, len(objectConfigs))
+	for i, config := range objectConfigs {
+		fileName, ok := config["fileName"].(string)
+		if !ok || !filepath.IsLocal(fileName) {
+			return nil, fmt.Errorf("'fileName' of object %d must be a relative path", i)
+		}
+		if fileNames[fileName] {
+			return nil, fmt.Errorf("'fileName' %s is used by more than one object", fileName)
+		}
+		fileNames[fileName] = true
+		storeName, _ := config["store"].(string)
+		store, found := stores[storeName]
+		if !found {
+			return nil, fmt.Errorf("'store' of object %s must be a store of the provider config", fileName)
+		}
+		providerConfig, err := store.objectConfig(fileName, config)
+		if err != nil {
+			return nil, err
+		}
+		providerConfig[pathConfigs[store.providerType]] = fileName
+		// the driver refreshes secrets with its rotation interval
+		providerConfig["refresh"] = 0
+		objects = append(objects, mountObject{fileName: fileName, store: store, config: providerConfig})
+	}
+	return objects, nil
+}
+
+func createRenderer(
+	providerType string, config map[string]interface{}, token provider.ServiceAccountToken, logger zerolog.Logger,
+) (provider.SecretRenderer, error) {
+	switch providerType {
+	case awsSmFile:
+		fileProvider, err := awsSm.CreateAwsSecretsManagerFileWithToken(config, token, logger)
+		if err != nil {
+			return nil, err
+		}
+		return fileProvider, nil
+	case azureKeyVaultFile:
+		fileProvider, err := azureKv.CreateAzureKeyVaultFileWithToken(config, token, logger)
+		if err != nil {
+			return nil, err
+		}
+		return fileProvider, nil
+	case hashicorpVaultFile:
+		fileProvider, err := hashicorpVault.CreateHashicorpVaultFileWithToken(config, token, logger)
+		if err != nil {
+			return nil, err
+		}
+		return fileProvider, nil
+	}
+	return nil, fmt.Errorf("unknown provider type %s", providerType)
+}
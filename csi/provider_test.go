@@ -0,0 +1,300 @@
+package csi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hasura/hasura-secret-refresh/provider"
+	"github.com/rs/zerolog"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"sigs.k8s.io/secrets-store-csi-driver/provider/v1alpha1"
+)
+
+type mockRenderer struct {
+	secret string
+}
+
+func (m *mockRenderer) RenderSecret() (string, error) {
+	if m.secret == "" {
+		return "", fmt.Errorf("secret not found")
+	}
+	return m.secret, nil
+}
+
+// mockRenderers returns the secret_id or path of the object as the secret and
+// records the service account tokens the file providers are created with
+func mockRenderers(tokens *[]string) createRendererFunc {
+	return func(
+		providerType string, config map[string]interface{}, token provider.ServiceAccountToken, logger zerolog.Logger,
+	) (provider.SecretRenderer, error) {
+		jwt, err := token()
+		if err != nil {
+			return nil, err
+		}
+		*tokens = append(*tokens, jwt)
+		secret, _ := config["secret_id"].(string)
+		if providerType == hashicorpVaultFile {
+			secret, _ = config["path"].(string)
+		}
+		return &mockRenderer{secret: secret}, nil
+	}
+}
+
+// startProvider serves the provider on a Unix socket and returns a client
+// calling it like the driver
+func startProvider(t *testing.T, p *Provider) v1alpha1.CSIDriverProviderClient {
+	socket := filepath.Join(t.TempDir(), "provider.sock")
+	lis, err := Listen(socket)
+	if err != nil {
+		t.Fatalf("Unable to listen on socket: %s", err)
+	}
+	server := NewServer(p)
+	go server.Serve(lis)
+	t.Cleanup(server.Stop)
+	conn, err := grpc.NewClient("unix://"+socket, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("Unable to connect to provider: %s", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return v1alpha1.NewCSIDriverProviderClient(conn)
+}
+
+// podTokens are the service account tokens the driver passes for a CSIDriver
+// with tokenRequests for the default audiences of AWS and Vault
+const podTokens = `{"sts.amazonaws.com": {"token": "aws-jwt", "expirationTimestamp": "2030-01-01T00:00:00Z"},` +
+	` "": {"token": "vault-jwt", "expirationTimestamp": "2030-01-01T00:00:00Z"}}`
+
+func mount(client v1alpha1.CSIDriverProviderClient, namespace string, objects string) (*v1alpha1.MountResponse, error) {
+	return mountWithTokens(client, namespace, objects, podTokens)
+}
+
+func mountWithTokens(client v1alpha1.CSIDriverProviderClient, namespace, objects, tokens string) (*v1alpha1.MountResponse, error) {
+	attributes, _ := json.Marshal(map[string]string{
+		objectsAttribute:        objects,
+		podNamespaceAttribute:   namespace,
+		podNameAttribute:        "app-0",
+		serviceAccountAttribute: "app",
+		tokensAttribute:         tokens,
+	})
+	request := &v1alpha1.MountRequest{Attributes: string(attributes), Secrets: "{}", TargetPath: "/mnt/secrets", Permission: "420"}
+	return client.Mount(context.Background(), request)
+}
+
+func getTestConfig() Config {
+	return Config{
+		Namespaces: []string{"apps"},
+		Stores: map[string]map[string]interface{}{
+			"aws": {
+				"type":     awsSmFile,
+				"region":   "us-east-1",
+				"role_arn": "arn:aws:iam::123456789012:role/apps",
+			},
+			"vault": {
+				"type":       hashicorpVaultFile,
+				"vault_addr": "https://vault.example.com:8200",
+				"auth":       map[string]interface{}{"role": "apps"},
+				"mount":      "kv",
+			},
+			"azure": {
+				"type":      azureKeyVaultFile,
+				"vault_url": "https://apps.vault.azure.net",
+				"tenant_id": "tenant",
+				"client_id": "client",
+			},
+		},
+	}
+}
+
+func getTestProvider(t *testing.T, tokens *[]string) *Provider {
+	p, err := NewProvider(getTestConfig(), zerolog.Nop())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	p.createRenderer = mockRenderers(tokens)
+	return p
+}
+
+func TestNewProvider_ConfigErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		update func(config *Config)
+	}{
+		{"no namespaces", func(config *Config) { config.Namespaces = nil }},
+		{"empty namespace", func(config *Config) { config.Namespaces = []string{""} }},
+		{"no stores", func(config *Config) { config.Stores = nil }},
+		{"unknown type", func(config *Config) { config.Stores["aws"]["type"] = "proxy_aws_secrets_manager" }},
+		{"invalid audience", func(config *Config) { config.Stores["aws"]["audience"] = 1 }},
+		{"path", func(config *Config) { config.Stores["aws"]["path"] = "/etc/passwd" }},
+		{"output", func(config *Config) { config.Stores["vault"]["output"] = map[string]interface{}{"mode": "json"} }},
+	}
+	for _, test := range tests {
+		config := getTestConfig()
+		test.update(&config)
+		if _, err := NewProvider(config, zerolog.Nop()); err == nil {
+			t.Errorf("%s: Expected an error", test.name)
+		}
+	}
+}
+
+func TestReadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	os.WriteFile(path, []byte(`
+namespaces: [apps]
+stores:
+  vault:
+    type: file_hashicorp_vault
+    vault_addr: https://vault.example.com:8200
+    audience: vault
+    auth:
+      role: apps
+`), 0o600)
+	config, err := ReadConfig(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	stores, err := parseStores(config)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	vault := stores["vault"]
+	if vault.providerType != hashicorpVaultFile || vault.audience != "vault" {
+		t.Errorf("Unexpected store %v", vault)
+	}
+	if _, found := vault.config["audience"]; found {
+		t.Errorf("Expected 'audience' not to be passed to the file provider")
+	}
+	if _, ok := vault.config["auth"].(map[string]interface{}); !ok {
+		t.Errorf("Expected 'auth' to be an object but got %T", vault.config["auth"])
+	}
+}
+
+func TestProvider_Version(t *testing.T) {
+	client := startProvider(t, getTestProvider(t, new([]string)))
+	response, err := client.Version(context.Background(), &v1alpha1.VersionRequest{Version: apiVersion})
+	if err != nil || response.Version != apiVersion || response.RuntimeName != runtimeName {
+		t.Errorf("Unexpected version response %v, %v", response, err)
+	}
+}
+
+func TestProvider_Mount(t *testing.T) {
+	tokens := []string{}
+	client := startProvider(t, getTestProvider(t, &tokens))
+	objects := `
+- fileName: db-url
+  store: aws
+  secret_id: prod/db
+- fileName: config/api-key
+  store: vault
+  path: secret/api
+`
+	response, err := mount(client, "apps", objects)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(response.Files) != 2 || len(response.ObjectVersion) != 2 {
+		t.Fatalf("Expected 2 files and object versions but got %v", response)
+	}
+	if file := response.Files[0]; file.Path != "db-url" || string(file.Contents) != "prod/db" || file.Mode != 0o644 {
+		t.Errorf("Unexpected file %v", file)
+	}
+	if file := response.Files[1]; file.Path != "config/api-key" || string(file.Contents) != "secret/api" {
+		t.Errorf("Unexpected file %v", file)
+	}
+	version := response.ObjectVersion[0]
+	if version.Id != "db-url" || version.Version == "" || version.Version == "prod/db" {
+		t.Errorf("Unexpected object version %v", version)
+	}
+
+	// file providers hold the identity of the pod, so they are created for
+	// every mount, and versions are stable while secrets do not change
+	response, err = mount(client, "apps", objects)
+	if err != nil || response.ObjectVersion[0].Version != version.Version {
+		t.Errorf("Expected the same object version but got %v, %v", response, err)
+	}
+	if strings.Join(tokens, ",") != "aws-jwt,vault-jwt,aws-jwt,vault-jwt" {
+		t.Errorf("Expected file providers to be created with the tokens of the pod but got %v", tokens)
+	}
+}
+
+func TestProvider_MountErrors(t *testing.T) {
+	client := startProvider(t, getTestProvider(t, new([]string)))
+	tests := []struct {
+		name      string
+		namespace string
+		objects   string
+		tokens    string
+		code      codes.Code
+	}{
+		{"namespace not allowed", "default", "- {fileName: a, store: aws, secret_id: a}", podTokens, codes.PermissionDenied},
+		{"missing objects", "apps", "", podTokens, codes.InvalidArgument},
+		{"invalid yaml", "apps", "fileName: [", podTokens, codes.InvalidArgument},
+		{"unknown store", "apps", "- {fileName: a, store: gcp, secret_id: a}", podTokens, codes.InvalidArgument},
+		{"type", "apps", "- {fileName: a, type: file_aws_secrets_manager, region: us-east-1, secret_id: a}", podTokens, codes.InvalidArgument},
+		{"store config", "apps", "- {fileName: a, store: aws, region: eu-west-1, secret_id: a}", podTokens, codes.InvalidArgument},
+		{"role", "apps", "- {fileName: a, store: aws, role_arn: 'arn:aws:iam::1:role/admin', secret_id: a}", podTokens, codes.InvalidArgument},
+		{"vault_addr", "apps", "- {fileName: a, store: vault, vault_addr: 'https://attacker', path: a}", podTokens, codes.InvalidArgument},
+		{"jwt_path", "apps", "- {fileName: a, store: vault, auth: {role: apps, jwt_path: /etc/passwd}, path: a}", podTokens, codes.InvalidArgument},
+		{"set by store", "apps", "- {fileName: a, store: vault, mount: secret, path: a}", podTokens, codes.InvalidArgument},
+		{"path", "apps", "- {fileName: a, store: aws, path: /etc/passwd, secret_id: a}", podTokens, codes.InvalidArgument},
+		{"output", "apps", "- {fileName: a, store: aws, secret_id: a, output: {mode: json}}", podTokens, codes.InvalidArgument},
+		{"absolute file name", "apps", "- {fileName: /etc/passwd, store: aws}", podTokens, codes.InvalidArgument},
+		{"parent file name", "apps", "- {fileName: ../a, store: aws}", podTokens, codes.InvalidArgument},
+		{"duplicate file name", "apps", "- {fileName: a, store: aws}\n- {fileName: a, store: vault}", podTokens, codes.InvalidArgument},
+		{"invalid tokens", "apps", "- {fileName: a, store: aws, secret_id: a}", "{", codes.InvalidArgument},
+		{"no tokens", "apps", "- {fileName: a, store: aws, secret_id: a}", "", codes.FailedPrecondition},
+		{"no token for audience", "apps", "- {fileName: a, store: azure, secret_name: a}", podTokens, codes.FailedPrecondition},
+		{"fetch error", "apps", "- {fileName: a, store: aws}", podTokens, codes.Unavailable},
+	}
+	for _, test := range tests {
+		_, err := mountWithTokens(client, test.namespace, test.objects, test.tokens)
+		if status.Code(err) != test.code {
+			t.Errorf("%s: Expected code %s but got %v", test.name, test.code, err)
+		}
+	}
+}
+
+func TestParseObjects(t *testing.T) {
+	stores, err := parseStores(getTestConfig())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	objects, err := parseObjects(`
+- fileName: db-url
+  store: vault
+  path: secret/db
+  version: 2
+  transform:
+    key_mappings:
+      - from: user
+        to: username
+`, stores)
+	if err != nil || len(objects) != 1 {
+		t.Fatalf("Unexpected objects %v, %v", objects, err)
+	}
+	config := objects[0].config
+	if config["path_on_disk"] != "db-url" || config["path"] != "secret/db" || config["version"] != 2 || config["refresh"] != 0 {
+		t.Errorf("Unexpected file provider config %v", config)
+	}
+	if config["vault_addr"] != "https://vault.example.com:8200" || config["mount"] != "kv" {
+		t.Errorf("Expected the store config in the file provider config but got %v", config)
+	}
+	for _, key := range []string{"fileName", "store"} {
+		if _, found := config[key]; found {
+			t.Errorf("Expected '%s' not to be passed to the file provider", key)
+		}
+	}
+	if _, ok := config["transform"].(map[string]interface{}); !ok {
+		t.Errorf("Expected 'transform' to be an object but got %T", config["transform"])
+	}
+	if _, found := stores["vault"].config["path_on_disk"]; found {
+		t.Errorf("Expected the store config not to be modified")
+	}
+}
@@ -0,0 +1,118 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+)
+
+/*
+	Encrypted secrets are stored as base64 (standard encoding) of
+
+		version (1 byte) | nonce (12 bytes) | AES-256-GCM ciphertext and tag
+
+	The version byte is also passed as additional authenticated data so that it
+	cannot be tampered with independently of the ciphertext.
+*/
+
+const (
+	// KeySize is the size of an AES-256 key in bytes
+	KeySize = 32
+
+	formatVersion byte = 1
+)
+
+var (
+	ErrInvalidKey        = errors.New("encryption: invalid key")
+	ErrInvalidCiphertext = errors.New("encryption: invalid ciphertext")
+)
+
+// LoadKey reads an AES-256 key from a file. The file may contain either the
+// 32 raw key bytes or the key encoded as base64.
+func LoadKey(path string) ([]byte, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("%w: unable to read key file %s: %v", ErrInvalidKey, path, err)
+	}
+	return ParseKey(contents)
+}
+
+// ParseKey accepts either 32 raw key bytes or a base64 encoded 32 byte key.
+func ParseKey(contents []byte) ([]byte, error) {
+	if len(contents) == KeySize {
+		return contents, nil
+	}
+	trimmed := bytes.TrimSpace(contents)
+	key := make([]byte, base64.StdEncoding.DecodedLen(len(trimmed)))
+	n, err := base64.StdEncoding.Decode(key, trimmed)
+	if err != nil {
+		return nil, fmt.Errorf("%w: key must be %d raw bytes or base64 encoded", ErrInvalidKey, KeySize)
+	}
+	if n != KeySize {
+		return nil, fmt.Errorf("%w: key must be %d bytes long, got %d", ErrInvalidKey, KeySize, n)
+	}
+	return key[:n], nil
+}
+
+// Encrypt seals plaintext with AES-256-GCM and returns it in the text format
+// described above.
+func Encrypt(key []byte, plaintext []byte) ([]byte, error) {
+	aead, err := newAead(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("encryption: unable to generate nonce: %w", err)
+	}
+	sealed := make([]byte, 0, 1+len(nonce)+len(plaintext)+aead.Overhead())
+	sealed = append(sealed, formatVersion)
+	sealed = append(sealed, nonce...)
+	sealed = aead.Seal(sealed, nonce, plaintext, []byte{formatVersion})
+	encoded := make([]byte, base64.StdEncoding.EncodedLen(len(sealed)))
+	base64.StdEncoding.Encode(encoded, sealed)
+	return encoded, nil
+}
+
+// Decrypt reverses Encrypt. Surrounding whitespace in ciphertext is ignored.
+func Decrypt(key []byte, ciphertext []byte) ([]byte, error) {
+	aead, err := newAead(key)
+	if err != nil {
+		return nil, err
+	}
+	trimmed := bytes.TrimSpace(ciphertext)
+	sealed := make([]byte, base64.StdEncoding.DecodedLen(len(trimmed)))
+	n, err := base64.StdEncoding.Decode(sealed, trimmed)
+	if err != nil {
+		return nil, fmt.Errorf("%w: not valid base64: %v", ErrInvalidCiphertext, err)
+	}
+	sealed = sealed[:n]
+	if len(sealed) < 1+aead.NonceSize()+aead.Overhead() {
+		return nil, fmt.Errorf("%w: ciphertext is too short", ErrInvalidCiphertext)
+	}
+	if sealed[0] != formatVersion {
+		return nil, fmt.Errorf("%w: unsupported format version %d", ErrInvalidCiphertext, sealed[0])
+	}
+	nonce := sealed[1 : 1+aead.NonceSize()]
+	plaintext, err := aead.Open(nil, nonce, sealed[1+aead.NonceSize():], []byte{formatVersion})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCiphertext, err)
+	}
+	return plaintext, nil
+}
+
+func newAead(key []byte) (cipher.AEAD, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("%w: key must be %d bytes long, got %d", ErrInvalidKey, KeySize, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidKey, err)
+	}
+	return cipher.NewGCM(block)
+}
@@ -4,14 +4,17 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"strings"
 
 	"github.com/hasura/hasura-secret-refresh/provider"
 	awsIamRds "github.com/hasura/hasura-secret-refresh/provider/aws_iam_auth_rds"
 	awsSm "github.com/hasura/hasura-secret-refresh/provider/aws_secrets_manager"
+	awsSigV4 "github.com/hasura/hasura-secret-refresh/provider/aws_sigv4"
 	awsSmOauth "github.com/hasura/hasura-secret-refresh/provider/aws_sm_oauth"
 	azureKv "github.com/hasura/hasura-secret-refresh/provider/azure_key_vault"
 	fileJson "github.com/hasura/hasura-secret-refresh/provider/file_json"
 	hashicorpVault "github.com/hasura/hasura-secret-refresh/provider/hashicorp_vault"
+	hmacSigner "github.com/hasura/hasura-secret-refresh/provider/hmac"
 	"github.com/hasura/hasura-secret-refresh/server"
 	"github.com/rs/zerolog"
 	"github.com/spf13/viper"
@@ -33,6 +36,8 @@ const (
 const (
 	aws_secrets_manager  = "proxy_aws_secrets_manager"
 	aws_sm_oauth         = "proxy_awssm_oauth"
+	aws_sigv4            = "proxy_aws_sigv4"
+	hmac_signer          = "proxy_hmac"
 	aws_sm_file          = "file_aws_secrets_manager"
 	aws_iam_auth_rds     = "file_aws_iam_auth_rds"
 	azure_key_vault      = "proxy_azure_key_vault"
@@ -81,9 +86,9 @@ func main() {
 	}
 	zLogLevel := getLogLevel(logLevel, logger)
 	zerolog.SetGlobalLevel(zLogLevel)
-	totalProviders := len(fileProviders) + len(config.Providers)
-	logger.Info().Msgf("%d providers initialized: %d file provider, %d http provider",
-		totalProviders, len(fileProviders), len(config.Providers),
+	totalProviders := len(fileProviders) + len(config.Providers) + len(config.Signers)
+	logger.Info().Msgf("%d providers initialized: %d file provider, %d http provider, %d signing provider",
+		totalProviders, len(fileProviders), len(config.Providers), len(config.Signers),
 	)
 
 	// if the type is init container, then we need to identify the last execution status to mark
@@ -116,6 +121,29 @@ func main() {
 		w.WriteHeader(http.StatusOK)
 	})
 
+	// state of the guards of the secret stores of providers
+	http.Handle("/healthz/providers", server.ProviderStatus{
+		Guards:    config.ProviderGuards,
+		Providers: config.Providers,
+	})
+
+	if config.CacheAdmin != nil {
+		http.Handle(config.CacheAdmin.Endpoint, config.CacheAdmin)
+		http.Handle(config.CacheAdmin.Endpoint+"/", config.CacheAdmin)
+	}
+
+	if config.SecretsApi != nil {
+		http.Handle(config.SecretsApi.Endpoint+"/", config.SecretsApi)
+	}
+
+	// the AWS Secrets Manager Agent API is served by at most one provider
+	for name, p := range config.Providers {
+		if awsSmProvider, ok := p.(*awsSm.AwsSecretsManager); ok && awsSmProvider.Agent() != nil {
+			http.Handle(awsSm.AgentPath, awsSmProvider.Agent())
+			logger.Info().Msgf("AWS Secrets Manager Agent endpoint served by provider %s", name)
+		}
+	}
+
 	refreshEndpoint := viper.GetString("refresh_config.endpoint")
 	if _, hasRefreshConfig := conf["refresh_config"]; hasRefreshConfig {
 		refreshConfig := make(map[string]provider.FileProvider)
@@ -126,7 +154,7 @@ func main() {
 		http.Handle(refreshEndpoint, refresher)
 		logger.Info().Msgf("Refresh endpoint set to: %s", refreshEndpoint)
 	}
-	err = http.ListenAndServe(":5353", nil)
+	err = http.ListenAndServe(":5353", httpServer.Handler(http.DefaultServeMux))
 	if err != nil {
 		logger.Err(err).Msg("Error from server")
 	}
@@ -150,7 +178,11 @@ func getLogLevel(level string, logger zerolog.Logger) zerolog.Level {
 
 func parseConfig(rawConfig map[string]interface{}, logger zerolog.Logger) (config server.Config, fileProviders []provider.FileProvider, deploymentType DeploymentType, err error) {
 	config.Providers = make(map[string]provider.HttpProvider)
+	config.Signers = make(map[string]provider.RequestSigner)
 	fileProviders = make([]provider.FileProvider, 0, 0)
+	// hmac signers fetch their key with the http providers, so they are
+	// created once all the other providers are
+	hmacSigners := make(map[string]map[string]interface{})
 	for k, v := range rawConfig {
 		if k == "type" {
 			t := v.(string)
@@ -162,7 +194,10 @@ func parseConfig(rawConfig map[string]interface{}, logger zerolog.Logger) (confi
 			}
 			continue
 		}
-		if k == "log_config" || k == "refresh_config" {
+		if k == "log_config" || k == "refresh_config" || k == "routes" || k == "destination_allowlist" ||
+			k == "retry_on_auth_failure" || k == "forward_proxy" || k == "error_details" ||
+			k == "access_log" || k == "proxy_timeout" || k == "cache_admin" ||
+			k == "secrets_api" {
 			continue
 		}
 		providerData, ok := v.(map[string]interface{})
@@ -197,6 +232,16 @@ func parseConfig(rawConfig map[string]interface{}, logger zerolog.Logger) (confi
 				return
 			}
 			config.Providers[k] = provider_
+		} else if providerType == aws_sigv4 {
+			var signer provider.RequestSigner
+			signer, err = awsSigV4.Create(providerData, sublogger)
+			if err != nil {
+				sublogger.Err(err).Msgf("Error creating provider")
+				return
+			}
+			config.Signers[k] = signer
+		} else if providerType == hmac_signer {
+			hmacSigners[k] = providerData
 		} else if providerType == aws_sm_file {
 			var fProvider_ provider.FileProvider
 			fProvider_, err = awsSm.CreateAwsSecretsManagerFile(providerData, sublogger)
@@ -259,6 +304,132 @@ func parseConfig(rawConfig map[string]interface{}, logger zerolog.Logger) (confi
 			return
 		}
 	}
+	for k, providerData := range hmacSigners {
+		sublogger := logger.With().Str("provider_name", k).Str("provider_type", hmac_signer).Logger()
+		var signer provider.RequestSigner
+		signer, err = hmacSigner.Create(providerData, config.Providers, sublogger)
+		if err != nil {
+			sublogger.Err(err).Msgf("Error creating provider")
+			return
+		}
+		config.Signers[k] = signer
+	}
+	config.DestinationAllowlist, err = server.ParseDestinationAllowlistFromConfig(rawConfig, logger)
+	if err != nil {
+		logger.Err(err).Msgf("Error in destination allowlist config")
+		return
+	}
+	agentProviders := make([]string, 0)
+	for k, p := range config.Providers {
+		if awsSmProvider, ok := p.(*awsSm.AwsSecretsManager); ok && awsSmProvider.Agent() != nil {
+			agentProviders = append(agentProviders, k)
+		}
+	}
+	if len(agentProviders) > 1 {
+		err = fmt.Errorf("config not valid: only one provider can enable 'agent', found %s", strings.Join(agentProviders, ", "))
+		logger.Err(err).Msgf("Error in agent config")
+		return
+	}
+	proxyProviders := make([]string, 0, len(config.Providers)+len(config.Signers))
+	for k := range config.Providers {
+		proxyProviders = append(proxyProviders, k)
+	}
+	for k := range config.Signers {
+		proxyProviders = append(proxyProviders, k)
+	}
+	config.ProviderDestinationAllowlists = make(map[string]*server.DestinationAllowlist)
+	for _, k := range proxyProviders {
+		sublogger := logger.With().Str("provider_name", k).Logger()
+		config.ProviderDestinationAllowlists[k], err = server.ParseDestinationAllowlistFromConfig(
+			rawConfig[k].(map[string]interface{}), sublogger,
+		)
+		if err != nil {
+			sublogger.Err(err).Msgf("Error in destination allowlist config")
+			return
+		}
+	}
+	config.ProviderTransports = make(map[string]*http.Transport)
+	for _, k := range proxyProviders {
+		sublogger := logger.With().Str("provider_name", k).Logger()
+		config.ProviderTransports[k], err = server.ParseTransportFromConfig(
+			rawConfig[k].(map[string]interface{}), config.Providers, sublogger,
+		)
+		if err != nil {
+			sublogger.Err(err).Msgf("Error in transport config")
+			return
+		}
+	}
+	config.ProviderGuards = make(map[string]*server.ProviderGuard)
+	for k := range config.Providers {
+		sublogger := logger.With().Str("provider_name", k).Logger()
+		config.ProviderGuards[k], err = server.ParseProviderGuardFromConfig(
+			rawConfig[k].(map[string]interface{}), sublogger,
+		)
+		if err != nil {
+			sublogger.Err(err).Msgf("Error in provider guard config")
+			return
+		}
+	}
+	config.CacheBypasses = make(map[string]*server.CacheBypass)
+	for k := range config.Providers {
+		sublogger := logger.With().Str("provider_name", k).Logger()
+		config.CacheBypasses[k], err = server.ParseCacheBypassFromConfig(
+			rawConfig[k].(map[string]interface{}), sublogger,
+		)
+		if err != nil {
+			sublogger.Err(err).Msgf("Error in cache bypass config")
+			return
+		}
+	}
+	config.ProxyTimeout, err = server.ParseProxyTimeoutFromConfig(rawConfig, logger)
+	if err != nil {
+		logger.Err(err).Msgf("Error in proxy_timeout config")
+		return
+	}
+	config.Routes, err = server.ParseRoutesFromConfig(rawConfig["routes"], config.Providers, config.Signers, logger)
+	if err != nil {
+		logger.Err(err).Msgf("Error in routes config")
+		return
+	}
+	config.ForwardProxy, err = server.ParseForwardProxyFromConfig(rawConfig, config.Providers, config.Signers, logger)
+	if err != nil {
+		logger.Err(err).Msgf("Error in forward_proxy config")
+		return
+	}
+	config.AuthFailureRetry, err = server.ParseAuthFailureRetryFromConfig(rawConfig, logger)
+	if err != nil {
+		logger.Err(err).Msgf("Error in retry_on_auth_failure config")
+		return
+	}
+	config.ErrorDetails, err = server.ParseErrorDetailsFromConfig(rawConfig, logger)
+	if err != nil {
+		logger.Err(err).Msgf("Error in error_details config")
+		return
+	}
+	config.AccessLog, err = server.ParseAccessLogFromConfig(rawConfig, logger)
+	if err != nil {
+		logger.Err(err).Msgf("Error in access_log config")
+		return
+	}
+	config.CacheAdmin, err = server.ParseCacheAdminFromConfig(rawConfig, logger)
+	if err != nil {
+		logger.Err(err).Msgf("Error in cache_admin config")
+		return
+	}
+	if config.CacheAdmin != nil {
+		config.CacheAdmin.Providers = config.Providers
+		config.CacheAdmin.Guards = config.ProviderGuards
+	}
+	config.SecretsApi, err = server.ParseSecretsApiFromConfig(rawConfig, config.Providers, logger)
+	if err != nil {
+		logger.Err(err).Msgf("Error in secrets_api config")
+		return
+	}
+	if config.SecretsApi != nil {
+		config.SecretsApi.Providers = config.Providers
+		config.SecretsApi.Guards = config.ProviderGuards
+		config.SecretsApi.CacheBypasses = config.CacheBypasses
+	}
 	return
 }
 
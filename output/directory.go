@@ -0,0 +1,194 @@
+package output
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	sharedprovider "github.com/hasura/hasura-secret-refresh/provider"
+	"github.com/rs/zerolog"
+)
+
+const (
+	// dataDirName is the symlink that always points at the directory holding
+	// the current set of secret files. Every per-key file in the output
+	// directory is a symlink through it, so swapping this one link switches
+	// all keys at once. This mirrors the layout of Kubernetes secret volumes.
+	dataDirName    = "..data"
+	dataDirTmpName = "..data_tmp"
+	// timestampDirPrefix is prefixed to the per-write directories. Names
+	// starting with ".." are reserved and never used for secret keys.
+	timestampDirPrefix = ".."
+	timestampFormat    = "2006_01_02_15_04_05."
+)
+
+const secretDirMode os.FileMode = 0o755
+
+func prepareSecretDirectory(dir string) error {
+	if err := os.MkdirAll(dir, secretDirMode); err != nil {
+		return err
+	}
+	return os.Chmod(dir, secretDirMode)
+}
+
+// writeSecretDirectory explodes a JSON secret into one file per top-level key
+// inside dir. The files are written into a fresh timestamped directory which
+// is then published by atomically renaming the '..data' symlink, so readers
+// never observe a mix of old and new values. Keys which are no longer present
+// in the secret are removed. encode is applied to the contents of every file.
+func writeSecretDirectory(dir string, secretString string, encode func([]byte) ([]byte, error), logger zerolog.Logger) error {
+	files, err := secretFiles(secretString)
+	if err != nil {
+		return err
+	}
+	if err := prepareSecretDirectory(dir); err != nil {
+		return err
+	}
+
+	dataLink := filepath.Join(dir, dataDirName)
+	oldTarget, err := os.Readlink(dataLink)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("unable to read symlink %s: %w", dataLink, err)
+	}
+
+	tsDir, err := os.MkdirTemp(dir, timestampDirPrefix+time.Now().UTC().Format(timestampFormat))
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(tsDir, secretDirMode); err != nil {
+		os.RemoveAll(tsDir)
+		return err
+	}
+	for name, contents := range files {
+		encoded, err := encode(contents)
+		if err != nil {
+			os.RemoveAll(tsDir)
+			return err
+		}
+		if err := sharedprovider.WriteSecretFile(filepath.Join(tsDir, name), encoded); err != nil {
+			os.RemoveAll(tsDir)
+			return err
+		}
+	}
+
+	tmpLink := filepath.Join(dir, dataDirTmpName)
+	if err := os.Remove(tmpLink); err != nil && !os.IsNotExist(err) {
+		os.RemoveAll(tsDir)
+		return err
+	}
+	if err := os.Symlink(filepath.Base(tsDir), tmpLink); err != nil {
+		os.RemoveAll(tsDir)
+		return err
+	}
+	if err := os.Rename(tmpLink, dataLink); err != nil {
+		os.RemoveAll(tsDir)
+		return err
+	}
+
+	for name := range files {
+		if err := linkSecretKey(dir, name); err != nil {
+			return err
+		}
+	}
+	if err := removeStaleKeys(dir, files, logger); err != nil {
+		return err
+	}
+
+	if isTimestampDir(oldTarget) && oldTarget != filepath.Base(tsDir) {
+		if err := os.RemoveAll(filepath.Join(dir, oldTarget)); err != nil {
+			logger.Err(err).Msgf("Unable to remove previous secret directory %s", oldTarget)
+		}
+	}
+	logger.Debug().Int("keys", len(files)).Str("dir", dir).Msg("Wrote secret directory")
+	return nil
+}
+
+// linkSecretKey makes sure that dir/name is a symlink to '..data/name'.
+func linkSecretKey(dir string, name string) error {
+	link := filepath.Join(dir, name)
+	target := filepath.Join(dataDirName, name)
+	if existing, err := os.Readlink(link); err == nil && existing == target {
+		return nil
+	}
+	tmpLink := filepath.Join(dir, dataDirTmpName+"_"+name)
+	if err := os.Remove(tmpLink); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Symlink(target, tmpLink); err != nil {
+		return err
+	}
+	return os.Rename(tmpLink, link)
+}
+
+// removeStaleKeys removes the per-key symlinks of keys that disappeared from
+// the secret. Only symlinks that point into '..data' are touched so that other
+// files placed in the directory are left alone.
+func removeStaleKeys(dir string, files map[string][]byte, logger zerolog.Logger) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, timestampDirPrefix) {
+			continue
+		}
+		if _, found := files[name]; found {
+			continue
+		}
+		link := filepath.Join(dir, name)
+		target, err := os.Readlink(link)
+		if err != nil || target != filepath.Join(dataDirName, name) {
+			continue
+		}
+		if err := os.Remove(link); err != nil {
+			return err
+		}
+		logger.Info().Msgf("Removed key %s which is no longer present in the secret", name)
+	}
+	return nil
+}
+
+// secretFiles converts a JSON object into file contents keyed by file name.
+// String values are written as-is, every other value is written as JSON.
+func secretFiles(secretString string) (map[string][]byte, error) {
+	secretData := make(map[string]interface{})
+	if err := json.Unmarshal([]byte(secretString), &secretData); err != nil {
+		return nil, fmt.Errorf("directory output requires the secret to be a JSON object: %w", err)
+	}
+	files := make(map[string][]byte, len(secretData))
+	for key, value := range secretData {
+		if err := validateKey(key); err != nil {
+			return nil, err
+		}
+		switch typed := value.(type) {
+		case string:
+			files[key] = []byte(typed)
+		case nil:
+			files[key] = []byte("")
+		default:
+			contents, err := json.Marshal(typed)
+			if err != nil {
+				return nil, fmt.Errorf("unable to encode value of key %s: %w", key, err)
+			}
+			files[key] = contents
+		}
+	}
+	return files, nil
+}
+
+func validateKey(key string) error {
+	if key == "" || key == "." || strings.HasPrefix(key, timestampDirPrefix) || strings.ContainsAny(key, `/\`) {
+		return fmt.Errorf("secret key %q cannot be used as a file name", key)
+	}
+	return nil
+}
+
+func isTimestampDir(name string) bool {
+	return strings.HasPrefix(name, timestampDirPrefix) &&
+		name != dataDirName &&
+		!strings.ContainsAny(name, `/\`)
+}
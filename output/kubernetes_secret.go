@@ -0,0 +1,289 @@
+package output
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+const (
+	serviceAccountDir           = "/var/run/secrets/kubernetes.io/serviceaccount"
+	defaultServiceAccountToken  = serviceAccountDir + "/token"
+	defaultServiceAccountCACert = serviceAccountDir + "/ca.crt"
+	serviceAccountNamespace     = serviceAccountDir + "/namespace"
+
+	// fieldManager identifies this service as the owner of the fields it
+	// writes through server-side apply.
+	fieldManager = "hasura-secret-refresh"
+
+	kubernetesRequestTimeout = 30 * time.Second
+)
+
+// kubernetesSecretTarget upserts the secret into a Kubernetes Secret object
+// using the in-cluster service account credentials.
+type kubernetesSecretTarget struct {
+	name      string
+	namespace string
+	// key stores the whole secret under a single data key
+	key string
+	// keys maps data keys of the Kubernetes Secret to keys of a JSON secret
+	keys   map[string]string
+	labels map[string]string
+
+	apiServer  string
+	tokenPath  string
+	httpClient *http.Client
+	logger     zerolog.Logger
+}
+
+func parseKubernetesSecretTarget(config map[string]interface{}, logger zerolog.Logger) (*kubernetesSecretTarget, error) {
+	target := &kubernetesSecretTarget{
+		tokenPath: defaultServiceAccountToken,
+		logger:    logger,
+	}
+
+	nameI, found := config["name"]
+	if !found {
+		logger.Error().Msg("output.kubernetes_secret.name not found")
+		return nil, fmt.Errorf("required configs not found: output.kubernetes_secret.name")
+	}
+	name, ok := nameI.(string)
+	if !ok || name == "" {
+		logger.Error().Msg("output.kubernetes_secret.name must be a non-empty string")
+		return nil, fmt.Errorf("config not valid: output.kubernetes_secret.name must be a non-empty string")
+	}
+	target.name = name
+
+	if namespaceI, found := config["namespace"]; found {
+		namespace, ok := namespaceI.(string)
+		if !ok {
+			logger.Error().Msg("output.kubernetes_secret.namespace must be a string")
+			return nil, fmt.Errorf("config not valid: output.kubernetes_secret.namespace must be a string")
+		}
+		target.namespace = namespace
+	}
+	if target.namespace == "" {
+		namespace, err := os.ReadFile(serviceAccountNamespace)
+		if err != nil {
+			logger.Err(err).Msg("output.kubernetes_secret.namespace not set and the pod namespace could not be read")
+			return nil, fmt.Errorf("required configs not found: output.kubernetes_secret.namespace")
+		}
+		target.namespace = strings.TrimSpace(string(namespace))
+	}
+
+	if keyI, found := config["key"]; found {
+		key, ok := keyI.(string)
+		if !ok {
+			logger.Error().Msg("output.kubernetes_secret.key must be a string")
+			return nil, fmt.Errorf("config not valid: output.kubernetes_secret.key must be a string")
+		}
+		target.key = key
+	}
+	keys, err := parseStringPairs(config, "keys", "key", "secret_key", logger)
+	if err != nil {
+		return nil, err
+	}
+	target.keys = keys
+	labels, err := parseStringPairs(config, "labels", "name", "value", logger)
+	if err != nil {
+		return nil, err
+	}
+	target.labels = labels
+
+	apiServer := ""
+	if apiServerI, found := config["api_server"]; found {
+		apiServer, ok = apiServerI.(string)
+		if !ok {
+			logger.Error().Msg("output.kubernetes_secret.api_server must be a string")
+			return nil, fmt.Errorf("config not valid: output.kubernetes_secret.api_server must be a string")
+		}
+	}
+	if apiServer == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			logger.Error().Msg("output.kubernetes_secret.api_server not set and not running inside a Kubernetes cluster")
+			return nil, fmt.Errorf("required configs not found: output.kubernetes_secret.api_server")
+		}
+		apiServer = "https://" + net.JoinHostPort(host, port)
+	}
+	target.apiServer = strings.TrimRight(apiServer, "/")
+
+	if tokenPathI, found := config["token_path"]; found {
+		tokenPath, ok := tokenPathI.(string)
+		if !ok {
+			logger.Error().Msg("output.kubernetes_secret.token_path must be a string")
+			return nil, fmt.Errorf("config not valid: output.kubernetes_secret.token_path must be a string")
+		}
+		target.tokenPath = tokenPath
+	}
+
+	caCertPath := defaultServiceAccountCACert
+	if caCertPathI, found := config["ca_cert_path"]; found {
+		caCertPath, ok = caCertPathI.(string)
+		if !ok {
+			logger.Error().Msg("output.kubernetes_secret.ca_cert_path must be a string")
+			return nil, fmt.Errorf("config not valid: output.kubernetes_secret.ca_cert_path must be a string")
+		}
+	}
+	httpClient, err := newKubernetesHttpClient(caCertPath)
+	if err != nil {
+		logger.Err(err).Msg("Unable to create Kubernetes API client")
+		return nil, fmt.Errorf("config not valid: %w", err)
+	}
+	target.httpClient = httpClient
+	return target, nil
+}
+
+func newKubernetesHttpClient(caCertPath string) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	caCert, err := os.ReadFile(caCertPath)
+	if err == nil {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("no certificates found in %s", caCertPath)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	} else if caCertPath != defaultServiceAccountCACert {
+		return nil, fmt.Errorf("unable to read CA certificate %s: %w", caCertPath, err)
+	}
+	return &http.Client{Transport: transport, Timeout: kubernetesRequestTimeout}, nil
+}
+
+// parseStringPairs parses a list of objects with the string fields keyField
+// and valueField into a map. Lists are used rather than maps since the config
+// loader lowercases map keys, while data keys and labels are case-sensitive.
+func parseStringPairs(
+	config map[string]interface{}, field, keyField, valueField string, logger zerolog.Logger,
+) (map[string]string, error) {
+	result := make(map[string]string)
+	valueI, found := config[field]
+	if !found {
+		return result, nil
+	}
+	valueList, ok := valueI.([]interface{})
+	if !ok {
+		logger.Error().Msgf("output.kubernetes_secret.%s must be a list", field)
+		return nil, fmt.Errorf("config not valid: output.kubernetes_secret.%s must be a list", field)
+	}
+	for i, pairI := range valueList {
+		pair, ok := pairI.(map[string]interface{})
+		if !ok {
+			logger.Error().Msgf("output.kubernetes_secret.%s[%d] must be an object", field, i)
+			return nil, fmt.Errorf("config not valid: output.kubernetes_secret.%s[%d] must be an object", field, i)
+		}
+		key, keyOk := pair[keyField].(string)
+		value, valueOk := pair[valueField].(string)
+		if !keyOk || key == "" || !valueOk {
+			logger.Error().Msgf("output.kubernetes_secret.%s[%d] must have string fields '%s' and '%s'", field, i, keyField, valueField)
+			return nil, fmt.Errorf("config not valid: output.kubernetes_secret.%s[%d] must have string fields '%s' and '%s'",
+				field, i, keyField, valueField)
+		}
+		if _, found := result[key]; found {
+			logger.Error().Msgf("output.kubernetes_secret.%s has duplicate %s '%s'", field, keyField, key)
+			return nil, fmt.Errorf("config not valid: output.kubernetes_secret.%s has duplicate %s '%s'", field, keyField, key)
+		}
+		result[key] = value
+	}
+	return result, nil
+}
+
+// secretData builds the data of the Kubernetes Secret. If neither 'key' nor
+// 'keys' is configured, every top-level key of a JSON secret becomes a data
+// key.
+func (t *kubernetesSecretTarget) secretData(secretString string) (map[string][]byte, error) {
+	data := make(map[string][]byte)
+	if t.key != "" {
+		data[t.key] = []byte(secretString)
+	}
+	if t.key != "" && len(t.keys) == 0 {
+		return data, nil
+	}
+	files, err := secretFiles(secretString)
+	if err != nil {
+		return nil, err
+	}
+	if len(t.keys) == 0 {
+		return files, nil
+	}
+	for dataKey, secretKey := range t.keys {
+		value, found := files[secretKey]
+		if !found {
+			return nil, fmt.Errorf("key %s not found in secret", secretKey)
+		}
+		data[dataKey] = value
+	}
+	return data, nil
+}
+
+// upsert creates or updates the Secret with server-side apply. Data keys
+// which were written previously but are no longer part of the secret are
+// removed by the API server, other fields of the object are left untouched.
+func (t *kubernetesSecretTarget) upsert(secretString string) error {
+	data, err := t.secretData(secretString)
+	if err != nil {
+		return err
+	}
+	metadata := map[string]interface{}{
+		"name":      t.name,
+		"namespace": t.namespace,
+	}
+	if len(t.labels) != 0 {
+		metadata["labels"] = t.labels
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Secret",
+		"type":       "Opaque",
+		"metadata":   metadata,
+		"data":       data,
+	})
+	if err != nil {
+		return err
+	}
+
+	token, err := os.ReadFile(t.tokenPath)
+	if err != nil {
+		return fmt.Errorf("unable to read service account token: %w", err)
+	}
+	query := url.Values{}
+	query.Set("fieldManager", fieldManager)
+	query.Set("force", "true")
+	secretUrl := fmt.Sprintf("%s/api/v1/namespaces/%s/secrets/%s?%s",
+		t.apiServer, url.PathEscape(t.namespace), url.PathEscape(t.name), query.Encode(),
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), kubernetesRequestTimeout)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, http.MethodPatch, secretUrl, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/apply-patch+yaml")
+	request.Header.Set("Accept", "application/json")
+	request.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	response, err := t.httpClient.Do(request)
+	if err != nil {
+		return fmt.Errorf("unable to upsert Kubernetes secret %s/%s: %w", t.namespace, t.name, err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK && response.StatusCode != http.StatusCreated {
+		responseBody, _ := io.ReadAll(io.LimitReader(response.Body, 4096))
+		return fmt.Errorf("unable to upsert Kubernetes secret %s/%s: received status %d: %s",
+			t.namespace, t.name, response.StatusCode, string(responseBody),
+		)
+	}
+	t.logger.Info().Msgf("Updated Kubernetes secret %s/%s with %d keys", t.namespace, t.name, len(data))
+	return nil
+}
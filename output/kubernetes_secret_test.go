@@ -0,0 +1,206 @@
+package output
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type appliedSecret struct {
+	Metadata struct {
+		Name      string            `json:"name"`
+		Namespace string            `json:"namespace"`
+		Labels    map[string]string `json:"labels"`
+	} `json:"metadata"`
+	Data map[string][]byte `json:"data"`
+}
+
+// fakeApiServer records the Secret objects applied to it
+func fakeApiServer(t *testing.T, status int) (*httptest.Server, *[]appliedSecret) {
+	applied := make([]appliedSecret, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPatch, r.Method)
+		assert.Equal(t, "/api/v1/namespaces/hasura/secrets/db-creds", r.URL.Path)
+		assert.Equal(t, fieldManager, r.URL.Query().Get("fieldManager"))
+		assert.Equal(t, "application/apply-patch+yaml", r.Header.Get("Content-Type"))
+		assert.Equal(t, "Bearer test-token", r.Header.Get("Authorization"))
+		var secret appliedSecret
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&secret))
+		applied = append(applied, secret)
+		rw.WriteHeader(status)
+		rw.Write([]byte(`{}`))
+	}))
+	t.Cleanup(server.Close)
+	return server, &applied
+}
+
+func kubernetesOutputConfig(t *testing.T, apiServer string, extra map[string]interface{}) map[string]interface{} {
+	tokenPath := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(tokenPath, []byte("test-token\n"), 0o600))
+	kubernetesSecret := map[string]interface{}{
+		"name":       "db-creds",
+		"namespace":  "hasura",
+		"api_server": apiServer,
+		"token_path": tokenPath,
+	}
+	for k, v := range extra {
+		kubernetesSecret[k] = v
+	}
+	return map[string]interface{}{
+		"output": map[string]interface{}{
+			"kubernetes_secret": kubernetesSecret,
+		},
+	}
+}
+
+func TestSecretOutput_KubernetesSecretAllKeys(t *testing.T) {
+	server, applied := fakeApiServer(t, http.StatusOK)
+	config := kubernetesOutputConfig(t, server.URL, map[string]interface{}{
+		"labels": []interface{}{map[string]interface{}{"name": "app", "value": "hasura"}},
+	})
+	secretOutput, err := ParseSecretOutputFromConfig(config, zerolog.Nop())
+	require.NoError(t, err)
+	filePath := filepath.Join(t.TempDir(), "secret")
+
+	require.NoError(t, secretOutput.Write(filePath, `{"username": "admin", "password": "secret"}`))
+
+	require.Len(t, *applied, 1)
+	secret := (*applied)[0]
+	assert.Equal(t, "db-creds", secret.Metadata.Name)
+	assert.Equal(t, "hasura", secret.Metadata.Namespace)
+	assert.Equal(t, map[string]string{"app": "hasura"}, secret.Metadata.Labels)
+	assert.Equal(t, map[string][]byte{"username": []byte("admin"), "password": []byte("secret")}, secret.Data)
+	_, err = os.Stat(filePath)
+	assert.NoError(t, err, "file must still be written by default")
+}
+
+func TestSecretOutput_KubernetesSecretSelectedKeys(t *testing.T) {
+	server, applied := fakeApiServer(t, http.StatusCreated)
+	config := kubernetesOutputConfig(t, server.URL, map[string]interface{}{
+		"key":  "connection.json",
+		"keys": []interface{}{map[string]interface{}{"key": "DB_USER", "secret_key": "username"}},
+	})
+	config["output"].(map[string]interface{})["write_file"] = false
+	secretOutput, err := ParseSecretOutputFromConfig(config, zerolog.Nop())
+	require.NoError(t, err)
+	filePath := filepath.Join(t.TempDir(), "secret")
+
+	require.NoError(t, secretOutput.Write(filePath, `{"username": "admin", "password": "secret"}`))
+
+	require.Len(t, *applied, 1)
+	assert.Equal(t, map[string][]byte{
+		"connection.json": []byte(`{"username": "admin", "password": "secret"}`),
+		"DB_USER":         []byte("admin"),
+	}, (*applied)[0].Data)
+	_, err = os.Stat(filePath)
+	assert.True(t, os.IsNotExist(err), "file must not be written when write_file is false")
+}
+
+func TestSecretOutput_KubernetesSecretPlainSecret(t *testing.T) {
+	server, applied := fakeApiServer(t, http.StatusOK)
+	config := kubernetesOutputConfig(t, server.URL, map[string]interface{}{"key": "token"})
+	secretOutput, err := ParseSecretOutputFromConfig(config, zerolog.Nop())
+	require.NoError(t, err)
+
+	require.NoError(t, secretOutput.Write(filepath.Join(t.TempDir(), "secret"), "plain-token"))
+
+	require.Len(t, *applied, 1)
+	assert.Equal(t, map[string][]byte{"token": []byte("plain-token")}, (*applied)[0].Data)
+}
+
+func TestSecretOutput_KubernetesSecretErrors(t *testing.T) {
+	server, _ := fakeApiServer(t, http.StatusForbidden)
+	secretOutput, err := ParseSecretOutputFromConfig(kubernetesOutputConfig(t, server.URL, nil), zerolog.Nop())
+	require.NoError(t, err)
+
+	err = secretOutput.Write(filepath.Join(t.TempDir(), "secret"), `{"username": "admin"}`)
+	assert.Error(t, err, "non-2xx responses from the API server must be reported")
+
+	err = secretOutput.Write(filepath.Join(t.TempDir(), "secret"), "not-json")
+	assert.Error(t, err, "a non-JSON secret requires 'key' to be configured")
+}
+
+func TestParseSecretOutputFromConfig_KubernetesSecret(t *testing.T) {
+	t.Run("missing name", func(t *testing.T) {
+		config := kubernetesOutputConfig(t, "http://localhost", nil)
+		delete(config["output"].(map[string]interface{})["kubernetes_secret"].(map[string]interface{}), "name")
+		_, err := ParseSecretOutputFromConfig(config, zerolog.Nop())
+		assert.Error(t, err)
+	})
+
+	t.Run("invalid labels", func(t *testing.T) {
+		config := kubernetesOutputConfig(t, "http://localhost", map[string]interface{}{
+			"labels": []interface{}{map[string]interface{}{"name": "app", "value": 1}},
+		})
+		_, err := ParseSecretOutputFromConfig(config, zerolog.Nop())
+		assert.Error(t, err)
+	})
+
+	t.Run("keys as object", func(t *testing.T) {
+		config := kubernetesOutputConfig(t, "http://localhost", map[string]interface{}{
+			"keys": map[string]interface{}{"DB_USER": "username"},
+		})
+		_, err := ParseSecretOutputFromConfig(config, zerolog.Nop())
+		assert.Error(t, err)
+	})
+
+	t.Run("duplicate key", func(t *testing.T) {
+		config := kubernetesOutputConfig(t, "http://localhost", map[string]interface{}{
+			"keys": []interface{}{
+				map[string]interface{}{"key": "DB_USER", "secret_key": "username"},
+				map[string]interface{}{"key": "DB_USER", "secret_key": "user"},
+			},
+		})
+		_, err := ParseSecretOutputFromConfig(config, zerolog.Nop())
+		assert.Error(t, err)
+	})
+
+	t.Run("write_file disabled without kubernetes_secret", func(t *testing.T) {
+		config := map[string]interface{}{
+			"output": map[string]interface{}{"write_file": false},
+		}
+		_, err := ParseSecretOutputFromConfig(config, zerolog.Nop())
+		assert.Error(t, err)
+	})
+}
+
+func TestSecretOutput_KubernetesSecretKeysThroughViper(t *testing.T) {
+	server, applied := fakeApiServer(t, http.StatusOK)
+	tokenPath := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(tokenPath, []byte("test-token\n"), 0o600))
+	v := viper.New()
+	v.SetConfigType("yaml")
+	require.NoError(t, v.ReadConfig(bytes.NewBufferString(`
+db_credentials:
+  output:
+    kubernetes_secret:
+      name: db-creds
+      namespace: hasura
+      api_server: `+server.URL+`
+      token_path: `+tokenPath+`
+      keys:
+        - key: DB_PASSWORD
+          secret_key: Password
+      labels:
+        - name: App.Kubernetes.io/Name
+          value: Hasura
+`)))
+	config := v.AllSettings()["db_credentials"].(map[string]interface{})
+	secretOutput, err := ParseSecretOutputFromConfig(config, zerolog.Nop())
+	require.NoError(t, err)
+
+	require.NoError(t, secretOutput.Write(filepath.Join(t.TempDir(), "secret"), `{"Password": "secret"}`))
+
+	require.Len(t, *applied, 1)
+	assert.Equal(t, map[string][]byte{"DB_PASSWORD": []byte("secret")}, (*applied)[0].Data)
+	assert.Equal(t, map[string]string{"App.Kubernetes.io/Name": "Hasura"}, (*applied)[0].Metadata.Labels)
+}
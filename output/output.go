@@ -0,0 +1,212 @@
+package output
+
+import (
+	"fmt"
+
+	"github.com/hasura/hasura-secret-refresh/encryption"
+	sharedprovider "github.com/hasura/hasura-secret-refresh/provider"
+	"github.com/rs/zerolog"
+)
+
+// OutputMode defines how a file provider lays out the secret on disk
+type OutputMode string
+
+const (
+	// OutputModeFile writes the whole secret to a single file
+	OutputModeFile OutputMode = "file"
+	// OutputModeDirectory explodes a JSON secret into one file per key
+	OutputModeDirectory OutputMode = "directory"
+)
+
+// SecretOutput writes secrets produced by file providers to their destination
+type SecretOutput struct {
+	mode OutputMode
+	// encryptionKeyPath is the file holding the AES-256 key used to encrypt
+	// secrets at rest. Secrets are written in plaintext when it is empty.
+	encryptionKeyPath string
+	// kubernetesSecret is set when the secret must also be upserted into a
+	// Kubernetes Secret object
+	kubernetesSecret *kubernetesSecretTarget
+	// skipFile disables writing to the configured path, which is useful when
+	// the Kubernetes Secret is the only consumer
+	skipFile bool
+	logger   zerolog.Logger
+}
+
+// NewSecretOutput creates a new SecretOutput instance
+func NewSecretOutput(mode OutputMode, encryptionKeyPath string, logger zerolog.Logger) *SecretOutput {
+	if mode == "" {
+		mode = OutputModeFile
+	}
+	return &SecretOutput{
+		mode:              mode,
+		encryptionKeyPath: encryptionKeyPath,
+		logger:            logger,
+	}
+}
+
+// ParseSecretOutputFromConfig extracts the output configuration from config map
+func ParseSecretOutputFromConfig(config map[string]interface{}, logger zerolog.Logger) (*SecretOutput, error) {
+	outputI, found := config["output"]
+	if !found {
+		return NewSecretOutput(OutputModeFile, "", logger), nil
+	}
+
+	outputConfig, ok := outputI.(map[string]interface{})
+	if !ok {
+		logger.Error().Msg("'output' must be an object")
+		return nil, fmt.Errorf("config not valid: 'output' must be an object")
+	}
+
+	mode := OutputModeFile
+	if modeI, hasMode := outputConfig["mode"]; hasMode {
+		modeStr, ok := modeI.(string)
+		if !ok {
+			logger.Error().Msg("output.mode must be a string")
+			return nil, fmt.Errorf("config not valid: output.mode must be a string")
+		}
+
+		switch modeStr {
+		case "file":
+			mode = OutputModeFile
+		case "directory":
+			mode = OutputModeDirectory
+		default:
+			logger.Error().Msgf("invalid output mode '%s', must be 'file' or 'directory'", modeStr)
+			return nil, fmt.Errorf("config not valid: invalid output mode '%s', must be 'file' or 'directory'", modeStr)
+		}
+	}
+
+	encryptionKeyPath := ""
+	if encryptionI, hasEncryption := outputConfig["encryption"]; hasEncryption {
+		encryptionConfig, ok := encryptionI.(map[string]interface{})
+		if !ok {
+			logger.Error().Msg("output.encryption must be an object")
+			return nil, fmt.Errorf("config not valid: output.encryption must be an object")
+		}
+		keyPathI, found := encryptionConfig["key_path"]
+		if !found {
+			logger.Error().Msg("output.encryption.key_path not found")
+			return nil, fmt.Errorf("required configs not found: output.encryption.key_path")
+		}
+		encryptionKeyPath, ok = keyPathI.(string)
+		if !ok || encryptionKeyPath == "" {
+			logger.Error().Msg("output.encryption.key_path must be a non-empty string")
+			return nil, fmt.Errorf("config not valid: output.encryption.key_path must be a non-empty string")
+		}
+		// Fail at startup rather than on the first write if the key is unusable.
+		if _, err := encryption.LoadKey(encryptionKeyPath); err != nil {
+			logger.Err(err).Msg("Unable to load output encryption key")
+			return nil, fmt.Errorf("config not valid: %w", err)
+		}
+	}
+
+	secretOutput := NewSecretOutput(mode, encryptionKeyPath, logger)
+
+	if kubernetesSecretI, found := outputConfig["kubernetes_secret"]; found {
+		kubernetesSecretConfig, ok := kubernetesSecretI.(map[string]interface{})
+		if !ok {
+			logger.Error().Msg("output.kubernetes_secret must be an object")
+			return nil, fmt.Errorf("config not valid: output.kubernetes_secret must be an object")
+		}
+		kubernetesSecret, err := parseKubernetesSecretTarget(kubernetesSecretConfig, logger)
+		if err != nil {
+			return nil, err
+		}
+		secretOutput.kubernetesSecret = kubernetesSecret
+	}
+
+	if writeFileI, found := outputConfig["write_file"]; found {
+		writeFile, ok := writeFileI.(bool)
+		if !ok {
+			logger.Error().Msg("output.write_file must be a bool")
+			return nil, fmt.Errorf("config not valid: output.write_file must be a bool")
+		}
+		if !writeFile && secretOutput.kubernetesSecret == nil {
+			logger.Error().Msg("output.write_file can only be disabled when output.kubernetes_secret is configured")
+			return nil, fmt.Errorf("config not valid: output.write_file can only be disabled when output.kubernetes_secret is configured")
+		}
+		secretOutput.skipFile = !writeFile
+	}
+
+	return secretOutput, nil
+}
+
+// Init prepares the destination before the first secret is fetched. In file
+// mode an empty file is created so that consumers can start watching it.
+func (o *SecretOutput) Init(path string) error {
+	if o != nil && o.skipFile {
+		return nil
+	}
+	if o.GetMode() == OutputModeDirectory {
+		return prepareSecretDirectory(path)
+	}
+	return sharedprovider.WriteSecretFile(path, []byte(""))
+}
+
+// Write stores the secret at path according to the configured mode. A nil
+// SecretOutput behaves like the default file mode.
+func (o *SecretOutput) Write(path string, secretString string) error {
+	if o == nil || !o.skipFile {
+		if err := o.writeFile(path, secretString); err != nil {
+			return err
+		}
+	}
+	if o.HasKubernetesSecret() {
+		if err := o.kubernetesSecret.upsert(secretString); err != nil {
+			o.logger.Err(err).Msg("Error occurred while writing secret to Kubernetes")
+			return err
+		}
+	}
+	return nil
+}
+
+func (o *SecretOutput) writeFile(path string, secretString string) error {
+	encode, err := o.encoder()
+	if err != nil {
+		return err
+	}
+	if o.GetMode() == OutputModeDirectory {
+		return writeSecretDirectory(path, secretString, encode, o.logger)
+	}
+	contents, err := encode([]byte(secretString))
+	if err != nil {
+		return err
+	}
+	return sharedprovider.WriteSecretFile(path, contents)
+}
+
+// encoder returns the function applied to file contents before they are
+// written. The key is read on every write so that a rotated key file is
+// picked up without a restart.
+func (o *SecretOutput) encoder() (func([]byte) ([]byte, error), error) {
+	if !o.IsEncrypted() {
+		return func(contents []byte) ([]byte, error) { return contents, nil }, nil
+	}
+	key, err := encryption.LoadKey(o.encryptionKeyPath)
+	if err != nil {
+		o.logger.Err(err).Msg("Unable to load output encryption key")
+		return nil, err
+	}
+	return func(contents []byte) ([]byte, error) {
+		return encryption.Encrypt(key, contents)
+	}, nil
+}
+
+// GetMode returns the output mode
+func (o *SecretOutput) GetMode() OutputMode {
+	if o == nil {
+		return OutputModeFile
+	}
+	return o.mode
+}
+
+// IsEncrypted returns true if secrets are encrypted before being written
+func (o *SecretOutput) IsEncrypted() bool {
+	return o != nil && o.encryptionKeyPath != ""
+}
+
+// HasKubernetesSecret returns true if secrets are upserted into a Kubernetes Secret
+func (o *SecretOutput) HasKubernetesSecret() bool {
+	return o != nil && o.kubernetesSecret != nil
+}
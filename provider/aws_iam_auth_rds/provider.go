@@ -9,6 +9,7 @@ import (
 
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/feature/rds/auth"
+	"github.com/hasura/hasura-secret-refresh/output"
 	sharedprovider "github.com/hasura/hasura-secret-refresh/provider"
 	"github.com/hasura/hasura-secret-refresh/template"
 	_ "github.com/lib/pq"
@@ -25,6 +26,8 @@ type AWSIAMAuthRDSFile struct {
 	mu              *sync.Mutex
 	refreshInterval time.Duration
 	template        string
+	secretOutput    *output.SecretOutput
+	refreshGroup    *sharedprovider.RefreshGroup
 	logger          zerolog.Logger
 }
 
@@ -35,11 +38,18 @@ func New(config map[string]interface{}, logger zerolog.Logger) (*AWSIAMAuthRDSFi
 		return nil, err
 	}
 
+	secretOutput, err := output.ParseSecretOutputFromConfig(config, logger)
+	if err != nil {
+		return nil, err
+	}
+	provider.secretOutput = secretOutput
+
 	// Automatically refresh every 5 minutes
 	refreshInterval := time.Duration(300) * time.Second
 	provider.refreshInterval = refreshInterval
 	provider.logger = logger
 	provider.mu = &sync.Mutex{}
+	provider.refreshGroup = sharedprovider.NewRefreshGroup()
 	return provider, nil
 }
 
@@ -66,29 +76,14 @@ func (provider *AWSIAMAuthRDSFile) checkDSNConnectivity(dsn string) error {
 }
 
 func (provider *AWSIAMAuthRDSFile) Start() {
-	err := sharedprovider.WriteSecretFile(provider.filePath, []byte(""))
+	err := provider.secretOutput.Init(provider.filePath)
 	if err != nil {
 		provider.logger.Err(err).Msgf("error occured while writing to a file :%s", provider.filePath)
 	}
 	for {
-		authenticationToken, err := provider.getSecret()
-		if err != nil {
-			time.Sleep(provider.refreshInterval)
-			continue
-		}
-
-		err = provider.checkDSNConnectivity(provider.buildDSN(authenticationToken))
+		err := provider.refreshGroup.Do(provider.getVerifiedSecret, provider.writeFile)
 		if err != nil {
-			provider.logger.Error().Err(err).Msg("failed to connect to generated token")
-			time.Sleep(provider.refreshInterval)
-			continue
-		}
-
-		err = provider.writeFile(authenticationToken)
-
-		if err != nil {
-			// if there was a problem with writing, add a logline
-			provider.logger.Error().Err(err).Msg("failed to write token to a file. Retrying ...")
+			provider.logger.Error().Err(err).Msg("failed to refresh token. Retrying ...")
 			time.Sleep(provider.refreshInterval)
 			continue
 		}
@@ -135,10 +130,25 @@ func (provider AWSIAMAuthRDSFile) getSecret() (string, error) {
 	return authenticationToken, err
 }
 
+// getVerifiedSecret fetches a new token and checks that it can be used to
+// connect to the database before it is written.
+func (provider AWSIAMAuthRDSFile) getVerifiedSecret() (string, error) {
+	authenticationToken, err := provider.getSecret()
+	if err != nil {
+		return "", err
+	}
+	err = provider.checkDSNConnectivity(provider.buildDSN(authenticationToken))
+	if err != nil {
+		provider.logger.Error().Err(err).Msg("failed to connect to generated token")
+		return "", err
+	}
+	return authenticationToken, nil
+}
+
 func (provider AWSIAMAuthRDSFile) writeFile(secretString string) error {
 	provider.mu.Lock()
 	defer provider.mu.Unlock()
-	err := sharedprovider.WriteSecretFile(provider.filePath, []byte(secretString))
+	err := provider.secretOutput.Write(provider.filePath, secretString)
 	if err != nil {
 		provider.logger.Err(err).Msgf("error occurred while writing secret to file %s", provider.filePath)
 		return err
@@ -151,22 +161,11 @@ func (provider AWSIAMAuthRDSFile) FileName() string {
 }
 
 func (provider AWSIAMAuthRDSFile) Refresh() error {
-	authenticationToken, err := provider.getSecret()
+	err := provider.refreshGroup.Do(provider.getVerifiedSecret, provider.writeFile)
 	if err != nil {
 		provider.logger.Err(err).Msgf("error occurred while refreshing the secret")
 		return err
 	}
-	err = provider.checkDSNConnectivity(provider.buildDSN(authenticationToken))
-	if err != nil {
-		provider.logger.Error().Err(err).Msg("failed to connect to generated token")
-		return err
-	}
-	err = provider.writeFile(authenticationToken)
-
-	if err != nil {
-		provider.logger.Err(err).Msgf("error occurred while writing the secret to the path: %s", provider.filePath)
-		return err
-	}
 	provider.logger.Info().Msgf("successfully fetched IAM Token. Fetching again in %s", provider.refreshInterval)
 	return nil
 }
@@ -0,0 +1,199 @@
+package aws_secrets_manager
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/hasura/hasura-secret-refresh/provider"
+	"github.com/rs/zerolog"
+)
+
+const (
+	// AgentPath is the path of the API of the AWS Secrets Manager Agent
+	AgentPath = "/secretsmanager/get"
+
+	agentTokenHeader     = "X-Aws-Parameters-Secrets-Token"
+	defaultAgentTokenEnv = "AWS_TOKEN"
+	agentTokenFilePrefix = "file://"
+)
+
+// Agent serves secrets from the cache of the provider with the API of the
+// AWS Secrets Manager Agent, so that applications using the agent or the
+// Lambda extension can use the proxy instead. Like the agent, it only accepts
+// requests from a loopback address that send the token of the agent.
+type Agent struct {
+	cache *SecretCache
+	// token is read from tokenFile for every request if it is set
+	token     string
+	tokenFile string
+	logger    zerolog.Logger
+}
+
+// agentSecretValue is the response of the agent, the response of the
+// GetSecretValue API of AWS Secrets Manager
+type agentSecretValue struct {
+	ARN           string   `json:"ARN"`
+	Name          string   `json:"Name"`
+	VersionId     string   `json:"VersionId"`
+	SecretString  *string  `json:"SecretString,omitempty"`
+	SecretBinary  []byte   `json:"SecretBinary,omitempty"`
+	VersionStages []string `json:"VersionStages"`
+	// CreatedDate is in seconds since the epoch
+	CreatedDate float64 `json:"CreatedDate"`
+}
+
+// parseAgentFromConfig parses the 'agent' config of the provider. The token
+// is read from the environment variable 'token_env'. Like for the agent, the
+// variable can reference a file with 'file://<path>'. Returns nil if the
+// agent is not enabled.
+//
+//	agent:
+//	  enabled: true
+//	  token_env: AWS_TOKEN
+func parseAgentFromConfig(config map[string]interface{}, cache *SecretCache, logger zerolog.Logger) (*Agent, error) {
+	agentI, found := config["agent"]
+	if !found {
+		return nil, nil
+	}
+	agentConfig, ok := agentI.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s: 'agent' must be an object", InitError)
+	}
+	if enabledI, found := agentConfig["enabled"]; found {
+		enabled, ok := enabledI.(bool)
+		if !ok {
+			return nil, fmt.Errorf("%s: 'agent.enabled' must be a boolean", InitError)
+		}
+		if !enabled {
+			return nil, nil
+		}
+	}
+	tokenEnv := defaultAgentTokenEnv
+	if tokenEnvI, found := agentConfig["token_env"]; found {
+		tokenEnv, ok = tokenEnvI.(string)
+		if !ok || tokenEnv == "" {
+			return nil, fmt.Errorf("%s: 'agent.token_env' must be a non-empty string", InitError)
+		}
+	}
+	token := os.Getenv(tokenEnv)
+	if token == "" {
+		return nil, fmt.Errorf("%s: environment variable %s of the agent token is not set", InitError, tokenEnv)
+	}
+	agent := &Agent{cache: cache, token: token, logger: logger}
+	if tokenFile, isFile := strings.CutPrefix(token, agentTokenFilePrefix); isFile {
+		agent.token, agent.tokenFile = "", tokenFile
+	}
+	logger.Info().Str("path", AgentPath).Str("token_env", tokenEnv).
+		Msg("Serving secrets with the API of the AWS Secrets Manager Agent")
+	return agent, nil
+}
+
+func (a *Agent) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	secretId := query.Get("secretId")
+	requestLogger := a.logger.With().Str("secret_id", secretId).Logger()
+	if r.Method != http.MethodGet {
+		writeAgentError(rw, http.StatusMethodNotAllowed, "MethodNotAllowed", "Only GET requests are supported")
+		return
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err != nil || !net.ParseIP(host).IsLoopback() {
+		requestLogger.Error().Str("remote_addr", r.RemoteAddr).Msg("Agent request not sent from a loopback address")
+		writeAgentError(rw, http.StatusForbidden, "AccessDeniedException", "Requests must be sent from a loopback address")
+		return
+	}
+	// the agent rejects forwarded requests to protect against SSRF
+	if r.Header.Get("X-Forwarded-For") != "" {
+		writeAgentError(rw, http.StatusBadRequest, "InvalidRequestException", "Forwarded requests are not supported")
+		return
+	}
+	if err := a.checkToken(r.Header.Get(agentTokenHeader)); err != nil {
+		requestLogger.Error().Err(err).Msg("Agent request not authorized")
+		writeAgentError(rw, http.StatusForbidden, "AccessDeniedException", err.Error())
+		return
+	}
+	if secretId == "" {
+		writeAgentError(rw, http.StatusBadRequest, "InvalidParameterException", "secretId must be set")
+		return
+	}
+	refreshNow, err := strconv.ParseBool(query.Get("refreshNow"))
+	if err != nil && query.Get("refreshNow") != "" {
+		writeAgentError(rw, http.StatusBadRequest, "InvalidParameterException", "refreshNow must be true or false")
+		return
+	}
+	versionId, versionStage := query.Get("versionId"), query.Get("versionStage")
+	var value *secretsmanager.GetSecretValueOutput
+	if refreshNow {
+		value, err = a.cache.RefreshSecretValue(secretId, versionId, versionStage)
+	} else {
+		value, _, err = a.cache.GetSecretValue(secretId, versionId, versionStage)
+	}
+	if err != nil {
+		requestLogger.Error().Err(err).Msg("Unable to fetch secret for agent request")
+		statusCode, code := agentErrorResponse(err)
+		writeAgentError(rw, statusCode, code, err.Error())
+		return
+	}
+	response := agentSecretValue{
+		ARN:           aws.StringValue(value.ARN),
+		Name:          aws.StringValue(value.Name),
+		VersionId:     aws.StringValue(value.VersionId),
+		SecretString:  value.SecretString,
+		SecretBinary:  value.SecretBinary,
+		VersionStages: aws.StringValueSlice(value.VersionStages),
+	}
+	if value.CreatedDate != nil {
+		response.CreatedDate = float64(value.CreatedDate.UnixMilli()) / 1000
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(response)
+}
+
+func (a *Agent) checkToken(sent string) error {
+	if sent == "" {
+		return fmt.Errorf("header %s is required", agentTokenHeader)
+	}
+	token := a.token
+	if a.tokenFile != "" {
+		data, err := os.ReadFile(a.tokenFile)
+		if err != nil {
+			return fmt.Errorf("unable to read token file: %w", err)
+		}
+		token = strings.TrimSpace(string(data))
+	}
+	if subtle.ConstantTimeCompare([]byte(sent), []byte(token)) != 1 {
+		return fmt.Errorf("header %s is not valid", agentTokenHeader)
+	}
+	return nil
+}
+
+// agentErrorResponse returns the status code and the error code of AWS
+// Secrets Manager if the request failed there
+func agentErrorResponse(err error) (int, string) {
+	var requestFailure awserr.RequestFailure
+	if errors.As(err, &requestFailure) {
+		return requestFailure.StatusCode(), requestFailure.Code()
+	}
+	switch ErrorKind(err) {
+	case provider.ErrorKindNotFound:
+		return http.StatusBadRequest, secretsmanager.ErrCodeResourceNotFoundException
+	case provider.ErrorKindTimeout:
+		return http.StatusGatewayTimeout, "RequestTimeout"
+	}
+	return http.StatusBadGateway, "ServiceUnavailable"
+}
+
+func writeAgentError(rw http.ResponseWriter, statusCode int, code string, message string) {
+	rw.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	rw.WriteHeader(statusCode)
+	json.NewEncoder(rw).Encode(map[string]string{"__type": code, "message": message})
+}
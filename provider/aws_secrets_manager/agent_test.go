@@ -0,0 +1,143 @@
+package aws_secrets_manager
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func getTestAgent(t *testing.T, client SecretsManagerInterface) *Agent {
+	t.Setenv("AWS_TOKEN", "agenttoken")
+	agent, err := parseAgentFromConfig(map[string]interface{}{
+		"agent": map[string]interface{}{"enabled": true},
+	}, NewSecretCache(client, time.Minute, DefaultCacheSize), zerolog.Nop())
+	assert.NoError(t, err)
+	return agent
+}
+
+func sendAgentRequest(agent *Agent, url string, token string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, url, nil)
+	r.RemoteAddr = "127.0.0.1:40000"
+	if token != "" {
+		r.Header.Set(agentTokenHeader, token)
+	}
+	rw := httptest.NewRecorder()
+	agent.ServeHTTP(rw, r)
+	return rw
+}
+
+func TestParseAgentFromConfig(t *testing.T) {
+	cache := NewSecretCache(new(MockSecretsManager), time.Minute, DefaultCacheSize)
+	agent, err := parseAgentFromConfig(map[string]interface{}{}, cache, zerolog.Nop())
+	assert.NoError(t, err)
+	assert.Nil(t, agent)
+
+	t.Setenv("AWS_TOKEN", "")
+	_, err = parseAgentFromConfig(map[string]interface{}{"agent": map[string]interface{}{}}, cache, zerolog.Nop())
+	assert.ErrorContains(t, err, "AWS_TOKEN")
+
+	t.Setenv("CUSTOM_TOKEN", "file:///run/token")
+	agent, err = parseAgentFromConfig(map[string]interface{}{
+		"agent": map[string]interface{}{"token_env": "CUSTOM_TOKEN"},
+	}, cache, zerolog.Nop())
+	assert.NoError(t, err)
+	assert.Equal(t, "/run/token", agent.tokenFile)
+
+	_, err = parseAgentFromConfig(map[string]interface{}{"agent": true}, cache, zerolog.Nop())
+	assert.Error(t, err)
+}
+
+func TestAgent_GetSecretValue(t *testing.T) {
+	client := new(MockSecretsManager)
+	createdDate := time.UnixMilli(1700000000123)
+	client.On("GetSecretValue", &secretsmanager.GetSecretValueInput{SecretId: aws.String("prod/db")}).
+		Return(&secretsmanager.GetSecretValueOutput{
+			ARN:           aws.String("arn:aws:secretsmanager:us-east-1:123456789012:secret:prod/db-AbCdEf"),
+			Name:          aws.String("prod/db"),
+			VersionId:     aws.String("v1"),
+			SecretString:  aws.String(`{"password":"topsecretval"}`),
+			VersionStages: aws.StringSlice([]string{"AWSCURRENT"}),
+			CreatedDate:   &createdDate,
+		}, nil)
+	agent := getTestAgent(t, client)
+
+	rw := sendAgentRequest(agent, "/secretsmanager/get?secretId=prod/db", "agenttoken")
+	assert.Equal(t, http.StatusOK, rw.Code)
+	var response map[string]interface{}
+	assert.NoError(t, json.Unmarshal(rw.Body.Bytes(), &response))
+	assert.Equal(t, `{"password":"topsecretval"}`, response["SecretString"])
+	assert.Equal(t, "v1", response["VersionId"])
+	assert.Equal(t, 1700000000.123, response["CreatedDate"])
+	assert.Equal(t, []interface{}{"AWSCURRENT"}, response["VersionStages"])
+
+	// served from the cache unless a refresh is requested
+	sendAgentRequest(agent, "/secretsmanager/get?secretId=prod/db", "agenttoken")
+	client.AssertNumberOfCalls(t, "GetSecretValue", 1)
+	sendAgentRequest(agent, "/secretsmanager/get?secretId=prod/db&refreshNow=true", "agenttoken")
+	client.AssertNumberOfCalls(t, "GetSecretValue", 2)
+}
+
+func TestAgent_VersionStage(t *testing.T) {
+	client := new(MockSecretsManager)
+	client.On("GetSecretValue", &secretsmanager.GetSecretValueInput{
+		SecretId: aws.String("prod/db"), VersionStage: aws.String("AWSPREVIOUS"),
+	}).Return(&secretsmanager.GetSecretValueOutput{SecretString: aws.String("previousval")}, nil)
+	agent := getTestAgent(t, client)
+
+	rw := sendAgentRequest(agent, "/secretsmanager/get?secretId=prod/db&versionStage=AWSPREVIOUS", "agenttoken")
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Contains(t, rw.Body.String(), `"SecretString":"previousval"`)
+	assert.Equal(t, []string{"prod/db?versionId=&versionStage=AWSPREVIOUS"}, agent.cache.Keys())
+}
+
+func TestAgent_Errors(t *testing.T) {
+	client := new(MockSecretsManager)
+	client.On("GetSecretValue", mock.Anything).Return((*secretsmanager.GetSecretValueOutput)(nil),
+		awserr.NewRequestFailure(awserr.New(secretsmanager.ErrCodeResourceNotFoundException, "secret not found", nil), 400, "id"))
+	agent := getTestAgent(t, client)
+
+	tests := []struct {
+		name       string
+		url        string
+		token      string
+		statusCode int
+		code       string
+	}{
+		{"missing token", "/secretsmanager/get?secretId=prod/db", "", http.StatusForbidden, "AccessDeniedException"},
+		{"wrong token", "/secretsmanager/get?secretId=prod/db", "wrongtoken", http.StatusForbidden, "AccessDeniedException"},
+		{"missing secret id", "/secretsmanager/get", "agenttoken", http.StatusBadRequest, "InvalidParameterException"},
+		{"secret not found", "/secretsmanager/get?secretId=prod/db", "agenttoken", http.StatusBadRequest, secretsmanager.ErrCodeResourceNotFoundException},
+	}
+	for _, test := range tests {
+		rw := sendAgentRequest(agent, test.url, test.token)
+		var response map[string]string
+		assert.NoError(t, json.Unmarshal(rw.Body.Bytes(), &response), test.name)
+		assert.Equal(t, test.statusCode, rw.Code, test.name)
+		assert.Equal(t, test.code, response["__type"], test.name)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/secretsmanager/get?secretId=prod/db", nil)
+	r.Header.Set(agentTokenHeader, "agenttoken")
+	rw := httptest.NewRecorder()
+	agent.ServeHTTP(rw, r)
+	assert.Equal(t, http.StatusForbidden, rw.Code, "remote address")
+}
+
+func TestAgent_TokenFile(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	assert.NoError(t, os.WriteFile(tokenFile, []byte("filetoken\n"), 0600))
+	agent := &Agent{tokenFile: tokenFile}
+	assert.NoError(t, agent.checkToken("filetoken"))
+	assert.Error(t, agent.checkToken("agenttoken"))
+}
@@ -3,6 +3,11 @@ package aws_secrets_manager
 import (
 	"errors"
 	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/hasura/hasura-secret-refresh/provider"
 )
 
 type secretFetcher struct {
@@ -15,6 +20,70 @@ var (
 )
 
 func (fetcher secretFetcher) FetchSecret() (string, error) {
-	secret, err := fetcher.cache.GetSecretString(fetcher.secretId)
-	return secret, fmt.Errorf("%s: %w", UnableToFetch, err)
+	secret, _, err := fetcher.FetchSecretWithCacheStatus()
+	return secret, err
+}
+
+func (fetcher secretFetcher) CachedSecret() (string, bool) {
+	return fetcher.cache.CachedSecretString(fetcher.secretId)
+}
+
+func (fetcher secretFetcher) FetchSecretWithCacheStatus() (string, bool, error) {
+	secret, cacheHit, err := fetcher.cache.GetSecretStringWithCacheStatus(fetcher.secretId)
+	if err != nil {
+		fetcher.logger.Err(err).Str("secret_id", fetcher.secretId).Msg("aws_secrets_manager: Failed to fetch secret")
+		return "", false, provider.NewError(ErrorKind(err), fmt.Errorf("%s: %w", UnableToFetch, err))
+	}
+	if !cacheHit {
+		fetcher.logger.Debug().Str("secret_id", fetcher.secretId).Msg("aws_secrets_manager: Fetched secret from AWS Secrets Manager")
+	}
+	return secret, cacheHit, nil
+}
+
+func (fetcher secretFetcher) RefetchSecret() (string, error) {
+	fetcher.logger.Debug().Str("secret_id", fetcher.secretId).Msg("aws_secrets_manager: Bypassing cache")
+	secret, err := fetcher.cache.RefreshSecretString(fetcher.secretId)
+	if err != nil {
+		fetcher.logger.Err(err).Str("secret_id", fetcher.secretId).Msg("aws_secrets_manager: Failed to fetch secret")
+		return "", provider.NewError(ErrorKind(err), fmt.Errorf("%s: %w", UnableToFetch, err))
+	}
+	return secret, nil
+}
+
+// WithRequestId adds the id of the request to the logs of the fetcher
+func (fetcher secretFetcher) WithRequestId(requestId string) provider.SecretFetcher {
+	secretsManager := *fetcher.AwsSecretsManager
+	secretsManager.logger = secretsManager.logger.With().Str("request_id", requestId).Logger()
+	fetcher.AwsSecretsManager = &secretsManager
+	return fetcher
+}
+
+func (fetcher secretFetcher) InvalidateSecret() {
+	fetcher.cache.Invalidate(fetcher.secretId)
+}
+
+// ErrorKind classifies the errors of requests to AWS Secrets Manager
+func ErrorKind(err error) provider.ErrorKind {
+	var awsError awserr.Error
+	if !errors.As(err, &awsError) {
+		return provider.ErrorKindFromError(err)
+	}
+	switch awsError.Code() {
+	case secretsmanager.ErrCodeResourceNotFoundException:
+		return provider.ErrorKindNotFound
+	case "AccessDeniedException", "UnrecognizedClientException":
+		return provider.ErrorKindUnauthorized
+	case secretsmanager.ErrCodeInvalidParameterException, secretsmanager.ErrCodeInvalidRequestException:
+		return provider.ErrorKindBadRequest
+	case request.CanceledErrorCode:
+		return provider.ErrorKindTimeout
+	}
+	var requestFailure awserr.RequestFailure
+	if errors.As(err, &requestFailure) {
+		return provider.ErrorKindFromStatusCode(requestFailure.StatusCode())
+	}
+	if awsError.OrigErr() != nil {
+		return provider.ErrorKindFromError(awsError.OrigErr())
+	}
+	return provider.ErrorKindUnavailable
 }
@@ -6,8 +6,12 @@ import (
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/hasura/hasura-secret-refresh/output"
 	sharedprovider "github.com/hasura/hasura-secret-refresh/provider"
 	"github.com/hasura/hasura-secret-refresh/template"
 	"github.com/hasura/hasura-secret-refresh/transform"
@@ -25,12 +29,42 @@ type AwsSecretsManagerFile struct {
 	secretId        string
 	template        string
 	secretTransform *transform.SecretTransform
+	secretOutput    *output.SecretOutput
+	refreshGroup    *sharedprovider.RefreshGroup
 
 	logger zerolog.Logger
 	mu     *sync.Mutex
 }
 
+// webIdentitySessionName is the session name of roles assumed with the token
+// of a service account
+const webIdentitySessionName = "hasura-secret-refresh"
+
 func CreateAwsSecretsManagerFile(config map[string]interface{}, logger zerolog.Logger) (AwsSecretsManagerFile, error) {
+	return createAwsSecretsManagerFile(config, nil, logger)
+}
+
+// CreateAwsSecretsManagerFileWithToken creates a file provider that fetches
+// secrets with the role in 'role_arn', assumed with the token of a service
+// account instead of the credentials of the process
+func CreateAwsSecretsManagerFileWithToken(
+	config map[string]interface{}, token sharedprovider.ServiceAccountToken, logger zerolog.Logger,
+) (AwsSecretsManagerFile, error) {
+	return createAwsSecretsManagerFile(config, token, logger)
+}
+
+// serviceAccountTokenFetcher provides the token of a service account to
+// assume a role with web identity
+type serviceAccountTokenFetcher sharedprovider.ServiceAccountToken
+
+func (f serviceAccountTokenFetcher) FetchToken(credentials.Context) ([]byte, error) {
+	token, err := f()
+	return []byte(token), err
+}
+
+func createAwsSecretsManagerFile(
+	config map[string]interface{}, token sharedprovider.ServiceAccountToken, logger zerolog.Logger,
+) (AwsSecretsManagerFile, error) {
 	regionI, found := config["region"]
 	if !found {
 		logger.Error().Msg("aws_secrets_manager_file: Config 'region' not found")
@@ -76,8 +110,24 @@ func CreateAwsSecretsManagerFile(config map[string]interface{}, logger zerolog.L
 		return AwsSecretsManagerFile{}, fmt.Errorf("config not valid")
 	}
 	refreshInterval := time.Duration(refreshIntervalInt) * time.Second
-	smClient := secretsmanager.New(sess, aws.NewConfig().
-		WithRegion(region))
+	awsConfig := aws.NewConfig().WithRegion(region)
+	if token != nil {
+		roleArnI, found := config["role_arn"]
+		if !found {
+			logger.Error().Msg("aws_secrets_manager_file: Config 'role_arn' not found")
+			return AwsSecretsManagerFile{}, fmt.Errorf("required configs not found")
+		}
+		roleArn, ok := roleArnI.(string)
+		if !ok {
+			logger.Error().Msg("aws_secrets_manager_file: 'role_arn' must be a string")
+			return AwsSecretsManagerFile{}, fmt.Errorf("config not valid")
+		}
+		roleProvider := stscreds.NewWebIdentityRoleProviderWithOptions(
+			sts.New(sess, aws.NewConfig().WithRegion(region)), roleArn, webIdentitySessionName, serviceAccountTokenFetcher(token),
+		)
+		awsConfig = awsConfig.WithCredentials(credentials.NewCredentials(roleProvider))
+	}
+	smClient := secretsmanager.New(sess, awsConfig)
 	secretTemplate := ""
 	secretTemplateI, ok := config["template"]
 	if ok {
@@ -95,6 +145,10 @@ func CreateAwsSecretsManagerFile(config map[string]interface{}, logger zerolog.L
 		logger.Error().Msg("aws_secrets_manager_file: Only one of 'template' or 'secret_transform' can be configured, not both")
 		return AwsSecretsManagerFile{}, fmt.Errorf("config not valid: Only one of 'template' or 'transform' can be configured, not both")
 	}
+	secretOutput, err := output.ParseSecretOutputFromConfig(config, logger)
+	if err != nil {
+		return AwsSecretsManagerFile{}, err
+	}
 	awsSm := AwsSecretsManagerFile{
 		refreshInterval: refreshInterval,
 		filePath:        filePath,
@@ -103,6 +157,8 @@ func CreateAwsSecretsManagerFile(config map[string]interface{}, logger zerolog.L
 		logger:          logger,
 		template:        secretTemplate,
 		secretTransform: secretTransform,
+		secretOutput:    secretOutput,
+		refreshGroup:    sharedprovider.NewRefreshGroup(),
 		mu:              &sync.Mutex{},
 	}
 	logger.Info().
@@ -111,22 +167,20 @@ func CreateAwsSecretsManagerFile(config map[string]interface{}, logger zerolog.L
 		Str("secret_id", secretId).
 		Int("key_mappings", len(secretTransform.GetMappings())).
 		Str("transform_mode", string(secretTransform.GetMode())).
+		Str("output_mode", string(secretOutput.GetMode())).
+		Bool("output_encrypted", secretOutput.IsEncrypted()).
+		Bool("output_kubernetes_secret", secretOutput.HasKubernetesSecret()).
 		Msg("Creating provider")
 	return awsSm, err
 }
 
 func (provider AwsSecretsManagerFile) Start() {
-	err := sharedprovider.WriteSecretFile(provider.filePath, []byte(""))
+	err := provider.secretOutput.Init(provider.filePath)
 	if err != nil {
 		provider.logger.Err(err).Msgf("aws_secrets_manager_file: Error occurred while writing to file %s", provider.filePath)
 	}
 	for {
-		secret, err := provider.getSecret()
-		if err != nil {
-			time.Sleep(provider.refreshInterval)
-			continue
-		}
-		err = provider.writeFile(secret)
+		err := provider.refreshGroup.Do(provider.getSecret, provider.writeFile)
 		if err != nil {
 			time.Sleep(provider.refreshInterval)
 			continue
@@ -138,11 +192,7 @@ func (provider AwsSecretsManagerFile) Start() {
 
 func (provider AwsSecretsManagerFile) Refresh() error {
 	provider.logger.Info().Msgf("aws_secrets_manager_file: Refresh invoked for secret %s", provider.secretId)
-	secret, err := provider.getSecret()
-	if err != nil {
-		return err
-	}
-	err = provider.writeFile(secret)
+	err := provider.refreshGroup.Do(provider.getSecret, provider.writeFile)
 	if err != nil {
 		return err
 	}
@@ -154,6 +204,11 @@ func (provider AwsSecretsManagerFile) FileName() string {
 	return provider.filePath
 }
 
+// RenderSecret returns the contents of the secret file without writing it
+func (provider AwsSecretsManagerFile) RenderSecret() (string, error) {
+	return provider.getSecret()
+}
+
 func (provider AwsSecretsManagerFile) getSecret() (string, error) {
 	provider.logger.Info().Msgf("aws_secrets_manager_file: Fetching secret %s", provider.secretId)
 	res, err := provider.secretsManager.GetSecretValue(
@@ -186,7 +241,7 @@ func (provider AwsSecretsManagerFile) getSecret() (string, error) {
 func (provider AwsSecretsManagerFile) writeFile(secretString string) error {
 	provider.mu.Lock()
 	defer provider.mu.Unlock()
-	err := sharedprovider.WriteSecretFile(provider.filePath, []byte(secretString))
+	err := provider.secretOutput.Write(provider.filePath, secretString)
 	if err != nil {
 		provider.logger.Err(err).Msgf("aws_secrets_manager_file: Error occurred while writing secret %s to file %s", provider.secretId, provider.filePath)
 		return err
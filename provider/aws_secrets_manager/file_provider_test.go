@@ -405,3 +405,23 @@ func TestAwsSecretsManagerFile_writeFileNormalizesPermissions(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, sharedprovider.SecretFileMode, info.Mode().Perm())
 }
+
+func TestCreateAwsSecretsManagerFileWithToken(t *testing.T) {
+	logger := zerolog.Nop()
+	token := func() (string, error) { return "jwt", nil }
+
+	config := map[string]interface{}{
+		"region":    "us-east-1",
+		"path":      "/tmp/test-secret",
+		"secret_id": "test-secret",
+		"refresh":   0,
+	}
+
+	_, err := CreateAwsSecretsManagerFileWithToken(config, token, logger)
+	assert.EqualError(t, err, "required configs not found")
+
+	config["role_arn"] = "arn:aws:iam::123456789012:role/apps"
+	provider, err := CreateAwsSecretsManagerFileWithToken(config, token, logger)
+	assert.NoError(t, err)
+	assert.Equal(t, "test-secret", provider.secretId)
+}
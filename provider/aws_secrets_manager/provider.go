@@ -6,21 +6,31 @@ import (
 	"net/http"
 	"time"
 
-	"github.com/aws/aws-secretsmanager-caching-go/secretcache"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/hasura/hasura-secret-refresh/cache"
 	"github.com/hasura/hasura-secret-refresh/provider"
 	"github.com/rs/zerolog"
 )
 
 type AwsSecretsManager struct {
-	cache *secretcache.Cache
+	cache *SecretCache
+	// agent is nil unless the provider serves the API of the AWS Secrets
+	// Manager Agent
+	agent  *Agent
+	logger zerolog.Logger
 }
 
 const (
-	cacheTtl = "cache_ttl"
+	cacheTtl  = "cache_ttl"
+	cacheSize = "cache_size"
 )
 
 const (
 	defaultCacheTtl = time.Minute * 5
+	// DefaultCacheSize is the number of secrets cached if the size of the
+	// cache is not configured
+	DefaultCacheSize = 1024
 )
 
 const (
@@ -46,20 +56,59 @@ func Create(config map[string]interface{}, logger zerolog.Logger) (*AwsSecretsMa
 		}
 		cacheTtl = time.Second * time.Duration(cacheTtlI)
 	}
+	cacheSize_, ok := config[cacheSize]
+	cacheSize := DefaultCacheSize
+	if ok {
+		cacheSize, ok = cacheSize_.(int)
+		if !ok || cacheSize <= 0 {
+			return nil, fmt.Errorf(
+				"%s: 'cache_size' must be a positive number", InitError,
+			)
+		}
+	}
+	refreshAhead, err := provider.ParseRefreshAheadFromConfig(config, cacheTtl, cacheSize, logger)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", InitError, err)
+	}
 	logger.Info().
 		Str("cache_ttl", cacheTtl.String()).
+		Int("cache_size", cacheSize).
 		Msg("Creating provider")
-	secretsCache, err := secretcache.New(
-		func(c *secretcache.Cache) {
-			c.CacheConfig.CacheItemTTL = cacheTtl.Nanoseconds()
-		},
-	)
+	sess, err := session.NewSession()
 	if err != nil {
 		return nil, fmt.Errorf(
-			"%s: unable to convert cacheTtl to int: %w", InitError, err,
+			"%s: error initializing secrets manager session: %w", InitError, err,
 		)
 	}
-	return &AwsSecretsManager{cache: secretsCache}, nil
+	secretsCache := NewSecretCache(secretsmanager.New(sess), cacheTtl, cacheSize)
+	secretsCache.refreshAhead = refreshAhead
+	agent, err := parseAgentFromConfig(config, secretsCache, logger)
+	if err != nil {
+		return nil, err
+	}
+	return &AwsSecretsManager{cache: secretsCache, agent: agent, logger: logger}, nil
+}
+
+// Agent returns the handler of the API of the AWS Secrets Manager Agent. It is
+// nil if the agent is not enabled.
+func (provider AwsSecretsManager) Agent() *Agent {
+	return provider.agent
+}
+
+func (provider AwsSecretsManager) CacheKeys() []string {
+	return provider.cache.Keys()
+}
+
+func (provider AwsSecretsManager) InvalidateCacheKey(key string) bool {
+	return provider.cache.Invalidate(key)
+}
+
+func (provider AwsSecretsManager) PurgeCache() {
+	provider.cache.Purge()
+}
+
+func (provider AwsSecretsManager) CacheStats() cache.Stats {
+	return provider.cache.Stats()
 }
 
 func (provider AwsSecretsManager) DeleteConfigHeaders(headers *http.Header) {
@@ -68,7 +117,7 @@ func (provider AwsSecretsManager) DeleteConfigHeaders(headers *http.Header) {
 
 func (provider AwsSecretsManager) SecretFetcher(headers http.Header) (provider.SecretFetcher, error) {
 	secretId := headers.Get(secretIdHeader)
-	if secretId != "" {
+	if secretId == "" {
 		return secretFetcher{}, fmt.Errorf("%s: %s", HeaderNotFound, secretIdHeader)
 	}
 	return secretFetcher{
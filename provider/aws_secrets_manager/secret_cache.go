@@ -0,0 +1,150 @@
+package aws_secrets_manager
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/hasura/hasura-secret-refresh/cache"
+	"github.com/hasura/hasura-secret-refresh/provider"
+)
+
+// SecretCache fetches secrets from AWS Secrets Manager and caches them
+type SecretCache struct {
+	client SecretsManagerInterface
+	cache  *cache.Cache[*secretsmanager.GetSecretValueOutput]
+	// refreshAhead is nil unless cached secrets in use are refreshed before
+	// they expire
+	refreshAhead *provider.RefreshAhead
+}
+
+func NewSecretCache(client SecretsManagerInterface, ttl time.Duration, size int) *SecretCache {
+	return &SecretCache{client: client, cache: cache.New[*secretsmanager.GetSecretValueOutput](ttl, size)}
+}
+
+func (c *SecretCache) GetSecretString(secretId string) (string, error) {
+	secret, _, err := c.GetSecretStringWithCacheStatus(secretId)
+	return secret, err
+}
+
+// GetSecretStringWithCacheStatus also reports whether the secret was served
+// from the cache
+func (c *SecretCache) GetSecretStringWithCacheStatus(secretId string) (string, bool, error) {
+	value, cacheHit, err := c.GetSecretValue(secretId, "", "")
+	if err != nil {
+		return "", false, err
+	}
+	secret, err := secretString(secretId, value)
+	return secret, cacheHit, err
+}
+
+// GetSecretValue returns a version of the secret, selected by its id or its
+// stage. The current version is returned if both are empty. Versions are
+// cached separately.
+func (c *SecretCache) GetSecretValue(
+	secretId string, versionId string, versionStage string,
+) (*secretsmanager.GetSecretValueOutput, bool, error) {
+	key := cacheKey(secretId, versionId, versionStage)
+	value, cacheHit, err := c.cache.LoadNotify(key, c.fetch(secretId, versionId, versionStage), c.stored(key))
+	if cacheHit {
+		c.refreshAhead.Hit(key, c.refetch(secretId, versionId, versionStage))
+	}
+	return value, cacheHit, err
+}
+
+// RefreshSecretValue fetches a version of the secret even if it is cached and
+// caches it
+func (c *SecretCache) RefreshSecretValue(
+	secretId string, versionId string, versionStage string,
+) (*secretsmanager.GetSecretValueOutput, error) {
+	key := cacheKey(secretId, versionId, versionStage)
+	return c.cache.ReloadNotify(key, c.fetch(secretId, versionId, versionStage), c.stored(key))
+}
+
+// RefreshSecretString fetches the secret even if it is cached and caches it
+func (c *SecretCache) RefreshSecretString(secretId string) (string, error) {
+	value, err := c.RefreshSecretValue(secretId, "", "")
+	if err != nil {
+		return "", err
+	}
+	return secretString(secretId, value)
+}
+
+// CachedSecretString returns the secret only if it is cached
+func (c *SecretCache) CachedSecretString(secretId string) (string, bool) {
+	value, found := c.cache.Get(secretId)
+	if !found || value.SecretString == nil {
+		return "", false
+	}
+	c.refreshAhead.Hit(secretId, c.refetch(secretId, "", ""))
+	return *value.SecretString, true
+}
+
+// Invalidate returns false if the secret is not cached
+func (c *SecretCache) Invalidate(secretId string) bool {
+	c.refreshAhead.Remove(secretId)
+	return c.cache.Remove(secretId)
+}
+
+func (c *SecretCache) Purge() {
+	c.refreshAhead.Purge()
+	c.cache.Purge()
+}
+
+// Keys returns the ids of the cached secrets. Versions other than the current
+// one are suffixed with their version id and stage.
+func (c *SecretCache) Keys() []string {
+	return c.cache.Keys()
+}
+
+func (c *SecretCache) Stats() cache.Stats {
+	return c.cache.Stats()
+}
+
+func (c *SecretCache) fetch(
+	secretId string, versionId string, versionStage string,
+) cache.Loader[*secretsmanager.GetSecretValueOutput] {
+	return func() (*secretsmanager.GetSecretValueOutput, time.Duration, error) {
+		input := &secretsmanager.GetSecretValueInput{SecretId: &secretId}
+		if versionId != "" {
+			input.VersionId = &versionId
+		}
+		if versionStage != "" {
+			input.VersionStage = &versionStage
+		}
+		value, err := c.client.GetSecretValue(input)
+		return value, 0, err
+	}
+}
+
+// stored records a fetched version of the secret for refreshing it ahead once
+// it was cached
+func (c *SecretCache) stored(key string) cache.Stored[*secretsmanager.GetSecretValueOutput] {
+	return func(_ *secretsmanager.GetSecretValueOutput, ttl time.Duration) {
+		c.refreshAhead.AddWithTtl(key, ttl)
+	}
+}
+
+// refetch fetches a version of the secret in the background, bypassing the
+// cache
+func (c *SecretCache) refetch(secretId string, versionId string, versionStage string) func() error {
+	return func() error {
+		_, err := c.RefreshSecretValue(secretId, versionId, versionStage)
+		return err
+	}
+}
+
+func cacheKey(secretId string, versionId string, versionStage string) string {
+	if versionId == "" && versionStage == "" {
+		return secretId
+	}
+	return fmt.Sprintf("%s?versionId=%s&versionStage=%s", secretId, versionId, versionStage)
+}
+
+func secretString(secretId string, value *secretsmanager.GetSecretValueOutput) (string, error) {
+	if value.SecretString == nil {
+		return "", provider.NewError(provider.ErrorKindNotFound,
+			fmt.Errorf("secret %s does not have a string value", secretId))
+	}
+	return *value.SecretString, nil
+}
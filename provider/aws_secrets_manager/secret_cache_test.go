@@ -0,0 +1,50 @@
+package aws_secrets_manager
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/hasura/hasura-secret-refresh/provider"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countingSecretsManager counts the secrets fetched from it
+type countingSecretsManager struct {
+	fetches atomic.Int64
+}
+
+func (m *countingSecretsManager) GetSecretValue(input *secretsmanager.GetSecretValueInput) (*secretsmanager.GetSecretValueOutput, error) {
+	m.fetches.Add(1)
+	return &secretsmanager.GetSecretValueOutput{Name: input.SecretId, SecretString: aws.String("topsecretval")}, nil
+}
+
+func TestSecretCache_RefreshAhead(t *testing.T) {
+	client := &countingSecretsManager{}
+	secretCache := NewSecretCache(client, 200*time.Millisecond, DefaultCacheSize)
+	secretCache.refreshAhead = provider.NewRefreshAhead(0.5, 200*time.Millisecond, DefaultCacheSize, zerolog.Nop())
+
+	secret, err := secretCache.GetSecretString("prod/db")
+	require.NoError(t, err)
+	assert.Equal(t, "topsecretval", secret)
+
+	// the secret is not refreshed before half of its ttl
+	_, found := secretCache.CachedSecretString("prod/db")
+	assert.True(t, found)
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, int64(1), client.fetches.Load())
+
+	time.Sleep(100 * time.Millisecond)
+	_, found = secretCache.CachedSecretString("prod/db")
+	assert.True(t, found)
+	assert.Eventually(t, func() bool { return client.fetches.Load() == 2 }, time.Second, 5*time.Millisecond)
+}
+
+func TestCreate_RefreshAhead(t *testing.T) {
+	_, err := Create(map[string]interface{}{"refresh_ahead": 1.5}, zerolog.Nop())
+	assert.ErrorContains(t, err, "refresh_ahead")
+}
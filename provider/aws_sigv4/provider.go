@@ -0,0 +1,208 @@
+package aws_sigv4
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/rs/zerolog"
+)
+
+// AwsSigV4 signs requests with AWS Signature Version 4, e.g. for API Gateway
+// endpoints that use IAM authorization. Credentials are resolved with the
+// default credential chain, optionally assuming a role.
+type AwsSigV4 struct {
+	signer      *v4.Signer
+	credentials aws.CredentialsProvider
+	service     string
+	region      string
+	// maxBodySize is the size of the largest request body whose payload hash
+	// is signed
+	maxBodySize int64
+	// unsignedPayload signs requests with a larger body with UNSIGNED-PAYLOAD
+	// instead of rejecting them
+	unsignedPayload bool
+	logger          zerolog.Logger
+}
+
+const (
+	defaultRoleSessionName = "hasura-secret-refresh"
+	defaultMaxBodySize     = 10485760
+	unsignedPayloadHash    = "UNSIGNED-PAYLOAD"
+)
+
+var (
+	InitError    = errors.New("aws_sigv4: unable to initialize")
+	UnableToSign = errors.New("aws_sigv4: unable to sign request")
+)
+
+func Create(configMap map[string]interface{}, logger zerolog.Logger) (*AwsSigV4, error) {
+	service, err := getString(configMap, "service", true, logger)
+	if err != nil {
+		return nil, err
+	}
+	region, err := getString(configMap, "region", false, logger)
+	if err != nil {
+		return nil, err
+	}
+	roleArn, err := getString(configMap, "role_arn", false, logger)
+	if err != nil {
+		return nil, err
+	}
+	roleSessionName, err := getString(configMap, "role_session_name", false, logger)
+	if err != nil {
+		return nil, err
+	}
+	if roleSessionName == "" {
+		roleSessionName = defaultRoleSessionName
+	}
+	externalId, err := getString(configMap, "external_id", false, logger)
+	if err != nil {
+		return nil, err
+	}
+	maxBodySize := defaultMaxBodySize
+	if maxBodySizeI, found := configMap["max_body_size"]; found {
+		var ok bool
+		maxBodySize, ok = maxBodySizeI.(int)
+		if !ok || maxBodySize < 0 {
+			logger.Error().Msg("aws_sigv4: 'max_body_size' must be a non negative number")
+			return nil, fmt.Errorf("%s: 'max_body_size' must be a non negative number", InitError)
+		}
+	}
+	unsignedPayload := false
+	if unsignedPayloadI, found := configMap["unsigned_payload"]; found {
+		var ok bool
+		unsignedPayload, ok = unsignedPayloadI.(bool)
+		if !ok {
+			logger.Error().Msg("aws_sigv4: 'unsigned_payload' must be a boolean")
+			return nil, fmt.Errorf("%s: 'unsigned_payload' must be a boolean", InitError)
+		}
+	}
+
+	loadOptions := make([]func(*config.LoadOptions) error, 0)
+	if region != "" {
+		loadOptions = append(loadOptions, config.WithRegion(region))
+	}
+	cfg, err := config.LoadDefaultConfig(context.Background(), loadOptions...)
+	if err != nil {
+		logger.Err(err).Msg("aws_sigv4: Unable to load AWS config")
+		return nil, fmt.Errorf("%s: unable to load AWS config: %w", InitError, err)
+	}
+	if cfg.Region == "" {
+		logger.Error().Msg("aws_sigv4: Config 'region' not found and no region is configured in the environment")
+		return nil, fmt.Errorf("%s: required config 'region' not found", InitError)
+	}
+	credentials := cfg.Credentials
+	if roleArn != "" {
+		credentials = stscreds.NewAssumeRoleProvider(sts.NewFromConfig(cfg), roleArn,
+			func(o *stscreds.AssumeRoleOptions) {
+				o.RoleSessionName = roleSessionName
+				if externalId != "" {
+					o.ExternalID = aws.String(externalId)
+				}
+			},
+		)
+	}
+
+	logger.Info().
+		Str("service", service).
+		Str("region", cfg.Region).
+		Str("role_arn", roleArn).
+		Int("max_body_size", maxBodySize).
+		Bool("unsigned_payload", unsignedPayload).
+		Msg("Creating provider")
+
+	return &AwsSigV4{
+		signer:          v4.NewSigner(),
+		credentials:     aws.NewCredentialsCache(credentials),
+		service:         service,
+		region:          cfg.Region,
+		maxBodySize:     int64(maxBodySize),
+		unsignedPayload: unsignedPayload,
+		logger:          logger,
+	}, nil
+}
+
+// SignRequest adds the SigV4 Authorization, X-Amz-Date and, for temporary
+// credentials, X-Amz-Security-Token headers to the request. The body is read
+// to compute the payload hash and replaced with an identical one. A body
+// larger than the max body size is streamed with UNSIGNED-PAYLOAD if that is
+// enabled, and otherwise rejected with an *http.MaxBytesError.
+func (provider AwsSigV4) SignRequest(req *http.Request) error {
+	payloadHash, err := provider.payloadHash(req)
+	if err != nil {
+		return err
+	}
+	credentials, err := provider.credentials.Retrieve(req.Context())
+	if err != nil {
+		provider.logger.Err(err).Msg("aws_sigv4: Unable to retrieve AWS credentials")
+		return fmt.Errorf("%s: unable to retrieve credentials: %w", UnableToSign, err)
+	}
+	err = provider.signer.SignHTTP(req.Context(), credentials, req,
+		payloadHash, provider.service, provider.region, time.Now(),
+	)
+	if err != nil {
+		return fmt.Errorf("%s: %w", UnableToSign, err)
+	}
+	return nil
+}
+
+// payloadHash returns the hex encoded SHA-256 hash of the body, or
+// UNSIGNED-PAYLOAD for a body that is too large to be buffered. At most
+// max body size + 1 bytes of the body are held in memory.
+func (provider AwsSigV4) payloadHash(req *http.Request) (string, error) {
+	body := []byte{}
+	if req.Body != nil && req.Body != http.NoBody {
+		var err error
+		body, err = io.ReadAll(io.LimitReader(req.Body, provider.maxBodySize+1))
+		if err != nil {
+			req.Body.Close()
+			return "", fmt.Errorf("%s: unable to read request body: %w", UnableToSign, err)
+		}
+		if int64(len(body)) > provider.maxBodySize {
+			if !provider.unsignedPayload {
+				req.Body.Close()
+				return "", fmt.Errorf("%s: %w", UnableToSign, &http.MaxBytesError{Limit: provider.maxBodySize})
+			}
+			// the part of the body that was read is sent before the rest
+			req.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(body), req.Body), req.Body}
+			req.Header.Set("X-Amz-Content-Sha256", unsignedPayloadHash)
+			return unsignedPayloadHash, nil
+		}
+		req.Body.Close()
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	payloadHash := sha256.Sum256(body)
+	return hex.EncodeToString(payloadHash[:]), nil
+}
+
+func getString(config map[string]interface{}, key string, required bool, logger zerolog.Logger) (string, error) {
+	valueI, found := config[key]
+	if !found {
+		if required {
+			logger.Error().Msgf("aws_sigv4: Config '%s' not found", key)
+			return "", fmt.Errorf("%s: required config '%s' not found", InitError, key)
+		}
+		return "", nil
+	}
+	value, ok := valueI.(string)
+	if !ok {
+		logger.Error().Msgf("aws_sigv4: '%s' must be a string", key)
+		return "", fmt.Errorf("%s: '%s' must be a string", InitError, key)
+	}
+	return value, nil
+}
@@ -0,0 +1,110 @@
+package aws_sigv4
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/rs/zerolog"
+)
+
+func TestCreate(t *testing.T) {
+	t.Setenv("AWS_REGION", "")
+	t.Setenv("AWS_DEFAULT_REGION", "")
+	t.Setenv("AWS_CONFIG_FILE", "/dev/null")
+	provider, err := Create(map[string]interface{}{
+		"service":  "execute-api",
+		"region":   "us-east-1",
+		"role_arn": "arn:aws:iam::123456789012:role/actions",
+	}, zerolog.Nop())
+	if err != nil {
+		t.Fatalf("Unable to create provider: %s", err)
+	}
+	if provider.service != "execute-api" || provider.region != "us-east-1" {
+		t.Errorf("Unexpected service %s or region %s", provider.service, provider.region)
+	}
+	invalidConfigs := map[string]map[string]interface{}{
+		"missing service":         {"region": "us-east-1"},
+		"missing region":          {"service": "execute-api"},
+		"service not a string":    {"service": 1, "region": "us-east-1"},
+		"role_arn not a string":   {"service": "execute-api", "region": "us-east-1", "role_arn": true},
+		"external_id not string":  {"service": "execute-api", "region": "us-east-1", "external_id": 1},
+		"negative max_body_size":  {"service": "execute-api", "region": "us-east-1", "max_body_size": -1},
+		"unsigned_payload string": {"service": "execute-api", "region": "us-east-1", "unsigned_payload": "true"},
+	}
+	for name, config := range invalidConfigs {
+		_, err := Create(config, zerolog.Nop())
+		if err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func getTestProvider(maxBodySize int64, unsignedPayload bool) AwsSigV4 {
+	return AwsSigV4{
+		signer:          v4.NewSigner(),
+		credentials:     aws.NewCredentialsCache(credentials.NewStaticCredentialsProvider("AKIDEXAMPLE", "secret", "session")),
+		service:         "execute-api",
+		region:          "eu-west-1",
+		maxBodySize:     maxBodySize,
+		unsignedPayload: unsignedPayload,
+		logger:          zerolog.Nop(),
+	}
+}
+
+func TestSignRequest(t *testing.T) {
+	provider := getTestProvider(defaultMaxBodySize, false)
+	body := `{"action":"create"}`
+	req, _ := http.NewRequest("POST", "https://abc123.execute-api.eu-west-1.amazonaws.com/prod/orders?id=1", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	err := provider.SignRequest(req)
+	if err != nil {
+		t.Fatalf("Unable to sign request: %s", err)
+	}
+	authorization := req.Header.Get("Authorization")
+	if !strings.HasPrefix(authorization, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/") ||
+		!strings.Contains(authorization, "/eu-west-1/execute-api/aws4_request") ||
+		!strings.Contains(authorization, "Signature=") {
+		t.Errorf("Unexpected Authorization header %s", authorization)
+	}
+	if req.Header.Get("X-Amz-Date") == "" {
+		t.Errorf("Expected X-Amz-Date header to be set")
+	}
+	if req.Header.Get("X-Amz-Security-Token") != "session" {
+		t.Errorf("Expected X-Amz-Security-Token header to be set")
+	}
+	signedBody, _ := io.ReadAll(req.Body)
+	if string(signedBody) != body {
+		t.Errorf("Expected body to be preserved but got %s", string(signedBody))
+	}
+}
+
+func TestSignRequest_MaxBodySize(t *testing.T) {
+	body := `{"action":"create"}`
+	req, _ := http.NewRequest("POST", "https://abc123.execute-api.eu-west-1.amazonaws.com/prod/orders", strings.NewReader(body))
+	err := getTestProvider(8, false).SignRequest(req)
+	var maxBytesErr *http.MaxBytesError
+	if !errors.As(err, &maxBytesErr) || maxBytesErr.Limit != 8 {
+		t.Errorf("Expected body larger than 'max_body_size' to be rejected but got %v", err)
+	}
+
+	req, _ = http.NewRequest("POST", "https://bucket.s3.eu-west-1.amazonaws.com/upload", strings.NewReader(body))
+	if err := getTestProvider(8, true).SignRequest(req); err != nil {
+		t.Fatalf("Unable to sign request: %s", err)
+	}
+	if req.Header.Get("X-Amz-Content-Sha256") != "UNSIGNED-PAYLOAD" {
+		t.Errorf("Expected large body to be signed with UNSIGNED-PAYLOAD")
+	}
+	if !strings.Contains(req.Header.Get("Authorization"), "x-amz-content-sha256") {
+		t.Errorf("Expected X-Amz-Content-Sha256 to be signed but got %s", req.Header.Get("Authorization"))
+	}
+	streamedBody, _ := io.ReadAll(req.Body)
+	if string(streamedBody) != body {
+		t.Errorf("Expected body to be preserved but got %s", string(streamedBody))
+	}
+}
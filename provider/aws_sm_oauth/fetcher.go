@@ -2,10 +2,15 @@ package aws_sm_oauth
 
 import (
 	"fmt"
+	"net/http"
 	"strings"
 	"time"
 
 	retryablehttp "github.com/hashicorp/go-retryablehttp"
+	"github.com/hasura/hasura-secret-refresh/cache"
+	"github.com/hasura/hasura-secret-refresh/provider"
+	awsSm "github.com/hasura/hasura-secret-refresh/provider/aws_secrets_manager"
+	"github.com/rs/zerolog"
 )
 
 type secretFetcher struct {
@@ -14,62 +19,171 @@ type secretFetcher struct {
 	privateKeySecretId  string
 	backendApiId        string
 	oAuthClientId       string
+	// requestId is sent to the oauth endpoint if it is set
+	requestId string
+	// logger adds the id of the request to the logs of the fetcher
+	logger zerolog.Logger
 }
 
 var (
 	UnableToFetch = "aws_sm_oauth: unable to fetch secret"
 )
 
+// requestIdHeader carries the id of the request the access token is exchanged
+// for to the oauth endpoint
+const requestIdHeader = "X-Request-Id"
+
+// maxTokenExpirySkew is the maximum time before its 'expires_in' at which an
+// access token is no longer served from the cache
+const maxTokenExpirySkew = 30 * time.Second
+
 func (fetcher secretFetcher) FetchSecret() (string, error) {
+	accessToken, _, err := fetcher.FetchSecretWithCacheStatus()
+	return accessToken, err
+}
+
+func (fetcher secretFetcher) CachedSecret() (string, bool) {
 	cacheKey := fetcher.getCacheKey()
-	cachedToken, ok := fetcher.cache.Get(cacheKey)
-	if ok {
-		return cachedToken, nil
+	token, found := fetcher.cache.Get(cacheKey)
+	if found {
+		fetcher.refreshAhead.Hit(cacheKey, fetcher.background().refetch)
+	}
+	return token, found
+}
+
+func (fetcher secretFetcher) FetchSecretWithCacheStatus() (string, bool, error) {
+	return provider.FetchSecretOrStale(fetcher)
+}
+
+func (fetcher secretFetcher) FetchFreshSecret() (string, bool, error) {
+	if cachedToken, ok := fetcher.CachedSecret(); ok {
+		return cachedToken, true, nil
+	}
+	load, stored := fetcher.accessTokenLoader()
+	return fetcher.cache.LoadNotify(fetcher.getCacheKey(), load, stored)
+}
+
+func (fetcher secretFetcher) StaleSecret(err error) (string, bool) {
+	return fetcher.staleIfError.Get(fetcher.getCacheKey(), err, fetcher.background().refetch)
+}
+
+// RefetchSecret exchanges a new access token. The certificate and the private
+// key are still served from the aws secrets manager cache.
+func (fetcher secretFetcher) RefetchSecret() (string, error) {
+	load, stored := fetcher.accessTokenLoader()
+	return fetcher.cache.ReloadNotify(fetcher.getCacheKey(), load, stored)
+}
+
+// refetch fetches an access token in the background, bypassing the cache
+func (fetcher secretFetcher) refetch() error {
+	load, stored := fetcher.accessTokenLoader()
+	_, err := fetcher.cache.ReloadNotify(fetcher.getCacheKey(), load, stored)
+	return err
+}
+
+// accessTokenLoader returns a loader of the cache exchanging an access token,
+// and the callback recording the token for serving it stale and refreshing it
+// ahead once it was cached. Tokens removed from the cache while they were
+// exchanged are not recorded.
+func (fetcher secretFetcher) accessTokenLoader() (cache.Loader[string], cache.Stored[string]) {
+	var expiresIn time.Duration
+	load := func() (string, time.Duration, error) {
+		token, tokenExpiresIn, ttl, err := fetcher.fetchAccessToken()
+		expiresIn = tokenExpiresIn
+		return token, ttl, err
 	}
+	stored := func(token string, ttl time.Duration) {
+		fetcher.staleIfError.AddWithExpiry(fetcher.getCacheKey(), token, expiresIn)
+		fetcher.refreshAhead.AddWithTtl(fetcher.getCacheKey(), ttl)
+	}
+	return load, stored
+}
+
+// fetchAccessToken exchanges a new jwt token for an access token. Returns the
+// 'expires_in' of the token and the TTL to cache it for, until shortly before
+// its 'expires_in' if that is earlier than the TTL of the cache. The token is
+// not served stale after its 'expires_in'.
+func (fetcher secretFetcher) fetchAccessToken() (token string, expiresIn time.Duration, ttl time.Duration, err error) {
 	jwtToken, err := fetcher.createJwtToken()
 	if err != nil {
-		return "", err
+		return "", 0, 0, err
 	}
-	accessToken, err := fetcher.getAccessToken(jwtToken)
+	token, expiresIn, err = fetcher.getAccessToken(jwtToken)
 	if err != nil {
-		return "", err
+		return "", 0, 0, err
+	}
+	ttl = fetcher.tokenCacheTtl
+	if expiresIn > 0 {
+		ttl = min(ttl, expiresIn-min(expiresIn/10, maxTokenExpirySkew))
 	}
-	_ = fetcher.cache.Add(cacheKey, accessToken)
-	return accessToken, nil
+	return token, expiresIn, ttl, nil
+}
+
+// WithRequestId adds the id of the request to the logs of the fetcher and to
+// the token exchange with the oauth endpoint. Token exchanges that run in the
+// background, eg. to refresh the token ahead of expiry, are not attributed to
+// the request.
+func (fetcher secretFetcher) WithRequestId(requestId string) provider.SecretFetcher {
+	fetcher.logger = fetcher.AwsSmOauth.logger.With().Str("request_id", requestId).Logger()
+	fetcher.requestId = requestId
+	return fetcher
 }
 
-func (fetcher secretFetcher) getAccessToken(jwtToken string) (string, error) {
+// background returns the fetcher without the id of the request, for token
+// exchanges that run in the background
+func (fetcher secretFetcher) background() secretFetcher {
+	fetcher.logger = fetcher.AwsSmOauth.logger
+	fetcher.requestId = ""
+	return fetcher
+}
+
+// InvalidateSecret removes the cached access token. The certificate and the
+// private key are still served from the aws secrets manager cache.
+func (fetcher secretFetcher) InvalidateSecret() {
+	fetcher.cache.Remove(fetcher.getCacheKey())
+	fetcher.staleIfError.Remove(fetcher.getCacheKey())
+	fetcher.refreshAhead.Remove(fetcher.getCacheKey())
+}
+
+func (fetcher secretFetcher) getAccessToken(jwtToken string) (string, time.Duration, error) {
 	oAuthMethod, oAuthFormData, oAuthHeader := getOauthRequest(jwtToken, fetcher.backendApiId, fetcher.oAuthClientId, &fetcher.oAuthUrl)
 	oAuthRequest, err := retryablehttp.NewRequest(oAuthMethod, fetcher.oAuthUrl.String(), strings.NewReader(oAuthFormData.Encode()))
 	if err != nil {
-		return "", fmt.Errorf("%s: Unable to create oauth request: %w", UnableToFetch, err)
+		return "", 0, fmt.Errorf("%s: Unable to create oauth request: %w", UnableToFetch, err)
 	}
 	oAuthRequest.Header = oAuthHeader
+	if fetcher.requestId != "" {
+		oAuthRequest.Header.Set(requestIdHeader, fetcher.requestId)
+	}
 	logOauthRequest(fetcher.oAuthUrl, oAuthMethod, oAuthFormData, oAuthHeader, "Sending request to oauth endpoint", fetcher.logger)
 	response, err := fetcher.httpClient.Do(oAuthRequest)
 	if err != nil {
-		return "", fmt.Errorf("%s: Unable perform oauth request: %w", UnableToFetch, err)
+		return "", 0, provider.NewError(provider.ErrorKindFromError(err),
+			fmt.Errorf("%s: Unable perform oauth request: %w", UnableToFetch, err))
 	}
 	logOAuthResponse(response, "Response from oauth endpoint", fetcher.logger)
 	if response.StatusCode != 200 {
-		return "", fmt.Errorf("Did not receive 200 response from oauth server. Received: status code: %d", response.StatusCode)
+		return "", 0, provider.NewError(oAuthErrorKind(response.StatusCode),
+			fmt.Errorf("Did not receive 200 response from oauth server. Received: status code: %d", response.StatusCode))
 	}
-	accessToken, err := getAccessTokenFromResponse(response, fetcher.logger)
+	accessToken, expiresIn, err := getAccessTokenFromResponse(response, fetcher.logger)
 	if err != nil {
-		return "", fmt.Errorf("%s: Unable to get access token from oauth response: %w", UnableToFetch, err)
+		return "", 0, fmt.Errorf("%s: Unable to get access token from oauth response: %w", UnableToFetch, err)
 	}
-	return accessToken, nil
+	return accessToken, expiresIn, nil
 }
 
 func (fetcher secretFetcher) createJwtToken() (string, error) {
 	rsaPrivateKeyPemRaw, err := fetcher.awsSecretsManager.GetSecretString(fetcher.privateKeySecretId)
 	if err != nil {
-		return "", fmt.Errorf("%s: unable to retrieve private key from aws secrets manager: %w", UnableToFetch, err)
+		return "", provider.NewError(awsSm.ErrorKind(err),
+			fmt.Errorf("%s: unable to retrieve private key from aws secrets manager: %w", UnableToFetch, err))
 	}
 	fetcher.logger.Debug().Str("aws_secret_id", fetcher.privateKeySecretId).Str("aws_response", rsaPrivateKeyPemRaw).Msg("Response from aws secrets manager")
 	sslCert, err := fetcher.awsSecretsManager.GetSecretString(fetcher.certificateSecretId)
 	if err != nil {
-		return "", fmt.Errorf("%s: unable to retrieve certificate from aws secrets manager: %w", UnableToFetch, err)
+		return "", provider.NewError(awsSm.ErrorKind(err),
+			fmt.Errorf("%s: unable to retrieve certificate from aws secrets manager: %w", UnableToFetch, err))
 	}
 	fetcher.logger.Debug().Str("aws_secret_id", fetcher.certificateSecretId).Str("aws_response", sslCert).Msg("Response from aws secrets manager")
 	tokenString, err := createJwtToken(rsaPrivateKeyPemRaw, fetcher.jwtClaimMap,
@@ -81,6 +195,17 @@ func (fetcher secretFetcher) createJwtToken() (string, error) {
 	return tokenString, nil
 }
 
+// oAuthErrorKind classifies error responses of the oauth server. Client
+// errors other than throttling mean that the client was not authenticated,
+// eg. because the certificate is not trusted.
+func oAuthErrorKind(statusCode int) provider.ErrorKind {
+	if statusCode >= 400 && statusCode < 500 &&
+		statusCode != http.StatusTooManyRequests && statusCode != http.StatusRequestTimeout {
+		return provider.ErrorKindUnauthorized
+	}
+	return provider.ErrorKindFromStatusCode(statusCode)
+}
+
 func (fetcher secretFetcher) getCacheKey() string {
 	return fmt.Sprintf("%s_%s_%s_%s",
 		fetcher.certificateSecretId,
@@ -10,12 +10,12 @@ import (
 	"github.com/rs/zerolog"
 )
 
-func logConfig(config AwsSmOauth, tokenCacheTtl time.Duration,
-	tokenCacheSize int, logger zerolog.Logger,
+func logConfig(config AwsSmOauth, certificateCacheTtl time.Duration, certificateCacheSize int,
+	tokenCacheTtl time.Duration, tokenCacheSize int, logger zerolog.Logger,
 ) {
-	certificateCacheTtl := time.Duration(config.awsSecretsManager.CacheConfig.CacheItemTTL) * time.Nanosecond
 	logger.Info().
 		Str("certificate_cache_ttl", certificateCacheTtl.String()).
+		Int("certificate_cache_size", certificateCacheSize).
 		Str("certificate_region", config.certificateRegion).
 		Str("oauth_url", config.oAuthUrl.String()).
 		Str("token_cache_ttl", tokenCacheTtl.String()).
@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"strconv"
+	"time"
 
 	"github.com/rs/zerolog"
 )
@@ -23,20 +25,34 @@ func getOauthRequest(jwtToken string, secretId string,
 	return
 }
 
-func getAccessTokenFromResponse(response *http.Response, logger zerolog.Logger) (token string, err error) {
+// getAccessTokenFromResponse returns the access token and its lifetime from
+// 'expires_in'. The lifetime is 0 if the response does not include it.
+func getAccessTokenFromResponse(response *http.Response, logger zerolog.Logger) (token string, expiresIn time.Duration, err error) {
 	defer response.Body.Close()
 	responseJson := make(map[string]interface{})
 	err = json.NewDecoder(response.Body).Decode(&responseJson)
 	if err != nil {
-		return "", fmt.Errorf("Error converting oauth response to json: %s", err)
+		return "", 0, fmt.Errorf("Error converting oauth response to json: %s", err)
 	}
 	_, ok := responseJson["access_token"]
 	if !ok {
-		return "", fmt.Errorf("Key 'access_token' not found in the response from oauth endpoint")
+		return "", 0, fmt.Errorf("Key 'access_token' not found in the response from oauth endpoint")
 	}
 	token, ok = responseJson["access_token"].(string)
 	if !ok {
-		return token, errors.New(fmt.Sprintf("Error converting token to string"))
+		return token, 0, errors.New(fmt.Sprintf("Error converting token to string"))
+	}
+	switch expiresInI := responseJson["expires_in"].(type) {
+	case float64:
+		expiresIn = time.Duration(expiresInI) * time.Second
+	case string:
+		// some servers send expires_in as a string
+		seconds, convErr := strconv.Atoi(expiresInI)
+		if convErr != nil {
+			logger.Warn().Str("expires_in", expiresInI).Msg("Ignoring 'expires_in' of oauth response as it is not a number")
+			break
+		}
+		expiresIn = time.Duration(seconds) * time.Second
 	}
 	return
 }
@@ -6,6 +6,7 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"testing"
+	"time"
 
 	"github.com/rs/zerolog"
 )
@@ -69,13 +70,32 @@ func TestOauth_GetAccessToken(t *testing.T) {
 	}
 	json.NewEncoder(mockResponse).Encode(jsonBody)
 	response := mockResponse.Result()
-	token, err := getAccessTokenFromResponse(response, zerolog.Nop())
+	token, expiresIn, err := getAccessTokenFromResponse(response, zerolog.Nop())
 	if err != nil {
 		t.Fatalf("Unexpected error: %s", err)
 	}
 	if token != "token123" {
 		t.Fatalf("Expected token to be '%s' but received %s", "token123", token)
 	}
+	if expiresIn != 12*time.Hour {
+		t.Fatalf("Expected token to expire in %s but received %s", 12*time.Hour, expiresIn)
+	}
+}
+
+func TestOauth_GetAccessTokenExpiresInString(t *testing.T) {
+	mockResponse := httptest.NewRecorder()
+	json.NewEncoder(mockResponse).Encode(map[string]interface{}{"access_token": "token123", "expires_in": "3600"})
+	_, expiresIn, err := getAccessTokenFromResponse(mockResponse.Result(), zerolog.Nop())
+	if err != nil || expiresIn != time.Hour {
+		t.Fatalf("Expected token to expire in %s but received %s, %v", time.Hour, expiresIn, err)
+	}
+
+	mockResponse = httptest.NewRecorder()
+	json.NewEncoder(mockResponse).Encode(map[string]interface{}{"access_token": "token123"})
+	_, expiresIn, err = getAccessTokenFromResponse(mockResponse.Result(), zerolog.Nop())
+	if err != nil || expiresIn != 0 {
+		t.Fatalf("Expected no expiry without 'expires_in' but received %s, %v", expiresIn, err)
+	}
 }
 
 func TestOauth_GetAccessTokenInvalidResponse(t *testing.T) {
@@ -83,7 +103,7 @@ func TestOauth_GetAccessTokenInvalidResponse(t *testing.T) {
 	mockResponse.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(mockResponse).Encode("")
 	invalidJsonResponse := mockResponse.Result()
-	_, err := getAccessTokenFromResponse(invalidJsonResponse, zerolog.Nop())
+	_, _, err := getAccessTokenFromResponse(invalidJsonResponse, zerolog.Nop())
 	if err == nil {
 		t.Fatalf("Expected error because the body was an invalid json")
 	}
@@ -97,7 +117,7 @@ func TestOauth_GetAccessTokenInvalidResponse(t *testing.T) {
 	}
 	json.NewEncoder(mockResponse).Encode(jsonBody)
 	invalidTypeResponse := mockResponse.Result()
-	_, err = getAccessTokenFromResponse(invalidTypeResponse, zerolog.Nop())
+	_, _, err = getAccessTokenFromResponse(invalidTypeResponse, zerolog.Nop())
 	if err == nil {
 		t.Fatalf("Expected error because the type of token was invalid")
 	}
@@ -12,17 +12,20 @@ import (
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/secretsmanager"
-	"github.com/aws/aws-secretsmanager-caching-go/secretcache"
 	retryablehttp "github.com/hashicorp/go-retryablehttp"
-	"github.com/hashicorp/golang-lru/v2/expirable"
+	"github.com/hasura/hasura-secret-refresh/cache"
 	"github.com/hasura/hasura-secret-refresh/provider"
+	awsSm "github.com/hasura/hasura-secret-refresh/provider/aws_secrets_manager"
 	"github.com/rs/zerolog"
 )
 
 type AwsSmOauth struct {
-	cache             *expirable.LRU[string, string]
+	cache             *cache.Cache[string]
+	tokenCacheTtl     time.Duration
+	staleIfError      *provider.StaleIfError
+	refreshAhead      *provider.RefreshAhead
 	certificateRegion string
-	awsSecretsManager *secretcache.Cache
+	awsSecretsManager *awsSm.SecretCache
 	oAuthUrl          url.URL
 	jwtClaimMap       map[string]interface{}
 	jwtDuration       time.Duration
@@ -31,16 +34,17 @@ type AwsSmOauth struct {
 }
 
 type configJson struct {
-	TokenCacheTtl       int64  `json:"token_cache_ttl"`
-	TokenCacheSize      int    `json:"token_cache_size"`
-	CertificateCacheTtl int64  `json:"certificate_cache_ttl"`
-	CertificateRegion   string `json:"certificate_region"`
-	OauthUrl            string `json:"oauth_url"`
-	JwtClaimMap         string `json:"jwt_claims_map"`
-	JwtDuration         int64  `json:"jwt_duration"`
-	HttpRetryAttempts   int    `json:"http_retry_attempts"`
-	HttpRetryMinWait    int64  `json:"http_retry_min_wait"`
-	HttpRetryMaxWait    int64  `json:"http_retry_max_wait"`
+	TokenCacheTtl        int64  `json:"token_cache_ttl"`
+	TokenCacheSize       int    `json:"token_cache_size"`
+	CertificateCacheTtl  int64  `json:"certificate_cache_ttl"`
+	CertificateCacheSize int    `json:"certificate_cache_size"`
+	CertificateRegion    string `json:"certificate_region"`
+	OauthUrl             string `json:"oauth_url"`
+	JwtClaimMap          string `json:"jwt_claims_map"`
+	JwtDuration          int64  `json:"jwt_duration"`
+	HttpRetryAttempts    int    `json:"http_retry_attempts"`
+	HttpRetryMinWait     int64  `json:"http_retry_min_wait"`
+	HttpRetryMaxWait     int64  `json:"http_retry_max_wait"`
 }
 
 var (
@@ -58,6 +62,7 @@ const (
 func (provider AwsSmOauth) SecretFetcher(headers http.Header) (provider.SecretFetcher, error) {
 	secretFetcher := secretFetcher{
 		AwsSmOauth: &provider,
+		logger:     provider.logger,
 	}
 	notFoundHeaders := make([]string, 0, 0)
 	certificateSecretId := headers.Get(certificateSecretIdHeader)
@@ -87,6 +92,34 @@ func (provider AwsSmOauth) SecretFetcher(headers http.Header) (provider.SecretFe
 	return secretFetcher, nil
 }
 
+func (provider AwsSmOauth) StaleServed() int64 {
+	return provider.staleIfError.Served()
+}
+
+// CacheKeys returns the keys of the cached access tokens
+func (provider AwsSmOauth) CacheKeys() []string {
+	return provider.cache.Keys()
+}
+
+func (provider AwsSmOauth) InvalidateCacheKey(key string) bool {
+	provider.staleIfError.Remove(key)
+	provider.refreshAhead.Remove(key)
+	return provider.cache.Remove(key)
+}
+
+// PurgeCache removes the cached access tokens and the cached certificates and
+// private keys
+func (provider AwsSmOauth) PurgeCache() {
+	provider.cache.Purge()
+	provider.staleIfError.Purge()
+	provider.refreshAhead.Purge()
+	provider.awsSecretsManager.Purge()
+}
+
+func (provider AwsSmOauth) CacheStats() cache.Stats {
+	return provider.cache.Stats()
+}
+
 func (provider AwsSmOauth) DeleteConfigHeaders(headers *http.Header) {
 	headers.Del(certificateSecretIdHeader)
 	headers.Del(oauthClientIdHeader)
@@ -113,19 +146,20 @@ func Create(config map[string]interface{}, logger zerolog.Logger) (*AwsSmOauth,
 		WithRegion(configJson.CertificateRegion).
 		WithHTTPClient(httpClient.StandardClient()))
 	certificateCacheTtl := time.Duration(configJson.CertificateCacheTtl) * time.Second
-	awsSecretsManagerCache, err := secretcache.New(
-		func(c *secretcache.Cache) {
-			c.CacheConfig.CacheItemTTL = certificateCacheTtl.Nanoseconds()
-		},
-		func(c *secretcache.Cache) {
-			c.Client = smClient
-		},
-	)
-	if err != nil {
-		return nil, fmt.Errorf("%s: error initializing secrets manager cache: %w", InitError, err)
+	certificateCacheSize := configJson.CertificateCacheSize
+	if certificateCacheSize <= 0 {
+		certificateCacheSize = awsSm.DefaultCacheSize
 	}
+	awsSecretsManagerCache := awsSm.NewSecretCache(smClient, certificateCacheTtl, certificateCacheSize)
 	tokenCacheTtl := time.Duration(configJson.TokenCacheTtl) * time.Second
-	cache := expirable.NewLRU[string, string](configJson.TokenCacheSize, nil, tokenCacheTtl)
+	staleIfError, err := provider.ParseStaleIfErrorFromConfig(config, tokenCacheTtl, configJson.TokenCacheSize, logger)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", InitError, err)
+	}
+	refreshAhead, err := provider.ParseRefreshAheadFromConfig(config, tokenCacheTtl, configJson.TokenCacheSize, logger)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", InitError, err)
+	}
 	oauthUrl, err := url.Parse(configJson.OauthUrl)
 	if err != nil {
 		return nil, fmt.Errorf("%s: unable to parse oauth url: %w", InitError, err)
@@ -139,14 +173,17 @@ func Create(config map[string]interface{}, logger zerolog.Logger) (*AwsSmOauth,
 	conf := AwsSmOauth{
 		awsSecretsManager: awsSecretsManagerCache,
 		certificateRegion: configJson.CertificateRegion,
-		cache:             cache,
+		cache:             cache.New[string](tokenCacheTtl, configJson.TokenCacheSize),
+		tokenCacheTtl:     tokenCacheTtl,
+		staleIfError:      staleIfError,
+		refreshAhead:      refreshAhead,
 		oAuthUrl:          *oauthUrl,
 		jwtClaimMap:       jwtClaimMap,
 		jwtDuration:       jwtDuration,
 		httpClient:        httpClient,
 		logger:            logger,
 	}
-	logConfig(conf, tokenCacheTtl, configJson.TokenCacheSize, logger)
+	logConfig(conf, certificateCacheTtl, certificateCacheSize, tokenCacheTtl, configJson.TokenCacheSize, logger)
 	return &conf, nil
 }
 
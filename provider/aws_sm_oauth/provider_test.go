@@ -2,9 +2,11 @@ package aws_sm_oauth
 
 import (
 	"encoding/json"
+	"errors"
 	"io"
 	"net/http"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -12,8 +14,9 @@ import (
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/secretsmanager"
-	"github.com/aws/aws-secretsmanager-caching-go/secretcache"
 	"github.com/hashicorp/go-retryablehttp"
+	"github.com/hasura/hasura-secret-refresh/provider"
+	awsSm "github.com/hasura/hasura-secret-refresh/provider/aws_secrets_manager"
 	"github.com/rs/zerolog"
 )
 
@@ -52,7 +55,8 @@ func (m mockRoundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
 		}, nil
 	} else if r.URL.String() == "http://localhost:8090/oauth" {
 		respJson := []byte(`{
-			"access_token": "random_access_token_123"
+			"access_token": "random_access_token_123",
+			"expires_in": 60
 		 }`)
 		return &http.Response{
 			StatusCode: 200,
@@ -67,22 +71,14 @@ var mockHttpClient = http.Client{
 	Transport: mockRoundTripper{},
 }
 
-func mockAwsSmClient(httpClient *retryablehttp.Client) *secretcache.Cache {
+func mockAwsSmClient(httpClient *retryablehttp.Client) *awsSm.SecretCache {
 	sess, _ := session.NewSession()
 	smClient := secretsmanager.New(sess, aws.NewConfig().
 		WithRegion("us-east-2").
 		WithCredentials(credentials.AnonymousCredentials).
 		WithHTTPClient(httpClient.StandardClient()))
 	certificateCacheTtl := time.Duration(300) * time.Second
-	awsSecretsManagerCache, _ := secretcache.New(
-		func(c *secretcache.Cache) {
-			c.CacheConfig.CacheItemTTL = certificateCacheTtl.Nanoseconds()
-		},
-		func(c *secretcache.Cache) {
-			c.Client = smClient
-		},
-	)
-	return awsSecretsManagerCache
+	return awsSm.NewSecretCache(smClient, certificateCacheTtl, awsSm.DefaultCacheSize)
 }
 
 func Test_AwsSmOauthProvider(t *testing.T) {
@@ -131,4 +127,180 @@ func Test_AwsSmOauthProvider(t *testing.T) {
 	if secretStr != "random_access_token_123" {
 		t.Fatalf("Expected secret string to be %s but got %s", "random_access_token_123", secretStr)
 	}
+	if provider.cache.Len() != 1 {
+		t.Fatalf("Expected access token to be cached")
+	}
+	// the token expires before the token cache ttl
+	expiresAt, _ := provider.cache.ExpiresAt(fetcher.(secretFetcher).getCacheKey())
+	if expiresIn := time.Until(expiresAt); expiresIn > 54*time.Second || expiresIn < 50*time.Second {
+		t.Fatalf("Expected access token to be cached until shortly before its expiry but expires in %s", expiresIn)
+	}
+	fetcher.(secretFetcher).InvalidateSecret()
+	if provider.cache.Len() != 0 {
+		t.Fatalf("Expected access token to be removed from cache")
+	}
+}
+
+// requestIdRoundTripper records the request ids sent to the oauth endpoint
+type requestIdRoundTripper struct {
+	mockRoundTripper
+	mu         *sync.Mutex
+	requestIds *[]string
+}
+
+func (m requestIdRoundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.URL.String() == "http://localhost:8090/oauth" {
+		m.mu.Lock()
+		*m.requestIds = append(*m.requestIds, r.Header.Get(requestIdHeader))
+		m.mu.Unlock()
+	}
+	return m.mockRoundTripper.RoundTrip(r)
+}
+
+func (m requestIdRoundTripper) sent() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string{}, *m.requestIds...)
+}
+
+func Test_AwsSmOauthProvider_RequestId(t *testing.T) {
+	testConfig := map[string]interface{}{
+		"certificate_region":  "us-east-2",
+		"oauth_url":           "http://localhost:8090/oauth",
+		"jwt_claims_map":      `{}`,
+		"http_retry_attempts": 0,
+	}
+	provider, err := Create(testConfig, zerolog.Nop())
+	if err != nil {
+		t.Fatalf("Unable to initialize provider: %s", err)
+	}
+	requestIds := make([]string, 0)
+	provider.httpClient.HTTPClient = &http.Client{
+		Transport: requestIdRoundTripper{mockRoundTripper: mockRoundTripper{t: t}, mu: &sync.Mutex{}, requestIds: &requestIds},
+	}
+	provider.awsSecretsManager = mockAwsSmClient(provider.httpClient)
+	fetcher, err := provider.SecretFetcher(http.Header{
+		"X-Hasura-Certificate-Id":  []string{"testCert"},
+		"X-Hasura-Backend-Id":      []string{"testBackendId"},
+		"X-Hasura-Oauth-Client-Id": []string{"testOauthClientId"},
+		"X-Hasura-Private-Key-Id":  []string{"testPrivateKeyId"},
+	})
+	if err != nil {
+		t.Fatalf("Unable to retrieve fetcher: %s", err)
+	}
+	if _, err := fetcher.(secretFetcher).WithRequestId("req-123").FetchSecret(); err != nil {
+		t.Fatalf("Failed to fetch secret: %s", err)
+	}
+	if _, err := fetcher.(secretFetcher).RefetchSecret(); err != nil {
+		t.Fatalf("Failed to refetch secret: %s", err)
+	}
+	if len(requestIds) != 2 || requestIds[0] != "req-123" || requestIds[1] != "" {
+		t.Errorf("Expected the request id to be sent with the token exchange of the request only but got %v", requestIds)
+	}
+}
+
+func Test_AwsSmOauthProvider_RequestIdNotSentInBackground(t *testing.T) {
+	testConfig := map[string]interface{}{
+		"certificate_region":  "us-east-2",
+		"oauth_url":           "http://localhost:8090/oauth",
+		"jwt_claims_map":      `{}`,
+		"http_retry_attempts": 0,
+		"token_cache_ttl":     300,
+		"refresh_ahead":       0.5,
+	}
+	provider, err := Create(testConfig, zerolog.Nop())
+	if err != nil {
+		t.Fatalf("Unable to initialize provider: %s", err)
+	}
+	roundTripper := requestIdRoundTripper{mockRoundTripper: mockRoundTripper{t: t}, mu: &sync.Mutex{}, requestIds: &[]string{}}
+	provider.httpClient.HTTPClient = &http.Client{Transport: roundTripper}
+	provider.awsSecretsManager = mockAwsSmClient(provider.httpClient)
+	fetcher, err := provider.SecretFetcher(http.Header{
+		"X-Hasura-Certificate-Id":  []string{"testCert"},
+		"X-Hasura-Backend-Id":      []string{"testBackendId"},
+		"X-Hasura-Oauth-Client-Id": []string{"testOauthClientId"},
+		"X-Hasura-Private-Key-Id":  []string{"testPrivateKeyId"},
+	})
+	if err != nil {
+		t.Fatalf("Unable to retrieve fetcher: %s", err)
+	}
+	if _, err := fetcher.(secretFetcher).WithRequestId("req-123").FetchSecret(); err != nil {
+		t.Fatalf("Failed to fetch secret: %s", err)
+	}
+
+	// the cached token is due for a refresh when the next request uses it
+	provider.refreshAhead.AddWithTtl(fetcher.(secretFetcher).getCacheKey(), time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	if _, err := fetcher.(secretFetcher).WithRequestId("req-456").FetchSecret(); err != nil {
+		t.Fatalf("Failed to fetch secret: %s", err)
+	}
+	for i := 0; len(roundTripper.sent()) < 2 && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if sent := roundTripper.sent(); len(sent) != 2 || sent[0] != "req-123" || sent[1] != "" {
+		t.Errorf("Expected the background refresh to be sent without a request id but got %v", sent)
+	}
+}
+
+// blockingRoundTripper blocks token exchanges until release is closed
+type blockingRoundTripper struct {
+	mockRoundTripper
+	started chan struct{}
+	release chan struct{}
+}
+
+func (m blockingRoundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.URL.String() == "http://localhost:8090/oauth" {
+		close(m.started)
+		<-m.release
+	}
+	return m.mockRoundTripper.RoundTrip(r)
+}
+
+func Test_AwsSmOauthProvider_InvalidateDuringLoad(t *testing.T) {
+	testConfig := map[string]interface{}{
+		"certificate_region":  "us-east-2",
+		"oauth_url":           "http://localhost:8090/oauth",
+		"jwt_claims_map":      `{}`,
+		"http_retry_attempts": 0,
+		"stale_if_error":      300,
+	}
+	p, err := Create(testConfig, zerolog.Nop())
+	if err != nil {
+		t.Fatalf("Unable to initialize provider: %s", err)
+	}
+	roundTripper := blockingRoundTripper{
+		mockRoundTripper: mockRoundTripper{t: t}, started: make(chan struct{}), release: make(chan struct{}),
+	}
+	p.httpClient.HTTPClient = &http.Client{Transport: roundTripper}
+	p.awsSecretsManager = mockAwsSmClient(p.httpClient)
+	fetcher, err := p.SecretFetcher(http.Header{
+		"X-Hasura-Certificate-Id":  []string{"testCert"},
+		"X-Hasura-Backend-Id":      []string{"testBackendId"},
+		"X-Hasura-Oauth-Client-Id": []string{"testOauthClientId"},
+		"X-Hasura-Private-Key-Id":  []string{"testPrivateKeyId"},
+	})
+	if err != nil {
+		t.Fatalf("Unable to retrieve fetcher: %s", err)
+	}
+	done := make(chan error)
+	go func() {
+		_, err := fetcher.FetchSecret()
+		done <- err
+	}()
+	<-roundTripper.started
+	fetcher.(secretFetcher).InvalidateSecret()
+	close(roundTripper.release)
+	if err := <-done; err != nil {
+		t.Fatalf("Failed to fetch secret: %s", err)
+	}
+
+	cacheKey := fetcher.(secretFetcher).getCacheKey()
+	if p.cache.Len() != 0 {
+		t.Errorf("Expected the token exchanged before the invalidation not to be cached")
+	}
+	storeErr := provider.NewError(provider.ErrorKindUnavailable, errors.New("oauth endpoint unavailable"))
+	if stale, found := p.staleIfError.Get(cacheKey, storeErr, func() error { return storeErr }); found {
+		t.Errorf("Expected the token exchanged before the invalidation not to be served stale but got %s", stale)
+	}
 }
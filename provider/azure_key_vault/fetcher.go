@@ -5,6 +5,9 @@ import (
 	"errors"
 	"fmt"
 	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/hasura/hasura-secret-refresh/provider"
 )
 
 type secretFetcher struct {
@@ -17,13 +20,50 @@ var (
 )
 
 func (fetcher secretFetcher) FetchSecret() (string, error) {
-	// Check cache first
-	if cachedSecret, found := fetcher.cache.Get(fetcher.secretName); found {
+	secret, _, err := fetcher.FetchSecretWithCacheStatus()
+	return secret, err
+}
+
+func (fetcher secretFetcher) CachedSecret() (string, bool) {
+	cachedSecret, found := fetcher.cache.Get(fetcher.secretName)
+	if found {
 		fetcher.logger.Debug().Str("secret_name", fetcher.secretName).Msg("azure_key_vault: Secret found in cache")
-		return cachedSecret, nil
+		fetcher.refreshAhead.Hit(fetcher.secretName, fetcher.refetch)
+	}
+	return cachedSecret, found
+}
+
+func (fetcher secretFetcher) FetchSecretWithCacheStatus() (string, bool, error) {
+	return provider.FetchSecretOrStale(fetcher)
+}
+
+func (fetcher secretFetcher) FetchFreshSecret() (string, bool, error) {
+	// Check cache first
+	if cachedSecret, found := fetcher.CachedSecret(); found {
+		return cachedSecret, true, nil
 	}
 
-	// Fetch from Azure Key Vault
+	return fetcher.cache.LoadNotify(fetcher.secretName, fetcher.fetchFromKeyVault, fetcher.stored)
+}
+
+func (fetcher secretFetcher) StaleSecret(err error) (string, bool) {
+	return fetcher.staleIfError.Get(fetcher.secretName, err, fetcher.refetch)
+}
+
+func (fetcher secretFetcher) RefetchSecret() (string, error) {
+	fetcher.logger.Debug().Str("secret_name", fetcher.secretName).Msg("azure_key_vault: Bypassing cache")
+	return fetcher.cache.ReloadNotify(fetcher.secretName, fetcher.fetchFromKeyVault, fetcher.stored)
+}
+
+// refetch fetches the secret in the background, bypassing the cache
+func (fetcher secretFetcher) refetch() error {
+	_, err := fetcher.cache.ReloadNotify(fetcher.secretName, fetcher.fetchFromKeyVault, fetcher.stored)
+	return err
+}
+
+// fetchFromKeyVault fetches the secret from Azure Key Vault. It is cached
+// with the TTL of the cache.
+func (fetcher secretFetcher) fetchFromKeyVault() (string, time.Duration, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 
@@ -32,19 +72,46 @@ func (fetcher secretFetcher) FetchSecret() (string, error) {
 	resp, err := fetcher.client.GetSecret(ctx, fetcher.secretName, "", nil)
 	if err != nil {
 		fetcher.logger.Err(err).Str("secret_name", fetcher.secretName).Msg("azure_key_vault: Failed to fetch secret")
-		return "", fmt.Errorf("%s: %w", UnableToFetch, err)
+		return "", 0, provider.NewError(errorKind(err), fmt.Errorf("%s: %w", UnableToFetch, err))
 	}
 
 	if resp.Value == nil {
 		fetcher.logger.Error().Str("secret_name", fetcher.secretName).Msg("azure_key_vault: Secret value is nil")
-		return "", fmt.Errorf("%s: secret value is nil", UnableToFetch)
+		return "", 0, provider.NewError(provider.ErrorKindNotFound, fmt.Errorf("%s: secret value is nil", UnableToFetch))
 	}
 
-	secretValue := *resp.Value
-	
-	// Cache the secret
-	fetcher.cache.Add(fetcher.secretName, secretValue)
+	return *resp.Value, 0, nil
+}
+
+// stored records a secret that was cached for serving it stale and refreshing
+// it ahead. Secrets removed from the cache while they were fetched are not
+// recorded.
+func (fetcher secretFetcher) stored(secretValue string, ttl time.Duration) {
+	fetcher.staleIfError.Add(fetcher.secretName, secretValue)
+	fetcher.refreshAhead.AddWithTtl(fetcher.secretName, ttl)
 	fetcher.logger.Debug().Str("secret_name", fetcher.secretName).Msg("azure_key_vault: Secret cached successfully")
+}
+
+// WithRequestId adds the id of the request to the logs of the fetcher
+func (fetcher secretFetcher) WithRequestId(requestId string) provider.SecretFetcher {
+	keyVault := *fetcher.AzureKeyVault
+	keyVault.logger = keyVault.logger.With().Str("request_id", requestId).Logger()
+	fetcher.AzureKeyVault = &keyVault
+	return fetcher
+}
 
-	return secretValue, nil
+func (fetcher secretFetcher) InvalidateSecret() {
+	fetcher.cache.Remove(fetcher.secretName)
+	fetcher.staleIfError.Remove(fetcher.secretName)
+	fetcher.refreshAhead.Remove(fetcher.secretName)
+	fetcher.logger.Debug().Str("secret_name", fetcher.secretName).Msg("azure_key_vault: Secret removed from cache")
+}
+
+// errorKind classifies the errors of requests to Azure Key Vault
+func errorKind(err error) provider.ErrorKind {
+	var responseError *azcore.ResponseError
+	if errors.As(err, &responseError) {
+		return provider.ErrorKindFromStatusCode(responseError.StatusCode)
+	}
+	return provider.ErrorKindFromError(err)
 }
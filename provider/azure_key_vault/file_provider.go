@@ -9,6 +9,7 @@ import (
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
 	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
 	"github.com/Azure/azure-sdk-for-go/sdk/security/keyvault/azsecrets"
+	"github.com/hasura/hasura-secret-refresh/output"
 	sharedprovider "github.com/hasura/hasura-secret-refresh/provider"
 	"github.com/hasura/hasura-secret-refresh/template"
 	"github.com/hasura/hasura-secret-refresh/transform"
@@ -23,11 +24,29 @@ type AzureKeyVaultFile struct {
 	secretVersion   string
 	template        string
 	secretTransform *transform.SecretTransform
+	secretOutput    *output.SecretOutput
+	refreshGroup    *sharedprovider.RefreshGroup
 	logger          zerolog.Logger
 	mu              *sync.Mutex
 }
 
 func CreateAzureKeyVaultFile(config map[string]interface{}, logger zerolog.Logger) (AzureKeyVaultFile, error) {
+	return createAzureKeyVaultFile(config, nil, logger)
+}
+
+// CreateAzureKeyVaultFileWithToken creates a file provider that fetches
+// secrets as the application in 'client_id' of the tenant in 'tenant_id',
+// with the token of a service account as federated credential instead of the
+// credentials of the process
+func CreateAzureKeyVaultFileWithToken(
+	config map[string]interface{}, token sharedprovider.ServiceAccountToken, logger zerolog.Logger,
+) (AzureKeyVaultFile, error) {
+	return createAzureKeyVaultFile(config, token, logger)
+}
+
+func createAzureKeyVaultFile(
+	config map[string]interface{}, token sharedprovider.ServiceAccountToken, logger zerolog.Logger,
+) (AzureKeyVaultFile, error) {
 	// Parse vault URL
 	vaultUrlI, found := config["vault_url"]
 	if !found {
@@ -107,17 +126,51 @@ func CreateAzureKeyVaultFile(config map[string]interface{}, logger zerolog.Logge
 		return AzureKeyVaultFile{}, fmt.Errorf("config not valid: Only one of 'template' or 'transform' can be configured, not both")
 	}
 
+	secretOutput, err := output.ParseSecretOutputFromConfig(config, logger)
+	if err != nil {
+		return AzureKeyVaultFile{}, err
+	}
+
 	// Create Azure credential
 	var cred azcore.TokenCredential
 
-	// Create Azure credential using DefaultAzureCredential
-	// This will automatically try different authentication methods in sequence
-	defaultCred, err := azidentity.NewDefaultAzureCredential(nil)
-	if err != nil {
-		logger.Error().Err(err).Msg("azure_key_vault_file: Failed to create default Azure credential")
-		return AzureKeyVaultFile{}, fmt.Errorf("failed to create credential")
+	if token != nil {
+		ids := make(map[string]string)
+		for _, key := range []string{"tenant_id", "client_id"} {
+			idI, found := config[key]
+			if !found {
+				logger.Error().Msgf("azure_key_vault_file: Config '%s' not found", key)
+				return AzureKeyVaultFile{}, fmt.Errorf("required configs not found")
+			}
+			id, ok := idI.(string)
+			if !ok {
+				logger.Error().Msgf("azure_key_vault_file: '%s' must be a string", key)
+				return AzureKeyVaultFile{}, fmt.Errorf("config not valid")
+			}
+			ids[key] = id
+		}
+		// the token of the service account is exchanged as a federated
+		// credential of the application
+		assertionCred, err := azidentity.NewClientAssertionCredential(
+			ids["tenant_id"], ids["client_id"],
+			func(context.Context) (string, error) { return token() },
+			nil,
+		)
+		if err != nil {
+			logger.Error().Err(err).Msg("azure_key_vault_file: Failed to create client assertion credential")
+			return AzureKeyVaultFile{}, fmt.Errorf("failed to create credential")
+		}
+		cred = assertionCred
+	} else {
+		// Create Azure credential using DefaultAzureCredential
+		// This will automatically try different authentication methods in sequence
+		defaultCred, err := azidentity.NewDefaultAzureCredential(nil)
+		if err != nil {
+			logger.Error().Err(err).Msg("azure_key_vault_file: Failed to create default Azure credential")
+			return AzureKeyVaultFile{}, fmt.Errorf("failed to create credential")
+		}
+		cred = defaultCred
 	}
-	cred = defaultCred
 
 	// Create Key Vault client
 	client, err := azsecrets.NewClient(vaultUrl, cred, nil)
@@ -134,6 +187,8 @@ func CreateAzureKeyVaultFile(config map[string]interface{}, logger zerolog.Logge
 		secretVersion:   secretVersion,
 		logger:          logger,
 		secretTransform: secretTransform,
+		secretOutput:    secretOutput,
+		refreshGroup:    sharedprovider.NewRefreshGroup(),
 		template:        secretTemplate,
 		mu:              &sync.Mutex{},
 	}
@@ -145,23 +200,21 @@ func CreateAzureKeyVaultFile(config map[string]interface{}, logger zerolog.Logge
 		Str("vault_url", vaultUrl).
 		Int("transformations", len(secretTransform.GetMappings())).
 		Str("transform_mode", string(secretTransform.GetMode())).
+		Str("output_mode", string(secretOutput.GetMode())).
+		Bool("output_encrypted", secretOutput.IsEncrypted()).
+		Bool("output_kubernetes_secret", secretOutput.HasKubernetesSecret()).
 		Msg("Creating Azure Key Vault file provider")
 
 	return azureKv, nil
 }
 
 func (provider AzureKeyVaultFile) Start() {
-	err := sharedprovider.WriteSecretFile(provider.filePath, []byte(""))
+	err := provider.secretOutput.Init(provider.filePath)
 	if err != nil {
 		provider.logger.Err(err).Msgf("azure_key_vault_file: Error occurred while writing to file %s", provider.filePath)
 	}
 	for {
-		secret, err := provider.getSecret()
-		if err != nil {
-			time.Sleep(provider.refreshInterval)
-			continue
-		}
-		err = provider.writeFile(secret)
+		err := provider.refreshGroup.Do(provider.getSecret, provider.writeFile)
 		if err != nil {
 			time.Sleep(provider.refreshInterval)
 			continue
@@ -173,11 +226,7 @@ func (provider AzureKeyVaultFile) Start() {
 
 func (provider AzureKeyVaultFile) Refresh() error {
 	provider.logger.Info().Msgf("azure_key_vault_file: Refresh invoked for secret %s", provider.secretName)
-	secret, err := provider.getSecret()
-	if err != nil {
-		return err
-	}
-	err = provider.writeFile(secret)
+	err := provider.refreshGroup.Do(provider.getSecret, provider.writeFile)
 	if err != nil {
 		return err
 	}
@@ -189,6 +238,11 @@ func (provider AzureKeyVaultFile) FileName() string {
 	return provider.filePath
 }
 
+// RenderSecret returns the contents of the secret file without writing it
+func (provider AzureKeyVaultFile) RenderSecret() (string, error) {
+	return provider.getSecret()
+}
+
 func (provider AzureKeyVaultFile) getSecret() (string, error) {
 	provider.logger.Info().Msgf("azure_key_vault_file: Fetching secret %s", provider.secretName)
 
@@ -225,7 +279,7 @@ func (provider AzureKeyVaultFile) getSecret() (string, error) {
 func (provider AzureKeyVaultFile) writeFile(secretString string) error {
 	provider.mu.Lock()
 	defer provider.mu.Unlock()
-	err := sharedprovider.WriteSecretFile(provider.filePath, []byte(secretString))
+	err := provider.secretOutput.Write(provider.filePath, secretString)
 	if err != nil {
 		provider.logger.Err(err).Msgf("azure_key_vault_file: Error occurred while writing secret %s to file %s", provider.secretName, provider.filePath)
 		return err
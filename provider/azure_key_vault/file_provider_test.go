@@ -271,3 +271,30 @@ func TestAzureKeyVaultFile_writeFileNormalizesPermissions(t *testing.T) {
 		t.Fatalf("expected mode %04o, got %04o", sharedprovider.SecretFileMode, got)
 	}
 }
+
+func TestCreateAzureKeyVaultFileWithToken(t *testing.T) {
+	logger := zerolog.Nop()
+	token := func() (string, error) { return "jwt", nil }
+	config := map[string]interface{}{
+		"vault_url":   "https://test.vault.azure.net/",
+		"path":        "/tmp/test-secret",
+		"secret_name": "test-secret",
+		"refresh":     60,
+		"tenant_id":   "test-tenant-id",
+		"client_id":   "test-client-id",
+	}
+
+	provider, err := CreateAzureKeyVaultFileWithToken(config, token, logger)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if provider.secretName != "test-secret" {
+		t.Errorf("Expected secret name 'test-secret', got '%s'", provider.secretName)
+	}
+
+	delete(config, "tenant_id")
+	_, err = CreateAzureKeyVaultFileWithToken(config, token, logger)
+	if err == nil || err.Error() != "required configs not found" {
+		t.Errorf("Expected error when tenant_id is missing but got %v", err)
+	}
+}
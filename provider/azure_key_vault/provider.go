@@ -9,19 +9,22 @@ import (
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
 	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
 	"github.com/Azure/azure-sdk-for-go/sdk/security/keyvault/azsecrets"
-	lru "github.com/hashicorp/golang-lru/v2"
+	"github.com/hasura/hasura-secret-refresh/cache"
 	"github.com/hasura/hasura-secret-refresh/provider"
 	"github.com/rs/zerolog"
 )
 
 type AzureKeyVault struct {
-	client *azsecrets.Client
-	cache  *lru.Cache[string, string]
-	logger zerolog.Logger
+	client       *azsecrets.Client
+	cache        *cache.Cache[string]
+	staleIfError *provider.StaleIfError
+	refreshAhead *provider.RefreshAhead
+	logger       zerolog.Logger
 }
 
 const (
-	cacheTtl = "cache_ttl"
+	cacheTtl  = "cache_ttl"
+	cacheSize = "cache_size"
 )
 
 const (
@@ -64,6 +67,15 @@ func Create(config map[string]interface{}, logger zerolog.Logger) (*AzureKeyVaul
 		cacheTtlDuration = time.Second * time.Duration(cacheTtlI)
 	}
 
+	// Parse cache size
+	cacheSizeInt := defaultCacheSize
+	if cacheSizeI, found := config[cacheSize]; found {
+		cacheSizeInt, ok = cacheSizeI.(int)
+		if !ok || cacheSizeInt <= 0 {
+			return nil, fmt.Errorf("%s: 'cache_size' must be a positive number", InitError)
+		}
+	}
+
 	var cred azcore.TokenCredential
 
 	// Create Azure credential using DefaultAzureCredential
@@ -81,24 +93,54 @@ func Create(config map[string]interface{}, logger zerolog.Logger) (*AzureKeyVaul
 		return nil, fmt.Errorf("%s: failed to create Azure Key Vault client: %w", InitError, err)
 	}
 
-	// Create cache
-	cache, err := lru.New[string, string](defaultCacheSize)
+	staleIfError, err := provider.ParseStaleIfErrorFromConfig(config, cacheTtlDuration, cacheSizeInt, logger)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", InitError, err)
+	}
+	refreshAhead, err := provider.ParseRefreshAheadFromConfig(config, cacheTtlDuration, cacheSizeInt, logger)
 	if err != nil {
-		return nil, fmt.Errorf("%s: failed to create cache: %w", InitError, err)
+		return nil, fmt.Errorf("%s: %w", InitError, err)
 	}
 
 	logger.Info().
 		Str("vault_url", vaultUrl).
 		Str("cache_ttl", cacheTtlDuration.String()).
+		Int("cache_size", cacheSizeInt).
 		Msg("Creating Azure Key Vault provider")
 
 	return &AzureKeyVault{
-		client: client,
-		cache:  cache,
-		logger: logger,
+		client:       client,
+		cache:        cache.New[string](cacheTtlDuration, cacheSizeInt),
+		staleIfError: staleIfError,
+		refreshAhead: refreshAhead,
+		logger:       logger,
 	}, nil
 }
 
+func (provider AzureKeyVault) StaleServed() int64 {
+	return provider.staleIfError.Served()
+}
+
+func (provider AzureKeyVault) CacheKeys() []string {
+	return provider.cache.Keys()
+}
+
+func (provider AzureKeyVault) InvalidateCacheKey(key string) bool {
+	provider.staleIfError.Remove(key)
+	provider.refreshAhead.Remove(key)
+	return provider.cache.Remove(key)
+}
+
+func (provider AzureKeyVault) PurgeCache() {
+	provider.cache.Purge()
+	provider.staleIfError.Purge()
+	provider.refreshAhead.Purge()
+}
+
+func (provider AzureKeyVault) CacheStats() cache.Stats {
+	return provider.cache.Stats()
+}
+
 func (provider AzureKeyVault) DeleteConfigHeaders(headers *http.Header) {
 	headers.Del(secretNameHeader)
 }
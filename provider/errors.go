@@ -0,0 +1,106 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+)
+
+// ErrorKind classifies why a provider was unable to provide a secret, so
+// that the proxy can respond with a matching status code
+type ErrorKind string
+
+const (
+	// ErrorKindBadRequest is returned if the request for the secret is not
+	// valid, eg. a required header is missing
+	ErrorKindBadRequest ErrorKind = "bad_request"
+	// ErrorKindNotFound is returned if the secret does not exist
+	ErrorKindNotFound ErrorKind = "not_found"
+	// ErrorKindUnauthorized is returned if the provider is not allowed to
+	// read the secret
+	ErrorKindUnauthorized ErrorKind = "unauthorized"
+	// ErrorKindUnavailable is returned if the secret store failed or could
+	// not be reached, eg. it is down or throttles requests
+	ErrorKindUnavailable ErrorKind = "unavailable"
+	// ErrorKindTimeout is returned if the secret store did not respond in time
+	ErrorKindTimeout ErrorKind = "timeout"
+)
+
+// Error is an error of a provider with its kind. The wrapped error can be
+// retrieved with errors.Unwrap.
+type Error struct {
+	Kind ErrorKind
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// NewError returns err with its kind. Returns nil if err is nil.
+func NewError(kind ErrorKind, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &Error{Kind: kind, Err: err}
+}
+
+// GetErrorKind returns the kind of the first Error in the chain of err.
+// Returns an empty ErrorKind if err was not classified by a provider.
+func GetErrorKind(err error) ErrorKind {
+	var providerError *Error
+	if errors.As(err, &providerError) {
+		return providerError.Kind
+	}
+	return ""
+}
+
+// ErrorKindFromStatusCode classifies the HTTP status code of an error
+// response of a secret store
+func ErrorKindFromStatusCode(statusCode int) ErrorKind {
+	switch {
+	case statusCode == http.StatusNotFound:
+		return ErrorKindNotFound
+	case statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden:
+		return ErrorKindUnauthorized
+	case statusCode == http.StatusRequestTimeout || statusCode == http.StatusGatewayTimeout:
+		return ErrorKindTimeout
+	case statusCode == http.StatusTooManyRequests || statusCode >= 500:
+		return ErrorKindUnavailable
+	case statusCode >= 400:
+		return ErrorKindBadRequest
+	}
+	return ErrorKindUnavailable
+}
+
+// ErrorKindFromError classifies errors of requests to a secret store that
+// did not receive a response
+func ErrorKindFromError(err error) ErrorKind {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return ErrorKindTimeout
+	}
+	var netError net.Error
+	if errors.As(err, &netError) && netError.Timeout() {
+		return ErrorKindTimeout
+	}
+	return ErrorKindUnavailable
+}
+
+// IsStoreFailure reports whether err is a failure of the secret store, as
+// opposed to eg. a secret that does not exist. Errors that were not
+// classified are treated as failures of the secret store.
+func IsStoreFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+	switch GetErrorKind(err) {
+	case "", ErrorKindUnavailable, ErrorKindTimeout:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,62 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestGetErrorKind(t *testing.T) {
+	err := fmt.Errorf("proxy_hmac: unable to get signing key: %w",
+		NewError(ErrorKindNotFound, errors.New("secret not found")))
+	if GetErrorKind(err) != ErrorKindNotFound {
+		t.Errorf("Expected kind %s but got %s", ErrorKindNotFound, GetErrorKind(err))
+	}
+	if GetErrorKind(errors.New("error")) != "" {
+		t.Errorf("Expected no kind for an unclassified error")
+	}
+	if NewError(ErrorKindTimeout, nil) != nil {
+		t.Errorf("Expected nil error for a nil cause")
+	}
+}
+
+func TestErrorKindFromStatusCode(t *testing.T) {
+	tests := map[int]ErrorKind{
+		http.StatusBadRequest:          ErrorKindBadRequest,
+		http.StatusUnauthorized:        ErrorKindUnauthorized,
+		http.StatusForbidden:           ErrorKindUnauthorized,
+		http.StatusNotFound:            ErrorKindNotFound,
+		http.StatusTooManyRequests:     ErrorKindUnavailable,
+		http.StatusInternalServerError: ErrorKindUnavailable,
+		http.StatusServiceUnavailable:  ErrorKindUnavailable,
+		http.StatusGatewayTimeout:      ErrorKindTimeout,
+	}
+	for statusCode, kind := range tests {
+		if ErrorKindFromStatusCode(statusCode) != kind {
+			t.Errorf("Expected kind %s for status code %d but got %s", kind, statusCode, ErrorKindFromStatusCode(statusCode))
+		}
+	}
+}
+
+func TestErrorKindFromError(t *testing.T) {
+	if kind := ErrorKindFromError(fmt.Errorf("read: %w", context.DeadlineExceeded)); kind != ErrorKindTimeout {
+		t.Errorf("Expected kind %s but got %s", ErrorKindTimeout, kind)
+	}
+	if kind := ErrorKindFromError(errors.New("connection refused")); kind != ErrorKindUnavailable {
+		t.Errorf("Expected kind %s but got %s", ErrorKindUnavailable, kind)
+	}
+}
+
+func TestIsStoreFailure(t *testing.T) {
+	if !IsStoreFailure(errors.New("connection refused")) {
+		t.Errorf("Expected unclassified error to be a failure of the secret store")
+	}
+	if !IsStoreFailure(NewError(ErrorKindTimeout, errors.New("timeout"))) {
+		t.Errorf("Expected timeout to be a failure of the secret store")
+	}
+	if IsStoreFailure(NewError(ErrorKindNotFound, errors.New("secret not found"))) || IsStoreFailure(nil) {
+		t.Errorf("Expected not found and nil to not be failures of the secret store")
+	}
+}
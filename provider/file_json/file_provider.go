@@ -6,6 +6,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/hasura/hasura-secret-refresh/output"
 	sharedprovider "github.com/hasura/hasura-secret-refresh/provider"
 	"github.com/hasura/hasura-secret-refresh/template"
 	"github.com/hasura/hasura-secret-refresh/transform"
@@ -18,6 +19,8 @@ type FileJsonProvider struct {
 	filePath        string
 	template        string
 	secretTransform *transform.SecretTransform
+	secretOutput    *output.SecretOutput
+	refreshGroup    *sharedprovider.RefreshGroup
 
 	logger zerolog.Logger
 	mu     *sync.Mutex
@@ -78,6 +81,11 @@ func CreateFileJsonProvider(config map[string]interface{}, logger zerolog.Logger
 		return FileJsonProvider{}, fmt.Errorf("config not valid: Only one of 'template' or 'transform' can be configured, not both")
 	}
 
+	secretOutput, err := output.ParseSecretOutputFromConfig(config, logger)
+	if err != nil {
+		return FileJsonProvider{}, err
+	}
+
 	provider := FileJsonProvider{
 		refreshInterval: refreshInterval,
 		inputPath:       inputPath,
@@ -85,6 +93,8 @@ func CreateFileJsonProvider(config map[string]interface{}, logger zerolog.Logger
 		logger:          logger,
 		template:        secretTemplate,
 		secretTransform: secretTransform,
+		secretOutput:    secretOutput,
+		refreshGroup:    sharedprovider.NewRefreshGroup(),
 		mu:              &sync.Mutex{},
 	}
 
@@ -94,23 +104,21 @@ func CreateFileJsonProvider(config map[string]interface{}, logger zerolog.Logger
 		Str("file_path", filePath).
 		Int("key_mappings", len(secretTransform.GetMappings())).
 		Str("transform_mode", string(secretTransform.GetMode())).
+		Str("output_mode", string(secretOutput.GetMode())).
+		Bool("output_encrypted", secretOutput.IsEncrypted()).
+		Bool("output_kubernetes_secret", secretOutput.HasKubernetesSecret()).
 		Msg("Creating file_json provider")
 
 	return provider, nil
 }
 
 func (provider FileJsonProvider) Start() {
-	err := sharedprovider.WriteSecretFile(provider.filePath, []byte(""))
+	err := provider.secretOutput.Init(provider.filePath)
 	if err != nil {
 		provider.logger.Err(err).Msgf("file_json: Error occurred while writing to file %s", provider.filePath)
 	}
 	for {
-		secret, err := provider.getSecret()
-		if err != nil {
-			time.Sleep(provider.refreshInterval)
-			continue
-		}
-		err = provider.writeFile(secret)
+		err := provider.refreshGroup.Do(provider.getSecret, provider.writeFile)
 		if err != nil {
 			time.Sleep(provider.refreshInterval)
 			continue
@@ -122,11 +130,7 @@ func (provider FileJsonProvider) Start() {
 
 func (provider FileJsonProvider) Refresh() error {
 	provider.logger.Info().Msgf("file_json: Refresh invoked for input %s", provider.inputPath)
-	secret, err := provider.getSecret()
-	if err != nil {
-		return err
-	}
-	err = provider.writeFile(secret)
+	err := provider.refreshGroup.Do(provider.getSecret, provider.writeFile)
 	if err != nil {
 		return err
 	}
@@ -168,7 +172,7 @@ func (provider FileJsonProvider) getSecret() (string, error) {
 func (provider FileJsonProvider) writeFile(secretString string) error {
 	provider.mu.Lock()
 	defer provider.mu.Unlock()
-	err := sharedprovider.WriteSecretFile(provider.filePath, []byte(secretString))
+	err := provider.secretOutput.Write(provider.filePath, secretString)
 	if err != nil {
 		provider.logger.Err(err).Msgf("file_json: Error occurred while writing to file %s", provider.filePath)
 		return err
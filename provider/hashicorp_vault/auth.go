@@ -9,6 +9,7 @@ import (
 
 	"github.com/hashicorp/vault/api"
 	authkubernetes "github.com/hashicorp/vault/api/auth/kubernetes"
+	sharedprovider "github.com/hasura/hasura-secret-refresh/provider"
 	"github.com/rs/zerolog"
 )
 
@@ -33,6 +34,9 @@ type VaultConfig struct {
 	AuthMethod  string
 	MountPath   string
 	JwtPath     string
+	// ServiceAccountToken, if set, is logged in with instead of the token
+	// file at JwtPath
+	ServiceAccountToken sharedprovider.ServiceAccountToken
 }
 
 // parseVaultConfig extracts the common Vault connection / auth options out
@@ -168,13 +172,20 @@ func newVaultClient(vc VaultConfig) (*api.Client, error) {
 // login performs a Kubernetes-auth login against Vault and returns the
 // resulting Secret (which carries the renewable client token).
 func login(ctx context.Context, client *api.Client, vc VaultConfig, logger zerolog.Logger) (*api.Secret, error) {
-	if _, err := os.Stat(vc.JwtPath); err != nil {
+	tokenOption := authkubernetes.WithServiceAccountTokenPath(vc.JwtPath)
+	if vc.ServiceAccountToken != nil {
+		jwt, err := vc.ServiceAccountToken()
+		if err != nil {
+			return nil, fmt.Errorf("%w: service account token not available: %v", ErrLogin, err)
+		}
+		tokenOption = authkubernetes.WithServiceAccountToken(jwt)
+	} else if _, err := os.Stat(vc.JwtPath); err != nil {
 		return nil, fmt.Errorf("%w: service account token file not accessible at %s: %v", ErrLogin, vc.JwtPath, err)
 	}
 
 	k8sAuth, err := authkubernetes.NewKubernetesAuth(
 		vc.AuthRole,
-		authkubernetes.WithServiceAccountTokenPath(vc.JwtPath),
+		tokenOption,
 		authkubernetes.WithMountPath(vc.MountPath),
 	)
 	if err != nil {
@@ -44,6 +44,25 @@ func newAuthenticatedClient(cfg VaultConfig, logger zerolog.Logger) (*vaultClien
 	return vc, nil
 }
 
+// newLoggedInClient logs in once without managing the token lifecycle, for
+// clients that are used only until the token expires
+func newLoggedInClient(cfg VaultConfig, logger zerolog.Logger) (*vaultClient, error) {
+	client, err := newVaultClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := login(context.Background(), client, cfg, logger); err != nil {
+		return nil, err
+	}
+
+	return &vaultClient{
+		api:    client,
+		cfg:    cfg,
+		logger: logger,
+	}, nil
+}
+
 // client returns the wrapped api.Client. It exists so callers don't reach
 // straight into the struct field while a re-login might be swapping it.
 func (v *vaultClient) client() *api.Client {
@@ -3,6 +3,11 @@ package hashicorp_vault
 import (
 	"errors"
 	"fmt"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+	"github.com/hasura/hasura-secret-refresh/cache"
+	"github.com/hasura/hasura-secret-refresh/provider"
 )
 
 type secretFetcher struct {
@@ -24,26 +29,106 @@ func (f secretFetcher) cacheKey() string {
 }
 
 func (f secretFetcher) FetchSecret() (string, error) {
+	secret, _, err := f.FetchSecretWithCacheStatus()
+	return secret, err
+}
+
+func (f secretFetcher) CachedSecret() (string, bool) {
 	key := f.cacheKey()
-	if cached, found := f.cache.Get(key); found {
+	cached, found := f.cache.Get(key)
+	if found {
 		f.logger.Debug().Str("vault_path", f.path).Msg("hashicorp_vault: secret found in cache")
-		return cached, nil
+		f.refreshAhead.Hit(key, f.refetch(key))
+	}
+	return cached, found
+}
+
+func (f secretFetcher) FetchSecretWithCacheStatus() (string, bool, error) {
+	return provider.FetchSecretOrStale(f)
+}
+
+func (f secretFetcher) FetchFreshSecret() (string, bool, error) {
+	if cached, found := f.CachedSecret(); found {
+		return cached, true, nil
+	}
+	key := f.cacheKey()
+	return f.cache.LoadNotify(key, f.fetchFromVault, f.stored(key))
+}
+
+func (f secretFetcher) StaleSecret(err error) (string, bool) {
+	key := f.cacheKey()
+	return f.staleIfError.Get(key, err, f.refetch(key))
+}
+
+func (f secretFetcher) RefetchSecret() (string, error) {
+	f.logger.Debug().Str("vault_path", f.path).Msg("hashicorp_vault: bypassing cache")
+	return f.cache.ReloadNotify(f.cacheKey(), f.fetchFromVault, f.stored(f.cacheKey()))
+}
+
+// refetch fetches the secret in the background, bypassing the cache
+func (f secretFetcher) refetch(key string) func() error {
+	return func() error {
+		_, err := f.cache.ReloadNotify(key, f.fetchFromVault, f.stored(key))
+		return err
 	}
+}
 
+// fetchFromVault reads the secret from Vault. It is cached with the TTL of
+// the cache.
+func (f secretFetcher) fetchFromVault() (string, time.Duration, error) {
 	f.logger.Info().Str("vault_path", f.path).Msg("hashicorp_vault: fetching secret from Vault")
 
 	data, err := readKVv2WithTimeout(f.client.client(), f.mount, f.path, f.version, f.logger)
 	if err != nil {
 		f.logger.Err(err).Str("vault_path", f.path).Msg("hashicorp_vault: failed to fetch secret")
-		return "", fmt.Errorf("%w: %v", ErrUnableToFetch, err)
+		return "", 0, provider.NewError(errorKind(err), fmt.Errorf("%w: %v", ErrUnableToFetch, err))
 	}
 
 	value, err := extractField(data, f.field)
 	if err != nil {
-		return "", fmt.Errorf("%w: %v", ErrUnableToFetch, err)
+		return "", 0, provider.NewError(provider.ErrorKindNotFound, fmt.Errorf("%w: %v", ErrUnableToFetch, err))
+	}
+
+	return value, 0, nil
+}
+
+// stored records a secret that was cached for serving it stale and refreshing
+// it ahead. Secrets removed from the cache while they were fetched are not
+// recorded.
+func (f secretFetcher) stored(key string) cache.Stored[string] {
+	return func(value string, ttl time.Duration) {
+		f.staleIfError.Add(key, value)
+		f.refreshAhead.AddWithTtl(key, ttl)
+		f.logger.Debug().Str("vault_path", f.path).Msg("hashicorp_vault: secret cached")
 	}
+}
 
-	f.cache.Add(key, value)
-	f.logger.Debug().Str("vault_path", f.path).Msg("hashicorp_vault: secret cached")
-	return value, nil
+// WithRequestId adds the id of the request to the logs of the fetcher
+func (f secretFetcher) WithRequestId(requestId string) provider.SecretFetcher {
+	vault := *f.HashicorpVault
+	vault.logger = vault.logger.With().Str("request_id", requestId).Logger()
+	f.HashicorpVault = &vault
+	return f
+}
+
+func (f secretFetcher) InvalidateSecret() {
+	f.cache.Remove(f.cacheKey())
+	f.staleIfError.Remove(f.cacheKey())
+	f.refreshAhead.Remove(f.cacheKey())
+	f.logger.Debug().Str("vault_path", f.path).Msg("hashicorp_vault: secret removed from cache")
+}
+
+// errorKind classifies the errors of reads from Vault
+func errorKind(err error) provider.ErrorKind {
+	if errors.Is(err, ErrSecretNotFound) {
+		return provider.ErrorKindNotFound
+	}
+	if errors.Is(err, ErrInvalidKvData) {
+		return provider.ErrorKindBadRequest
+	}
+	var responseError *api.ResponseError
+	if errors.As(err, &responseError) {
+		return provider.ErrorKindFromStatusCode(responseError.StatusCode)
+	}
+	return provider.ErrorKindFromError(err)
 }
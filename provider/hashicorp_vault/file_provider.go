@@ -5,6 +5,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/hasura/hasura-secret-refresh/output"
 	sharedprovider "github.com/hasura/hasura-secret-refresh/provider"
 	"github.com/hasura/hasura-secret-refresh/template"
 	"github.com/hasura/hasura-secret-refresh/transform"
@@ -21,6 +22,8 @@ type HashicorpVaultFile struct {
 	field           string
 	template        string
 	secretTransform *transform.SecretTransform
+	secretOutput    *output.SecretOutput
+	refreshGroup    *sharedprovider.RefreshGroup
 	logger          zerolog.Logger
 	mu              *sync.Mutex
 }
@@ -33,6 +36,31 @@ func CreateHashicorpVaultFile(config map[string]interface{}, logger zerolog.Logg
 		logger.Err(err).Msg("hashicorp_vault_file: invalid vault/auth config")
 		return HashicorpVaultFile{}, fmt.Errorf("config not valid: %v", err)
 	}
+	return createHashicorpVaultFile(config, vc, newAuthenticatedClient, logger)
+}
+
+// CreateHashicorpVaultFileWithToken builds a file provider that logs in with
+// the token of a service account instead of the token file in
+// 'auth.jwt_path'. The Vault token is not renewed, so the provider is meant
+// to render secrets once rather than to be started.
+func CreateHashicorpVaultFileWithToken(
+	config map[string]interface{}, token sharedprovider.ServiceAccountToken, logger zerolog.Logger,
+) (HashicorpVaultFile, error) {
+	vc, err := parseVaultConfig(config)
+	if err != nil {
+		logger.Err(err).Msg("hashicorp_vault_file: invalid vault/auth config")
+		return HashicorpVaultFile{}, fmt.Errorf("config not valid: %v", err)
+	}
+	vc.ServiceAccountToken = token
+	return createHashicorpVaultFile(config, vc, newLoggedInClient, logger)
+}
+
+func createHashicorpVaultFile(
+	config map[string]interface{},
+	vc VaultConfig,
+	newClient func(VaultConfig, zerolog.Logger) (*vaultClient, error),
+	logger zerolog.Logger,
+) (HashicorpVaultFile, error) {
 
 	filePathI, found := config["path_on_disk"]
 	if !found {
@@ -121,7 +149,12 @@ func CreateHashicorpVaultFile(config map[string]interface{}, logger zerolog.Logg
 		return HashicorpVaultFile{}, fmt.Errorf("config not valid: Only one of 'template' or 'transform' can be configured, not both")
 	}
 
-	client, err := newAuthenticatedClient(vc, logger)
+	secretOutput, err := output.ParseSecretOutputFromConfig(config, logger)
+	if err != nil {
+		return HashicorpVaultFile{}, err
+	}
+
+	client, err := newClient(vc, logger)
 	if err != nil {
 		return HashicorpVaultFile{}, err
 	}
@@ -136,6 +169,8 @@ func CreateHashicorpVaultFile(config map[string]interface{}, logger zerolog.Logg
 		field:           field,
 		template:        secretTemplate,
 		secretTransform: secretTransform,
+		secretOutput:    secretOutput,
+		refreshGroup:    sharedprovider.NewRefreshGroup(),
 		logger:          logger,
 		mu:              &sync.Mutex{},
 	}
@@ -148,25 +183,24 @@ func CreateHashicorpVaultFile(config map[string]interface{}, logger zerolog.Logg
 		Str("path", path).
 		Int("transformations", len(secretTransform.GetMappings())).
 		Str("transform_mode", string(secretTransform.GetMode())).
+		Str("output_mode", string(secretOutput.GetMode())).
+		Bool("output_encrypted", secretOutput.IsEncrypted()).
+		Bool("output_kubernetes_secret", secretOutput.HasKubernetesSecret()).
 		Msg("Creating HashiCorp Vault file provider")
 
 	return hv, nil
 }
 
 func (p HashicorpVaultFile) Start() {
-	if err := sharedprovider.WriteSecretFile(p.filePath, []byte("")); err != nil {
+	if err := p.secretOutput.Init(p.filePath); err != nil {
 		p.logger.Err(err).Msgf("hashicorp_vault_file: Error occurred while writing to file %s", p.filePath)
 	}
 	for {
-		secret, err := p.getSecret()
+		err := p.refreshGroup.Do(p.getSecret, p.writeFile)
 		if err != nil {
 			time.Sleep(p.refreshInterval)
 			continue
 		}
-		if err := p.writeFile(secret); err != nil {
-			time.Sleep(p.refreshInterval)
-			continue
-		}
 		p.logger.Info().Msgf("hashicorp_vault_file: Successfully fetched secret %s. Fetching again in %s", p.path, p.refreshInterval)
 		time.Sleep(p.refreshInterval)
 	}
@@ -174,13 +208,10 @@ func (p HashicorpVaultFile) Start() {
 
 func (p HashicorpVaultFile) Refresh() error {
 	p.logger.Info().Msgf("hashicorp_vault_file: Refresh invoked for secret %s", p.path)
-	secret, err := p.getSecret()
+	err := p.refreshGroup.Do(p.getSecret, p.writeFile)
 	if err != nil {
 		return err
 	}
-	if err := p.writeFile(secret); err != nil {
-		return err
-	}
 	p.logger.Info().Msgf("hashicorp_vault_file: Successfully refreshed secret %s upon invocation", p.path)
 	return nil
 }
@@ -189,6 +220,11 @@ func (p HashicorpVaultFile) FileName() string {
 	return p.filePath
 }
 
+// RenderSecret returns the contents of the secret file without writing it
+func (p HashicorpVaultFile) RenderSecret() (string, error) {
+	return p.getSecret()
+}
+
 func (p HashicorpVaultFile) getSecret() (string, error) {
 	p.logger.Info().Msgf("hashicorp_vault_file: Fetching secret %s", p.path)
 
@@ -221,7 +257,7 @@ func (p HashicorpVaultFile) getSecret() (string, error) {
 func (p HashicorpVaultFile) writeFile(secretString string) error {
 	p.mu.Lock()
 	defer p.mu.Unlock()
-	if err := sharedprovider.WriteSecretFile(p.filePath, []byte(secretString)); err != nil {
+	if err := p.secretOutput.Write(p.filePath, secretString); err != nil {
 		p.logger.Err(err).Msgf("hashicorp_vault_file: Error writing secret %s to file %s", p.path, p.filePath)
 		return err
 	}
@@ -1,6 +1,9 @@
 package hashicorp_vault
 
 import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"strings"
@@ -128,3 +131,35 @@ func TestHashicorpVaultFile_writeFileNormalizesPermissions(t *testing.T) {
 		t.Fatalf("expected mode %04o, got %04o", sharedprovider.SecretFileMode, got)
 	}
 }
+
+func TestCreateHashicorpVaultFileWithToken_LogsInWithToken(t *testing.T) {
+	var jwt string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/auth/kubernetes/login" {
+			http.NotFound(w, r)
+			return
+		}
+		var body map[string]string
+		json.NewDecoder(r.Body).Decode(&body)
+		jwt = body["jwt"]
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"auth": {"client_token": "s.token", "lease_duration": 60}}`))
+	}))
+	defer server.Close()
+
+	cfg := validFileConfig(map[string]interface{}{
+		"vault_addr": server.URL,
+		"auth":       map[string]interface{}{"role": "apps", "jwt_path": "/nonexistent/token"},
+	})
+	token := func() (string, error) { return "pod-jwt", nil }
+	p, err := CreateHashicorpVaultFileWithToken(cfg, token, zerolog.Nop())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if jwt != "pod-jwt" {
+		t.Errorf("expected login with the service account token, got %q", jwt)
+	}
+	if p.client.client().Token() != "s.token" {
+		t.Errorf("expected the client token of the login, got %q", p.client.client().Token())
+	}
+}
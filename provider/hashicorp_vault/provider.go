@@ -7,21 +7,24 @@ import (
 	"strings"
 	"time"
 
-	lru "github.com/hashicorp/golang-lru/v2"
+	"github.com/hasura/hasura-secret-refresh/cache"
 	"github.com/hasura/hasura-secret-refresh/provider"
 	"github.com/rs/zerolog"
 )
 
 type HashicorpVault struct {
 	client      *vaultClient
-	cache       *lru.Cache[string, string]
+	cache       *cache.Cache[string]
+	staleIfError *provider.StaleIfError
+	refreshAhead *provider.RefreshAhead
 	defaultMount string
 	logger      zerolog.Logger
 }
 
 const (
-	cacheTtlKey = "cache_ttl"
-	mountKey    = "mount"
+	cacheTtlKey  = "cache_ttl"
+	cacheSizeKey = "cache_size"
+	mountKey     = "mount"
 )
 
 const (
@@ -59,6 +62,15 @@ func Create(config map[string]interface{}, logger zerolog.Logger) (*HashicorpVau
 		cacheTtlDuration = time.Second * time.Duration(cacheTtl)
 	}
 
+	cacheSize := defaultCacheSize
+	if cacheSizeI, ok := config[cacheSizeKey]; ok {
+		size, ok := cacheSizeI.(int)
+		if !ok || size <= 0 {
+			return nil, fmt.Errorf("%w: 'cache_size' must be a positive number", ErrInit)
+		}
+		cacheSize = size
+	}
+
 	mount := defaultMount
 	if mountI, ok := config[mountKey]; ok {
 		m, ok := mountI.(string)
@@ -75,9 +87,14 @@ func Create(config map[string]interface{}, logger zerolog.Logger) (*HashicorpVau
 		return nil, fmt.Errorf("%w: %v", ErrInit, err)
 	}
 
-	cache, err := lru.New[string, string](defaultCacheSize)
+	staleIfError, err := provider.ParseStaleIfErrorFromConfig(config, cacheTtlDuration, cacheSize, logger)
 	if err != nil {
-		return nil, fmt.Errorf("%w: failed to create cache: %v", ErrInit, err)
+		return nil, fmt.Errorf("%w: %v", ErrInit, err)
+	}
+
+	refreshAhead, err := provider.ParseRefreshAheadFromConfig(config, cacheTtlDuration, cacheSize, logger)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInit, err)
 	}
 
 	logger.Info().
@@ -85,16 +102,43 @@ func Create(config map[string]interface{}, logger zerolog.Logger) (*HashicorpVau
 		Str("namespace", vc.Namespace).
 		Str("mount", mount).
 		Str("cache_ttl", cacheTtlDuration.String()).
+		Int("cache_size", cacheSize).
 		Msg("Creating HashiCorp Vault provider")
 
 	return &HashicorpVault{
 		client:       client,
-		cache:        cache,
+		cache:        cache.New[string](cacheTtlDuration, cacheSize),
+		staleIfError: staleIfError,
+		refreshAhead: refreshAhead,
 		defaultMount: mount,
 		logger:       logger,
 	}, nil
 }
 
+func (p HashicorpVault) StaleServed() int64 {
+	return p.staleIfError.Served()
+}
+
+func (p HashicorpVault) CacheKeys() []string {
+	return p.cache.Keys()
+}
+
+func (p HashicorpVault) InvalidateCacheKey(key string) bool {
+	p.staleIfError.Remove(key)
+	p.refreshAhead.Remove(key)
+	return p.cache.Remove(key)
+}
+
+func (p HashicorpVault) PurgeCache() {
+	p.cache.Purge()
+	p.staleIfError.Purge()
+	p.refreshAhead.Purge()
+}
+
+func (p HashicorpVault) CacheStats() cache.Stats {
+	return p.cache.Stats()
+}
+
 func (p HashicorpVault) DeleteConfigHeaders(headers *http.Header) {
 	headers.Del(vaultPathHeader)
 	headers.Del(vaultFieldHeader)
@@ -1,10 +1,14 @@
 package hashicorp_vault
 
 import (
+	"context"
+	"fmt"
 	"net/http"
 	"strings"
 	"testing"
 
+	"github.com/hashicorp/vault/api"
+	"github.com/hasura/hasura-secret-refresh/provider"
 	"github.com/rs/zerolog"
 )
 
@@ -234,3 +238,17 @@ func TestCreate_InvalidCacheTtl(t *testing.T) {
 		t.Errorf("expected cache_ttl error, got: %v", err)
 	}
 }
+
+func TestErrorKind(t *testing.T) {
+	tests := map[error]provider.ErrorKind{
+		fmt.Errorf("%w: secret/data/missing", ErrSecretNotFound):                      provider.ErrorKindNotFound,
+		fmt.Errorf("read: %w", &api.ResponseError{StatusCode: http.StatusForbidden}):  provider.ErrorKindUnauthorized,
+		fmt.Errorf("read: %w", &api.ResponseError{StatusCode: http.StatusBadGateway}): provider.ErrorKindUnavailable,
+		fmt.Errorf("read: %w", context.DeadlineExceeded):                              provider.ErrorKindTimeout,
+	}
+	for err, kind := range tests {
+		if errorKind(err) != kind {
+			t.Errorf("Expected kind %s for %s but got %s", kind, err, errorKind(err))
+		}
+	}
+}
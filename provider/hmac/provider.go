@@ -0,0 +1,243 @@
+package hmac
+
+import (
+	"bytes"
+	stdhmac "crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hasura/hasura-secret-refresh/provider"
+	"github.com/rs/zerolog"
+)
+
+const (
+	// defaultMaxBodySize is the size of the largest request body that is
+	// read to build the canonical string
+	defaultMaxBodySize     = 1048576
+	defaultCanonicalString = "{method}\n{path}\n{timestamp}\n{body_sha256}"
+	defaultTimestampHeader = "X-Timestamp"
+	defaultSignatureHeader = "X-Signature"
+	defaultSignatureFormat = "{signature}"
+)
+
+var hmacAlgorithms = map[string]func() hash.Hash{
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// Hmac signs requests with an HMAC of a canonical string built from the
+// request. The key is read from a file or fetched from a proxy provider for
+// every request, so rotated keys are used as soon as the provider returns
+// them.
+type Hmac struct {
+	key             *provider.SecretSource
+	keyEncoding     string
+	maxBodySize     int64
+	algorithm       func() hash.Hash
+	encoding        string
+	canonicalString string
+	timestampFormat string
+	timestampHeader string
+	signatureHeader string
+	signatureFormat string
+	now             func() time.Time
+	logger          zerolog.Logger
+}
+
+// Create parses the config of a 'proxy_hmac' provider. The key is read from a
+// file or fetched with one of the http providers.
+//
+//	webhook_signer:
+//	  type: proxy_hmac
+//	  key:
+//	    provider: vault
+//	    provider_params:
+//	      X-Hasura-Vault-Path: webhooks/orders
+//	      X-Hasura-Vault-Field: signing_key
+//	  algorithm: sha256
+//	  encoding: hex
+//	  canonical_string: "{method}\n{path}\n{timestamp}\n{body_sha256}"
+//	  timestamp_header: X-Timestamp
+//	  signature_header: X-Signature
+func Create(
+	config map[string]interface{}, providers map[string]provider.HttpProvider, logger zerolog.Logger,
+) (*Hmac, error) {
+	keyI, found := config["key"]
+	if !found {
+		logger.Error().Msg("proxy_hmac: Config 'key' not found")
+		return nil, fmt.Errorf("required configs not found: 'key'")
+	}
+	key, err := provider.ParseSecretSource(keyI, "key", providers, logger)
+	if err != nil {
+		return nil, err
+	}
+	signer := &Hmac{key: key, maxBodySize: defaultMaxBodySize, now: time.Now, logger: logger}
+	if maxBodySizeI, found := config["max_body_size"]; found {
+		maxBodySize, ok := maxBodySizeI.(int)
+		if !ok || maxBodySize < 0 {
+			logger.Error().Msg("proxy_hmac: 'max_body_size' must be a non negative number")
+			return nil, fmt.Errorf("config not valid: 'max_body_size' must be a non negative number")
+		}
+		signer.maxBodySize = int64(maxBodySize)
+	}
+
+	algorithm, err := getHmacConfig(config, "algorithm", "sha256", []string{"sha1", "sha256", "sha512"}, logger)
+	if err != nil {
+		return nil, err
+	}
+	signer.algorithm = hmacAlgorithms[algorithm]
+	if signer.keyEncoding, err = getHmacConfig(config, "key_encoding", "raw", []string{"raw", "hex", "base64"}, logger); err != nil {
+		return nil, err
+	}
+	if signer.encoding, err = getHmacConfig(config, "encoding", "hex", []string{"hex", "base64"}, logger); err != nil {
+		return nil, err
+	}
+	if signer.timestampFormat, err = getHmacConfig(config, "timestamp_format", "unix", []string{"unix", "unix_ms", "rfc3339"}, logger); err != nil {
+		return nil, err
+	}
+	if signer.canonicalString, err = getHmacConfig(config, "canonical_string", defaultCanonicalString, nil, logger); err != nil {
+		return nil, err
+	}
+	if signer.timestampHeader, err = getHmacConfig(config, "timestamp_header", defaultTimestampHeader, nil, logger); err != nil {
+		return nil, err
+	}
+	if signer.signatureHeader, err = getHmacConfig(config, "signature_header", defaultSignatureHeader, nil, logger); err != nil {
+		return nil, err
+	}
+	if signer.signatureHeader == "" {
+		logger.Error().Msg("proxy_hmac: 'signature_header' must not be empty")
+		return nil, fmt.Errorf("config not valid: 'signature_header' must not be empty")
+	}
+	if signer.signatureFormat, err = getHmacConfig(config, "signature_format", defaultSignatureFormat, nil, logger); err != nil {
+		return nil, err
+	}
+	if !strings.Contains(signer.signatureFormat, "{signature}") {
+		logger.Error().Msg("proxy_hmac: 'signature_format' must contain '{signature}'")
+		return nil, fmt.Errorf("config not valid: 'signature_format' must contain '{signature}'")
+	}
+
+	logger.Info().
+		Str("algorithm", algorithm).
+		Str("signature_header", signer.signatureHeader).
+		Str("timestamp_header", signer.timestampHeader).
+		Msg("Creating provider")
+	return signer, nil
+}
+
+// getHmacConfig returns the string config or defaultValue if it is not
+// configured. If allowed is not empty, the value must be one of them.
+func getHmacConfig(
+	config map[string]interface{}, key string, defaultValue string, allowed []string, logger zerolog.Logger,
+) (string, error) {
+	valueI, found := config[key]
+	if !found {
+		return defaultValue, nil
+	}
+	value, ok := valueI.(string)
+	if !ok {
+		logger.Error().Msgf("proxy_hmac: '%s' must be a string", key)
+		return "", fmt.Errorf("config not valid: '%s' must be a string", key)
+	}
+	if len(allowed) == 0 {
+		return value, nil
+	}
+	for _, v := range allowed {
+		if value == v {
+			return value, nil
+		}
+	}
+	logger.Error().Msgf("proxy_hmac: '%s' must be one of %s", key, strings.Join(allowed, ", "))
+	return "", fmt.Errorf("config not valid: '%s' must be one of %s", key, strings.Join(allowed, ", "))
+}
+
+// SignRequest sets the signature header, and the timestamp header unless it
+// is disabled. The body is read to build the canonical string and replaced
+// with an identical one. Returns an *http.MaxBytesError if the body is larger
+// than the max body size.
+func (signer *Hmac) SignRequest(req *http.Request) error {
+	key, err := signer.getKey()
+	if err != nil {
+		signer.logger.Err(err).Msg("proxy_hmac: Unable to get signing key")
+		return fmt.Errorf("proxy_hmac: unable to get signing key: %w", err)
+	}
+	body := []byte{}
+	if req.Body != nil && req.Body != http.NoBody {
+		body, err = io.ReadAll(http.MaxBytesReader(nil, req.Body, signer.maxBodySize))
+		req.Body.Close()
+		if err != nil {
+			return fmt.Errorf("proxy_hmac: unable to read request body: %w", err)
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	bodyHash := sha256.Sum256(body)
+	host := req.URL.Host
+	if req.Host != "" {
+		host = req.Host
+	}
+	timestamp := signer.timestamp()
+	canonicalString := strings.NewReplacer(
+		"{method}", req.Method,
+		"{host}", host,
+		"{path}", req.URL.EscapedPath(),
+		"{query}", req.URL.RawQuery,
+		"{timestamp}", timestamp,
+		"{body_sha256}", hex.EncodeToString(bodyHash[:]),
+		"{body}", string(body),
+	).Replace(signer.canonicalString)
+
+	mac := stdhmac.New(signer.algorithm, key)
+	mac.Write([]byte(canonicalString))
+	var signature string
+	if signer.encoding == "base64" {
+		signature = base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	} else {
+		signature = hex.EncodeToString(mac.Sum(nil))
+	}
+	req.Header.Set(signer.signatureHeader, strings.NewReplacer(
+		"{signature}", signature,
+		"{timestamp}", timestamp,
+	).Replace(signer.signatureFormat))
+	if signer.timestampHeader != "" {
+		req.Header.Set(signer.timestampHeader, timestamp)
+	}
+	return nil
+}
+
+// getKey returns the decoded key. Leading and trailing whitespace, eg. the
+// newline at the end of a key file, is not part of the key.
+func (signer *Hmac) getKey() ([]byte, error) {
+	key, err := signer.key.Read()
+	if err != nil {
+		return nil, err
+	}
+	key = strings.TrimSpace(key)
+	switch signer.keyEncoding {
+	case "hex":
+		return hex.DecodeString(key)
+	case "base64":
+		return base64.StdEncoding.DecodeString(key)
+	}
+	return []byte(key), nil
+}
+
+func (signer *Hmac) timestamp() string {
+	now := signer.now()
+	switch signer.timestampFormat {
+	case "unix_ms":
+		return strconv.FormatInt(now.UnixMilli(), 10)
+	case "rfc3339":
+		return now.UTC().Format(time.RFC3339)
+	}
+	return strconv.FormatInt(now.Unix(), 10)
+}
@@ -0,0 +1,193 @@
+package hmac
+
+import (
+	stdhmac "crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hasura/hasura-secret-refresh/provider"
+	"github.com/rs/zerolog"
+)
+
+// keyProvider serves the keys in secrets by their X-Hasura-Secret-Id
+type keyProvider struct {
+	secrets map[string]string
+}
+
+type keyFetcher struct {
+	keyProvider
+	secretId string
+}
+
+func (f keyFetcher) FetchSecret() (string, error) {
+	secret, found := f.secrets[f.secretId]
+	if !found {
+		return "", errors.New("secret not found")
+	}
+	return secret, nil
+}
+
+func (p keyProvider) SecretFetcher(header http.Header) (provider.SecretFetcher, error) {
+	return keyFetcher{keyProvider: p, secretId: header.Get("X-Hasura-Secret-Id")}, nil
+}
+
+func (p keyProvider) DeleteConfigHeaders(header *http.Header) {}
+
+func getMockHmacSigner(t *testing.T, keys keyProvider, config map[string]interface{}) *Hmac {
+	config["key"] = map[string]interface{}{
+		"provider":        "key_provider",
+		"provider_params": map[string]interface{}{"X-Hasura-Secret-Id": "webhook"},
+	}
+	providers := map[string]provider.HttpProvider{"key_provider": keys}
+	signer, err := Create(config, providers, zerolog.Nop())
+	if err != nil {
+		t.Fatalf("Unable to parse signer: %s", err)
+	}
+	signer.now = func() time.Time { return time.Unix(1700000000, 0) }
+	return signer
+}
+
+func TestHmac_SignRequest(t *testing.T) {
+	keys := keyProvider{secrets: map[string]string{"webhook": "topsecretkey"}}
+	signer := getMockHmacSigner(t, keys, map[string]interface{}{})
+	body := `{"action":"create"}`
+	req, _ := http.NewRequest("POST", "http://orders.example.com/v1/orders?id=1", strings.NewReader(body))
+	if err := signer.SignRequest(req); err != nil {
+		t.Fatalf("Unable to sign request: %s", err)
+	}
+	bodyHash := sha256.Sum256([]byte(body))
+	mac := stdhmac.New(sha256.New, []byte("topsecretkey"))
+	mac.Write([]byte("POST\n/v1/orders\n1700000000\n" + hex.EncodeToString(bodyHash[:])))
+	expected := hex.EncodeToString(mac.Sum(nil))
+	if req.Header.Get("X-Signature") != expected {
+		t.Errorf("Expected signature %s but got %s", expected, req.Header.Get("X-Signature"))
+	}
+	if req.Header.Get("X-Timestamp") != "1700000000" {
+		t.Errorf("Expected timestamp 1700000000 but got %s", req.Header.Get("X-Timestamp"))
+	}
+	signedBody, _ := io.ReadAll(req.Body)
+	if string(signedBody) != body {
+		t.Errorf("Expected body to be preserved but got %s", string(signedBody))
+	}
+
+	// the key is fetched for every request
+	keys.secrets["webhook"] = "rotatedkey"
+	req, _ = http.NewRequest("POST", "http://orders.example.com/v1/orders?id=1", strings.NewReader(body))
+	if err := signer.SignRequest(req); err != nil {
+		t.Fatalf("Unable to sign request: %s", err)
+	}
+	if req.Header.Get("X-Signature") == expected {
+		t.Errorf("Expected signature to change after the key was rotated")
+	}
+}
+
+func TestHmac_SignatureFormat(t *testing.T) {
+	keys := keyProvider{secrets: map[string]string{
+		"webhook": base64.StdEncoding.EncodeToString([]byte("binarykey")),
+	}}
+	signer := getMockHmacSigner(t, keys, map[string]interface{}{
+		"algorithm":        "sha512",
+		"key_encoding":     "base64",
+		"encoding":         "base64",
+		"canonical_string": "{timestamp}.{body}",
+		"timestamp_header": "",
+		"signature_header": "Webhook-Signature",
+		"signature_format": "t={timestamp},v1={signature}",
+	})
+	req, _ := http.NewRequest("POST", "http://orders.example.com/webhook", strings.NewReader(`{}`))
+	if err := signer.SignRequest(req); err != nil {
+		t.Fatalf("Unable to sign request: %s", err)
+	}
+	mac := stdhmac.New(sha512.New, []byte("binarykey"))
+	mac.Write([]byte("1700000000.{}"))
+	expected := "t=1700000000,v1=" + base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	if req.Header.Get("Webhook-Signature") != expected {
+		t.Errorf("Expected signature %s but got %s", expected, req.Header.Get("Webhook-Signature"))
+	}
+	if req.Header.Get("X-Timestamp") != "" {
+		t.Errorf("Expected timestamp header to not be set")
+	}
+}
+
+func TestHmac_KeyNotFound(t *testing.T) {
+	signer := getMockHmacSigner(t, keyProvider{secrets: map[string]string{}}, map[string]interface{}{})
+	req, _ := http.NewRequest("GET", "http://orders.example.com/v1/orders", nil)
+	if err := signer.SignRequest(req); err == nil {
+		t.Errorf("Expected an error when the key cannot be fetched")
+	}
+}
+
+func TestCreate_Invalid(t *testing.T) {
+	providers := map[string]provider.HttpProvider{"mock_provider": keyProvider{}}
+	key := map[string]interface{}{"file": "/etc/hmac/key"}
+	invalidConfigs := map[string]map[string]interface{}{
+		"missing key":              {},
+		"invalid key":              {"key": map[string]interface{}{"provider": "unknown"}},
+		"unknown algorithm":        {"key": key, "algorithm": "md5"},
+		"unknown encoding":         {"key": key, "encoding": "base32"},
+		"unknown key encoding":     {"key": key, "key_encoding": "pem"},
+		"unknown timestamp":        {"key": key, "timestamp_format": "iso"},
+		"empty signature header":   {"key": key, "signature_header": ""},
+		"format without signature": {"key": key, "signature_format": "t={timestamp}"},
+		"canonical not a string":   {"key": key, "canonical_string": 1},
+		"negative max body size":   {"key": key, "max_body_size": -1},
+	}
+	for name, config := range invalidConfigs {
+		_, err := Create(config, providers, zerolog.Nop())
+		if err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+	_, err := Create(map[string]interface{}{"key": key}, providers, zerolog.Nop())
+	if err != nil {
+		t.Errorf("Expected valid config to be parsed. Received error %s", err)
+	}
+}
+
+func TestHmac_KeyFileNewline(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "key")
+	if err := os.WriteFile(keyFile, []byte("topsecretkey\n"), 0o600); err != nil {
+		t.Fatalf("Unable to write key: %s", err)
+	}
+	signer, err := Create(map[string]interface{}{
+		"key":              map[string]interface{}{"file": keyFile},
+		"canonical_string": "{method}",
+	}, nil, zerolog.Nop())
+	if err != nil {
+		t.Fatalf("Unable to parse signer: %s", err)
+	}
+	req, _ := http.NewRequest("GET", "http://orders.example.com/v1/orders", nil)
+	if err := signer.SignRequest(req); err != nil {
+		t.Fatalf("Unable to sign request: %s", err)
+	}
+	mac := stdhmac.New(sha256.New, []byte("topsecretkey"))
+	mac.Write([]byte("GET"))
+	if expected := hex.EncodeToString(mac.Sum(nil)); req.Header.Get("X-Signature") != expected {
+		t.Errorf("Expected signature %s but got %s", expected, req.Header.Get("X-Signature"))
+	}
+}
+
+func TestHmac_MaxBodySize(t *testing.T) {
+	keys := keyProvider{secrets: map[string]string{"webhook": "topsecretkey"}}
+	signer := getMockHmacSigner(t, keys, map[string]interface{}{"max_body_size": 8})
+	req, _ := http.NewRequest("POST", "http://orders.example.com/v1/orders", strings.NewReader(`{"a":1}`))
+	if err := signer.SignRequest(req); err != nil {
+		t.Fatalf("Unable to sign request: %s", err)
+	}
+	req, _ = http.NewRequest("POST", "http://orders.example.com/v1/orders", strings.NewReader(`{"action":"create"}`))
+	err := signer.SignRequest(req)
+	var maxBytesErr *http.MaxBytesError
+	if !errors.As(err, &maxBytesErr) || maxBytesErr.Limit != 8 {
+		t.Errorf("Expected body larger than 'max_body_size' to be rejected but got %v", err)
+	}
+}
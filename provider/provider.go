@@ -1,6 +1,10 @@
 package provider
 
-import "net/http"
+import (
+	"net/http"
+
+	"github.com/hasura/hasura-secret-refresh/cache"
+)
 
 type HttpProvider interface {
 	SecretFetcher(http.Header) (SecretFetcher, error)
@@ -13,6 +17,93 @@ type FileProvider interface {
 	FileName() string
 }
 
+// SecretRenderer is implemented by file providers. RenderSecret fetches the
+// secret and applies the template or transform of the provider, without
+// writing the file.
+type SecretRenderer interface {
+	RenderSecret() (string, error)
+}
+
+// ServiceAccountToken returns a token of the Kubernetes service account whose
+// identity secrets are fetched with, eg. of a pod mounting them with the
+// Secrets Store CSI driver
+type ServiceAccountToken func() (string, error)
+
 type SecretFetcher interface {
 	FetchSecret() (string, error)
 }
+
+// InvalidatingSecretFetcher is implemented by fetchers that cache secrets.
+// InvalidateSecret removes the cached secret so that the next FetchSecret
+// retrieves it from the source.
+type InvalidatingSecretFetcher interface {
+	SecretFetcher
+	InvalidateSecret()
+}
+
+// CachingSecretFetcher is implemented by fetchers that cache secrets.
+// CachedSecret returns the secret only if it is cached, without contacting
+// the secret store. FetchSecretWithCacheStatus reports whether the secret was
+// served from the cache.
+type CachingSecretFetcher interface {
+	SecretFetcher
+	CachedSecret() (secret string, found bool)
+	FetchSecretWithCacheStatus() (secret string, cacheHit bool, err error)
+}
+
+// StaleSecretFetcher is implemented by fetchers that serve expired secrets
+// while the secret store is unavailable. FetchFreshSecret is like
+// FetchSecretWithCacheStatus but returns the failure of the secret store
+// instead of serving a stale secret. StaleSecret returns the stale secret to
+// serve after a fetch failed with err.
+type StaleSecretFetcher interface {
+	CachingSecretFetcher
+	FetchFreshSecret() (secret string, cacheHit bool, err error)
+	StaleSecret(err error) (secret string, found bool)
+}
+
+// RefetchingSecretFetcher is implemented by fetchers that cache secrets.
+// RefetchSecret retrieves the secret from the source even if it is cached, and
+// replaces the cached secret.
+type RefetchingSecretFetcher interface {
+	SecretFetcher
+	RefetchSecret() (string, error)
+}
+
+// RequestIdSecretFetcher is implemented by fetchers that log the fetches of
+// secrets. WithRequestId returns a copy of the fetcher that adds the id of
+// the request the secret is fetched for to its logs and, where the secret
+// store accepts it, to its requests to the secret store.
+type RequestIdSecretFetcher interface {
+	SecretFetcher
+	WithRequestId(requestId string) SecretFetcher
+}
+
+// StaleServingProvider is implemented by providers that serve expired secrets
+// while the secret store is unavailable. StaleServed returns the number of
+// times a stale secret was served.
+type StaleServingProvider interface {
+	StaleServed() int64
+}
+
+// CacheStatsProvider is implemented by providers that cache secrets
+type CacheStatsProvider interface {
+	CacheStats() cache.Stats
+}
+
+// CacheAdministrator is implemented by providers whose cache can be inspected
+// and flushed at runtime, eg. after the secrets were rotated. Invalidated
+// secrets are not served stale.
+type CacheAdministrator interface {
+	// CacheKeys returns the keys of the cached secrets, never their values
+	CacheKeys() []string
+	// InvalidateCacheKey returns false if key is not cached
+	InvalidateCacheKey(key string) bool
+	PurgeCache()
+}
+
+// RequestSigner is implemented by providers that sign the requests sent
+// upstream instead of providing a secret that is injected into them
+type RequestSigner interface {
+	SignRequest(*http.Request) error
+}
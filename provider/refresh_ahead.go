@@ -0,0 +1,143 @@
+package provider
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/hasura/hasura-secret-refresh/cache"
+	"github.com/rs/zerolog"
+)
+
+// refreshAheadRetryWait is the minimum time between refreshes of a secret
+// after a refresh failed
+const refreshAheadRetryWait = 5 * time.Second
+
+// RefreshAhead refetches a cached secret in the background when it is served
+// after a fraction of its TTL has passed. Secrets in use are then refreshed
+// before they expire, instead of being fetched on the request path. Secrets
+// that are not accessed are left to expire. A nil RefreshAhead refreshes
+// nothing.
+type RefreshAhead struct {
+	fraction float64
+	// ttl is the TTL of the cache of the provider
+	ttl     time.Duration
+	entries *cache.Cache[refreshEntry]
+	// mu guards the refresh state of entries
+	mu     sync.Mutex
+	logger zerolog.Logger
+}
+
+type refreshEntry struct {
+	fetchedAt time.Time
+	ttl       time.Duration
+	// refreshing is set while the secret is refetched
+	refreshing bool
+	// failedAt is the time of the last failed refresh
+	failedAt time.Time
+}
+
+// ParseRefreshAheadFromConfig parses the 'refresh_ahead' config of a
+// provider, the fraction of the TTL of a cached secret after which it is
+// refreshed when accessed. Returns nil if it is not configured.
+func ParseRefreshAheadFromConfig(
+	config map[string]interface{}, cacheTtl time.Duration, cacheSize int, logger zerolog.Logger,
+) (*RefreshAhead, error) {
+	fractionI, found := config["refresh_ahead"]
+	if !found {
+		return nil, nil
+	}
+	fraction, ok := fractionI.(float64)
+	if !ok || fraction <= 0 || fraction >= 1 {
+		logger.Error().Msg("'refresh_ahead' must be a number between 0 and 1")
+		return nil, fmt.Errorf("config not valid: 'refresh_ahead' must be a number between 0 and 1")
+	}
+	logger.Info().Float64("refresh_ahead", fraction).Msg("Cached secrets in use are refreshed before they expire")
+	return NewRefreshAhead(fraction, cacheTtl, cacheSize, logger), nil
+}
+
+func NewRefreshAhead(fraction float64, cacheTtl time.Duration, cacheSize int, logger zerolog.Logger) *RefreshAhead {
+	return &RefreshAhead{
+		fraction: fraction,
+		ttl:      cacheTtl,
+		entries:  cache.New[refreshEntry](cacheTtl, cacheSize),
+		logger:   logger,
+	}
+}
+
+// Add records that a secret was cached with the TTL of the cache
+func (r *RefreshAhead) Add(key string) {
+	if r == nil {
+		return
+	}
+	r.AddWithTtl(key, r.ttl)
+}
+
+// AddWithTtl records that a secret was cached for ttl, eg. because it expires
+// before the TTL of the cache
+func (r *RefreshAhead) AddWithTtl(key string, ttl time.Duration) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries.Set(key, refreshEntry{fetchedAt: time.Now(), ttl: ttl})
+}
+
+func (r *RefreshAhead) Remove(key string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries.Remove(key)
+}
+
+func (r *RefreshAhead) Purge() {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries.Purge()
+}
+
+// Hit is called when a secret is served from the cache. refetch runs in the
+// background if the secret is due for a refresh. refetch must add the secret
+// to the cache.
+func (r *RefreshAhead) Hit(key string, refetch func() error) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	entry, found := r.entries.Peek(key)
+	if !found || entry.refreshing {
+		return
+	}
+	now := time.Now()
+	refreshAt := entry.fetchedAt.Add(time.Duration(float64(entry.ttl) * r.fraction))
+	if now.Before(refreshAt) || now.Sub(entry.failedAt) < refreshAheadRetryWait {
+		return
+	}
+	entry.refreshing = true
+	r.entries.Update(key, entry)
+	go r.refresh(key, refetch)
+}
+
+func (r *RefreshAhead) refresh(key string, refetch func() error) {
+	r.logger.Debug().Msg("Refreshing cached secret ahead of expiry")
+	err := refetch()
+	if err == nil {
+		// refetch added a new entry
+		return
+	}
+	r.logger.Warn().Err(err).Msg("Unable to refresh cached secret ahead of expiry")
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if entry, found := r.entries.Peek(key); found {
+		entry.refreshing = false
+		entry.failedAt = time.Now()
+		r.entries.Update(key, entry)
+	}
+}
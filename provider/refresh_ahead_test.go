@@ -0,0 +1,116 @@
+package provider
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+func TestParseRefreshAheadFromConfig(t *testing.T) {
+	refreshAhead, err := ParseRefreshAheadFromConfig(map[string]interface{}{}, time.Minute, 10, zerolog.Nop())
+	if err != nil || refreshAhead != nil {
+		t.Errorf("Expected refresh ahead to be disabled without config, got %v, %v", refreshAhead, err)
+	}
+	refreshAhead, err = ParseRefreshAheadFromConfig(map[string]interface{}{"refresh_ahead": 0.8}, time.Minute, 10, zerolog.Nop())
+	if err != nil || refreshAhead == nil || refreshAhead.fraction != 0.8 {
+		t.Errorf("Unexpected refresh ahead %+v, %v", refreshAhead, err)
+	}
+	for _, fraction := range []interface{}{0.0, 1.0, 1, "0.8"} {
+		if _, err := ParseRefreshAheadFromConfig(map[string]interface{}{"refresh_ahead": fraction}, time.Minute, 10, zerolog.Nop()); err == nil {
+			t.Errorf("Expected error for 'refresh_ahead' %v", fraction)
+		}
+	}
+}
+
+func TestRefreshAhead(t *testing.T) {
+	refreshAhead := NewRefreshAhead(0.5, time.Minute, 10, zerolog.Nop())
+	refreshed := make(chan struct{}, 10)
+	refetch := func() error {
+		refreshAhead.Add("key")
+		refreshed <- struct{}{}
+		return nil
+	}
+	refreshAhead.Add("key")
+	refreshAhead.Hit("key", refetch)
+	select {
+	case <-refreshed:
+		t.Fatalf("Expected secret to not be refreshed before half of its ttl")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// the secret was cached 40 seconds ago with a ttl of 60 seconds
+	refreshAhead.AddWithTtl("key", 60*time.Second)
+	entry, _ := refreshAhead.entries.Peek("key")
+	entry.fetchedAt = entry.fetchedAt.Add(-40 * time.Second)
+	refreshAhead.entries.Set("key", entry)
+	refreshAhead.Hit("key", refetch)
+	select {
+	case <-refreshed:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected secret to be refreshed after half of its ttl")
+	}
+	// the refetch recorded a new entry
+	refreshAhead.Hit("key", refetch)
+	select {
+	case <-refreshed:
+		t.Fatalf("Expected refreshed secret to not be refreshed again")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestRefreshAhead_Failure(t *testing.T) {
+	refreshAhead := NewRefreshAhead(0.5, time.Minute, 10, zerolog.Nop())
+	attempts := make(chan struct{}, 10)
+	refetch := func() error {
+		attempts <- struct{}{}
+		return errors.New("vault returned status 503")
+	}
+	refreshAhead.AddWithTtl("key", time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	refreshAhead.Hit("key", refetch)
+	<-attempts
+	for i := 0; i < 100; i++ {
+		refreshAhead.mu.Lock()
+		entry, _ := refreshAhead.entries.Peek("key")
+		refreshAhead.mu.Unlock()
+		if !entry.refreshing {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// a failed refresh is not retried right away
+	refreshAhead.Hit("key", refetch)
+	select {
+	case <-attempts:
+		t.Fatalf("Expected failed refresh to not be retried before %s", refreshAheadRetryWait)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestRefreshAhead_HitKeepsExpiry(t *testing.T) {
+	refreshAhead := NewRefreshAhead(0.5, time.Minute, 10, zerolog.Nop())
+	attempts := make(chan struct{}, 10)
+	refetch := func() error {
+		attempts <- struct{}{}
+		return errors.New("vault returned status 503")
+	}
+	refreshAhead.AddWithTtl("key", time.Millisecond)
+	expiresAt, _ := refreshAhead.entries.ExpiresAt("key")
+	time.Sleep(5 * time.Millisecond)
+	refreshAhead.Hit("key", refetch)
+	<-attempts
+	for i := 0; i < 100; i++ {
+		refreshAhead.mu.Lock()
+		entry, _ := refreshAhead.entries.Peek("key")
+		refreshAhead.mu.Unlock()
+		if !entry.refreshing {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if afterHit, found := refreshAhead.entries.ExpiresAt("key"); !found || !afterHit.Equal(expiresAt) {
+		t.Errorf("Expected hits to keep the expiry %s of the entry but got %s", expiresAt, afterHit)
+	}
+}
@@ -0,0 +1,81 @@
+package provider
+
+import "sync"
+
+// RefreshGroup coordinates the fetch and write cycle of a file provider
+// between its scheduled refresh loop and on-demand refreshes.
+//
+// Callers arriving while a fetch is in flight wait for it and share its
+// result instead of issuing another backend call. Every fetch is assigned a
+// monotonically increasing version and its result is only written if no
+// newer result has been written yet, so an older value can never overwrite a
+// newer one.
+type RefreshGroup struct {
+	mu       sync.Mutex
+	inflight *refreshCall
+	version  uint64
+
+	writeMu sync.Mutex
+	written uint64
+}
+
+type refreshCall struct {
+	done chan struct{}
+	err  error
+}
+
+func NewRefreshGroup() *RefreshGroup {
+	return &RefreshGroup{}
+}
+
+// Do fetches the secret and writes it. A nil RefreshGroup simply calls fetch
+// and write without any coordination.
+func (g *RefreshGroup) Do(fetch func() (string, error), write func(string) error) error {
+	if g == nil {
+		secret, err := fetch()
+		if err != nil {
+			return err
+		}
+		return write(secret)
+	}
+
+	g.mu.Lock()
+	if call := g.inflight; call != nil {
+		g.mu.Unlock()
+		<-call.done
+		return call.err
+	}
+	call := &refreshCall{done: make(chan struct{})}
+	g.inflight = call
+	g.version++
+	version := g.version
+	g.mu.Unlock()
+
+	secret, err := fetch()
+
+	// The fetch is done, later callers start a new one from here on.
+	g.mu.Lock()
+	g.inflight = nil
+	g.mu.Unlock()
+
+	if err == nil {
+		err = g.write(version, secret, write)
+	}
+	call.err = err
+	close(call.done)
+	return err
+}
+
+func (g *RefreshGroup) write(version uint64, secret string, write func(string) error) error {
+	g.writeMu.Lock()
+	defer g.writeMu.Unlock()
+	if version <= g.written {
+		// A newer value has already been written
+		return nil
+	}
+	if err := write(secret); err != nil {
+		return err
+	}
+	g.written = version
+	return nil
+}
@@ -0,0 +1,181 @@
+package provider
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRefreshGroupSharesInflightFetch(t *testing.T) {
+	group := NewRefreshGroup()
+	var fetches, writes int32
+	release := make(chan struct{})
+	fetch := func() (string, error) {
+		atomic.AddInt32(&fetches, 1)
+		<-release
+		return "secret", nil
+	}
+	write := func(string) error {
+		atomic.AddInt32(&writes, 1)
+		return nil
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, 5)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		errs[0] = group.Do(fetch, write)
+	}()
+	waitForInflight(t, group)
+	for i := 1; i < len(errs); i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = group.Do(fetch, write)
+		}(i)
+	}
+	// give the other callers time to join the in-flight fetch
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("caller %d received error: %v", i, err)
+		}
+	}
+	if fetches != 1 {
+		t.Fatalf("expected exactly 1 fetch, got %d", fetches)
+	}
+	if writes != 1 {
+		t.Fatalf("expected exactly 1 write, got %d", writes)
+	}
+}
+
+func TestRefreshGroupSharesErrors(t *testing.T) {
+	group := NewRefreshGroup()
+	fetchErr := errors.New("backend unavailable")
+	release := make(chan struct{})
+	fetch := func() (string, error) {
+		<-release
+		return "", fetchErr
+	}
+	write := func(string) error {
+		t.Fatalf("write must not be called when the fetch fails")
+		return nil
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		errs[0] = group.Do(fetch, write)
+	}()
+	waitForInflight(t, group)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		errs[1] = group.Do(fetch, write)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	for i, err := range errs {
+		if !errors.Is(err, fetchErr) {
+			t.Fatalf("caller %d: expected fetch error, got %v", i, err)
+		}
+	}
+}
+
+func TestRefreshGroupNewestResultWins(t *testing.T) {
+	group := NewRefreshGroup()
+	var mu sync.Mutex
+	written := make([]string, 0)
+	write := func(secret string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		written = append(written, secret)
+		return nil
+	}
+
+	// Simulate an older fetch whose write is delayed until after a newer
+	// fetch has been written.
+	olderFetched := make(chan struct{})
+	releaseOlderWrite := make(chan struct{})
+	olderDone := make(chan error)
+	go func() {
+		olderDone <- group.Do(
+			func() (string, error) { return "old", nil },
+			func(secret string) error {
+				close(olderFetched)
+				<-releaseOlderWrite
+				return write(secret)
+			},
+		)
+	}()
+	<-olderFetched
+
+	// The older call holds the write lock, so write the newer value from a
+	// separate goroutine and let the older write go first through the lock.
+	newerDone := make(chan error)
+	go func() {
+		newerDone <- group.Do(func() (string, error) { return "new", nil }, write)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	close(releaseOlderWrite)
+	if err := <-olderDone; err != nil {
+		t.Fatalf("older refresh returned error: %v", err)
+	}
+	if err := <-newerDone; err != nil {
+		t.Fatalf("newer refresh returned error: %v", err)
+	}
+	if got := written[len(written)-1]; got != "new" {
+		t.Fatalf("expected the newest value to be written last, got %v", written)
+	}
+
+	// A stale version that completes late must not be written.
+	if err := group.write(1, "stale", write); err != nil {
+		t.Fatalf("write returned error: %v", err)
+	}
+	if got := written[len(written)-1]; got != "new" {
+		t.Fatalf("stale value overwrote the newest value: %v", written)
+	}
+}
+
+func TestRefreshGroupNil(t *testing.T) {
+	var group *RefreshGroup
+	var written string
+	err := group.Do(
+		func() (string, error) { return "secret", nil },
+		func(secret string) error {
+			written = secret
+			return nil
+		},
+	)
+	if err != nil {
+		t.Fatalf("Do returned error: %v", err)
+	}
+	if written != "secret" {
+		t.Fatalf("expected secret to be written, got %q", written)
+	}
+}
+
+func waitForInflight(t *testing.T, group *RefreshGroup) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		group.mu.Lock()
+		inflight := group.inflight != nil
+		group.mu.Unlock()
+		if inflight {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("fetch did not start")
+}
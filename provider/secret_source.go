@@ -0,0 +1,101 @@
+package provider
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/hasura/hasura-secret-refresh/template"
+	"github.com/rs/zerolog"
+)
+
+// SecretSource is a value read from a file or fetched from a proxy provider,
+// eg. TLS material or a signing key. It is read again every time it is used,
+// so values rotated in the file or in the secret store are picked up without
+// a restart.
+type SecretSource struct {
+	file     string
+	fetcher  SecretFetcher
+	template *template.Template
+}
+
+// ParseSecretSource parses a source config. It has either a 'file' or a
+// 'provider' with its 'provider_params', and an optional 'template' to
+// extract the value from a JSON secret.
+func ParseSecretSource(
+	sourceI interface{}, name string, providers map[string]HttpProvider, logger zerolog.Logger,
+) (*SecretSource, error) {
+	sourceConfig, ok := sourceI.(map[string]interface{})
+	if !ok {
+		logger.Error().Msgf("'%s' must be an object", name)
+		return nil, fmt.Errorf("config not valid: '%s' must be an object", name)
+	}
+	file, fileOk := sourceConfig["file"].(string)
+	providerName, providerOk := sourceConfig["provider"].(string)
+	if fileOk == providerOk || (fileOk && file == "") || (providerOk && providerName == "") {
+		logger.Error().Msgf("'%s' must have exactly one of 'file' or 'provider'", name)
+		return nil, fmt.Errorf("config not valid: '%s' must have exactly one of 'file' or 'provider'", name)
+	}
+	source := &SecretSource{file: file}
+	if templI, found := sourceConfig["template"]; found {
+		templ, ok := templI.(string)
+		if !ok {
+			logger.Error().Msgf("'template' of '%s' must be a string", name)
+			return nil, fmt.Errorf("config not valid: 'template' of '%s' must be a string", name)
+		}
+		source.template = &template.Template{Templ: templ, Logger: logger}
+	}
+	if fileOk {
+		return source, nil
+	}
+	httpProvider, found := providers[providerName]
+	if !found {
+		logger.Error().Msgf("Provider %s of '%s' does not exist", providerName, name)
+		return nil, fmt.Errorf("config not valid: Provider %s of '%s' does not exist", providerName, name)
+	}
+	params := make(http.Header)
+	if paramsI, found := sourceConfig["provider_params"]; found {
+		paramsConfig, ok := paramsI.(map[string]interface{})
+		if !ok {
+			logger.Error().Msgf("'provider_params' of '%s' must be an object", name)
+			return nil, fmt.Errorf("config not valid: 'provider_params' of '%s' must be an object", name)
+		}
+		for k, v := range paramsConfig {
+			value, ok := v.(string)
+			if !ok {
+				logger.Error().Msgf("'provider_params.%s' of '%s' must be a string", k, name)
+				return nil, fmt.Errorf("config not valid: 'provider_params.%s' of '%s' must be a string", k, name)
+			}
+			params.Set(k, value)
+		}
+	}
+	fetcher, err := httpProvider.SecretFetcher(params)
+	if err != nil {
+		logger.Err(err).Msgf("'provider_params' of '%s' are not valid for provider %s", name, providerName)
+		return nil, fmt.Errorf("config not valid: 'provider_params' of '%s': %w", name, err)
+	}
+	source.fetcher = fetcher
+	return source, nil
+}
+
+// Read reads the file or fetches the secret, and applies the template
+func (s *SecretSource) Read() (string, error) {
+	var value string
+	if s.fetcher != nil {
+		secret, err := s.fetcher.FetchSecret()
+		if err != nil {
+			return "", fmt.Errorf("unable to fetch secret: %w", err)
+		}
+		value = secret
+	} else {
+		data, err := os.ReadFile(s.file)
+		if err != nil {
+			return "", fmt.Errorf("unable to read file: %w", err)
+		}
+		value = string(data)
+	}
+	if s.template != nil {
+		value = s.template.Substitute(value)
+	}
+	return value, nil
+}
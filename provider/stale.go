@@ -0,0 +1,173 @@
+package provider
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hasura/hasura-secret-refresh/cache"
+	"github.com/rs/zerolog"
+)
+
+const (
+	staleRetryMinWait = time.Second
+	staleRetryMaxWait = 30 * time.Second
+)
+
+// StaleIfError keeps the last good value of cached secrets for a window after
+// they expired from the cache of a provider. If fetching an expired secret
+// fails because the secret store is unavailable, the last good value is
+// served while the fetch is retried in the background. A nil StaleIfError
+// serves nothing.
+type StaleIfError struct {
+	window time.Duration
+	// ttl is the time values are kept for, window after they expire from the
+	// cache of the provider
+	ttl      time.Duration
+	values   *cache.Cache[staleValue]
+	retrying sync.Map
+	served   atomic.Int64
+	minWait  time.Duration
+	maxWait  time.Duration
+	logger   zerolog.Logger
+}
+
+type staleValue struct {
+	value     string
+	fetchedAt time.Time
+}
+
+// ParseStaleIfErrorFromConfig parses the 'stale_if_error' config of a
+// provider, the number of seconds for which a secret is served after it
+// expired from a cache with the given ttl and size. Returns nil if it is not
+// configured.
+func ParseStaleIfErrorFromConfig(
+	config map[string]interface{}, cacheTtl time.Duration, cacheSize int, logger zerolog.Logger,
+) (*StaleIfError, error) {
+	windowI, found := config["stale_if_error"]
+	if !found {
+		return nil, nil
+	}
+	window, ok := windowI.(int)
+	if !ok || window < 0 {
+		logger.Error().Msg("'stale_if_error' must be a non-negative number of seconds")
+		return nil, fmt.Errorf("config not valid: 'stale_if_error' must be a non-negative number of seconds")
+	}
+	if window == 0 {
+		return nil, nil
+	}
+	logger.Info().Int("stale_if_error", window).Msg("Expired secrets are served while the secret store is unavailable")
+	return NewStaleIfError(time.Duration(window)*time.Second, cacheTtl, cacheSize, logger), nil
+}
+
+func NewStaleIfError(window time.Duration, cacheTtl time.Duration, cacheSize int, logger zerolog.Logger) *StaleIfError {
+	return &StaleIfError{
+		window:  window,
+		ttl:     cacheTtl + window,
+		values:  cache.New[staleValue](cacheTtl+window, cacheSize),
+		minWait: staleRetryMinWait,
+		maxWait: staleRetryMaxWait,
+		logger:  logger,
+	}
+}
+
+// Add records the value of a secret that was fetched successfully
+func (s *StaleIfError) Add(key string, value string) {
+	if s == nil {
+		return
+	}
+	s.values.Set(key, staleValue{value: value, fetchedAt: time.Now()})
+}
+
+// AddWithExpiry records the value of a secret that is no longer valid after
+// expiresIn, eg. an access token. The value is not served once it expired,
+// even within the window. expiresIn is ignored if it is not positive.
+func (s *StaleIfError) AddWithExpiry(key string, value string, expiresIn time.Duration) {
+	if s == nil {
+		return
+	}
+	if expiresIn <= 0 || expiresIn >= s.ttl {
+		s.Add(key, value)
+		return
+	}
+	s.values.SetWithTtl(key, staleValue{value: value, fetchedAt: time.Now()}, expiresIn)
+}
+
+// Remove forgets the value of a secret, eg. because it was rejected upstream
+func (s *StaleIfError) Remove(key string) {
+	if s == nil {
+		return
+	}
+	s.values.Remove(key)
+}
+
+// Purge forgets the values of all secrets
+func (s *StaleIfError) Purge() {
+	if s == nil {
+		return
+	}
+	s.values.Purge()
+}
+
+// Get returns the last good value of a secret whose fetch failed with err. No
+// value is returned unless err is a failure of the secret store. When a value
+// is returned, refetch is retried in the background until it succeeds or the
+// value is no longer served. refetch must add the secret to the cache.
+func (s *StaleIfError) Get(key string, err error, refetch func() error) (string, bool) {
+	if s == nil || !IsStoreFailure(err) {
+		return "", false
+	}
+	stale, found := s.values.Get(key)
+	if !found {
+		return "", false
+	}
+	s.served.Add(1)
+	s.logger.Warn().Err(err).
+		Str("age", time.Since(stale.fetchedAt).Round(time.Second).String()).
+		Msg("Serving stale secret as the secret store is unavailable")
+	if _, alreadyRetrying := s.retrying.LoadOrStore(key, true); !alreadyRetrying {
+		go s.retry(key, refetch)
+	}
+	return stale.value, true
+}
+
+// FetchSecretOrStale fetches the secret with the fetcher and serves the stale
+// secret if the fetch failed. Stale secrets are reported as cache hits.
+func FetchSecretOrStale(fetcher StaleSecretFetcher) (string, bool, error) {
+	secret, cacheHit, err := fetcher.FetchFreshSecret()
+	if err != nil {
+		if stale, found := fetcher.StaleSecret(err); found {
+			return stale, true, nil
+		}
+		return "", false, err
+	}
+	return secret, cacheHit, nil
+}
+
+// Served returns the number of times a stale secret was served
+func (s *StaleIfError) Served() int64 {
+	if s == nil {
+		return 0
+	}
+	return s.served.Load()
+}
+
+func (s *StaleIfError) retry(key string, refetch func() error) {
+	defer s.retrying.Delete(key)
+	wait := s.minWait
+	for {
+		time.Sleep(wait)
+		err := refetch()
+		if err == nil {
+			s.logger.Info().Msg("Refetched stale secret")
+			return
+		}
+		if _, found := s.values.Peek(key); !found || !IsStoreFailure(err) {
+			s.logger.Error().Err(err).Msg("Stopped refetching stale secret")
+			return
+		}
+		s.logger.Debug().Err(err).Str("wait", wait.String()).Msg("Unable to refetch stale secret")
+		wait = min(wait*2, s.maxWait)
+	}
+}
@@ -0,0 +1,96 @@
+package provider
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+func TestParseStaleIfErrorFromConfig(t *testing.T) {
+	stale, err := ParseStaleIfErrorFromConfig(map[string]interface{}{}, time.Minute, 10, zerolog.Nop())
+	if err != nil || stale != nil {
+		t.Errorf("Expected stale-if-error to be disabled without config, got %v, %v", stale, err)
+	}
+	stale, err = ParseStaleIfErrorFromConfig(map[string]interface{}{"stale_if_error": 600}, time.Minute, 10, zerolog.Nop())
+	if err != nil || stale == nil || stale.window != 10*time.Minute {
+		t.Errorf("Unexpected stale-if-error %+v, %v", stale, err)
+	}
+	if _, err := ParseStaleIfErrorFromConfig(map[string]interface{}{"stale_if_error": "10m"}, time.Minute, 10, zerolog.Nop()); err == nil {
+		t.Errorf("Expected error for invalid 'stale_if_error'")
+	}
+}
+
+func TestStaleIfError(t *testing.T) {
+	stale := NewStaleIfError(time.Minute, time.Minute, 10, zerolog.Nop())
+	stale.minWait = time.Millisecond
+	stale.Add("key", "old-secret")
+
+	unavailable := NewError(ErrorKindUnavailable, errors.New("vault returned status 503"))
+	refetches := atomic.Int64{}
+	refetched := make(chan struct{})
+	refetch := func() error {
+		if refetches.Add(1) < 3 {
+			return unavailable
+		}
+		close(refetched)
+		return nil
+	}
+	value, found := stale.Get("key", unavailable, refetch)
+	if !found || value != "old-secret" {
+		t.Fatalf("Expected stale secret to be served, got %q, %t", value, found)
+	}
+	// the fetch is only retried once at a time
+	stale.Get("key", unavailable, refetch)
+	select {
+	case <-refetched:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected secret to be refetched in the background")
+	}
+	if stale.Served() != 2 {
+		t.Errorf("Expected 2 stale secrets served but got %d", stale.Served())
+	}
+	if refetches.Load() != 3 {
+		t.Errorf("Expected 3 refetches but got %d", refetches.Load())
+	}
+}
+
+func TestStaleIfError_NotServed(t *testing.T) {
+	stale := NewStaleIfError(time.Minute, time.Minute, 10, zerolog.Nop())
+	stale.Add("key", "old-secret")
+	refetch := func() error { return nil }
+	notFound := NewError(ErrorKindNotFound, errors.New("secret not found"))
+	if _, found := stale.Get("key", notFound, refetch); found {
+		t.Errorf("Expected stale secret to not be served for a secret that does not exist")
+	}
+	unavailable := NewError(ErrorKindUnavailable, errors.New("vault returned status 503"))
+	if _, found := stale.Get("other-key", unavailable, refetch); found {
+		t.Errorf("Expected no stale secret for a secret that was never fetched")
+	}
+	stale.Remove("key")
+	if _, found := stale.Get("key", unavailable, refetch); found {
+		t.Errorf("Expected no stale secret after it was removed")
+	}
+	var disabled *StaleIfError
+	if _, found := disabled.Get("key", unavailable, refetch); found {
+		t.Errorf("Expected no stale secret if stale-if-error is disabled")
+	}
+}
+
+func TestStaleIfError_AddWithExpiry(t *testing.T) {
+	stale := NewStaleIfError(time.Minute, time.Minute, 10, zerolog.Nop())
+	stale.AddWithExpiry("token", "expiring-token", 50*time.Millisecond)
+	stale.AddWithExpiry("no expiry", "secret", 0)
+	time.Sleep(100 * time.Millisecond)
+
+	unavailable := NewError(ErrorKindUnavailable, errors.New("oauth server returned status 503"))
+	refetch := func() error { return unavailable }
+	if value, found := stale.Get("token", unavailable, refetch); found {
+		t.Errorf("Expected an expired token not to be served but got %q", value)
+	}
+	if value, found := stale.Get("no expiry", unavailable, refetch); !found || value != "secret" {
+		t.Errorf("Expected stale secret to be served, got %q, %t", value, found)
+	}
+}
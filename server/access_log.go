@@ -0,0 +1,286 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+const (
+	accessLogType = "access_log"
+
+	accessLogFormatJson   = "json"
+	accessLogFormatCommon = "common"
+
+	cacheStatusHit  = "hit"
+	cacheStatusMiss = "miss"
+	// cacheStatusBypass is the status of secrets refetched as the request
+	// asked to bypass the cache
+	cacheStatusBypass = "bypass"
+)
+
+// secretHeaders are never written to the access log, in addition to the
+// headers into which secrets are injected
+var secretHeaders = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"Cookie":              true,
+	"Set-Cookie":          true,
+}
+
+// AccessLog writes a line for every request handled by the proxy at info
+// level. A nil AccessLog writes nothing.
+type AccessLog struct {
+	format string
+	// headers are the request headers included in the log
+	headers []string
+	// writer receives the lines in common log format
+	writer io.Writer
+	mu     sync.Mutex
+}
+
+// ParseAccessLogFromConfig parses the 'access_log' config. The access log is
+// written in JSON if it is not configured. Returns nil if it is disabled.
+//
+//	access_log:
+//	  enabled: true
+//	  format: common
+//	  headers:
+//	    - User-Agent
+func ParseAccessLogFromConfig(config map[string]interface{}, logger zerolog.Logger) (*AccessLog, error) {
+	accessLog := &AccessLog{format: accessLogFormatJson, writer: os.Stdout}
+	accessLogI, found := config["access_log"]
+	if !found {
+		return accessLog, nil
+	}
+	accessLogConfig, ok := accessLogI.(map[string]interface{})
+	if !ok {
+		logger.Error().Msg("'access_log' must be an object")
+		return nil, fmt.Errorf("config not valid: 'access_log' must be an object")
+	}
+	if enabledI, found := accessLogConfig["enabled"]; found {
+		enabled, ok := enabledI.(bool)
+		if !ok {
+			logger.Error().Msg("'access_log.enabled' must be a boolean")
+			return nil, fmt.Errorf("config not valid: 'access_log.enabled' must be a boolean")
+		}
+		if !enabled {
+			logger.Info().Msg("Access log disabled")
+			return nil, nil
+		}
+	}
+	if formatI, found := accessLogConfig["format"]; found {
+		format, ok := formatI.(string)
+		if !ok || (format != accessLogFormatJson && format != accessLogFormatCommon) {
+			logger.Error().Msgf("'access_log.format' must be one of '%s' or '%s'", accessLogFormatJson, accessLogFormatCommon)
+			return nil, fmt.Errorf("config not valid: 'access_log.format' must be one of '%s' or '%s'", accessLogFormatJson, accessLogFormatCommon)
+		}
+		accessLog.format = format
+	}
+	if headersI, found := accessLogConfig["headers"]; found {
+		headers, ok := headersI.([]interface{})
+		if !ok {
+			logger.Error().Msg("'access_log.headers' must be a list")
+			return nil, fmt.Errorf("config not valid: 'access_log.headers' must be a list")
+		}
+		for _, headerI := range headers {
+			header, ok := headerI.(string)
+			if !ok {
+				logger.Error().Msg("'access_log.headers' must be a list of strings")
+				return nil, fmt.Errorf("config not valid: 'access_log.headers' must be a list of strings")
+			}
+			header = http.CanonicalHeaderKey(header)
+			if isSecretHeader(header) {
+				logger.Error().Msgf("Header %s in 'access_log.headers' may contain secrets and cannot be logged", header)
+				return nil, fmt.Errorf("config not valid: header %s in 'access_log.headers' may contain secrets", header)
+			}
+			accessLog.headers = append(accessLog.headers, header)
+		}
+	}
+	logger.Info().Str("format", accessLog.format).Msg("Access log enabled")
+	return accessLog, nil
+}
+
+func isSecretHeader(header string) bool {
+	return secretHeaders[header] || strings.HasPrefix(header, "X-Hasura-")
+}
+
+// accessLogEntry collects the details of a request while it is handled
+type accessLogEntry struct {
+	start      time.Time
+	requestId  string
+	remoteAddr string
+	method     string
+	path       string
+	proto      string
+	headers    map[string]string
+
+	provider    string
+	destination string
+	// cacheStatus is empty if the provider does not report whether the secret
+	// was cached
+	cacheStatus string
+
+	rw *accessLogResponseWriter
+}
+
+// start returns the entry of the request. The request id is taken from the
+// X-Request-Id header, which is set by setRequestId.
+func (accessLog *AccessLog) start(rw http.ResponseWriter, r *http.Request) (*accessLogEntry, http.ResponseWriter) {
+	if accessLog == nil {
+		return nil, rw
+	}
+	entry := &accessLogEntry{
+		start:      time.Now(),
+		requestId:  r.Header.Get(requestIdHeader),
+		remoteAddr: r.RemoteAddr,
+		method:     r.Method,
+		path:       r.URL.Path,
+		proto:      r.Proto,
+		headers:    make(map[string]string),
+		rw:         &accessLogResponseWriter{ResponseWriter: rw},
+	}
+	if r.Method == http.MethodConnect {
+		entry.path = r.Host
+		entry.destination = r.Host
+	}
+	for _, header := range accessLog.headers {
+		if value := r.Header.Get(header); value != "" {
+			entry.headers[header] = value
+		}
+	}
+	return entry, entry.rw
+}
+
+// setDetails records how the request is forwarded. Headers into which
+// secrets are injected are removed from the entry.
+func (entry *accessLogEntry) setDetails(details rewriteDetails) {
+	if entry == nil {
+		return
+	}
+	entry.provider = details.providerName
+	entry.cacheStatus = details.cacheStatus
+	if details.url != nil {
+		entry.destination = details.url.Host
+	}
+	for header := range details.injected.headers {
+		delete(entry.headers, http.CanonicalHeaderKey(header))
+	}
+}
+
+func (accessLog *AccessLog) write(entry *accessLogEntry, logger zerolog.Logger) {
+	if accessLog == nil || entry == nil {
+		return
+	}
+	latency := time.Since(entry.start)
+	status := entry.rw.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	if accessLog.format == accessLogFormatCommon {
+		accessLog.writeCommon(entry, status, latency)
+		return
+	}
+	headers := zerolog.Dict()
+	for k, v := range entry.headers {
+		headers = headers.Str(k, v)
+	}
+	logger.Info().
+		Str("log_type", accessLogType).
+		Str("request_id", entry.requestId).
+		Str("remote_addr", entry.remoteAddr).
+		Str("provider", entry.provider).
+		Str("destination", entry.destination).
+		Str("method", entry.method).
+		Str("path", entry.path).
+		Int("status", status).
+		Int64("bytes", entry.rw.bytes).
+		Int64("latency_ms", latency.Milliseconds()).
+		Str("cache", entry.cacheStatus).
+		Dict("headers", headers).
+		Msg("Request completed")
+}
+
+// writeCommon writes the entry in common log format followed by the details
+// of the proxy as key=value pairs
+func (accessLog *AccessLog) writeCommon(entry *accessLogEntry, status int, latency time.Duration) {
+	host := entry.remoteAddr
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	var line strings.Builder
+	fmt.Fprintf(&line, "%s - - [%s] \"%s %s %s\" %d %d",
+		clfValue(host), entry.start.Format("02/Jan/2006:15:04:05 -0700"),
+		entry.method, entry.path, entry.proto, status, entry.rw.bytes,
+	)
+	fmt.Fprintf(&line, " request_id=%s provider=%s destination=%s latency_ms=%d cache=%s",
+		clfValue(entry.requestId), clfValue(entry.provider), clfValue(entry.destination),
+		latency.Milliseconds(), clfValue(entry.cacheStatus),
+	)
+	for _, header := range accessLog.headers {
+		if value, found := entry.headers[header]; found {
+			fmt.Fprintf(&line, " %s=%s", strings.ToLower(header), strconv.Quote(value))
+		}
+	}
+	line.WriteString("\n")
+	accessLog.mu.Lock()
+	defer accessLog.mu.Unlock()
+	io.WriteString(accessLog.writer, line.String())
+}
+
+func clfValue(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+// accessLogResponseWriter records the status and the size of the response
+type accessLogResponseWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (rw *accessLogResponseWriter) WriteHeader(status int) {
+	if rw.status == 0 {
+		rw.status = status
+	}
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *accessLogResponseWriter) Write(b []byte) (int, error) {
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+	n, err := rw.ResponseWriter.Write(b)
+	rw.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController flush the response
+func (rw *accessLogResponseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+// Hijack is used for CONNECT requests of the forward proxy
+func (rw *accessLogResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := rw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response writer does not support hijacking")
+	}
+	conn, buffered, err := hijacker.Hijack()
+	if err == nil && rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+	return conn, buffered, err
+}
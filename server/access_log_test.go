@@ -0,0 +1,176 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"strings"
+	"testing"
+
+	"github.com/hasura/hasura-secret-refresh/provider"
+	"github.com/rs/zerolog"
+)
+
+// cachingProvider reports a cache miss for the first fetch of a secret and a
+// cache hit afterwards
+type cachingProvider struct {
+	cached map[string]bool
+}
+
+type cachingFetcher struct {
+	cachingProvider
+	secretId string
+}
+
+func (f cachingFetcher) FetchSecret() (string, error) {
+	secret, _, err := f.FetchSecretWithCacheStatus()
+	return secret, err
+}
+
+func (f cachingFetcher) CachedSecret() (string, bool) {
+	if f.cached[f.secretId] {
+		return "topsecretval", true
+	}
+	return "", false
+}
+
+func (f cachingFetcher) FetchSecretWithCacheStatus() (string, bool, error) {
+	cacheHit := f.cached[f.secretId]
+	f.cached[f.secretId] = true
+	return "topsecretval", cacheHit, nil
+}
+
+func (p cachingProvider) SecretFetcher(header http.Header) (provider.SecretFetcher, error) {
+	return cachingFetcher{cachingProvider: p, secretId: header.Get("X-Hasura-Secret-Id")}, nil
+}
+
+func (p cachingProvider) DeleteConfigHeaders(header *http.Header) {}
+
+func getAccessLogServer(accessLog *AccessLog, logger zerolog.Logger) Server {
+	config := Config{
+		Providers: map[string]provider.HttpProvider{"caching_provider": cachingProvider{cached: map[string]bool{}}},
+		AccessLog: accessLog,
+	}
+	server := Create(config, logger)
+	server.reverseProxy = func(rewrite rewriteRequest) httputil.ReverseProxy {
+		return httputil.ReverseProxy{Transport: mockTransport{}, Rewrite: rewrite}
+	}
+	return server
+}
+
+func getAccessLogRequest(t *testing.T) *http.Request {
+	return getMockRequest("http://proxyserver/orders?id=1", map[string]string{
+		forwardToHeader:      "http://somehost",
+		secretProviderHeader: "caching_provider",
+		templateHeader:       "X-Api-Key: ##secret##",
+		"X-Hasura-Secret-Id": "api-key",
+		"X-Request-Id":       "req-123",
+		"X-Api-Key":          "sent-by-client",
+		"User-Agent":         "orders-service",
+	}, t)
+}
+
+func TestAccessLog_Json(t *testing.T) {
+	var logs bytes.Buffer
+	accessLog := &AccessLog{format: accessLogFormatJson, headers: []string{"User-Agent", "X-Api-Key"}}
+	server := getAccessLogServer(accessLog, zerolog.New(&logs))
+	for _, expectedCache := range []string{cacheStatusMiss, cacheStatusHit} {
+		logs.Reset()
+		server.ServeHTTP(httptest.NewRecorder(), getAccessLogRequest(t))
+		var entry map[string]interface{}
+		var accessLogLine string
+		for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+			json.Unmarshal([]byte(line), &entry)
+			if entry["log_type"] == accessLogType {
+				accessLogLine = line
+				break
+			}
+		}
+		expected := map[string]interface{}{
+			"level":       "info",
+			"request_id":  "req-123",
+			"provider":    "caching_provider",
+			"destination": "somehost",
+			"method":      "GET",
+			"path":        "/orders",
+			"status":      float64(200),
+			"bytes":       float64(len(`{"someField": 123}`)),
+			"cache":       expectedCache,
+		}
+		for k, v := range expected {
+			if entry[k] != v {
+				t.Errorf("Expected %s to be %v but got %v", k, v, entry[k])
+			}
+		}
+		headers, _ := entry["headers"].(map[string]interface{})
+		if headers["User-Agent"] != "orders-service" {
+			t.Errorf("Expected User-Agent to be logged but got %v", headers)
+		}
+		// the secret is injected into X-Api-Key
+		if _, found := headers["X-Api-Key"]; found {
+			t.Errorf("Expected header with injected secret to not be logged")
+		}
+		if strings.Contains(accessLogLine, "topsecretval") || strings.Contains(accessLogLine, "sent-by-client") {
+			t.Errorf("Expected secret to not be logged")
+		}
+	}
+}
+
+func TestAccessLog_Common(t *testing.T) {
+	var lines bytes.Buffer
+	accessLog := &AccessLog{format: accessLogFormatCommon, writer: &lines}
+	server := getAccessLogServer(accessLog, zerolog.Nop())
+	request := getAccessLogRequest(t)
+	request.RemoteAddr = "10.0.0.1:51234"
+	server.ServeHTTP(httptest.NewRecorder(), request)
+	line := lines.String()
+	if !strings.HasPrefix(line, "10.0.0.1 - - [") {
+		t.Errorf("Unexpected line %s", line)
+	}
+	for _, expected := range []string{
+		`"GET /orders HTTP/1.1" 200 18`, "request_id=req-123", "provider=caching_provider",
+		"destination=somehost", "cache=miss",
+	} {
+		if !strings.Contains(line, expected) {
+			t.Errorf("Expected line to contain %s but got %s", expected, line)
+		}
+	}
+
+	// requests that fail before a secret is fetched are logged too
+	lines.Reset()
+	rw := httptest.NewRecorder()
+	server.ServeHTTP(rw, getMockRequest("http://proxyserver/orders", nil, t))
+	if !strings.Contains(lines.String(), `"GET /orders HTTP/1.1" 400`) || !strings.Contains(lines.String(), "provider=-") {
+		t.Errorf("Unexpected line %s", lines.String())
+	}
+	if strings.Contains(lines.String(), "request_id=-") {
+		t.Errorf("Expected a request id to be generated")
+	}
+}
+
+func TestParseAccessLogFromConfig(t *testing.T) {
+	accessLog, err := ParseAccessLogFromConfig(map[string]interface{}{}, zerolog.Nop())
+	if err != nil || accessLog == nil || accessLog.format != accessLogFormatJson {
+		t.Errorf("Expected JSON access log by default")
+	}
+	accessLog, err = ParseAccessLogFromConfig(map[string]interface{}{
+		"access_log": map[string]interface{}{"enabled": false},
+	}, zerolog.Nop())
+	if err != nil || accessLog != nil {
+		t.Errorf("Expected access log to be disabled")
+	}
+	invalidConfigs := map[string]interface{}{
+		"not an object":  "json",
+		"unknown format": map[string]interface{}{"format": "combined"},
+		"secret header":  map[string]interface{}{"headers": []interface{}{"authorization"}},
+		"config header":  map[string]interface{}{"headers": []interface{}{"X-Hasura-Secret-Id"}},
+	}
+	for name, config := range invalidConfigs {
+		_, err := ParseAccessLogFromConfig(map[string]interface{}{"access_log": config}, zerolog.Nop())
+		if err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
@@ -0,0 +1,399 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+const dnsLookupTimeout = 5 * time.Second
+
+// privateNetworks are the ranges rejected when deny_private_networks is set,
+// unless they are explicitly allowed with a CIDR entry.
+var privateNetworks = mustParseCIDRs(
+	"0.0.0.0/8",      // "this" network
+	"10.0.0.0/8",     // RFC 1918
+	"100.64.0.0/10",  // carrier-grade NAT
+	"127.0.0.0/8",    // loopback
+	"169.254.0.0/16", // link local, includes cloud metadata endpoints
+	"172.16.0.0/12",  // RFC 1918
+	"192.168.0.0/16", // RFC 1918
+	"::1/128",        // loopback
+	"fc00::/7",       // unique local
+	"fe80::/10",      // link local
+)
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+type allowlistEntry struct {
+	// host is either an exact host name or, if wildcard is set, the domain
+	// whose subdomains are allowed
+	host     string
+	wildcard bool
+	network  *net.IPNet
+	// port is 0 if every port is allowed
+	port int
+}
+
+// DestinationAllowlist restricts the hosts to which requests with attached
+// secrets can be forwarded. A nil DestinationAllowlist allows every
+// destination.
+type DestinationAllowlist struct {
+	// restrictHosts is false if 'hosts' is not configured, in which case only
+	// the private network check applies
+	restrictHosts       bool
+	entries             []allowlistEntry
+	denyPrivateNetworks bool
+	lookupIP            func(ctx context.Context, host string) ([]net.IP, error)
+}
+
+// ParseDestinationAllowlistFromConfig parses the 'destination_allowlist'
+// config. Returns nil if it is not configured.
+//
+//	destination_allowlist:
+//	  hosts:
+//	    - api.example.com
+//	    - "*.example.org:443"
+//	    - 10.20.0.0/16
+//	  deny_private_networks: true
+func ParseDestinationAllowlistFromConfig(config map[string]interface{}, logger zerolog.Logger) (*DestinationAllowlist, error) {
+	allowlistI, found := config["destination_allowlist"]
+	if !found {
+		return nil, nil
+	}
+	allowlistConfig, ok := allowlistI.(map[string]interface{})
+	if !ok {
+		logger.Error().Msg("'destination_allowlist' must be an object")
+		return nil, fmt.Errorf("config not valid: 'destination_allowlist' must be an object")
+	}
+	allowlist := &DestinationAllowlist{
+		lookupIP: func(ctx context.Context, host string) ([]net.IP, error) {
+			return net.DefaultResolver.LookupIP(ctx, "ip", host)
+		},
+	}
+	hosts := make([]interface{}, 0)
+	if hostsI, found := allowlistConfig["hosts"]; found {
+		hosts, ok = hostsI.([]interface{})
+		if !ok {
+			logger.Error().Msg("'destination_allowlist.hosts' must be a list")
+			return nil, fmt.Errorf("config not valid: 'destination_allowlist.hosts' must be a list")
+		}
+		allowlist.restrictHosts = true
+	}
+	for _, hostI := range hosts {
+		host, ok := hostI.(string)
+		if !ok {
+			logger.Error().Msg("'destination_allowlist.hosts' must be a list of strings")
+			return nil, fmt.Errorf("config not valid: 'destination_allowlist.hosts' must be a list of strings")
+		}
+		entry, err := parseAllowlistEntry(host)
+		if err != nil {
+			logger.Err(err).Msgf("Entry %q of 'destination_allowlist.hosts' is not valid", host)
+			return nil, fmt.Errorf("config not valid: entry %q of 'destination_allowlist.hosts': %w", host, err)
+		}
+		allowlist.entries = append(allowlist.entries, entry)
+	}
+	if denyI, found := allowlistConfig["deny_private_networks"]; found {
+		deny, ok := denyI.(bool)
+		if !ok {
+			logger.Error().Msg("'destination_allowlist.deny_private_networks' must be a boolean")
+			return nil, fmt.Errorf("config not valid: 'destination_allowlist.deny_private_networks' must be a boolean")
+		}
+		allowlist.denyPrivateNetworks = deny
+	}
+	return allowlist, nil
+}
+
+func parseAllowlistEntry(input string) (entry allowlistEntry, err error) {
+	input = strings.ToLower(strings.TrimSpace(input))
+	if input == "" {
+		return entry, fmt.Errorf("entry must not be empty")
+	}
+	if _, network, err := net.ParseCIDR(input); err == nil {
+		entry.network = network
+		return entry, nil
+	}
+	host := input
+	if h, p, err := net.SplitHostPort(input); err == nil {
+		port, err := strconv.Atoi(p)
+		if err != nil || port <= 0 || port > 65535 {
+			return entry, fmt.Errorf("port %q is not valid", p)
+		}
+		host, entry.port = h, port
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		bits := 8 * net.IPv4len
+		if ip.To4() == nil {
+			bits = 8 * net.IPv6len
+		}
+		entry.network = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		return entry, nil
+	}
+	if strings.HasPrefix(host, "*.") {
+		entry.wildcard = true
+		host = strings.TrimPrefix(host, "*.")
+	}
+	if host == "" || strings.Contains(host, "*") {
+		return entry, fmt.Errorf("only a leading '*.' wildcard is supported")
+	}
+	entry.host = host
+	return entry, nil
+}
+
+func (entry allowlistEntry) matchesPort(port int) bool {
+	return entry.port == 0 || entry.port == port
+}
+
+// matchesHost checks a destination host name against the entry
+func (entry allowlistEntry) matchesHost(host string) bool {
+	if entry.host == "" {
+		return false
+	}
+	if entry.wildcard {
+		return strings.HasSuffix(host, "."+entry.host)
+	}
+	return host == entry.host
+}
+
+func (entry allowlistEntry) matchesIP(ip net.IP) bool {
+	return entry.network != nil && entry.network.Contains(ip)
+}
+
+func destinationPort(destination *url.URL) int {
+	if p := destination.Port(); p != "" {
+		port, _ := strconv.Atoi(p)
+		return port
+	}
+	if destination.Scheme == "https" {
+		return 443
+	}
+	return 80
+}
+
+// Check returns an error if requests must not be forwarded to the destination.
+func (allowlist *DestinationAllowlist) Check(ctx context.Context, destination *url.URL) error {
+	if allowlist == nil {
+		return nil
+	}
+	host := strings.ToLower(strings.TrimSuffix(destination.Hostname(), "."))
+	port := destinationPort(destination)
+	ip := net.ParseIP(host)
+
+	allowed := !allowlist.restrictHosts
+	for _, entry := range allowlist.entries {
+		if !entry.matchesPort(port) {
+			continue
+		}
+		if (ip != nil && entry.matchesIP(ip)) || (ip == nil && entry.matchesHost(host)) {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return fmt.Errorf("destination %s is not in the allowlist", destination.Host)
+	}
+	if !allowlist.denyPrivateNetworks {
+		return nil
+	}
+
+	ips := []net.IP{ip}
+	if ip == nil {
+		ctx, cancel := context.WithTimeout(ctx, dnsLookupTimeout)
+		defer cancel()
+		var err error
+		ips, err = allowlist.lookupIP(ctx, host)
+		if err != nil {
+			return fmt.Errorf("unable to resolve destination %s: %w", host, err)
+		}
+	}
+	for _, resolved := range ips {
+		if err := allowlist.checkIP(resolved, port); err != nil {
+			return fmt.Errorf("destination %s resolves to %w", destination.Host, err)
+		}
+	}
+	return nil
+}
+
+// checkIP returns an error if the IP is in a private network that is denied
+func (allowlist *DestinationAllowlist) checkIP(ip net.IP, port int) error {
+	if !allowlist.deniesPrivateNetworks() {
+		return nil
+	}
+	if isPrivateIP(ip) && !allowlist.allowsNetwork(ip, port) {
+		return fmt.Errorf("the private address %s", ip)
+	}
+	return nil
+}
+
+func (allowlist *DestinationAllowlist) deniesPrivateNetworks() bool {
+	return allowlist != nil && allowlist.denyPrivateNetworks
+}
+
+// allowsNetwork reports whether an IP is explicitly allowed with an IP or CIDR entry
+func (allowlist *DestinationAllowlist) allowsNetwork(ip net.IP, port int) bool {
+	for _, entry := range allowlist.entries {
+		if entry.matchesPort(port) && entry.matchesIP(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func isPrivateIP(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	for _, network := range privateNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return ip.IsUnspecified() || ip.IsMulticast()
+}
+
+type dialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+// privateNetworkGuard refuses connections to denied private networks when
+// they are dialed. Check rejects requests early, but the name of the
+// destination can resolve to another address by the time the transport
+// connects, eg. with DNS rebinding. The guard resolves the name itself and
+// only dials the addresses that every allowlist accepts.
+type privateNetworkGuard struct {
+	allowlists []*DestinationAllowlist
+	dial       dialFunc
+}
+
+func (guard privateNetworkGuard) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	var lookupIP func(ctx context.Context, host string) ([]net.IP, error)
+	for _, allowlist := range guard.allowlists {
+		if allowlist.deniesPrivateNetworks() {
+			lookupIP = allowlist.lookupIP
+			break
+		}
+	}
+	if lookupIP == nil {
+		return guard.dial(ctx, network, address)
+	}
+	host, p, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, _ := strconv.Atoi(p)
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		lookupCtx, cancel := context.WithTimeout(ctx, dnsLookupTimeout)
+		defer cancel()
+		ips, err = lookupIP(lookupCtx, host)
+		if err != nil {
+			return nil, fmt.Errorf("unable to resolve destination %s: %w", host, err)
+		}
+	}
+	ctx = context.WithValue(ctx, dialHostKey{}, host)
+	err = fmt.Errorf("destination %s did not resolve to an address", host)
+	for _, ip := range ips {
+		if checkErr := guard.checkIP(ip, port); checkErr != nil {
+			err = fmt.Errorf("destination %s resolves to %w", host, checkErr)
+			continue
+		}
+		conn, dialErr := guard.dial(ctx, network, net.JoinHostPort(ip.String(), p))
+		if dialErr == nil {
+			return conn, nil
+		}
+		err = dialErr
+	}
+	return nil, err
+}
+
+type dialHostKey struct{}
+
+// dialHost returns the host of the destination being dialed. The address is
+// the address the guard resolved the host to, if it dialed it.
+func dialHost(ctx context.Context, address string) string {
+	if host, ok := ctx.Value(dialHostKey{}).(string); ok {
+		return host
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return address
+	}
+	return host
+}
+
+func (guard privateNetworkGuard) checkIP(ip net.IP, port int) error {
+	for _, allowlist := range guard.allowlists {
+		if err := allowlist.checkIP(ip, port); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type guardedTransportKey struct {
+	transport *http.Transport
+	provider  string
+}
+
+// guardedTransports are the upstream transports whose connections are
+// checked by a privateNetworkGuard. Each provider gets its own transport so
+// that pooled connections are only reused by requests with the same
+// allowlists.
+type guardedTransports struct {
+	mu         sync.Mutex
+	transports map[guardedTransportKey]*http.Transport
+}
+
+// get returns the transport sending the requests of the provider. It is
+// transport itself, nil for the default transport, unless an allowlist denies
+// private networks.
+func (g *guardedTransports) get(
+	transport *http.Transport, provider string, allowlists ...*DestinationAllowlist,
+) *http.Transport {
+	denies := false
+	for _, allowlist := range allowlists {
+		denies = denies || allowlist.deniesPrivateNetworks()
+	}
+	if !denies {
+		return transport
+	}
+	key := guardedTransportKey{transport: transport, provider: provider}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if guarded, found := g.transports[key]; found {
+		return guarded
+	}
+	if transport == nil {
+		transport = http.DefaultTransport.(*http.Transport)
+	}
+	guarded := transport.Clone()
+	dial := guarded.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	guarded.DialContext = privateNetworkGuard{allowlists: allowlists, dial: dial}.DialContext
+	if guarded.DialTLSContext != nil {
+		guarded.DialTLSContext = privateNetworkGuard{allowlists: allowlists, dial: guarded.DialTLSContext}.DialContext
+	}
+	if g.transports == nil {
+		g.transports = make(map[guardedTransportKey]*http.Transport)
+	}
+	g.transports[key] = guarded
+	return guarded
+}
@@ -0,0 +1,269 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/hasura/hasura-secret-refresh/provider"
+	"github.com/rs/zerolog"
+)
+
+func getMockAllowlist(t *testing.T, hosts []interface{}, denyPrivateNetworks bool) *DestinationAllowlist {
+	config := map[string]interface{}{
+		"destination_allowlist": map[string]interface{}{
+			"hosts":                 hosts,
+			"deny_private_networks": denyPrivateNetworks,
+		},
+	}
+	allowlist, err := ParseDestinationAllowlistFromConfig(config, zerolog.Nop())
+	if err != nil {
+		t.Fatalf("Unable to parse allowlist: %s", err)
+	}
+	allowlist.lookupIP = func(ctx context.Context, host string) ([]net.IP, error) {
+		mockDns := map[string][]net.IP{
+			"api.example.com":      {net.ParseIP("93.184.216.34")},
+			"internal.example.com": {net.ParseIP("10.1.2.3")},
+			"rebind.example.com":   {net.ParseIP("93.184.216.34"), net.ParseIP("169.254.169.254")},
+		}
+		ips, found := mockDns[host]
+		if !found {
+			return nil, errors.New("no such host")
+		}
+		return ips, nil
+	}
+	return allowlist
+}
+
+func TestDestinationAllowlist_Check(t *testing.T) {
+	allowlist := getMockAllowlist(t, []interface{}{
+		"api.example.com",
+		"*.example.org",
+		"payments.example.net:8443",
+		"192.168.10.0/24",
+		"[::1]:8080",
+	}, false)
+	testCases := map[string]bool{
+		"https://api.example.com":           true,
+		"http://API.example.com:8080":       true,
+		"https://other.example.com":         false,
+		"https://a.example.org":             true,
+		"https://a.b.example.org":           true,
+		"https://example.org":               false,
+		"https://evilexample.org":           false,
+		"https://payments.example.net:8443": true,
+		"https://payments.example.net":      false,
+		"http://192.168.10.20":              true,
+		"http://192.168.11.20":              false,
+		"http://[::1]:8080":                 true,
+		"http://[::1]:8081":                 false,
+	}
+	for destination, expected := range testCases {
+		destinationUrl, _ := url.Parse(destination)
+		err := allowlist.Check(context.Background(), destinationUrl)
+		if expected && err != nil {
+			t.Errorf("Expected %s to be allowed but got error: %s", destination, err)
+		}
+		if !expected && err == nil {
+			t.Errorf("Expected %s to be rejected", destination)
+		}
+	}
+}
+
+func TestDestinationAllowlist_DenyPrivateNetworks(t *testing.T) {
+	allowlist := getMockAllowlist(t, []interface{}{
+		"*.example.com",
+		"10.1.0.0/16",
+	}, true)
+	testCases := map[string]bool{
+		"https://api.example.com":      true,
+		"https://internal.example.com": true, // resolves to 10.1.2.3 which is explicitly allowed
+		"https://rebind.example.com":   false,
+		"https://unknown.example.com":  false,
+		"http://10.1.2.3":              true,
+	}
+	for destination, expected := range testCases {
+		destinationUrl, _ := url.Parse(destination)
+		err := allowlist.Check(context.Background(), destinationUrl)
+		if expected && err != nil {
+			t.Errorf("Expected %s to be allowed but got error: %s", destination, err)
+		}
+		if !expected && err == nil {
+			t.Errorf("Expected %s to be rejected", destination)
+		}
+	}
+
+	// without 'hosts' only the private network check applies
+	config := map[string]interface{}{
+		"destination_allowlist": map[string]interface{}{"deny_private_networks": true},
+	}
+	allowlist, err := ParseDestinationAllowlistFromConfig(config, zerolog.Nop())
+	if err != nil {
+		t.Fatalf("Unable to parse allowlist: %s", err)
+	}
+	for destination, expected := range map[string]bool{
+		"http://93.184.216.34":       true,
+		"http://127.0.0.1:8080":      false,
+		"http://169.254.169.254":     false,
+		"http://[::ffff:10.0.0.1]":   false,
+		"http://[fd00::1]":           false,
+		"http://[2606:4700::6810:1]": true,
+	} {
+		destinationUrl, _ := url.Parse(destination)
+		err := allowlist.Check(context.Background(), destinationUrl)
+		if expected && err != nil {
+			t.Errorf("Expected %s to be allowed but got error: %s", destination, err)
+		}
+		if !expected && err == nil {
+			t.Errorf("Expected %s to be rejected", destination)
+		}
+	}
+}
+
+func TestParseDestinationAllowlistFromConfig(t *testing.T) {
+	allowlist, err := ParseDestinationAllowlistFromConfig(map[string]interface{}{}, zerolog.Nop())
+	if err != nil || allowlist != nil {
+		t.Errorf("Expected no allowlist when it is not configured")
+	}
+	invalidConfigs := map[string]interface{}{
+		"not an object":        "api.example.com",
+		"hosts not a list":     map[string]interface{}{"hosts": "api.example.com"},
+		"host not a string":    map[string]interface{}{"hosts": []interface{}{1}},
+		"inner wildcard":       map[string]interface{}{"hosts": []interface{}{"api.*.example.com"}},
+		"invalid port":         map[string]interface{}{"hosts": []interface{}{"api.example.com:http"}},
+		"deny not a boolean":   map[string]interface{}{"deny_private_networks": "yes"},
+		"empty host":           map[string]interface{}{"hosts": []interface{}{""}},
+		"bare wildcard domain": map[string]interface{}{"hosts": []interface{}{"*."}},
+	}
+	for name, allowlistConfig := range invalidConfigs {
+		config := map[string]interface{}{"destination_allowlist": allowlistConfig}
+		_, err := ParseDestinationAllowlistFromConfig(config, zerolog.Nop())
+		if err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestGetRewriteDetails_WithDisallowedDestination(t *testing.T) {
+	providers := map[string]provider.HttpProvider{
+		"mock_provider": mockProvider{},
+	}
+	testCases := map[string]Config{
+		"global allowlist": {
+			Providers:            providers,
+			DestinationAllowlist: getMockAllowlist(t, []interface{}{"allowed.example.com"}, false),
+		},
+		"provider allowlist": {
+			Providers: providers,
+			ProviderDestinationAllowlists: map[string]*DestinationAllowlist{
+				"mock_provider": getMockAllowlist(t, []interface{}{"allowed.example.com"}, false),
+			},
+		},
+		"provider allowlist narrower than global allowlist": {
+			Providers:            providers,
+			DestinationAllowlist: getMockAllowlist(t, []interface{}{"*.example.com"}, false),
+			ProviderDestinationAllowlists: map[string]*DestinationAllowlist{
+				"mock_provider": getMockAllowlist(t, []interface{}{"allowed.example.com"}, false),
+			},
+		},
+	}
+	for name, config := range testCases {
+		withHeaders := map[string]string{
+			forwardToHeader:      "http://somehost.example.com",
+			"X-Hasura-Secret-Id": "secret123",
+			secretProviderHeader: "mock_provider",
+			templateHeader:       "Auth: Bearer ##secret##",
+		}
+		mockRequest := getMockRequest("http://localhost:5353", withHeaders, t)
+		rw := httptest.NewRecorder()
+		_, ok := getRequestRewriteDetails(rw, mockRequest, config, zerolog.Nop())
+		if ok != false {
+			t.Errorf("%s: Expected 'ok' to be false", name)
+		}
+		if rw.Code != http.StatusForbidden {
+			t.Errorf("%s: Expected status code to be %d but got %d", name, http.StatusForbidden, rw.Code)
+		}
+		hasuraError := make(map[string]interface{})
+		if err := json.NewDecoder(rw.Body).Decode(&hasuraError); err != nil || hasuraError["message"] == "" {
+			t.Errorf("%s: Expected a Hasura error in the response body", name)
+		}
+
+		withHeaders[forwardToHeader] = "http://allowed.example.com"
+		mockRequest = getMockRequest("http://localhost:5353", withHeaders, t)
+		rw = httptest.NewRecorder()
+		_, ok = getRequestRewriteDetails(rw, mockRequest, config, zerolog.Nop())
+		if ok != true {
+			t.Errorf("%s: Expected 'ok' to be true for an allowed destination", name)
+		}
+	}
+}
+
+func TestPrivateNetworkGuard(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+	_, port, _ := net.SplitHostPort(upstream.Listener.Addr().String())
+	dialed := make([]string, 0)
+	dialer := &net.Dialer{}
+	dial := func(ctx context.Context, network, address string) (net.Conn, error) {
+		dialed = append(dialed, address)
+		return dialer.DialContext(ctx, network, address)
+	}
+
+	// the name resolved to a public address when the request was checked,
+	// it resolves to a private one when the transport connects
+	allowlist := getMockAllowlist(t, []interface{}{"rebind.example.com"}, true)
+	allowlist.lookupIP = func(ctx context.Context, host string) ([]net.IP, error) {
+		return []net.IP{net.ParseIP("127.0.0.1")}, nil
+	}
+	guard := privateNetworkGuard{allowlists: []*DestinationAllowlist{nil, allowlist}, dial: dial}
+	if _, err := guard.DialContext(context.Background(), "tcp", net.JoinHostPort("rebind.example.com", port)); err == nil {
+		t.Errorf("Expected the connection to a private address to be refused")
+	}
+	if _, err := guard.DialContext(context.Background(), "tcp", net.JoinHostPort("127.0.0.1", port)); err == nil {
+		t.Errorf("Expected the connection to a private address to be refused")
+	}
+	if len(dialed) != 0 {
+		t.Errorf("Expected no address to be dialed but got %v", dialed)
+	}
+
+	// explicitly allowed networks are dialed by address
+	allowlist.entries = append(allowlist.entries, allowlistEntry{network: mustParseCIDRs("127.0.0.0/8")[0]})
+	conn, err := guard.DialContext(context.Background(), "tcp", net.JoinHostPort("rebind.example.com", port))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	conn.Close()
+	if len(dialed) != 1 || dialed[0] != net.JoinHostPort("127.0.0.1", port) {
+		t.Errorf("Expected the resolved address to be dialed but got %v", dialed)
+	}
+}
+
+func TestGuardedTransports(t *testing.T) {
+	transports := &guardedTransports{}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if got := transports.get(transport, "mock_provider", getMockAllowlist(t, nil, false), nil); got != transport {
+		t.Errorf("Expected the transport to be used if no allowlist denies private networks")
+	}
+	if got := transports.get(nil, "mock_provider"); got != nil {
+		t.Errorf("Expected the default transport to be used if there is no allowlist")
+	}
+	denying := getMockAllowlist(t, nil, true)
+	guarded := transports.get(nil, "mock_provider", nil, denying)
+	if guarded == nil || guarded == http.DefaultTransport {
+		t.Fatalf("Expected a guarded transport")
+	}
+	if transports.get(nil, "mock_provider", nil, denying) != guarded {
+		t.Errorf("Expected the guarded transport to be reused by the provider")
+	}
+	if transports.get(nil, "other_provider", denying) == guarded {
+		t.Errorf("Expected providers not to share guarded transports")
+	}
+	if transports.get(transport, "mock_provider", denying) == guarded {
+		t.Errorf("Expected route transports not to share guarded transports")
+	}
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/rs/zerolog"
+)
+
+const defaultRetryMaxBodySize = 1024 * 1024
+
+// AuthFailureRetry replays a request once with a freshly fetched secret when
+// the upstream rejects it with 401 or 403. This recovers from secrets that
+// were rotated while the previous value was still cached. A nil
+// AuthFailureRetry disables the replay.
+type AuthFailureRetry struct {
+	// MaxBodySize is the size in bytes up to which request bodies are buffered
+	// so that they can be sent again. Requests with larger bodies are not
+	// replayed.
+	MaxBodySize int64
+}
+
+// ParseAuthFailureRetryFromConfig parses the 'retry_on_auth_failure' config.
+// Returns nil if it is not configured or not enabled.
+//
+//	retry_on_auth_failure:
+//	  enabled: true
+//	  max_body_size: 1048576
+func ParseAuthFailureRetryFromConfig(config map[string]interface{}, logger zerolog.Logger) (*AuthFailureRetry, error) {
+	retryI, found := config["retry_on_auth_failure"]
+	if !found {
+		return nil, nil
+	}
+	retryConfig, ok := retryI.(map[string]interface{})
+	if !ok {
+		logger.Error().Msg("'retry_on_auth_failure' must be an object")
+		return nil, fmt.Errorf("config not valid: 'retry_on_auth_failure' must be an object")
+	}
+	enabled := true
+	if enabledI, found := retryConfig["enabled"]; found {
+		enabled, ok = enabledI.(bool)
+		if !ok {
+			logger.Error().Msg("'enabled' in 'retry_on_auth_failure' must be a boolean")
+			return nil, fmt.Errorf("config not valid: 'enabled' in 'retry_on_auth_failure' must be a boolean")
+		}
+	}
+	if !enabled {
+		return nil, nil
+	}
+	retry := &AuthFailureRetry{MaxBodySize: defaultRetryMaxBodySize}
+	if maxBodySizeI, found := retryConfig["max_body_size"]; found {
+		maxBodySize, ok := maxBodySizeI.(int)
+		if !ok || maxBodySize < 0 {
+			logger.Error().Msg("'max_body_size' in 'retry_on_auth_failure' must be a non negative number")
+			return nil, fmt.Errorf("config not valid: 'max_body_size' in 'retry_on_auth_failure' must be a non negative number")
+		}
+		retry.MaxBodySize = int64(maxBodySize)
+	}
+	logger.Info().Int64("max_body_size", retry.MaxBodySize).Msg("Requests rejected by upstream with 401 or 403 will be retried with a fresh secret")
+	return retry, nil
+}
+
+// bufferBody reads the request body into memory if it is at most maxSize
+// bytes long and replaces the request body with the buffered copy. If the
+// body is larger, the request body is left readable as it was and
+// replayable is false.
+func bufferBody(r *http.Request, maxSize int64) (body []byte, replayable bool, err error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, true, nil
+	}
+	if r.ContentLength > maxSize {
+		return nil, false, nil
+	}
+	body, err = io.ReadAll(io.LimitReader(r.Body, maxSize+1))
+	if err != nil {
+		return nil, false, fmt.Errorf("unable to read request body: %w", err)
+	}
+	if int64(len(body)) > maxSize {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		return nil, false, nil
+	}
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	return body, true, nil
+}
+
+func isAuthFailure(statusCode int) bool {
+	return statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden
+}
+
+// authRetryTransport sends the request again with a refreshed secret if the
+// upstream responded with 401 or 403. The request is replayed at most once.
+type authRetryTransport struct {
+	transport     http.RoundTripper
+	body          []byte
+	refreshSecret secretRefresher
+	logger        zerolog.Logger
+}
+
+func (t authRetryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	response, err := t.transport.RoundTrip(req)
+	if err != nil || !isAuthFailure(response.StatusCode) {
+		return response, err
+	}
+	t.logger.Info().Int("status_code", response.StatusCode).
+		Msg("Upstream rejected the request. Retrying with a fresh secret")
+	retryReq := req.Clone(req.Context())
+	retryReq.Body = http.NoBody
+	if t.body != nil {
+		retryReq.Body = io.NopCloser(bytes.NewReader(t.body))
+	}
+	retryReq.ContentLength = int64(len(t.body))
+	err = t.refreshSecret(retryReq)
+	if err != nil {
+		// the response of the first attempt is returned as is
+		t.logger.Error().Err(err).Msg("Unable to refresh secret. Not retrying the request")
+		return response, nil
+	}
+	response.Body.Close()
+	logRequest(retryReq, false, "Retrying request to backend service", t.logger)
+	return t.transport.RoundTrip(retryReq)
+}
@@ -0,0 +1,334 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hasura/hasura-secret-refresh/provider"
+	"github.com/rs/zerolog"
+)
+
+// rotatingProvider caches the secret until it is invalidated, like the
+// providers that fetch secrets from a remote secret store
+type rotatingProvider struct {
+	state *rotatingState
+}
+
+type rotatingState struct {
+	current       string
+	cached        string
+	invalidations int
+}
+
+type rotatingFetcher struct {
+	state *rotatingState
+}
+
+func (f rotatingFetcher) FetchSecret() (string, error) {
+	if f.state.cached == "" {
+		f.state.cached = f.state.current
+	}
+	return f.state.cached, nil
+}
+
+func (f rotatingFetcher) InvalidateSecret() {
+	f.state.cached = ""
+	f.state.invalidations++
+}
+
+func (p rotatingProvider) SecretFetcher(header http.Header) (provider.SecretFetcher, error) {
+	return rotatingFetcher{state: p.state}, nil
+}
+
+func (p rotatingProvider) DeleteConfigHeaders(header *http.Header) {}
+
+// authTransport accepts requests authorized with the given token and records
+// the requests it received
+type authTransport struct {
+	token    string
+	requests *[]recordedRequest
+}
+
+type recordedRequest struct {
+	authorization string
+	body          string
+}
+
+func (t authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	body := []byte{}
+	if req.Body != nil {
+		body, _ = io.ReadAll(req.Body)
+	}
+	authorization := req.Header.Get("Authorization")
+	*t.requests = append(*t.requests, recordedRequest{authorization, string(body)})
+	statusCode := http.StatusOK
+	if authorization != "Bearer "+t.token {
+		statusCode = http.StatusUnauthorized
+	}
+	return &http.Response{
+		StatusCode: statusCode,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Body:       io.NopCloser(bytes.NewBufferString("{}")),
+		Request:    req,
+		Header:     make(http.Header),
+	}, nil
+}
+
+func getAuthRetryServer(retry *AuthFailureRetry, state *rotatingState, token string, requests *[]recordedRequest) Server {
+	return getGuardedAuthRetryServer(retry, nil, state, token, requests, func() {})
+}
+
+// hookTransport calls before ahead of every request
+type hookTransport struct {
+	http.RoundTripper
+	before func()
+}
+
+func (t hookTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.before()
+	return t.RoundTripper.RoundTrip(req)
+}
+
+// getGuardedAuthRetryServer calls beforeUpstream ahead of every request to
+// the upstream
+func getGuardedAuthRetryServer(
+	retry *AuthFailureRetry, guard *ProviderGuard, state *rotatingState, token string, requests *[]recordedRequest,
+	beforeUpstream func(),
+) Server {
+	config := Config{
+		Providers: map[string]provider.HttpProvider{
+			"rotating_provider": rotatingProvider{state: state},
+		},
+		ProviderGuards:   map[string]*ProviderGuard{"rotating_provider": guard},
+		AuthFailureRetry: retry,
+	}
+	server := Create(config, zerolog.Nop())
+	server.reverseProxy = func(rewrite rewriteRequest) httputil.ReverseProxy {
+		return httputil.ReverseProxy{
+			Transport: hookTransport{authTransport{token: token, requests: requests}, beforeUpstream},
+			Rewrite:   rewrite,
+		}
+	}
+	return server
+}
+
+func getAuthRetryRequest(body string, t *testing.T) *http.Request {
+	mockRequest := getMockRequest("http://proxyserver/test", map[string]string{
+		forwardToHeader:         "http://somehost",
+		secretProviderHeader:    "rotating_provider",
+		templateHeader:          "Authorization: Bearer ##secret##",
+		bodyFieldTemplateHeader: "auth.token=##secret##",
+	}, t)
+	mockRequest.Method = http.MethodPost
+	mockRequest.Body = io.NopCloser(strings.NewReader(body))
+	mockRequest.ContentLength = int64(len(body))
+	return mockRequest
+}
+
+func TestEndpoint_RetryOnAuthFailure(t *testing.T) {
+	state := &rotatingState{current: "new_secret", cached: "old_secret"}
+	requests := []recordedRequest{}
+	server := getAuthRetryServer(&AuthFailureRetry{MaxBodySize: 1024}, state, "new_secret", &requests)
+	rw := httptest.NewRecorder()
+	server.ServeHTTP(rw, getAuthRetryRequest(`{"action":"create"}`, t))
+	if rw.Code != http.StatusOK {
+		t.Errorf("Expected status code to be %d but got %d", http.StatusOK, rw.Code)
+	}
+	if len(requests) != 2 {
+		t.Fatalf("Expected 2 requests to the upstream but got %d", len(requests))
+	}
+	if requests[0].authorization != "Bearer old_secret" || requests[1].authorization != "Bearer new_secret" {
+		t.Errorf("Unexpected authorization headers %s, %s", requests[0].authorization, requests[1].authorization)
+	}
+	for i, request := range requests {
+		body := make(map[string]interface{})
+		if err := json.Unmarshal([]byte(request.body), &body); err != nil {
+			t.Fatalf("Unable to decode body of request %d: %s", i, err)
+		}
+		if body["action"] != "create" {
+			t.Errorf("Expected body of request %d to be preserved but got %s", i, request.body)
+		}
+	}
+	if !strings.Contains(requests[1].body, "new_secret") || strings.Contains(requests[1].body, "old_secret") {
+		t.Errorf("Expected body of the retried request to contain the new secret but got %s", requests[1].body)
+	}
+	if state.invalidations != 1 {
+		t.Errorf("Expected the cached secret to be invalidated once but got %d", state.invalidations)
+	}
+}
+
+func TestEndpoint_RetryOnAuthFailure_RetriedOnlyOnce(t *testing.T) {
+	state := &rotatingState{current: "still_wrong", cached: "old_secret"}
+	requests := []recordedRequest{}
+	server := getAuthRetryServer(&AuthFailureRetry{MaxBodySize: 1024}, state, "new_secret", &requests)
+	rw := httptest.NewRecorder()
+	server.ServeHTTP(rw, getAuthRetryRequest(`{}`, t))
+	if rw.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status code to be %d but got %d", http.StatusUnauthorized, rw.Code)
+	}
+	if len(requests) != 2 {
+		t.Errorf("Expected 2 requests to the upstream but got %d", len(requests))
+	}
+}
+
+func TestEndpoint_RetryOnAuthFailure_NotReplayed(t *testing.T) {
+	testCases := map[string]struct {
+		retry *AuthFailureRetry
+		body  string
+	}{
+		"retry disabled":            {nil, `{"action":"create"}`},
+		"body larger than max size": {&AuthFailureRetry{MaxBodySize: 8}, `{"action":"create"}`},
+	}
+	for name, v := range testCases {
+		state := &rotatingState{current: "new_secret", cached: "old_secret"}
+		requests := []recordedRequest{}
+		server := getAuthRetryServer(v.retry, state, "new_secret", &requests)
+		rw := httptest.NewRecorder()
+		server.ServeHTTP(rw, getAuthRetryRequest(v.body, t))
+		if rw.Code != http.StatusUnauthorized {
+			t.Errorf("%s: Expected status code to be %d but got %d", name, http.StatusUnauthorized, rw.Code)
+		}
+		if len(requests) != 1 {
+			t.Fatalf("%s: Expected 1 request to the upstream but got %d", name, len(requests))
+		}
+		if !strings.Contains(requests[0].body, `"action":"create"`) || !strings.Contains(requests[0].body, "old_secret") {
+			t.Errorf("%s: Expected body to be forwarded with the secret but got %s", name, requests[0].body)
+		}
+		if state.invalidations != 0 {
+			t.Errorf("%s: Expected the cached secret to not be invalidated", name)
+		}
+	}
+}
+
+func TestEndpoint_RetryOnAuthFailure_FetcherWithoutCache(t *testing.T) {
+	config := Config{
+		Providers: map[string]provider.HttpProvider{
+			"mock_provider": mockProvider{},
+		},
+		AuthFailureRetry: &AuthFailureRetry{MaxBodySize: 1024},
+	}
+	requests := []recordedRequest{}
+	server := Create(config, zerolog.Nop())
+	server.reverseProxy = func(rewrite rewriteRequest) httputil.ReverseProxy {
+		return httputil.ReverseProxy{
+			Transport: authTransport{token: "other", requests: &requests},
+			Rewrite:   rewrite,
+		}
+	}
+	mockRequest := getMockRequest("http://proxyserver/test", map[string]string{
+		forwardToHeader:      "http://somehost",
+		"X-Hasura-Secret-Id": "secret123",
+		secretProviderHeader: "mock_provider",
+		templateHeader:       "Authorization: Bearer ##secret##",
+	}, t)
+	rw := httptest.NewRecorder()
+	server.ServeHTTP(rw, mockRequest)
+	if rw.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status code to be %d but got %d", http.StatusUnauthorized, rw.Code)
+	}
+	if len(requests) != 1 {
+		t.Errorf("Expected 1 request to the upstream but got %d", len(requests))
+	}
+}
+
+func TestEndpoint_RetryOnAuthFailure_CircuitOpen(t *testing.T) {
+	guard, err := ParseProviderGuardFromConfig(map[string]interface{}{
+		"circuit_breaker": map[string]interface{}{"failure_threshold": 1, "cooldown": 60},
+	}, zerolog.Nop())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	state := &rotatingState{current: "new_secret", cached: "old_secret"}
+	requests := []recordedRequest{}
+	// the secret store fails after the first request was sent
+	server := getGuardedAuthRetryServer(&AuthFailureRetry{MaxBodySize: 1024}, guard, state, "new_secret", &requests, func() {
+		guard.breaker.record(provider.NewError(provider.ErrorKindUnavailable, errors.New("secret store unavailable")))
+	})
+	rw := httptest.NewRecorder()
+	server.ServeHTTP(rw, getAuthRetryRequest(`{}`, t))
+	if rw.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status code to be %d but got %d", http.StatusUnauthorized, rw.Code)
+	}
+	if len(requests) != 1 {
+		t.Errorf("Expected the request not to be retried but got %d requests", len(requests))
+	}
+	if state.invalidations != 1 || state.cached != "" {
+		t.Errorf("Expected the secret not to be fetched while the circuit is open but got %q", state.cached)
+	}
+}
+
+func TestEndpoint_RetryOnAuthFailure_ProxyTimeout(t *testing.T) {
+	guard, err := ParseProviderGuardFromConfig(map[string]interface{}{"max_concurrent_fetches": 1}, zerolog.Nop())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	state := &rotatingState{current: "new_secret", cached: "old_secret"}
+	requests := []recordedRequest{}
+	// the only fetch slot is taken after the first request was sent, so the
+	// refetch waits until the request times out
+	taken := false
+	server := getGuardedAuthRetryServer(&AuthFailureRetry{MaxBodySize: 1024}, guard, state, "new_secret", &requests, func() {
+		if !taken {
+			guard.slots <- struct{}{}
+			taken = true
+		}
+	})
+	defer func() { <-guard.slots }()
+	server.config.ProxyTimeout = 50 * time.Millisecond
+	rw := httptest.NewRecorder()
+	server.ServeHTTP(rw, getAuthRetryRequest(`{}`, t))
+	if len(requests) != 1 {
+		t.Errorf("Expected the request not to be retried but got %d requests", len(requests))
+	}
+	if state.cached != "" {
+		t.Errorf("Expected the secret not to be fetched but got %q", state.cached)
+	}
+}
+
+func TestParseAuthFailureRetryFromConfig(t *testing.T) {
+	retry, err := ParseAuthFailureRetryFromConfig(map[string]interface{}{}, zerolog.Nop())
+	if err != nil || retry != nil {
+		t.Errorf("Expected retry to be disabled when it is not configured")
+	}
+	retry, err = ParseAuthFailureRetryFromConfig(map[string]interface{}{
+		"retry_on_auth_failure": map[string]interface{}{"enabled": false},
+	}, zerolog.Nop())
+	if err != nil || retry != nil {
+		t.Errorf("Expected retry to be disabled when 'enabled' is false")
+	}
+	retry, err = ParseAuthFailureRetryFromConfig(map[string]interface{}{
+		"retry_on_auth_failure": map[string]interface{}{},
+	}, zerolog.Nop())
+	if err != nil || retry == nil || retry.MaxBodySize != defaultRetryMaxBodySize {
+		t.Errorf("Expected retry to be enabled with the default max body size. Got %v, %v", retry, err)
+	}
+	retry, err = ParseAuthFailureRetryFromConfig(map[string]interface{}{
+		"retry_on_auth_failure": map[string]interface{}{"max_body_size": 2048},
+	}, zerolog.Nop())
+	if err != nil || retry == nil || retry.MaxBodySize != 2048 {
+		t.Errorf("Expected max body size to be 2048. Got %v, %v", retry, err)
+	}
+	invalidConfigs := map[string]interface{}{
+		"not an object":          true,
+		"enabled not a boolean":  map[string]interface{}{"enabled": "yes"},
+		"max body size negative": map[string]interface{}{"max_body_size": -1},
+		"max body size a string": map[string]interface{}{"max_body_size": "1MB"},
+	}
+	for name, retryConfig := range invalidConfigs {
+		config := map[string]interface{}{"retry_on_auth_failure": retryConfig}
+		_, err := ParseAuthFailureRetryFromConfig(config, zerolog.Nop())
+		if err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/hasura/hasura-secret-refresh/provider"
+	"github.com/rs/zerolog"
+)
+
+const (
+	defaultCacheAdminEndpoint = "/admin/cache"
+	cacheAdminWarmPath        = "warm"
+)
+
+// CacheAdmin serves the endpoints to inspect and flush the caches of the
+// providers at runtime:
+//
+//	GET    <endpoint>                    keys of all providers
+//	GET    <endpoint>/<provider>         keys of a provider
+//	DELETE <endpoint>/<provider>         invalidates all keys of a provider
+//	DELETE <endpoint>/<provider>?key=<k> invalidates a key
+//	POST   <endpoint>/<provider>/warm    fetches secrets into the cache
+//
+// Cached values are never served.
+type CacheAdmin struct {
+	Endpoint string
+	// token must be sent as a bearer token
+	token     string
+	Providers map[string]provider.HttpProvider
+	Guards    map[string]*ProviderGuard
+	Logger    zerolog.Logger
+}
+
+// cacheWarmRequest lists the secrets to fetch. Every secret is selected by
+// the headers that select it in a proxied request.
+type cacheWarmRequest struct {
+	Secrets []map[string]string `json:"secrets"`
+}
+
+type cacheWarmResult struct {
+	Cache string          `json:"cache,omitempty"`
+	Error *cacheWarmError `json:"error,omitempty"`
+}
+
+type cacheWarmError struct {
+	Message string `json:"message"`
+	Code    string `json:"code"`
+}
+
+// ParseCacheAdminFromConfig parses the 'cache_admin' config. Returns nil if
+// it is not configured.
+//
+//	cache_admin:
+//	  endpoint: /admin/cache
+//	  token: some-token
+func ParseCacheAdminFromConfig(config map[string]interface{}, logger zerolog.Logger) (*CacheAdmin, error) {
+	cacheAdminI, found := config["cache_admin"]
+	if !found {
+		return nil, nil
+	}
+	cacheAdminConfig, ok := cacheAdminI.(map[string]interface{})
+	if !ok {
+		logger.Error().Msg("'cache_admin' must be an object")
+		return nil, fmt.Errorf("config not valid: 'cache_admin' must be an object")
+	}
+	cacheAdmin := &CacheAdmin{Endpoint: defaultCacheAdminEndpoint, Logger: logger}
+	if endpointI, found := cacheAdminConfig["endpoint"]; found {
+		endpoint, ok := endpointI.(string)
+		if !ok || !strings.HasPrefix(endpoint, "/") || endpoint == "/" {
+			logger.Error().Msg("'cache_admin.endpoint' must be a path other than '/'")
+			return nil, fmt.Errorf("config not valid: 'cache_admin.endpoint' must be a path other than '/'")
+		}
+		cacheAdmin.Endpoint = strings.TrimSuffix(endpoint, "/")
+	}
+	// the endpoint is served on the same listener as proxied requests
+	tokenI, found := cacheAdminConfig["token"]
+	if !found {
+		logger.Error().Msg("'cache_admin.token' not found")
+		return nil, fmt.Errorf("required configs not found: 'cache_admin.token'")
+	}
+	token, ok := tokenI.(string)
+	if !ok || token == "" {
+		logger.Error().Msg("'cache_admin.token' must be a non-empty string")
+		return nil, fmt.Errorf("config not valid: 'cache_admin.token' must be a non-empty string")
+	}
+	cacheAdmin.token = token
+	logger.Info().Str("endpoint", cacheAdmin.Endpoint).Msg("Cache admin endpoint enabled")
+	return cacheAdmin, nil
+}
+
+func (c *CacheAdmin) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	requestLogger := c.Logger.With().Str("method", r.Method).Str("path", r.URL.Path).Logger()
+	if !hasBearerToken(r, c.token) {
+		errMsg := "Cache admin requests require a valid bearer token"
+		requestLogger.Error().Msg(errMsg)
+		writeError(rw, r, http.StatusUnauthorized, errorCodeUnauthorized, errMsg, nil)
+		return
+	}
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, c.Endpoint), "/")
+	if path == "" {
+		if r.Method != http.MethodGet {
+			c.methodNotAllowed(rw, r, requestLogger)
+			return
+		}
+		c.listAllKeys(rw)
+		return
+	}
+	providerName, action, _ := strings.Cut(path, "/")
+	requestLogger = requestLogger.With().Str("provider_name", providerName).Logger()
+	secretProvider, found := c.Providers[providerName]
+	if !found {
+		errMsg := fmt.Sprintf("Provider %s not found", providerName)
+		requestLogger.Error().Msg(errMsg)
+		writeError(rw, r, http.StatusNotFound, errorCodeProviderNotFound, errMsg, nil)
+		return
+	}
+	admin, ok := secretProvider.(provider.CacheAdministrator)
+	if !ok {
+		errMsg := fmt.Sprintf("Provider %s does not cache secrets", providerName)
+		requestLogger.Error().Msg(errMsg)
+		writeError(rw, r, http.StatusBadRequest, errorCodeInvalidRequest, errMsg, nil)
+		return
+	}
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		writeJson(rw, http.StatusOK, map[string][]string{"keys": admin.CacheKeys()})
+	case action == "" && r.Method == http.MethodDelete:
+		c.invalidate(rw, r, admin, requestLogger)
+	case action == cacheAdminWarmPath && r.Method == http.MethodPost:
+		c.warm(rw, r, secretProvider, c.Guards[providerName], requestLogger)
+	case action == "" || action == cacheAdminWarmPath:
+		c.methodNotAllowed(rw, r, requestLogger)
+	default:
+		errMsg := fmt.Sprintf("Unknown cache admin path %s", r.URL.Path)
+		requestLogger.Error().Msg(errMsg)
+		writeError(rw, r, http.StatusNotFound, errorCodeInvalidRequest, errMsg, nil)
+	}
+}
+
+func (c *CacheAdmin) listAllKeys(rw http.ResponseWriter) {
+	keys := make(map[string][]string)
+	for name, p := range c.Providers {
+		if admin, ok := p.(provider.CacheAdministrator); ok {
+			keys[name] = admin.CacheKeys()
+		}
+	}
+	writeJson(rw, http.StatusOK, keys)
+}
+
+func (c *CacheAdmin) invalidate(
+	rw http.ResponseWriter, r *http.Request, admin provider.CacheAdministrator, requestLogger zerolog.Logger,
+) {
+	if !r.URL.Query().Has("key") {
+		admin.PurgeCache()
+		requestLogger.Info().Msg("Invalidated all cached secrets of provider")
+		rw.WriteHeader(http.StatusNoContent)
+		return
+	}
+	key := r.URL.Query().Get("key")
+	if !admin.InvalidateCacheKey(key) {
+		errMsg := fmt.Sprintf("Key %s is not cached", key)
+		requestLogger.Error().Msg(errMsg)
+		writeError(rw, r, http.StatusNotFound, errorCodeCacheKeyNotFound, errMsg, nil)
+		return
+	}
+	requestLogger.Info().Str("key", key).Msg("Invalidated cached secret")
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// warm fetches the requested secrets that are not cached. Responds with the
+// result of every secret, and with the status of the first failure if any
+// secret could not be fetched.
+func (c *CacheAdmin) warm(
+	rw http.ResponseWriter, r *http.Request,
+	secretProvider provider.HttpProvider, guard *ProviderGuard, requestLogger zerolog.Logger,
+) {
+	var warmRequest cacheWarmRequest
+	if err := json.NewDecoder(r.Body).Decode(&warmRequest); err != nil {
+		errMsg := "Unable to decode cache warm request body as JSON"
+		requestLogger.Error().Err(err).Msg(errMsg)
+		writeError(rw, r, http.StatusBadRequest, errorCodeInvalidRequest, errMsg, err)
+		return
+	}
+	statusCode := http.StatusOK
+	results := make([]cacheWarmResult, 0, len(warmRequest.Secrets))
+	for _, secretHeaders := range warmRequest.Secrets {
+		header := make(http.Header, len(secretHeaders))
+		for k, v := range secretHeaders {
+			header.Set(k, v)
+		}
+		result, status := warmSecret(r, secretProvider, guard, header, requestLogger)
+		if statusCode == http.StatusOK {
+			statusCode = status
+		}
+		results = append(results, result)
+	}
+	requestLogger.Info().Int("secrets", len(results)).Msg("Warmed cache of provider")
+	writeJson(rw, statusCode, map[string][]cacheWarmResult{"results": results})
+}
+
+func warmSecret(
+	r *http.Request, secretProvider provider.HttpProvider, guard *ProviderGuard,
+	header http.Header, requestLogger zerolog.Logger,
+) (cacheWarmResult, int) {
+	fetcher, err := secretProvider.SecretFetcher(header)
+	if err != nil {
+		requestLogger.Error().Err(err).Msg("Required configurations not found in cache warm request")
+		return cacheWarmResult{Error: &cacheWarmError{Message: err.Error(), Code: errorCodeInvalidRequest}},
+			http.StatusBadRequest
+	}
+	result := guard.fetchSecret(r.Context(), fetcher)
+	if result.err != nil {
+		statusCode, code := getProviderErrorResponse(result.err)
+		requestLogger.Error().Err(result.err).Str("error_code", code).Msg("Unable to warm cache")
+		return cacheWarmResult{Error: &cacheWarmError{Message: "Unable to fetch secret", Code: code}}, statusCode
+	}
+	if result.cacheHit {
+		return cacheWarmResult{Cache: cacheStatusHit}, http.StatusOK
+	}
+	return cacheWarmResult{Cache: cacheStatusMiss}, http.StatusOK
+}
+
+func (c *CacheAdmin) methodNotAllowed(rw http.ResponseWriter, r *http.Request, requestLogger zerolog.Logger) {
+	errMsg := fmt.Sprintf("Method %s is not allowed on %s", r.Method, r.URL.Path)
+	requestLogger.Error().Msg(errMsg)
+	writeError(rw, r, http.StatusMethodNotAllowed, errorCodeMethodNotAllowed, errMsg, nil)
+}
+
+func writeJson(rw http.ResponseWriter, statusCode int, v interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(statusCode)
+	json.NewEncoder(rw).Encode(v)
+}
@@ -0,0 +1,233 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/hasura/hasura-secret-refresh/provider"
+	"github.com/rs/zerolog"
+)
+
+// adminProvider caches the secrets selected by 'X-Hasura-Secret-Id'. The
+// secret 'unavailable' cannot be fetched.
+type adminProvider struct {
+	mu    *sync.Mutex
+	cache map[string]string
+}
+
+func newAdminProvider(keys ...string) adminProvider {
+	p := adminProvider{mu: &sync.Mutex{}, cache: make(map[string]string)}
+	for _, key := range keys {
+		p.cache[key] = "topsecretval"
+	}
+	return p
+}
+
+type adminFetcher struct {
+	adminProvider
+	secretId string
+}
+
+func (p adminProvider) SecretFetcher(header http.Header) (provider.SecretFetcher, error) {
+	secretId := header.Get("X-Hasura-Secret-Id")
+	if secretId == "" {
+		return nil, errors.New("header X-Hasura-Secret-Id not found")
+	}
+	return adminFetcher{adminProvider: p, secretId: secretId}, nil
+}
+
+func (p adminProvider) DeleteConfigHeaders(header *http.Header) {}
+
+func (p adminProvider) CacheKeys() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	keys := make([]string, 0, len(p.cache))
+	for key := range p.cache {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (p adminProvider) InvalidateCacheKey(key string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, found := p.cache[key]
+	delete(p.cache, key)
+	return found
+}
+
+func (p adminProvider) PurgeCache() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	clear(p.cache)
+}
+
+func (f adminFetcher) FetchSecret() (string, error) {
+	secret, _, err := f.FetchSecretWithCacheStatus()
+	return secret, err
+}
+
+func (f adminFetcher) CachedSecret() (string, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	secret, found := f.cache[f.secretId]
+	return secret, found
+}
+
+func (f adminFetcher) FetchSecretWithCacheStatus() (string, bool, error) {
+	if secret, found := f.CachedSecret(); found {
+		return secret, true, nil
+	}
+	if f.secretId == "unavailable" {
+		return "", false, provider.NewError(provider.ErrorKindUnavailable, errors.New("secret store unavailable"))
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.cache[f.secretId] = "topsecretval"
+	return "topsecretval", false, nil
+}
+
+func getCacheAdmin(t *testing.T, config map[string]interface{}, providers map[string]provider.HttpProvider) *CacheAdmin {
+	if _, found := config["token"]; !found {
+		config["token"] = "admintoken"
+	}
+	cacheAdmin, err := ParseCacheAdminFromConfig(map[string]interface{}{"cache_admin": config}, zerolog.Nop())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	cacheAdmin.Providers = providers
+	return cacheAdmin
+}
+
+func sendAdminRequest(cacheAdmin *CacheAdmin, method string, url string, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, url, strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer admintoken")
+	rw := httptest.NewRecorder()
+	cacheAdmin.ServeHTTP(rw, r)
+	return rw
+}
+
+func TestParseCacheAdminFromConfig(t *testing.T) {
+	cacheAdmin, err := ParseCacheAdminFromConfig(map[string]interface{}{}, zerolog.Nop())
+	if err != nil || cacheAdmin != nil {
+		t.Errorf("Expected cache admin to be disabled but got %v, %v", cacheAdmin, err)
+	}
+	cacheAdmin, err = ParseCacheAdminFromConfig(map[string]interface{}{
+		"cache_admin": map[string]interface{}{"token": "admintoken"},
+	}, zerolog.Nop())
+	if err != nil || cacheAdmin.Endpoint != defaultCacheAdminEndpoint {
+		t.Errorf("Expected default endpoint but got %v, %v", cacheAdmin, err)
+	}
+	invalidConfigs := []interface{}{
+		true,
+		map[string]interface{}{"endpoint": "admin", "token": "admintoken"},
+		map[string]interface{}{"endpoint": "/", "token": "admintoken"},
+		map[string]interface{}{},
+		map[string]interface{}{"token": ""},
+		map[string]interface{}{"token": 123},
+	}
+	for _, config := range invalidConfigs {
+		if _, err := ParseCacheAdminFromConfig(map[string]interface{}{"cache_admin": config}, zerolog.Nop()); err == nil {
+			t.Errorf("Expected error for config %v", config)
+		}
+	}
+}
+
+func TestCacheAdmin_Token(t *testing.T) {
+	cacheAdmin := getCacheAdmin(t, map[string]interface{}{"token": "admintoken"}, nil)
+	rw := httptest.NewRecorder()
+	cacheAdmin.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/admin/cache", nil))
+	if rw.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status code to be %d but got %d", http.StatusUnauthorized, rw.Code)
+	}
+	if rw := sendAdminRequest(cacheAdmin, http.MethodGet, "/admin/cache", ""); rw.Code != http.StatusOK {
+		t.Errorf("Expected status code to be %d but got %d", http.StatusOK, rw.Code)
+	}
+}
+
+func TestCacheAdmin_ListKeys(t *testing.T) {
+	cacheAdmin := getCacheAdmin(t, map[string]interface{}{}, map[string]provider.HttpProvider{
+		"vault": newAdminProvider("db-password", "api-key"),
+		"hmac":  mockProvider{},
+	})
+	rw := sendAdminRequest(cacheAdmin, http.MethodGet, "/admin/cache", "")
+	if expected := `{"vault":["api-key","db-password"]}`; strings.TrimSpace(rw.Body.String()) != expected {
+		t.Errorf("Expected keys %s but got %s", expected, rw.Body.String())
+	}
+	rw = sendAdminRequest(cacheAdmin, http.MethodGet, "/admin/cache/vault", "")
+	if expected := `{"keys":["api-key","db-password"]}`; strings.TrimSpace(rw.Body.String()) != expected {
+		t.Errorf("Expected keys %s but got %s", expected, rw.Body.String())
+	}
+	rw = sendAdminRequest(cacheAdmin, http.MethodGet, "/admin/cache/hmac", "")
+	if rw.Code != http.StatusBadRequest {
+		t.Errorf("Expected status code to be %d but got %d", http.StatusBadRequest, rw.Code)
+	}
+	rw = sendAdminRequest(cacheAdmin, http.MethodGet, "/admin/cache/azure", "")
+	if _, code := getErrorResponse(t, rw); rw.Code != http.StatusNotFound || code != errorCodeProviderNotFound {
+		t.Errorf("Expected %s but got status code %d, %s", errorCodeProviderNotFound, rw.Code, code)
+	}
+}
+
+func TestCacheAdmin_Invalidate(t *testing.T) {
+	p := newAdminProvider("db-password", "api-key", "token")
+	cacheAdmin := getCacheAdmin(t, map[string]interface{}{}, map[string]provider.HttpProvider{"vault": p})
+	rw := sendAdminRequest(cacheAdmin, http.MethodDelete, "/admin/cache/vault?key=api-key", "")
+	if rw.Code != http.StatusNoContent {
+		t.Errorf("Expected status code to be %d but got %d", http.StatusNoContent, rw.Code)
+	}
+	if keys := p.CacheKeys(); !reflect.DeepEqual(keys, []string{"db-password", "token"}) {
+		t.Errorf("Expected 'api-key' to be invalidated but got keys %v", keys)
+	}
+	rw = sendAdminRequest(cacheAdmin, http.MethodDelete, "/admin/cache/vault?key=api-key", "")
+	if _, code := getErrorResponse(t, rw); rw.Code != http.StatusNotFound || code != errorCodeCacheKeyNotFound {
+		t.Errorf("Expected %s but got status code %d, %s", errorCodeCacheKeyNotFound, rw.Code, code)
+	}
+	rw = sendAdminRequest(cacheAdmin, http.MethodDelete, "/admin/cache/vault", "")
+	if rw.Code != http.StatusNoContent || len(p.CacheKeys()) != 0 {
+		t.Errorf("Expected cache to be purged but got status code %d, keys %v", rw.Code, p.CacheKeys())
+	}
+}
+
+func TestCacheAdmin_Warm(t *testing.T) {
+	p := newAdminProvider("api-key")
+	cacheAdmin := getCacheAdmin(t, map[string]interface{}{}, map[string]provider.HttpProvider{"vault": p})
+	rw := sendAdminRequest(cacheAdmin, http.MethodPost, "/admin/cache/vault/warm",
+		`{"secrets": [{"X-Hasura-Secret-Id": "api-key"}, {"X-Hasura-Secret-Id": "db-password"}]}`)
+	if rw.Code != http.StatusOK {
+		t.Errorf("Expected status code to be %d but got %d", http.StatusOK, rw.Code)
+	}
+	if expected := `{"results":[{"cache":"hit"},{"cache":"miss"}]}`; strings.TrimSpace(rw.Body.String()) != expected {
+		t.Errorf("Expected results %s but got %s", expected, rw.Body.String())
+	}
+	if keys := p.CacheKeys(); !reflect.DeepEqual(keys, []string{"api-key", "db-password"}) {
+		t.Errorf("Expected 'db-password' to be cached but got keys %v", keys)
+	}
+
+	rw = sendAdminRequest(cacheAdmin, http.MethodPost, "/admin/cache/vault/warm",
+		`{"secrets": [{"X-Hasura-Secret-Id": "unavailable"}, {}]}`)
+	if rw.Code != http.StatusBadGateway {
+		t.Errorf("Expected status code to be %d but got %d", http.StatusBadGateway, rw.Code)
+	}
+	var response map[string][]cacheWarmResult
+	if err := json.Unmarshal(rw.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Unable to parse response %s: %s", rw.Body.String(), err)
+	}
+	results := response["results"]
+	if len(results) != 2 || results[0].Error.Code != errorCodeProviderUnavailable ||
+		results[1].Error.Code != errorCodeInvalidRequest {
+		t.Errorf("Expected both secrets to fail but got %s", rw.Body.String())
+	}
+
+	rw = sendAdminRequest(cacheAdmin, http.MethodGet, "/admin/cache/vault/warm", "")
+	if rw.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected status code to be %d but got %d", http.StatusMethodNotAllowed, rw.Code)
+	}
+}
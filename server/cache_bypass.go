@@ -0,0 +1,104 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+const (
+	// cacheBypassHeader asks the proxy to refetch the secret. It is not
+	// forwarded upstream.
+	cacheBypassHeader = "X-Hasura-Secret-Refresh"
+
+	defaultCacheBypassMaxPerMinute = 6
+)
+
+// CacheBypass lets requests skip the cache of a provider and refetch the
+// secret from the secret store. Bypasses are limited to maxPerMinute, further
+// requests are served from the cache. A nil CacheBypass allows no bypass.
+type CacheBypass struct {
+	maxPerMinute int
+	now          func() time.Time
+
+	mu sync.Mutex
+	// tokens is the number of bypasses allowed now. It is refilled at
+	// maxPerMinute up to maxPerMinute.
+	tokens    float64
+	updatedAt time.Time
+}
+
+// ParseCacheBypassFromConfig parses the 'cache_bypass' config of a provider.
+// Returns nil if it is not configured.
+//
+//	cache_bypass:
+//	  max_per_minute: 6
+func ParseCacheBypassFromConfig(config map[string]interface{}, logger zerolog.Logger) (*CacheBypass, error) {
+	cacheBypassI, found := config["cache_bypass"]
+	if !found {
+		return nil, nil
+	}
+	cacheBypassConfig, ok := cacheBypassI.(map[string]interface{})
+	if !ok {
+		logger.Error().Msg("'cache_bypass' must be an object")
+		return nil, fmt.Errorf("config not valid: 'cache_bypass' must be an object")
+	}
+	maxPerMinute := defaultCacheBypassMaxPerMinute
+	if maxPerMinuteI, found := cacheBypassConfig["max_per_minute"]; found {
+		maxPerMinute, ok = maxPerMinuteI.(int)
+		if !ok || maxPerMinute <= 0 {
+			logger.Error().Msg("'cache_bypass.max_per_minute' must be a positive number")
+			return nil, fmt.Errorf("config not valid: 'cache_bypass.max_per_minute' must be a positive number")
+		}
+	}
+	logger.Info().Int("max_per_minute", maxPerMinute).Msg("Requests can bypass the cache of the provider")
+	return NewCacheBypass(maxPerMinute), nil
+}
+
+func NewCacheBypass(maxPerMinute int) *CacheBypass {
+	now := time.Now
+	return &CacheBypass{
+		maxPerMinute: maxPerMinute,
+		now:          now,
+		tokens:       float64(maxPerMinute),
+		updatedAt:    now(),
+	}
+}
+
+// allow reports whether a bypass is allowed now and counts it if so
+func (b *CacheBypass) allow() bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.now()
+	refill := now.Sub(b.updatedAt).Minutes() * float64(b.maxPerMinute)
+	b.tokens = min(b.tokens+refill, float64(b.maxPerMinute))
+	b.updatedAt = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// isCacheBypassRequested reports whether the request asks to skip the cache,
+// with 'Cache-Control: no-cache' or 'X-Hasura-Secret-Refresh: true'
+func isCacheBypassRequested(header http.Header) bool {
+	if strings.EqualFold(header.Get(cacheBypassHeader), "true") {
+		return true
+	}
+	for _, value := range header.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(directive), "no-cache") {
+				return true
+			}
+		}
+	}
+	return false
+}
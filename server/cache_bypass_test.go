@@ -0,0 +1,145 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hasura/hasura-secret-refresh/provider"
+	"github.com/rs/zerolog"
+)
+
+// bypassProvider serves 'cachedval' from its cache and 'freshval' when the
+// secret is refetched, unless refetching fails
+type bypassProvider struct {
+	refetches *atomic.Int64
+	failing   bool
+}
+
+func (p bypassProvider) SecretFetcher(header http.Header) (provider.SecretFetcher, error) {
+	return p, nil
+}
+
+func (p bypassProvider) DeleteConfigHeaders(header *http.Header) {}
+
+func (p bypassProvider) FetchSecret() (string, error) {
+	return "cachedval", nil
+}
+
+func (p bypassProvider) CachedSecret() (string, bool) {
+	return "cachedval", true
+}
+
+func (p bypassProvider) FetchSecretWithCacheStatus() (string, bool, error) {
+	return "cachedval", true, nil
+}
+
+func (p bypassProvider) RefetchSecret() (string, error) {
+	p.refetches.Add(1)
+	if p.failing {
+		return "", provider.NewError(provider.ErrorKindUnavailable, errors.New("secret store unavailable"))
+	}
+	return "freshval", nil
+}
+
+// sendBypassRequest returns the secret sent upstream
+func sendBypassRequest(t *testing.T, p bypassProvider, bypass *CacheBypass, headers map[string]string) string {
+	var sentSecret string
+	server := Create(Config{
+		Providers:     map[string]provider.HttpProvider{"bypass_provider": p},
+		CacheBypasses: map[string]*CacheBypass{"bypass_provider": bypass},
+	}, zerolog.Nop())
+	server.reverseProxy = func(rewrite rewriteRequest) httputil.ReverseProxy {
+		return httputil.ReverseProxy{Transport: mockTransport{requestValidation: func(r *http.Request) {
+			sentSecret = r.Header.Get("Authorization")
+			if r.Header.Get(cacheBypassHeader) != "" {
+				t.Errorf("Expected header %s not to be forwarded", cacheBypassHeader)
+			}
+		}}, Rewrite: rewrite}
+	}
+	requestHeaders := map[string]string{
+		forwardToHeader:      "http://somehost",
+		secretProviderHeader: "bypass_provider",
+		templateHeader:       "Authorization: ##secret##",
+	}
+	for k, v := range headers {
+		requestHeaders[k] = v
+	}
+	rw := httptest.NewRecorder()
+	server.ServeHTTP(rw, getMockRequest("http://proxyserver/test", requestHeaders, t))
+	if rw.Code != http.StatusOK {
+		t.Errorf("Expected status code to be %d but got %d", http.StatusOK, rw.Code)
+	}
+	return sentSecret
+}
+
+func TestParseCacheBypassFromConfig(t *testing.T) {
+	bypass, err := ParseCacheBypassFromConfig(map[string]interface{}{}, zerolog.Nop())
+	if err != nil || bypass != nil {
+		t.Errorf("Expected no cache bypass without config but got %v, %v", bypass, err)
+	}
+	bypass, err = ParseCacheBypassFromConfig(map[string]interface{}{
+		"cache_bypass": map[string]interface{}{},
+	}, zerolog.Nop())
+	if err != nil || bypass.maxPerMinute != defaultCacheBypassMaxPerMinute {
+		t.Errorf("Expected default cache bypass but got %v, %v", bypass, err)
+	}
+	invalidConfigs := []interface{}{
+		true,
+		map[string]interface{}{"max_per_minute": 0},
+		map[string]interface{}{"max_per_minute": "6"},
+	}
+	for _, config := range invalidConfigs {
+		if _, err := ParseCacheBypassFromConfig(map[string]interface{}{"cache_bypass": config}, zerolog.Nop()); err == nil {
+			t.Errorf("Expected error for config %v", config)
+		}
+	}
+}
+
+func TestCacheBypass(t *testing.T) {
+	p := bypassProvider{refetches: &atomic.Int64{}}
+	bypass := NewCacheBypass(6)
+	if secret := sendBypassRequest(t, p, bypass, nil); secret != "cachedval" {
+		t.Errorf("Expected cached secret without bypass but got %s", secret)
+	}
+	if secret := sendBypassRequest(t, p, bypass, map[string]string{cacheBypassHeader: "true"}); secret != "freshval" {
+		t.Errorf("Expected refetched secret but got %s", secret)
+	}
+	if secret := sendBypassRequest(t, p, bypass, map[string]string{"Cache-Control": "max-age=0, no-cache"}); secret != "freshval" {
+		t.Errorf("Expected refetched secret but got %s", secret)
+	}
+	if secret := sendBypassRequest(t, p, nil, map[string]string{cacheBypassHeader: "true"}); secret != "cachedval" {
+		t.Errorf("Expected cached secret without cache bypass config but got %s", secret)
+	}
+	p.failing = true
+	if secret := sendBypassRequest(t, p, bypass, map[string]string{cacheBypassHeader: "true"}); secret != "cachedval" {
+		t.Errorf("Expected cached secret when refetching fails but got %s", secret)
+	}
+	if p.refetches.Load() != 3 {
+		t.Errorf("Expected 3 refetches but got %d", p.refetches.Load())
+	}
+}
+
+func TestCacheBypass_RateLimit(t *testing.T) {
+	bypass := NewCacheBypass(2)
+	now := time.Now()
+	bypass.now = func() time.Time { return now }
+	if !bypass.allow() || !bypass.allow() {
+		t.Errorf("Expected 2 bypasses to be allowed")
+	}
+	if bypass.allow() {
+		t.Errorf("Expected third bypass to be rate limited")
+	}
+	now = now.Add(30 * time.Second)
+	if !bypass.allow() || bypass.allow() {
+		t.Errorf("Expected a single bypass to be allowed after 30 seconds")
+	}
+	var nilBypass *CacheBypass
+	if nilBypass.allow() {
+		t.Errorf("Expected nil cache bypass to allow no bypass")
+	}
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/hasura/hasura-secret-refresh/provider"
+	"github.com/rs/zerolog"
+)
+
+// Error codes are sent in the extensions of the error responses of the proxy.
+// They are stable and can be used by clients to handle errors.
+const (
+	errorCodeInvalidRequest        = "invalid-request"
+	errorCodeProviderNotFound      = "provider-not-found"
+	errorCodeDestinationNotAllowed = "destination-not-allowed"
+	errorCodeMethodNotAllowed      = "method-not-allowed"
+	errorCodeSecretNotFound        = "secret-not-found"
+	errorCodeSecretAccessDenied    = "secret-access-denied"
+	errorCodeProviderUnavailable   = "secret-provider-unavailable"
+	errorCodeProviderTimeout       = "secret-provider-timeout"
+	errorCodeUpstreamUnavailable   = "upstream-unavailable"
+	errorCodeUpstreamTimeout       = "upstream-timeout"
+	errorCodeInternalError         = "internal-error"
+	errorCodeUnauthorized          = "unauthorized"
+	errorCodeCacheKeyNotFound      = "cache-key-not-found"
+	errorCodeRequestTooLarge       = "request-too-large"
+)
+
+type errorDetailsKey struct{}
+
+// ParseErrorDetailsFromConfig parses the 'error_details' config. If enabled,
+// error responses include the cause of the error, eg. the response of the
+// secret store. The cause may contain internal details, so it is meant for
+// debugging only.
+func ParseErrorDetailsFromConfig(config map[string]interface{}, logger zerolog.Logger) (bool, error) {
+	errorDetailsI, found := config["error_details"]
+	if !found {
+		return false, nil
+	}
+	errorDetails, ok := errorDetailsI.(bool)
+	if !ok {
+		logger.Error().Msg("'error_details' must be a boolean")
+		return false, fmt.Errorf("config not valid: 'error_details' must be a boolean")
+	}
+	if errorDetails {
+		logger.Warn().Msg("Error responses include error details. This should only be enabled for debugging")
+	}
+	return errorDetails, nil
+}
+
+func withErrorDetails(r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), errorDetailsKey{}, true))
+}
+
+// writeError responds with a Hasura error. The cause is appended to the
+// message if error details are enabled.
+func writeError(rw http.ResponseWriter, r *http.Request, statusCode int, code string, errMsg string, cause error) {
+	if details, _ := r.Context().Value(errorDetailsKey{}).(bool); details && cause != nil {
+		errMsg = fmt.Sprintf("%s: %s", errMsg, cause.Error())
+	}
+	http.Error(rw, makeHasuraError(errMsg, code), statusCode)
+}
+
+// getProviderErrorResponse maps the error of a provider to a status code and
+// an error code. Errors that the provider did not classify are treated as
+// failures of the secret store.
+func getProviderErrorResponse(err error) (statusCode int, code string) {
+	switch provider.GetErrorKind(err) {
+	case provider.ErrorKindBadRequest:
+		return http.StatusBadRequest, errorCodeInvalidRequest
+	case provider.ErrorKindNotFound:
+		return http.StatusBadRequest, errorCodeSecretNotFound
+	case provider.ErrorKindUnauthorized:
+		return http.StatusForbidden, errorCodeSecretAccessDenied
+	case provider.ErrorKindTimeout:
+		return http.StatusGatewayTimeout, errorCodeProviderTimeout
+	}
+	return http.StatusBadGateway, errorCodeProviderUnavailable
+}
+
+func isTimeout(err error) bool {
+	var netError net.Error
+	return errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netError) && netError.Timeout())
+}
+
+// getProxyErrorHandler handles errors of sending the request upstream,
+// including errors of signing providers
+func getProxyErrorHandler(requestLogger zerolog.Logger) func(http.ResponseWriter, *http.Request, error) {
+	return func(rw http.ResponseWriter, r *http.Request, err error) {
+		var signErr signingError
+		if errors.As(err, &signErr) {
+			// logged by the signing transport
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(signErr.err, &maxBytesErr) {
+				errMsg := fmt.Sprintf("Request body is larger than %d bytes and cannot be signed", maxBytesErr.Limit)
+				writeError(rw, r, http.StatusRequestEntityTooLarge, errorCodeRequestTooLarge, errMsg, nil)
+				return
+			}
+			statusCode, code := getProviderErrorResponse(signErr.err)
+			writeError(rw, r, statusCode, code, "Unable to sign request", signErr.err)
+			return
+		}
+		if isTimeout(err) {
+			errMsg := "Timed out sending request to backend service"
+			requestLogger.Error().Err(err).Msg(errMsg)
+			writeError(rw, r, http.StatusGatewayTimeout, errorCodeUpstreamTimeout, errMsg, err)
+			return
+		}
+		if errors.Is(err, context.Canceled) {
+			// the client went away, there is no one to respond to
+			requestLogger.Debug().Err(err).Msg("Request canceled by client")
+			rw.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		errMsg := "Unable to send request to backend service"
+		requestLogger.Error().Err(err).Msg(errMsg)
+		writeError(rw, r, http.StatusBadGateway, errorCodeUpstreamUnavailable, errMsg, err)
+	}
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"strings"
+	"testing"
+
+	"github.com/hasura/hasura-secret-refresh/provider"
+	"github.com/rs/zerolog"
+)
+
+// failingProvider fails to fetch the secret with an error of the kind sent
+// in X-Hasura-Secret-Id
+type failingProvider struct{}
+
+type failingFetcher struct {
+	kind provider.ErrorKind
+}
+
+func (f failingFetcher) FetchSecret() (string, error) {
+	return "", provider.NewError(f.kind, errors.New("vault returned status 503"))
+}
+
+func (p failingProvider) SecretFetcher(header http.Header) (provider.SecretFetcher, error) {
+	return failingFetcher{kind: provider.ErrorKind(header.Get("X-Hasura-Secret-Id"))}, nil
+}
+
+func (p failingProvider) DeleteConfigHeaders(header *http.Header) {}
+
+func getErrorResponse(t *testing.T, rw *httptest.ResponseRecorder) (message string, code string) {
+	response := struct {
+		Message    string            `json:"message"`
+		Extensions map[string]string `json:"extensions"`
+	}{}
+	if err := json.Unmarshal(rw.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Unable to parse error response %s: %s", rw.Body.String(), err)
+	}
+	return response.Message, response.Extensions["code"]
+}
+
+func TestEndpoint_ProviderErrors(t *testing.T) {
+	tests := []struct {
+		kind       provider.ErrorKind
+		statusCode int
+		code       string
+	}{
+		{provider.ErrorKindBadRequest, http.StatusBadRequest, errorCodeInvalidRequest},
+		{provider.ErrorKindNotFound, http.StatusBadRequest, errorCodeSecretNotFound},
+		{provider.ErrorKindUnauthorized, http.StatusForbidden, errorCodeSecretAccessDenied},
+		{provider.ErrorKindUnavailable, http.StatusBadGateway, errorCodeProviderUnavailable},
+		{provider.ErrorKindTimeout, http.StatusGatewayTimeout, errorCodeProviderTimeout},
+		{"", http.StatusBadGateway, errorCodeProviderUnavailable},
+	}
+	for _, test := range tests {
+		for _, errorDetails := range []bool{false, true} {
+			server := Create(Config{
+				Providers:    map[string]provider.HttpProvider{"failing_provider": failingProvider{}},
+				ErrorDetails: errorDetails,
+			}, zerolog.Nop())
+			mockRequest := getMockRequest("http://proxyserver/test", map[string]string{
+				forwardToHeader:      "http://somehost",
+				secretProviderHeader: "failing_provider",
+				templateHeader:       "Authorization: Bearer ##secret##",
+				"X-Hasura-Secret-Id": string(test.kind),
+			}, t)
+			rw := httptest.NewRecorder()
+			server.ServeHTTP(rw, mockRequest)
+			if rw.Code != test.statusCode {
+				t.Errorf("%s: Expected status code to be %d but got %d", test.kind, test.statusCode, rw.Code)
+			}
+			message, code := getErrorResponse(t, rw)
+			if code != test.code {
+				t.Errorf("%s: Expected error code %s but got %s", test.kind, test.code, code)
+			}
+			if strings.Contains(message, "vault returned status 503") != errorDetails {
+				t.Errorf("%s: Unexpected message %q with error details %t", test.kind, message, errorDetails)
+			}
+		}
+	}
+}
+
+func TestEndpoint_SignerProviderError(t *testing.T) {
+	signErr := provider.NewError(provider.ErrorKindUnauthorized, errors.New("access denied"))
+	server := getSigningServer(mockSigner{err: signErr}, func(req *http.Request) {
+		t.Errorf("Expected request to not be sent upstream")
+	})
+	mockRequest := getMockRequest("http://proxyserver/test", map[string]string{
+		forwardToHeader:      "http://somehost",
+		secretProviderHeader: "mock_signer",
+	}, t)
+	rw := httptest.NewRecorder()
+	server.ServeHTTP(rw, mockRequest)
+	if rw.Code != http.StatusForbidden {
+		t.Errorf("Expected status code to be %d but got %d", http.StatusForbidden, rw.Code)
+	}
+	if _, code := getErrorResponse(t, rw); code != errorCodeSecretAccessDenied {
+		t.Errorf("Expected error code %s but got %s", errorCodeSecretAccessDenied, code)
+	}
+}
+
+type failingTransport struct {
+	err error
+}
+
+func (t failingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return nil, t.err
+}
+
+func TestEndpoint_UpstreamError(t *testing.T) {
+	server := Create(Config{Providers: map[string]provider.HttpProvider{"mock_provider": mockProvider{}}}, zerolog.Nop())
+	server.reverseProxy = func(rewrite rewriteRequest) httputil.ReverseProxy {
+		return httputil.ReverseProxy{
+			Transport: failingTransport{err: errors.New("connection refused")},
+			Rewrite:   rewrite,
+		}
+	}
+	mockRequest := getMockRequest("http://proxyserver/test", map[string]string{
+		forwardToHeader:      "http://somehost",
+		secretProviderHeader: "mock_provider",
+		templateHeader:       "Authorization: Bearer ##secret##",
+		"X-Hasura-Secret-Id": "api-key",
+	}, t)
+	rw := httptest.NewRecorder()
+	server.ServeHTTP(rw, mockRequest)
+	if rw.Code != http.StatusBadGateway {
+		t.Errorf("Expected status code to be %d but got %d", http.StatusBadGateway, rw.Code)
+	}
+	if _, code := getErrorResponse(t, rw); code != errorCodeUpstreamUnavailable {
+		t.Errorf("Expected error code %s but got %s", errorCodeUpstreamUnavailable, code)
+	}
+}
@@ -0,0 +1,431 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hasura/hasura-secret-refresh/provider"
+	"github.com/rs/zerolog"
+)
+
+const (
+	tunnelDialTimeout        = 10 * time.Second
+	defaultTunnelIdleTimeout = 5 * time.Minute
+	defaultTunnelTimeout     = time.Hour
+	tunnelCopyBufferSize     = 32 * 1024
+)
+
+// ForwardProxy lets clients use the server as a standard HTTP forward proxy,
+// eg. by setting HTTP_PROXY. The secret provider and templates of a request
+// are selected by the host of its destination instead of X-Hasura-* headers.
+type ForwardProxy struct {
+	rules []forwardProxyRule
+	// connect enables tunneling with CONNECT. Tunneled connections are end to
+	// end encrypted, so no secrets are injected into them.
+	connect bool
+	// forwardUnmatched forwards requests that match no rule without injecting
+	// a secret
+	forwardUnmatched bool
+	// tunnelIdleTimeout closes tunnels without traffic in either direction
+	tunnelIdleTimeout time.Duration
+	// tunnelTimeout closes tunnels that are open for longer
+	tunnelTimeout time.Duration
+}
+
+type forwardProxyRule struct {
+	name string
+	host allowlistEntry
+	// scheme replaces the scheme of the request if set, eg. to send plain HTTP
+	// requests of clients upstream with HTTPS
+	scheme         string
+	secretProvider string
+	injections     []secretInjection
+	providerParams http.Header
+	transport      *http.Transport
+}
+
+// ParseForwardProxyFromConfig parses the 'forward_proxy' config. Returns nil
+// if it is not configured. Every rule must reference a provider that exists
+// in providers or signers.
+//
+//	forward_proxy:
+//	  connect: true
+//	  forward_unmatched: true
+//	  tunnel_idle_timeout: 300
+//	  tunnel_timeout: 3600
+//	  rules:
+//	    - host: api.payments.example.com
+//	      scheme: https
+//	      provider: aws_sm_prod
+//	      provider_params:
+//	        X-Hasura-Secret-Id: prod/payments/api-key
+//	      header: "Authorization: Bearer ##secret.token##"
+func ParseForwardProxyFromConfig(
+	config map[string]interface{}, providers map[string]provider.HttpProvider,
+	signers map[string]provider.RequestSigner, logger zerolog.Logger,
+) (*ForwardProxy, error) {
+	forwardProxyI, found := config["forward_proxy"]
+	if !found {
+		return nil, nil
+	}
+	forwardProxyConfig, ok := forwardProxyI.(map[string]interface{})
+	if !ok {
+		logger.Error().Msg("'forward_proxy' must be an object")
+		return nil, fmt.Errorf("config not valid: 'forward_proxy' must be an object")
+	}
+	forwardProxy := &ForwardProxy{tunnelIdleTimeout: defaultTunnelIdleTimeout, tunnelTimeout: defaultTunnelTimeout}
+	options := map[string]*bool{
+		"connect":           &forwardProxy.connect,
+		"forward_unmatched": &forwardProxy.forwardUnmatched,
+	}
+	for key, option := range options {
+		valueI, found := forwardProxyConfig[key]
+		if !found {
+			continue
+		}
+		value, ok := valueI.(bool)
+		if !ok {
+			logger.Error().Msgf("'forward_proxy.%s' must be a boolean", key)
+			return nil, fmt.Errorf("config not valid: 'forward_proxy.%s' must be a boolean", key)
+		}
+		*option = value
+	}
+	timeouts := map[string]*time.Duration{
+		"tunnel_idle_timeout": &forwardProxy.tunnelIdleTimeout,
+		"tunnel_timeout":      &forwardProxy.tunnelTimeout,
+	}
+	for key, timeout := range timeouts {
+		valueI, found := forwardProxyConfig[key]
+		if !found {
+			continue
+		}
+		value, ok := valueI.(int)
+		if !ok || value <= 0 {
+			logger.Error().Msgf("'forward_proxy.%s' must be a positive number of seconds", key)
+			return nil, fmt.Errorf("config not valid: 'forward_proxy.%s' must be a positive number of seconds", key)
+		}
+		*timeout = time.Duration(value) * time.Second
+	}
+
+	rules := make([]interface{}, 0)
+	if rulesI, found := forwardProxyConfig["rules"]; found {
+		rules, ok = rulesI.([]interface{})
+		if !ok {
+			logger.Error().Msg("'forward_proxy.rules' must be a list")
+			return nil, fmt.Errorf("config not valid: 'forward_proxy.rules' must be a list")
+		}
+	}
+	for i, ruleI := range rules {
+		ruleConfig, ok := ruleI.(map[string]interface{})
+		if !ok {
+			logger.Error().Msgf("Rule %d of 'forward_proxy.rules' must be an object", i)
+			return nil, fmt.Errorf("config not valid: rule %d of 'forward_proxy.rules' must be an object", i)
+		}
+		rule, err := parseForwardProxyRule(i, ruleConfig, providers, signers, logger)
+		if err != nil {
+			return nil, err
+		}
+		logger.Info().
+			Str("rule", rule.name).
+			Str("scheme", rule.scheme).
+			Str("provider", rule.secretProvider).
+			Msg("Forward proxy rule configured")
+		forwardProxy.rules = append(forwardProxy.rules, rule)
+	}
+	logger.Info().
+		Bool("connect", forwardProxy.connect).
+		Bool("forward_unmatched", forwardProxy.forwardUnmatched).
+		Dur("tunnel_idle_timeout", forwardProxy.tunnelIdleTimeout).
+		Dur("tunnel_timeout", forwardProxy.tunnelTimeout).
+		Int("rules", len(forwardProxy.rules)).
+		Msg("Forward proxy enabled")
+	return forwardProxy, nil
+}
+
+func parseForwardProxyRule(
+	index int, config map[string]interface{}, providers map[string]provider.HttpProvider,
+	signers map[string]provider.RequestSigner, logger zerolog.Logger,
+) (rule forwardProxyRule, err error) {
+	owner := fmt.Sprintf("forward proxy rule %d", index)
+	hostI, found := config["host"]
+	if !found {
+		logger.Error().Msgf("Config 'host' not found for %s", owner)
+		return rule, fmt.Errorf("required configs not found: 'host' of %s", owner)
+	}
+	host, ok := hostI.(string)
+	if !ok {
+		logger.Error().Msgf("'host' of %s must be a string", owner)
+		return rule, fmt.Errorf("config not valid: 'host' of %s must be a string", owner)
+	}
+	if rule.host, err = parseAllowlistEntry(host); err != nil {
+		logger.Err(err).Msgf("'host' of %s is not valid", owner)
+		return rule, fmt.Errorf("config not valid: 'host' of %s: %w", owner, err)
+	}
+	rule.name = host
+	owner = fmt.Sprintf("forward proxy rule %s", host)
+
+	if schemeI, found := config["scheme"]; found {
+		scheme, ok := schemeI.(string)
+		if !ok || (scheme != "http" && scheme != "https") {
+			logger.Error().Msgf("'scheme' of %s must be one of 'http' or 'https'", owner)
+			return rule, fmt.Errorf("config not valid: 'scheme' of %s must be one of 'http' or 'https'", owner)
+		}
+		rule.scheme = scheme
+	}
+
+	providerI, found := config["provider"]
+	if !found {
+		logger.Error().Msgf("Config 'provider' not found for %s", owner)
+		return rule, fmt.Errorf("required configs not found: 'provider' of %s", owner)
+	}
+	rule.secretProvider, ok = providerI.(string)
+	if !ok {
+		logger.Error().Msgf("'provider' of %s must be a string", owner)
+		return rule, fmt.Errorf("config not valid: 'provider' of %s must be a string", owner)
+	}
+	_, isProvider := providers[rule.secretProvider]
+	_, isSigner := signers[rule.secretProvider]
+	if !isProvider && !isSigner {
+		logger.Error().Msgf("Provider %s of %s does not exist", rule.secretProvider, owner)
+		return rule, fmt.Errorf("config not valid: Provider %s of %s does not exist", rule.secretProvider, owner)
+	}
+	if isSigner {
+		if err = checkNoInjections(config, owner, rule.secretProvider, logger); err != nil {
+			return
+		}
+	} else if rule.injections, err = parseInjectionsFromConfig(config, owner, logger); err != nil {
+		return
+	}
+	if rule.providerParams, err = parseProviderParams(config, owner, logger); err != nil {
+		return
+	}
+	rule.transport, err = ParseTransportFromConfig(config, providers, logger.With().Str("forward_proxy_rule", rule.name).Logger())
+	if err != nil {
+		return
+	}
+	return rule, nil
+}
+
+// isForwardProxyRequest reports whether the request was sent to the server as
+// a forward proxy, ie. with an absolute URL as the request target
+func isForwardProxyRequest(r *http.Request) bool {
+	return r.URL.IsAbs() && r.URL.Host != ""
+}
+
+// matches reports whether the destination host, and port if the rule has
+// one, matches the rule
+func (rule forwardProxyRule) matches(destination *url.URL) bool {
+	host := strings.ToLower(strings.TrimSuffix(destination.Hostname(), "."))
+	if !rule.host.matchesPort(destinationPort(destination)) {
+		return false
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return rule.host.matchesIP(ip)
+	}
+	return rule.host.matchesHost(host)
+}
+
+// matchRule returns the first rule, in config order, that matches the
+// destination
+func (forwardProxy *ForwardProxy) matchRule(destination *url.URL) (forwardProxyRule, bool) {
+	for _, rule := range forwardProxy.rules {
+		if rule.matches(destination) {
+			return rule, true
+		}
+	}
+	return forwardProxyRule{}, false
+}
+
+// getRequestConfig selects the configuration of a forward proxy request by
+// its destination. The secret provider is empty if no rule matched and
+// unmatched requests are forwarded.
+func (forwardProxy *ForwardProxy) getRequestConfig(
+	rw http.ResponseWriter, r *http.Request, requestLogger zerolog.Logger,
+) (requestConfig requestConf, ok bool) {
+	destination := &url.URL{Scheme: r.URL.Scheme, Host: r.URL.Host}
+	rule, found := forwardProxy.matchRule(destination)
+	if !found {
+		if !forwardProxy.forwardUnmatched {
+			errMsg := fmt.Sprintf("No forward proxy rule configured for %s", r.URL.Host)
+			requestLogger.Error().Msg(errMsg)
+			writeError(rw, r, http.StatusForbidden, errorCodeDestinationNotAllowed, errMsg, nil)
+			return requestConfig, false
+		}
+		requestLogger.Debug().Msgf("Forwarding request to %s without a secret as no forward proxy rule matched", r.URL.Host)
+		return requestConf{destinationUrl: destination.String(), providerHeaders: make(http.Header)}, true
+	}
+	requestLogger.Debug().Msgf("Request matched forward proxy rule %s", rule.name)
+	if rule.scheme != "" {
+		destination.Scheme = rule.scheme
+	}
+	return requestConf{
+		destinationUrl:  destination.String(),
+		secretProvider:  rule.secretProvider,
+		injections:      rule.injections,
+		forwardMode:     forwardModeHost,
+		providerHeaders: rule.providerParams,
+		transport:       rule.transport,
+	}, true
+}
+
+// tunnel handles a CONNECT request by relaying the connection to the target.
+// Only the destination allowlist applies as secrets cannot be injected into
+// tunneled connections.
+func (forwardProxy *ForwardProxy) tunnel(
+	rw http.ResponseWriter, r *http.Request, allowlist *DestinationAllowlist, requestLogger zerolog.Logger,
+) {
+	if !forwardProxy.connect {
+		errMsg := "CONNECT is not enabled for the forward proxy"
+		requestLogger.Error().Msg(errMsg)
+		writeError(rw, r, http.StatusMethodNotAllowed, errorCodeMethodNotAllowed, errMsg, nil)
+		return
+	}
+	target := r.Host
+	if _, port, err := net.SplitHostPort(target); err != nil || port == "" {
+		errMsg := fmt.Sprintf("CONNECT target %s must be a host and a port", target)
+		requestLogger.Error().Msg(errMsg)
+		writeError(rw, r, http.StatusBadRequest, errorCodeInvalidRequest, errMsg, nil)
+		return
+	}
+	destination := &url.URL{Scheme: "https", Host: target}
+	if err := allowlist.Check(r.Context(), destination); err != nil {
+		errMsg := fmt.Sprintf("Tunneling to %s is not allowed", target)
+		requestLogger.Error().Err(err).Msg(errMsg)
+		writeError(rw, r, http.StatusForbidden, errorCodeDestinationNotAllowed, errMsg, err)
+		return
+	}
+	if rule, found := forwardProxy.matchRule(destination); found {
+		requestLogger.Warn().Msgf("Tunneling to %s without injecting a secret. Forward proxy rule %s only applies to plain HTTP requests", target, rule.name)
+	}
+	hijacker, ok := rw.(http.Hijacker)
+	if !ok {
+		errMsg := "CONNECT is not supported by the connection"
+		requestLogger.Error().Msg(errMsg)
+		writeError(rw, r, http.StatusInternalServerError, errorCodeInternalError, errMsg, nil)
+		return
+	}
+	dialer := net.Dialer{Timeout: tunnelDialTimeout}
+	guard := privateNetworkGuard{allowlists: []*DestinationAllowlist{allowlist}, dial: dialer.DialContext}
+	upstream, err := guard.DialContext(r.Context(), "tcp", target)
+	if err != nil {
+		errMsg := fmt.Sprintf("Unable to connect to %s", target)
+		requestLogger.Error().Err(err).Msg(errMsg)
+		if isTimeout(err) {
+			writeError(rw, r, http.StatusGatewayTimeout, errorCodeUpstreamTimeout, errMsg, err)
+			return
+		}
+		writeError(rw, r, http.StatusBadGateway, errorCodeUpstreamUnavailable, errMsg, err)
+		return
+	}
+	client, buffered, err := hijacker.Hijack()
+	if err != nil {
+		upstream.Close()
+		requestLogger.Error().Err(err).Msg("Unable to take over the connection for CONNECT")
+		return
+	}
+	_, err = client.Write([]byte("HTTP/1.1 " + strconv.Itoa(http.StatusOK) + " Connection Established\r\n\r\n"))
+	if err != nil {
+		client.Close()
+		upstream.Close()
+		return
+	}
+	requestLogger.Debug().Msgf("Tunnel to %s established", target)
+
+	t := &tunnelTimeouts{idleTimeout: forwardProxy.tunnelIdleTimeout, end: time.Now().Add(forwardProxy.tunnelTimeout)}
+	t.touch()
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		// data the client sent after the CONNECT request may already be
+		// buffered
+		t.copy(upstream, client, buffered)
+	}()
+	go func() {
+		defer wg.Done()
+		t.copy(client, upstream, upstream)
+	}()
+	wg.Wait()
+	client.Close()
+	upstream.Close()
+	if t.timedOut.Load() {
+		requestLogger.Debug().Msgf("Tunnel to %s timed out", target)
+		return
+	}
+	requestLogger.Debug().Msgf("Tunnel to %s closed", target)
+}
+
+// tunnelTimeouts closes a tunnel without traffic in either direction for
+// idleTimeout, or when it reaches end
+type tunnelTimeouts struct {
+	idleTimeout time.Duration
+	end         time.Time
+	// lastActivity is the time of the last read in either direction, in
+	// nanoseconds since the epoch
+	lastActivity atomic.Int64
+	timedOut     atomic.Bool
+}
+
+func (t *tunnelTimeouts) touch() {
+	t.lastActivity.Store(time.Now().UnixNano())
+}
+
+// deadline is the time until which a read waits for data
+func (t *tunnelTimeouts) deadline() time.Time {
+	deadline := time.Unix(0, t.lastActivity.Load()).Add(t.idleTimeout)
+	if deadline.After(t.end) {
+		return t.end
+	}
+	return deadline
+}
+
+// copy relays src, which reads from srcConn, to dst until src ends or the
+// tunnel times out. A timeout closes both connections to end the other
+// direction too.
+func (t *tunnelTimeouts) copy(dst net.Conn, srcConn net.Conn, src io.Reader) {
+	dst.SetWriteDeadline(t.end)
+	buf := make([]byte, tunnelCopyBufferSize)
+	for {
+		srcConn.SetReadDeadline(t.deadline())
+		n, err := src.Read(buf)
+		if n > 0 {
+			t.touch()
+			if _, writeErr := dst.Write(buf[:n]); writeErr != nil {
+				break
+			}
+		}
+		if err == nil {
+			continue
+		}
+		if !isTimeout(err) {
+			closeWrite(dst)
+			return
+		}
+		// the other direction may have been active while waiting
+		if time.Now().Before(t.deadline()) {
+			continue
+		}
+		t.timedOut.Store(true)
+		break
+	}
+	dst.Close()
+	srcConn.Close()
+}
+
+// closeWrite signals the end of the stream to the peer while allowing the
+// other direction to finish
+func closeWrite(conn net.Conn) {
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		tcpConn.CloseWrite()
+		return
+	}
+	conn.Close()
+}
@@ -0,0 +1,300 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/hasura/hasura-secret-refresh/provider"
+	"github.com/rs/zerolog"
+)
+
+// startForwardProxy starts the server with the forward proxy config, behind
+// the handlers of the server like in main, and returns a client that sends
+// its requests through it
+func startForwardProxy(t *testing.T, forwardProxyConfig map[string]interface{}, transport *http.Transport) *http.Client {
+	providers := map[string]provider.HttpProvider{"mock_provider": mockProvider{}}
+	forwardProxy, err := ParseForwardProxyFromConfig(
+		map[string]interface{}{"forward_proxy": forwardProxyConfig}, providers, nil, zerolog.Nop(),
+	)
+	if err != nil {
+		t.Fatalf("Unable to parse forward proxy config: %s", err)
+	}
+	// the access log wraps the response writer, which must support CONNECT
+	accessLog := &AccessLog{format: accessLogFormatCommon, writer: io.Discard}
+	server := Create(Config{
+		Providers: providers, ForwardProxy: forwardProxy, AccessLog: accessLog,
+	}, zerolog.Nop())
+	mux := http.NewServeMux()
+	mux.Handle("/", server)
+	mux.HandleFunc("/healthz", func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte("proxy healthz"))
+	})
+	proxyServer := httptest.NewServer(server.Handler(mux))
+	t.Cleanup(proxyServer.Close)
+	proxyUrl, _ := url.Parse(proxyServer.URL)
+	if transport == nil {
+		transport = &http.Transport{}
+	}
+	transport.Proxy = http.ProxyURL(proxyUrl)
+	t.Cleanup(transport.CloseIdleConnections)
+	return &http.Client{Transport: transport}
+}
+
+func getMockForwardProxyRule(host string) map[string]interface{} {
+	return map[string]interface{}{
+		"host":            host,
+		"provider":        "mock_provider",
+		"provider_params": map[string]interface{}{"X-Hasura-Secret-Id": "api-key"},
+		"header":          "Authorization: Bearer ##secret##",
+	}
+}
+
+func TestForwardProxy_InjectsSecret(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer topsecretval" {
+			t.Errorf("Expected secret to be injected but got %s", r.Header.Get("Authorization"))
+		}
+		if r.URL.String() != "/orders?id=1" {
+			t.Errorf("Expected path and query to be preserved but got %s", r.URL.String())
+		}
+		if r.Header.Get("X-Hasura-Secret-Id") != "" {
+			t.Errorf("Expected no configuration headers to be sent")
+		}
+		rw.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+	client := startForwardProxy(t, map[string]interface{}{
+		"rules": []interface{}{getMockForwardProxyRule("127.0.0.1")},
+	}, nil)
+	res, err := client.Get(backend.URL + "/orders?id=1")
+	if err != nil {
+		t.Fatalf("Unable to send request: %s", err)
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+	if res.StatusCode != http.StatusOK || string(body) != "ok" {
+		t.Errorf("Unexpected response %d %s", res.StatusCode, string(body))
+	}
+}
+
+func TestForwardProxy_Unmatched(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "" {
+			t.Errorf("Expected no secret to be injected for an unmatched host")
+		}
+	}))
+	defer backend.Close()
+	rules := []interface{}{getMockForwardProxyRule("api.example.com")}
+
+	client := startForwardProxy(t, map[string]interface{}{"rules": rules, "forward_unmatched": true}, nil)
+	res, err := client.Get(backend.URL)
+	if err != nil {
+		t.Fatalf("Unable to send request: %s", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("Expected status code to be %d but got %d", http.StatusOK, res.StatusCode)
+	}
+
+	// unmatched requests are rejected by default
+	client = startForwardProxy(t, map[string]interface{}{"rules": rules}, nil)
+	res, err = client.Get(backend.URL)
+	if err != nil {
+		t.Fatalf("Unable to send request: %s", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected status code to be %d but got %d", http.StatusForbidden, res.StatusCode)
+	}
+}
+
+func TestForwardProxy_Connect(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "" {
+			t.Errorf("Expected no secret to be injected into a tunnel")
+		}
+		rw.Write([]byte("tunneled"))
+	}))
+	defer backend.Close()
+	transport := backend.Client().Transport.(*http.Transport).Clone()
+	client := startForwardProxy(t, map[string]interface{}{
+		"connect": true,
+		"rules":   []interface{}{getMockForwardProxyRule("127.0.0.1")},
+	}, transport)
+	res, err := client.Get(backend.URL)
+	if err != nil {
+		t.Fatalf("Unable to send request: %s", err)
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+	if string(body) != "tunneled" {
+		t.Errorf("Unexpected response %s", string(body))
+	}
+
+	transport = backend.Client().Transport.(*http.Transport).Clone()
+	// CONNECT is disabled by default
+	client = startForwardProxy(t, map[string]interface{}{}, transport)
+	_, err = client.Get(backend.URL)
+	if err == nil {
+		t.Errorf("Expected an error when CONNECT is not enabled")
+	}
+}
+
+func TestForwardProxy_ConnectTimeouts(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	defer backend.Close()
+	// the backend echoes what it receives
+	go func() {
+		for {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	tests := []struct {
+		name   string
+		config map[string]interface{}
+		// active sends data through the tunnel until it is closed
+		active bool
+	}{
+		{"idle", map[string]interface{}{"connect": true, "tunnel_idle_timeout": 1}, false},
+		{"total", map[string]interface{}{"connect": true, "tunnel_timeout": 1}, true},
+	}
+	for _, test := range tests {
+		client := startForwardProxy(t, test.config, nil)
+		proxyUrl, _ := client.Transport.(*http.Transport).Proxy(nil)
+		conn, err := net.Dial("tcp", proxyUrl.Host)
+		if err != nil {
+			t.Fatalf("%s: Unable to connect to proxy: %s", test.name, err)
+		}
+		fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", backend.Addr(), backend.Addr())
+		reader := bufio.NewReader(conn)
+		res, err := http.ReadResponse(reader, nil)
+		if err != nil || res.StatusCode != http.StatusOK {
+			t.Fatalf("%s: Unexpected CONNECT response %v, %v", test.name, res, err)
+		}
+		started := time.Now()
+		closed := make(chan struct{})
+		go func() {
+			io.Copy(io.Discard, reader)
+			close(closed)
+		}()
+		ticker := time.NewTicker(50 * time.Millisecond)
+		timeout := time.After(5 * time.Second)
+	wait:
+		for {
+			select {
+			case <-closed:
+				break wait
+			case <-ticker.C:
+				if test.active {
+					conn.Write([]byte("ping"))
+				}
+			case <-timeout:
+				t.Fatalf("%s: Expected the tunnel to be closed", test.name)
+			}
+		}
+		ticker.Stop()
+		conn.Close()
+		if elapsed := time.Since(started); elapsed < 900*time.Millisecond {
+			t.Errorf("%s: Tunnel closed after %s, before its timeout", test.name, elapsed)
+		}
+	}
+}
+
+func TestForwardProxy_AbsoluteUrlNotRoutedByPath(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte("backend " + r.URL.Path))
+	}))
+	defer backend.Close()
+	client := startForwardProxy(t, map[string]interface{}{"forward_unmatched": true}, nil)
+	res, err := client.Get(backend.URL + "/healthz")
+	if err != nil {
+		t.Fatalf("Unable to send request: %s", err)
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+	if string(body) != "backend /healthz" {
+		t.Errorf("Expected the request to be forwarded to the backend but got %s", string(body))
+	}
+}
+
+func TestForwardProxy_ConnectNotConfigured(t *testing.T) {
+	server := Create(Config{}, zerolog.Nop())
+	req := httptest.NewRequest(http.MethodConnect, "http://proxyserver", nil)
+	req.Host = "api.example.com:443"
+	rw := httptest.NewRecorder()
+	server.ServeHTTP(rw, req)
+	if rw.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected status code to be %d but got %d", http.StatusMethodNotAllowed, rw.Code)
+	}
+}
+
+func TestForwardProxyRule_Matches(t *testing.T) {
+	tests := []struct {
+		host        string
+		destination string
+		matches     bool
+	}{
+		{"api.example.com", "http://api.example.com", true},
+		{"api.example.com", "http://API.example.com:8080", true},
+		{"api.example.com", "http://other.example.com", false},
+		{"*.example.com", "http://api.example.com", true},
+		{"*.example.com", "http://example.com", false},
+		{"api.example.com:8080", "http://api.example.com", false},
+		{"10.0.0.0/8", "http://10.1.2.3", true},
+	}
+	for _, test := range tests {
+		entry, err := parseAllowlistEntry(test.host)
+		if err != nil {
+			t.Fatalf("Unable to parse host %s: %s", test.host, err)
+		}
+		destination, _ := url.Parse(test.destination)
+		if (forwardProxyRule{host: entry}).matches(destination) != test.matches {
+			t.Errorf("Expected rule %s matching %s to be %t", test.host, test.destination, test.matches)
+		}
+	}
+}
+
+func TestParseForwardProxyFromConfig_Invalid(t *testing.T) {
+	providers := map[string]provider.HttpProvider{"mock_provider": mockProvider{}}
+	signers := map[string]provider.RequestSigner{"mock_signer": mockSigner{}}
+	signerRule := getMockForwardProxyRule("api.example.com")
+	signerRule["provider"] = "mock_signer"
+	invalidConfigs := map[string]interface{}{
+		"not an object":      "enabled",
+		"connect not bool":   map[string]interface{}{"connect": "yes"},
+		"negative timeout":   map[string]interface{}{"tunnel_idle_timeout": -1},
+		"timeout not number": map[string]interface{}{"tunnel_timeout": "1h"},
+		"rules not a list":   map[string]interface{}{"rules": "api.example.com"},
+		"missing host":       map[string]interface{}{"rules": []interface{}{map[string]interface{}{"provider": "mock_provider"}}},
+		"unknown provider":   map[string]interface{}{"rules": []interface{}{map[string]interface{}{"host": "api.example.com", "provider": "unknown"}}},
+		"missing template":   map[string]interface{}{"rules": []interface{}{map[string]interface{}{"host": "api.example.com", "provider": "mock_provider"}}},
+		"template on signer": map[string]interface{}{"rules": []interface{}{signerRule}},
+	}
+	for name, config := range invalidConfigs {
+		_, err := ParseForwardProxyFromConfig(map[string]interface{}{"forward_proxy": config}, providers, signers, zerolog.Nop())
+		if err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+	forwardProxy, err := ParseForwardProxyFromConfig(map[string]interface{}{}, providers, signers, zerolog.Nop())
+	if err != nil || forwardProxy != nil {
+		t.Errorf("Expected no forward proxy if it is not configured")
+	}
+}
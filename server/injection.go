@@ -0,0 +1,258 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/hasura/hasura-secret-refresh/template"
+	"github.com/rs/zerolog"
+)
+
+// maxBodyFieldBodySize is the size in bytes up to which request bodies are
+// read to set body fields
+const maxBodyFieldBodySize = 1024 * 1024
+
+const (
+	queryTemplateHeader     = "X-Hasura-Secret-Query"
+	basicAuthTemplateHeader = "X-Hasura-Secret-Basic-Auth"
+	cookieTemplateHeader    = "X-Hasura-Secret-Cookie"
+	bodyFieldTemplateHeader = "X-Hasura-Secret-Body-Field"
+)
+
+type injectionPlacement string
+
+const (
+	// placementHeader sets a request header, template 'Key: Value'
+	placementHeader injectionPlacement = "header"
+	// placementQuery sets a query parameter, template 'name=value'
+	placementQuery injectionPlacement = "query"
+	// placementBasicAuth sets the Authorization header to HTTP Basic auth,
+	// template 'username:password'
+	placementBasicAuth injectionPlacement = "basic_auth"
+	// placementCookie sets a cookie, template 'name=value'
+	placementCookie injectionPlacement = "cookie"
+	// placementBodyField sets a field of a JSON request body, template
+	// 'path.to.field=value'
+	placementBodyField injectionPlacement = "body_field"
+)
+
+// templateHeaders maps the request headers configuring an injection to its placement
+var templateHeaders = map[string]injectionPlacement{
+	templateHeader:          placementHeader,
+	queryTemplateHeader:     placementQuery,
+	basicAuthTemplateHeader: placementBasicAuth,
+	cookieTemplateHeader:    placementCookie,
+	bodyFieldTemplateHeader: placementBodyField,
+}
+
+// secretInjection describes where the secret is placed in the forwarded request
+type secretInjection struct {
+	placement injectionPlacement
+	// name of the header, query parameter, cookie or the path of the body
+	// field. Empty for basic auth.
+	name string
+	// valueTemplate is the template of the value. For headers it is the
+	// complete 'Key: Value' template.
+	valueTemplate string
+}
+
+// injectedSecrets are the injections rendered with the fetched secret
+type injectedSecrets struct {
+	headers    http.Header
+	query      url.Values
+	cookies    []*http.Cookie
+	bodyFields []bodyField
+}
+
+type bodyField struct {
+	path  []string
+	value string
+}
+
+func parseInjection(placement injectionPlacement, input string) (injection secretInjection, err error) {
+	injection.placement = placement
+	switch placement {
+	case placementHeader:
+		key, _, found := strings.Cut(input, ":")
+		key = strings.TrimSpace(key)
+		if !found || key == "" {
+			return injection, fmt.Errorf("header template %s must be of the form 'Key: Value'", input)
+		}
+		injection.name, injection.valueTemplate = key, input
+	case placementBasicAuth:
+		if !strings.Contains(input, ":") {
+			return injection, fmt.Errorf("basic auth template %s must be of the form 'username:password'", input)
+		}
+		injection.valueTemplate = strings.TrimSpace(input)
+	case placementQuery, placementCookie, placementBodyField:
+		name, value, found := strings.Cut(input, "=")
+		name = strings.TrimSpace(name)
+		if !found || name == "" {
+			return injection, fmt.Errorf("%s template %s must be of the form 'name=value'", placement, input)
+		}
+		if placement == placementBodyField && strings.Contains("."+name+".", "..") {
+			return injection, fmt.Errorf("body field %s is not a valid path", name)
+		}
+		injection.name, injection.valueTemplate = name, strings.TrimSpace(value)
+	default:
+		return injection, fmt.Errorf("unknown placement %s", placement)
+	}
+	return injection, nil
+}
+
+// getInjectionsFromHeaders parses the injections configured by the request
+// headers. Every template header can be sent multiple times.
+func getInjectionsFromHeaders(header http.Header) (injections []secretInjection, err error) {
+	// iterate in a fixed order to keep the order of the injections stable
+	for _, name := range []string{
+		templateHeader, queryTemplateHeader, basicAuthTemplateHeader, cookieTemplateHeader, bodyFieldTemplateHeader,
+	} {
+		for _, value := range header.Values(name) {
+			injection, err := parseInjection(templateHeaders[name], value)
+			if err != nil {
+				return nil, err
+			}
+			injections = append(injections, injection)
+		}
+	}
+	return injections, nil
+}
+
+func deleteTemplateHeaders(header *http.Header) {
+	for name := range templateHeaders {
+		header.Del(name)
+	}
+}
+
+func renderInjections(injections []secretInjection, secret string, logger zerolog.Logger) injectedSecrets {
+	injected := injectedSecrets{
+		headers: make(http.Header),
+		query:   make(url.Values),
+	}
+	for _, injection := range injections {
+		if injection.placement == placementHeader {
+			// the template has been validated while parsing the injection
+			headerKey, headerVal, _ := getHeaderFromTemplate(injection.valueTemplate, secret, logger)
+			injected.headers.Add(headerKey, headerVal)
+			continue
+		}
+		templ := template.Template{Templ: injection.valueTemplate, Logger: logger}
+		value := templ.Substitute(secret)
+		switch injection.placement {
+		case placementBasicAuth:
+			injected.headers.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(value)))
+		case placementQuery:
+			injected.query.Add(injection.name, value)
+		case placementCookie:
+			injected.cookies = append(injected.cookies, &http.Cookie{Name: injection.name, Value: value})
+		case placementBodyField:
+			injected.bodyFields = append(injected.bodyFields, bodyField{
+				path: strings.Split(injection.name, "."), value: value,
+			})
+		}
+	}
+	return injected
+}
+
+// applyToRequest sets the headers, query parameters and cookies on the
+// outgoing request. Values sent by the caller with the same name are replaced.
+func (injected injectedSecrets) applyToRequest(req *http.Request) {
+	for k, v := range injected.headers {
+		req.Header[k] = v
+	}
+	if len(injected.query) != 0 {
+		req.URL.RawQuery = injected.applyToQuery(req.URL.RawQuery)
+	}
+	if len(injected.cookies) != 0 {
+		injectedNames := make(map[string]bool)
+		for _, cookie := range injected.cookies {
+			injectedNames[cookie.Name] = true
+		}
+		existing := req.Cookies()
+		req.Header.Del("Cookie")
+		for _, cookie := range existing {
+			if !injectedNames[cookie.Name] {
+				req.AddCookie(cookie)
+			}
+		}
+		for _, cookie := range injected.cookies {
+			req.AddCookie(cookie)
+		}
+	}
+}
+
+// applyToQuery replaces the injected parameters in the raw query. The other
+// parameters are kept as sent, in their order and with their encoding.
+func (injected injectedSecrets) applyToQuery(rawQuery string) string {
+	params := make([]string, 0)
+	for _, param := range strings.Split(rawQuery, "&") {
+		if param == "" {
+			continue
+		}
+		rawName, _, _ := strings.Cut(param, "=")
+		name, err := url.QueryUnescape(rawName)
+		if err == nil && injected.query.Has(name) {
+			continue
+		}
+		params = append(params, param)
+	}
+	return strings.Join(append(params, injected.query.Encode()), "&")
+}
+
+// applyToBody sets the body fields in the JSON object sent as the request
+// body. Intermediate objects are created if they do not exist. Returns an
+// *http.MaxBytesError if the body is larger than maxBodyFieldBodySize.
+func (injected injectedSecrets) applyToBody(r *http.Request) error {
+	if len(injected.bodyFields) == 0 {
+		return nil
+	}
+	body := make(map[string]interface{})
+	if r.Body != nil {
+		data, err := io.ReadAll(http.MaxBytesReader(nil, r.Body, maxBodyFieldBodySize))
+		r.Body.Close()
+		if err != nil {
+			return fmt.Errorf("unable to read request body: %w", err)
+		}
+		if len(bytes.TrimSpace(data)) != 0 {
+			// keep numbers as they are instead of converting them to float64
+			decoder := json.NewDecoder(bytes.NewReader(data))
+			decoder.UseNumber()
+			if err := decoder.Decode(&body); err != nil {
+				return fmt.Errorf("request body must be a JSON object: %w", err)
+			}
+		}
+	}
+	for _, field := range injected.bodyFields {
+		object := body
+		for _, key := range field.path[:len(field.path)-1] {
+			next, found := object[key]
+			if !found {
+				next = make(map[string]interface{})
+				object[key] = next
+			}
+			nextObject, ok := next.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("body field %s is not an object", key)
+			}
+			object = nextObject
+		}
+		object[field.path[len(field.path)-1]] = field.value
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(data))
+	r.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}
+	r.ContentLength = int64(len(data))
+	r.Header.Set("Content-Type", "application/json")
+	return nil
+}
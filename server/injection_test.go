@@ -0,0 +1,238 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"strings"
+	"testing"
+
+	"github.com/hasura/hasura-secret-refresh/provider"
+	"github.com/rs/zerolog"
+)
+
+func TestInjection_ParseInjection(t *testing.T) {
+	testCases := []struct {
+		placement     injectionPlacement
+		input         string
+		expectedName  string
+		expectedIsErr bool
+	}{
+		{placementHeader, "Authorization: Bearer ##secret##", "Authorization", false},
+		{placementHeader, "X-Api-Key: a:##secret##", "X-Api-Key", false},
+		{placementHeader, "Bearer ##secret##", "", true},
+		{placementQuery, "api_key=##secret.key##", "api_key", false},
+		{placementQuery, "=##secret##", "", true},
+		{placementQuery, "##secret##", "", true},
+		{placementBasicAuth, "##secret.username##:##secret.password##", "", false},
+		{placementBasicAuth, "##secret.username##", "", true},
+		{placementCookie, "session=##secret##", "session", false},
+		{placementBodyField, "auth.token=##secret##", "auth.token", false},
+		{placementBodyField, "auth..token=##secret##", "", true},
+		{placementBodyField, ".token=##secret##", "", true},
+	}
+	for _, v := range testCases {
+		injection, err := parseInjection(v.placement, v.input)
+		if v.expectedIsErr {
+			if err == nil {
+				t.Errorf("Expected error for %s template %s", v.placement, v.input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Unexpected error for %s template %s: %s", v.placement, v.input, err)
+			continue
+		}
+		if injection.name != v.expectedName {
+			t.Errorf("Expected name %s but got %s", v.expectedName, injection.name)
+		}
+	}
+}
+
+func TestInjection_RenderInjections(t *testing.T) {
+	header := make(http.Header)
+	header.Add(templateHeader, "Authorization: Bearer ##secret.token##")
+	header.Add(templateHeader, "X-Api-Key: key:##secret.token##")
+	header.Add(queryTemplateHeader, "api_key=##secret.token##")
+	header.Add(basicAuthTemplateHeader, "##secret.username##:##secret.password##")
+	header.Add(cookieTemplateHeader, "session=##secret.token##")
+	header.Add(bodyFieldTemplateHeader, "auth.token=##secret.token##")
+	injections, err := getInjectionsFromHeaders(header)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	secret := `{"token": "abc", "username": "user", "password": "p:ss"}`
+	injected := renderInjections(injections, secret, zerolog.Nop())
+
+	expectedBasicAuth := "Basic " + base64.StdEncoding.EncodeToString([]byte("user:p:ss"))
+	if injected.headers.Get("Authorization") != expectedBasicAuth {
+		t.Errorf("Expected basic auth to override the Authorization header, got %s", injected.headers.Get("Authorization"))
+	}
+	if injected.headers.Get("X-Api-Key") != "key:abc" {
+		t.Errorf("Expected X-Api-Key to be 'key:abc' but got %s", injected.headers.Get("X-Api-Key"))
+	}
+	if injected.query.Get("api_key") != "abc" {
+		t.Errorf("Expected query parameter api_key to be 'abc' but got %s", injected.query.Get("api_key"))
+	}
+	if len(injected.cookies) != 1 || injected.cookies[0].Name != "session" || injected.cookies[0].Value != "abc" {
+		t.Errorf("Unexpected cookies %v", injected.cookies)
+	}
+	if len(injected.bodyFields) != 1 || injected.bodyFields[0].value != "abc" {
+		t.Errorf("Unexpected body fields %v", injected.bodyFields)
+	}
+}
+
+func TestInjection_ApplyToRequest(t *testing.T) {
+	mockRequest := getMockRequest("http://somehost/path?z=1&api_key=caller&filter=a%2Cb&id=1", nil, t)
+	mockRequest.Header.Set("Cookie", "session=caller; theme=dark")
+	injections := []secretInjection{
+		{placement: placementQuery, name: "api_key", valueTemplate: "##secret##"},
+		{placement: placementCookie, name: "session", valueTemplate: "##secret##"},
+	}
+	injected := renderInjections(injections, "abc", zerolog.Nop())
+	injected.applyToRequest(mockRequest)
+
+	query := mockRequest.URL.Query()
+	if query.Get("api_key") != "abc" || len(query["api_key"]) != 1 {
+		t.Errorf("Expected the query parameter sent by the caller to be replaced, got %v", query)
+	}
+	if mockRequest.URL.RawQuery != "z=1&filter=a%2Cb&id=1&api_key=abc" {
+		t.Errorf("Expected other query parameters to be kept as sent, got %s", mockRequest.URL.RawQuery)
+	}
+	cookies := make(map[string]string)
+	for _, cookie := range mockRequest.Cookies() {
+		if _, found := cookies[cookie.Name]; found {
+			t.Errorf("Cookie %s is sent more than once", cookie.Name)
+		}
+		cookies[cookie.Name] = cookie.Value
+	}
+	if cookies["session"] != "abc" || cookies["theme"] != "dark" {
+		t.Errorf("Unexpected cookies %v", cookies)
+	}
+}
+
+func TestInjection_ApplyToBody(t *testing.T) {
+	testCases := []struct {
+		body          string
+		expectedBody  string
+		expectedIsErr bool
+	}{
+		{`{"input": {"id": 12345678901234567890}}`, `{"auth":{"token":"abc"},"input":{"id":12345678901234567890}}`, false},
+		{`{"auth": {"user": "x"}}`, `{"auth":{"token":"abc","user":"x"}}`, false},
+		{``, `{"auth":{"token":"abc"}}`, false},
+		{`{"auth": "x"}`, ``, true},
+		{`["a"]`, ``, true},
+	}
+	injections := []secretInjection{
+		{placement: placementBodyField, name: "auth.token", valueTemplate: "##secret##"},
+	}
+	injected := renderInjections(injections, "abc", zerolog.Nop())
+	for _, v := range testCases {
+		mockRequest, _ := http.NewRequest("POST", "http://somehost", bytes.NewBufferString(v.body))
+		err := injected.applyToBody(mockRequest)
+		if v.expectedIsErr {
+			if err == nil {
+				t.Errorf("Expected error for body %s", v.body)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Unexpected error for body %s: %s", v.body, err)
+			continue
+		}
+		body, _ := io.ReadAll(mockRequest.Body)
+		if string(body) != v.expectedBody {
+			t.Errorf("Expected body %s but got %s", v.expectedBody, string(body))
+		}
+		if mockRequest.ContentLength != int64(len(body)) {
+			t.Errorf("Expected content length %d but got %d", len(body), mockRequest.ContentLength)
+		}
+	}
+}
+
+func TestEndpoint_WithMultipleInjections(t *testing.T) {
+	config := Config{}
+	config.Providers = map[string]provider.HttpProvider{
+		"mock_provider": mockProvider{},
+	}
+	server := Create(config, zerolog.Nop())
+	server.reverseProxy = func(rewrite rewriteRequest) httputil.ReverseProxy {
+		return httputil.ReverseProxy{
+			Transport: mockTransport{
+				requestValidation: func(req *http.Request) {
+					if req.URL.String() != "http://somehost/test?api_key=topsecretval" {
+						t.Errorf("Unexpected URL %s", req.URL.String())
+					}
+					if req.Header.Get("X-Api-Key") != "key:topsecretval" {
+						t.Errorf("Unexpected X-Api-Key header %s", req.Header.Get("X-Api-Key"))
+					}
+					if req.Header.Get("X-Other") != "topsecretval" {
+						t.Errorf("Unexpected X-Other header %s", req.Header.Get("X-Other"))
+					}
+					for name := range templateHeaders {
+						if req.Header.Get(name) != "" {
+							t.Errorf("Header %s should not have been present in the request", name)
+						}
+					}
+					body := make(map[string]interface{})
+					if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+						t.Errorf("Unable to decode body: %s", err)
+					}
+					if body["token"] != "topsecretval" || body["action"] == nil {
+						t.Errorf("Unexpected body %v", body)
+					}
+				},
+			},
+			Rewrite: rewrite,
+		}
+	}
+	mockRequest, _ := http.NewRequest("POST", "http://proxyserver/test", bytes.NewBufferString(`{"action": {"name": "test"}}`))
+	mockRequest.Header.Set(forwardToHeader, "http://somehost")
+	mockRequest.Header.Set("X-Hasura-Secret-Id", "secret123")
+	mockRequest.Header.Set(secretProviderHeader, "mock_provider")
+	mockRequest.Header.Add(templateHeader, "X-Api-Key: key:##secret##")
+	mockRequest.Header.Add(templateHeader, "X-Other: ##secret##")
+	mockRequest.Header.Set(queryTemplateHeader, "api_key=##secret##")
+	mockRequest.Header.Set(bodyFieldTemplateHeader, "token=##secret##")
+	rw := httptest.NewRecorder()
+	server.ServeHTTP(rw, mockRequest)
+	if rw.Code != http.StatusOK {
+		t.Errorf("Expected status code to be %d but got %d", http.StatusOK, rw.Code)
+	}
+}
+
+func TestEndpoint_WithBodyFieldAndLargeBody(t *testing.T) {
+	config := Config{}
+	config.Providers = map[string]provider.HttpProvider{
+		"mock_provider": mockProvider{},
+	}
+	server := Create(config, zerolog.Nop())
+	server.reverseProxy = func(rewrite rewriteRequest) httputil.ReverseProxy {
+		return httputil.ReverseProxy{
+			Transport: mockTransport{
+				requestValidation: func(req *http.Request) {
+					t.Errorf("Request should not have been forwarded")
+				},
+			},
+			Rewrite: rewrite,
+		}
+	}
+	body := `{"input": "` + strings.Repeat("a", maxBodyFieldBodySize) + `"}`
+	mockRequest, _ := http.NewRequest("POST", "http://proxyserver/test", strings.NewReader(body))
+	mockRequest.Header.Set(forwardToHeader, "http://somehost")
+	mockRequest.Header.Set("X-Hasura-Secret-Id", "secret123")
+	mockRequest.Header.Set(secretProviderHeader, "mock_provider")
+	mockRequest.Header.Set(bodyFieldTemplateHeader, "token=##secret##")
+	rw := httptest.NewRecorder()
+	server.ServeHTTP(rw, mockRequest)
+	if rw.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected status code to be %d but got %d", http.StatusRequestEntityTooLarge, rw.Code)
+	}
+	if !strings.Contains(rw.Body.String(), errorCodeRequestTooLarge) {
+		t.Errorf("Expected error code %s in response %s", errorCodeRequestTooLarge, rw.Body.String())
+	}
+}
@@ -0,0 +1,337 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hasura/hasura-secret-refresh/cache"
+	"github.com/hasura/hasura-secret-refresh/provider"
+	"github.com/rs/zerolog"
+)
+
+const (
+	circuitClosed   = "closed"
+	circuitOpen     = "open"
+	circuitHalfOpen = "half_open"
+)
+
+// ProviderGuard protects the secret store of a provider. It limits the number
+// of concurrent fetches and stops fetching for a while after repeated
+// failures of the secret store. A nil ProviderGuard does not limit fetches.
+type ProviderGuard struct {
+	// slots is nil if concurrent fetches are not limited
+	slots    chan struct{}
+	inFlight atomic.Int64
+	// breaker is nil if the circuit breaker is disabled
+	breaker *circuitBreaker
+}
+
+// ParseProviderGuardFromConfig parses the 'max_concurrent_fetches' and
+// 'circuit_breaker' configs of a provider. Returns nil if neither is
+// configured.
+//
+//	max_concurrent_fetches: 10
+//	circuit_breaker:
+//	  failure_threshold: 5
+//	  cooldown: 30
+func ParseProviderGuardFromConfig(config map[string]interface{}, logger zerolog.Logger) (*ProviderGuard, error) {
+	guard := &ProviderGuard{}
+	if maxFetchesI, found := config["max_concurrent_fetches"]; found {
+		maxFetches, ok := maxFetchesI.(int)
+		if !ok || maxFetches <= 0 {
+			logger.Error().Msg("'max_concurrent_fetches' must be a positive integer")
+			return nil, fmt.Errorf("config not valid: 'max_concurrent_fetches' must be a positive integer")
+		}
+		guard.slots = make(chan struct{}, maxFetches)
+	}
+	if breakerI, found := config["circuit_breaker"]; found {
+		breakerConfig, ok := breakerI.(map[string]interface{})
+		if !ok {
+			logger.Error().Msg("'circuit_breaker' must be an object")
+			return nil, fmt.Errorf("config not valid: 'circuit_breaker' must be an object")
+		}
+		guard.breaker = &circuitBreaker{
+			failureThreshold: 5,
+			cooldown:         30 * time.Second,
+			state:            circuitClosed,
+			now:              time.Now,
+			logger:           logger,
+		}
+		if thresholdI, found := breakerConfig["failure_threshold"]; found {
+			threshold, ok := thresholdI.(int)
+			if !ok || threshold <= 0 {
+				logger.Error().Msg("'circuit_breaker.failure_threshold' must be a positive integer")
+				return nil, fmt.Errorf("config not valid: 'circuit_breaker.failure_threshold' must be a positive integer")
+			}
+			guard.breaker.failureThreshold = threshold
+		}
+		if cooldownI, found := breakerConfig["cooldown"]; found {
+			cooldown, ok := cooldownI.(int)
+			if !ok || cooldown <= 0 {
+				logger.Error().Msg("'circuit_breaker.cooldown' must be a positive number of seconds")
+				return nil, fmt.Errorf("config not valid: 'circuit_breaker.cooldown' must be a positive number of seconds")
+			}
+			guard.breaker.cooldown = time.Duration(cooldown) * time.Second
+		}
+	}
+	if guard.slots == nil && guard.breaker == nil {
+		return nil, nil
+	}
+	event := logger.Info().Int("max_concurrent_fetches", cap(guard.slots)).Bool("circuit_breaker", guard.breaker != nil)
+	if guard.breaker != nil {
+		event = event.Int("failure_threshold", guard.breaker.failureThreshold).Dur("cooldown", guard.breaker.cooldown)
+	}
+	event.Msg("Provider guard configured")
+	return guard, nil
+}
+
+type fetchResult struct {
+	secret   string
+	cacheHit bool
+	err      error
+}
+
+// fetch runs the fetch unless the circuit is open. It waits for a free slot
+// until the context is done. The fetch is not interrupted when the context is
+// done: it completes in the background so that its slot is released and its
+// outcome is recorded by the circuit breaker.
+func (guard *ProviderGuard) fetch(ctx context.Context, fetch func() fetchResult) fetchResult {
+	if guard != nil && guard.breaker != nil && !guard.breaker.allow() {
+		return fetchResult{err: provider.NewError(provider.ErrorKindUnavailable,
+			fmt.Errorf("circuit breaker is open after repeated failures of the secret store"))}
+	}
+	if guard != nil && guard.slots != nil {
+		select {
+		case guard.slots <- struct{}{}:
+		case <-ctx.Done():
+			guard.breaker.abandon()
+			return fetchResult{err: provider.NewError(provider.ErrorKindFromError(ctx.Err()),
+				fmt.Errorf("waiting for a free fetch slot: %w", ctx.Err()))}
+		}
+	}
+	if guard == nil && ctx.Done() == nil {
+		return fetch()
+	}
+	done := make(chan fetchResult, 1)
+	go func() {
+		if guard != nil {
+			guard.inFlight.Add(1)
+			defer guard.inFlight.Add(-1)
+			if guard.slots != nil {
+				defer func() { <-guard.slots }()
+			}
+		}
+		result := fetch()
+		if guard != nil {
+			guard.breaker.record(result.err)
+		}
+		done <- result
+	}()
+	select {
+	case result := <-done:
+		return result
+	case <-ctx.Done():
+		return fetchResult{err: provider.NewError(provider.ErrorKindFromError(ctx.Err()),
+			fmt.Errorf("waiting for the secret store: %w", ctx.Err()))}
+	}
+}
+
+// fetchSecret fetches the secret of the fetcher through the guard. Stale
+// secrets are served after the guard, so that the circuit breaker records the
+// failures of the secret store while they are served, and so that they are
+// served without waiting for the secret store while the circuit is open.
+func (guard *ProviderGuard) fetchSecret(ctx context.Context, fetcher provider.SecretFetcher) fetchResult {
+	staleFetcher, servesStale := fetcher.(provider.StaleSecretFetcher)
+	cachingFetcher, isCaching := fetcher.(provider.CachingSecretFetcher)
+	result := guard.fetch(ctx, func() fetchResult {
+		switch {
+		case servesStale:
+			secret, cacheHit, err := staleFetcher.FetchFreshSecret()
+			return fetchResult{secret: secret, cacheHit: cacheHit, err: err}
+		case isCaching:
+			secret, cacheHit, err := cachingFetcher.FetchSecretWithCacheStatus()
+			return fetchResult{secret: secret, cacheHit: cacheHit, err: err}
+		}
+		secret, err := fetcher.FetchSecret()
+		return fetchResult{secret: secret, err: err}
+	})
+	if result.err != nil && servesStale {
+		if stale, found := staleFetcher.StaleSecret(result.err); found {
+			return fetchResult{secret: stale, cacheHit: true}
+		}
+	}
+	return result
+}
+
+type providerStatus struct {
+	Circuit              string `json:"circuit,omitempty"`
+	ConsecutiveFailures  int    `json:"consecutive_failures"`
+	InFlightFetches      int64  `json:"in_flight_fetches"`
+	MaxConcurrentFetches int    `json:"max_concurrent_fetches,omitempty"`
+	// StaleServed is set for providers that serve stale secrets
+	StaleServed *int64 `json:"stale_served,omitempty"`
+	// Cache is set for providers that cache secrets
+	Cache *cache.Stats `json:"cache,omitempty"`
+}
+
+func (guard *ProviderGuard) status() providerStatus {
+	status := providerStatus{
+		InFlightFetches:      guard.inFlight.Load(),
+		MaxConcurrentFetches: cap(guard.slots),
+	}
+	if guard.breaker != nil {
+		status.Circuit, status.ConsecutiveFailures = guard.breaker.status()
+	}
+	return status
+}
+
+// circuitBreaker opens after failureThreshold consecutive failures of the
+// secret store and rejects fetches until the cooldown has passed. It then
+// lets a single trial fetch through, which closes the circuit if it succeeds
+// and opens it again otherwise.
+type circuitBreaker struct {
+	failureThreshold int
+	cooldown         time.Duration
+	now              func() time.Time
+	logger           zerolog.Logger
+
+	mu       sync.Mutex
+	state    string
+	failures int
+	openedAt time.Time
+	// trialInFlight is set while the trial fetch of the half open circuit runs
+	trialInFlight bool
+}
+
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case circuitOpen:
+		if b.now().Sub(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.setState(circuitHalfOpen)
+		b.trialInFlight = true
+		return true
+	case circuitHalfOpen:
+		if b.trialInFlight {
+			return false
+		}
+		b.trialInFlight = true
+		return true
+	}
+	return true
+}
+
+// abandon is called if an allowed fetch did not run
+func (b *circuitBreaker) abandon() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == circuitHalfOpen {
+		b.trialInFlight = false
+	}
+}
+
+// record updates the circuit with the outcome of a fetch. Only failures of
+// the secret store count, not eg. secrets that do not exist.
+func (b *circuitBreaker) record(err error) {
+	if b == nil {
+		return
+	}
+	failed := provider.IsStoreFailure(err)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !failed {
+		b.failures = 0
+		if b.state == circuitHalfOpen {
+			b.trialInFlight = false
+			b.setState(circuitClosed)
+		}
+		return
+	}
+	b.failures++
+	if b.state == circuitHalfOpen || (b.state == circuitClosed && b.failures >= b.failureThreshold) {
+		b.trialInFlight = false
+		b.openedAt = b.now()
+		b.setState(circuitOpen)
+	}
+}
+
+func (b *circuitBreaker) setState(state string) {
+	previous := b.state
+	b.state = state
+	event := b.logger.Info()
+	if state == circuitOpen {
+		event = b.logger.Warn().Dur("cooldown", b.cooldown)
+	}
+	event.Str("previous_state", previous).Str("state", state).Int("consecutive_failures", b.failures).
+		Msg("Circuit breaker state changed")
+}
+
+func (b *circuitBreaker) status() (state string, failures int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state, b.failures
+}
+
+// ProviderStatus serves the state of the provider guards, the number of stale
+// secrets served and the cache metrics of each provider as JSON
+type ProviderStatus struct {
+	// mapping from provider name to its guard
+	Guards    map[string]*ProviderGuard
+	Providers map[string]provider.HttpProvider
+}
+
+func (s ProviderStatus) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	statuses := make(map[string]providerStatus, len(s.Guards))
+	for name, guard := range s.Guards {
+		if guard != nil {
+			statuses[name] = guard.status()
+		}
+	}
+	for name, p := range s.Providers {
+		if staleServing, ok := p.(provider.StaleServingProvider); ok {
+			status := statuses[name]
+			served := staleServing.StaleServed()
+			status.StaleServed = &served
+			statuses[name] = status
+		}
+		if caching, ok := p.(provider.CacheStatsProvider); ok {
+			status := statuses[name]
+			stats := caching.CacheStats()
+			status.Cache = &stats
+			statuses[name] = status
+		}
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(statuses)
+}
+
+// ParseProxyTimeoutFromConfig parses the 'proxy_timeout' config, the time in
+// seconds in which a proxied request must be handled, including fetching the
+// secret and sending the request upstream. Returns 0 if it is not configured.
+func ParseProxyTimeoutFromConfig(config map[string]interface{}, logger zerolog.Logger) (time.Duration, error) {
+	timeoutI, found := config["proxy_timeout"]
+	if !found {
+		return 0, nil
+	}
+	timeout, ok := timeoutI.(int)
+	if !ok || timeout <= 0 {
+		logger.Error().Msg("'proxy_timeout' must be a positive number of seconds")
+		return 0, fmt.Errorf("config not valid: 'proxy_timeout' must be a positive number of seconds")
+	}
+	return time.Duration(timeout) * time.Second, nil
+}
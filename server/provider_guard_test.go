@@ -0,0 +1,328 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hasura/hasura-secret-refresh/cache"
+	"github.com/hasura/hasura-secret-refresh/provider"
+	"github.com/rs/zerolog"
+)
+
+// guardedProvider counts its fetches. Fetches block until release is closed
+// if it is set, and fail with err while failing is set.
+type guardedProvider struct {
+	fetches *atomic.Int64
+	release chan struct{}
+	failing *atomic.Bool
+	err     error
+}
+
+func newGuardedProvider(err error) guardedProvider {
+	p := guardedProvider{fetches: &atomic.Int64{}, failing: &atomic.Bool{}, err: err}
+	p.failing.Store(err != nil)
+	return p
+}
+
+func (p guardedProvider) FetchSecret() (string, error) {
+	p.fetches.Add(1)
+	if p.release != nil {
+		<-p.release
+	}
+	if p.failing.Load() {
+		return "", p.err
+	}
+	return "topsecretval", nil
+}
+
+func (p guardedProvider) SecretFetcher(header http.Header) (provider.SecretFetcher, error) {
+	return p, nil
+}
+
+func (p guardedProvider) DeleteConfigHeaders(header *http.Header) {}
+
+func getGuardedServer(p provider.HttpProvider, guard *ProviderGuard, proxyTimeout time.Duration) Server {
+	server := Create(Config{
+		Providers:      map[string]provider.HttpProvider{"guarded_provider": p},
+		ProviderGuards: map[string]*ProviderGuard{"guarded_provider": guard},
+		ProxyTimeout:   proxyTimeout,
+	}, zerolog.Nop())
+	server.reverseProxy = func(rewrite rewriteRequest) httputil.ReverseProxy {
+		return httputil.ReverseProxy{Transport: mockTransport{}, Rewrite: rewrite}
+	}
+	return server
+}
+
+func sendGuardedRequest(t *testing.T, server Server, providerName string) *httptest.ResponseRecorder {
+	mockRequest := getMockRequest("http://proxyserver/test", map[string]string{
+		forwardToHeader:      "http://somehost",
+		secretProviderHeader: providerName,
+		templateHeader:       "Authorization: Bearer ##secret##",
+		"X-Hasura-Secret-Id": "api-key",
+	}, t)
+	rw := httptest.NewRecorder()
+	server.ServeHTTP(rw, mockRequest)
+	return rw
+}
+
+func TestParseProviderGuardFromConfig(t *testing.T) {
+	guard, err := ParseProviderGuardFromConfig(map[string]interface{}{"type": "proxy_hashicorp_vault"}, zerolog.Nop())
+	if err != nil || guard != nil {
+		t.Errorf("Expected no guard without config but got %v, %v", guard, err)
+	}
+	guard, err = ParseProviderGuardFromConfig(map[string]interface{}{
+		"max_concurrent_fetches": 3,
+		"circuit_breaker":        map[string]interface{}{"failure_threshold": 2},
+	}, zerolog.Nop())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if cap(guard.slots) != 3 || guard.breaker.failureThreshold != 2 || guard.breaker.cooldown != 30*time.Second {
+		t.Errorf("Unexpected guard %+v, breaker %+v", guard, guard.breaker)
+	}
+	invalidConfigs := []map[string]interface{}{
+		{"max_concurrent_fetches": 0},
+		{"max_concurrent_fetches": "10"},
+		{"circuit_breaker": true},
+		{"circuit_breaker": map[string]interface{}{"failure_threshold": -1}},
+		{"circuit_breaker": map[string]interface{}{"cooldown": "30s"}},
+	}
+	for _, config := range invalidConfigs {
+		if _, err := ParseProviderGuardFromConfig(config, zerolog.Nop()); err == nil {
+			t.Errorf("Expected error for config %v", config)
+		}
+	}
+}
+
+func TestProviderGuard_CircuitBreaker(t *testing.T) {
+	p := newGuardedProvider(provider.NewError(provider.ErrorKindUnavailable, errors.New("vault returned status 503")))
+	guard, err := ParseProviderGuardFromConfig(map[string]interface{}{
+		"circuit_breaker": map[string]interface{}{"failure_threshold": 2, "cooldown": 10},
+	}, zerolog.Nop())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	now := time.Now()
+	guard.breaker.now = func() time.Time { return now }
+	server := getGuardedServer(p, guard, 0)
+
+	for i := 0; i < 3; i++ {
+		rw := sendGuardedRequest(t, server, "guarded_provider")
+		if rw.Code != http.StatusBadGateway {
+			t.Errorf("Expected status code to be %d but got %d", http.StatusBadGateway, rw.Code)
+		}
+	}
+	if p.fetches.Load() != 2 {
+		t.Errorf("Expected the open circuit to reject the third fetch, got %d fetches", p.fetches.Load())
+	}
+	if state, _ := guard.breaker.status(); state != circuitOpen {
+		t.Errorf("Expected circuit to be %s but got %s", circuitOpen, state)
+	}
+
+	// a failed trial fetch opens the circuit again
+	now = now.Add(11 * time.Second)
+	sendGuardedRequest(t, server, "guarded_provider")
+	sendGuardedRequest(t, server, "guarded_provider")
+	if p.fetches.Load() != 3 {
+		t.Errorf("Expected a single trial fetch, got %d fetches", p.fetches.Load())
+	}
+
+	// a successful trial fetch closes the circuit
+	now = now.Add(11 * time.Second)
+	p.failing.Store(false)
+	rw := sendGuardedRequest(t, server, "guarded_provider")
+	if rw.Code != http.StatusOK {
+		t.Errorf("Expected status code to be %d but got %d", http.StatusOK, rw.Code)
+	}
+	if state, failures := guard.breaker.status(); state != circuitClosed || failures != 0 {
+		t.Errorf("Expected circuit to be %s but got %s with %d failures", circuitClosed, state, failures)
+	}
+}
+
+func TestProviderGuard_NotFoundDoesNotOpenCircuit(t *testing.T) {
+	p := newGuardedProvider(provider.NewError(provider.ErrorKindNotFound, errors.New("secret not found")))
+	guard, _ := ParseProviderGuardFromConfig(map[string]interface{}{
+		"circuit_breaker": map[string]interface{}{"failure_threshold": 1},
+	}, zerolog.Nop())
+	server := getGuardedServer(p, guard, 0)
+	sendGuardedRequest(t, server, "guarded_provider")
+	sendGuardedRequest(t, server, "guarded_provider")
+	if p.fetches.Load() != 2 {
+		t.Errorf("Expected every request to be fetched, got %d fetches", p.fetches.Load())
+	}
+}
+
+func TestProviderGuard_CachedSecretSkipsGuard(t *testing.T) {
+	guard, _ := ParseProviderGuardFromConfig(map[string]interface{}{
+		"circuit_breaker": map[string]interface{}{"failure_threshold": 1},
+	}, zerolog.Nop())
+	guard.breaker.state = circuitOpen
+	guard.breaker.openedAt = time.Now()
+	server := Create(Config{
+		Providers: map[string]provider.HttpProvider{
+			"caching_provider": cachingProvider{cached: map[string]bool{"api-key": true}},
+		},
+		ProviderGuards: map[string]*ProviderGuard{"caching_provider": guard},
+	}, zerolog.Nop())
+	server.reverseProxy = func(rewrite rewriteRequest) httputil.ReverseProxy {
+		return httputil.ReverseProxy{Transport: mockTransport{}, Rewrite: rewrite}
+	}
+	rw := sendGuardedRequest(t, server, "caching_provider")
+	if rw.Code != http.StatusOK {
+		t.Errorf("Expected cached secret to be served with an open circuit, got status code %d", rw.Code)
+	}
+}
+
+func TestProviderGuard_MaxConcurrentFetches(t *testing.T) {
+	p := newGuardedProvider(nil)
+	p.release = make(chan struct{})
+	guard, _ := ParseProviderGuardFromConfig(map[string]interface{}{"max_concurrent_fetches": 1}, zerolog.Nop())
+	server := getGuardedServer(p, guard, 100*time.Millisecond)
+
+	// the first request holds the only slot until it times out; its fetch
+	// keeps running in the background
+	rw := sendGuardedRequest(t, server, "guarded_provider")
+	if rw.Code != http.StatusGatewayTimeout {
+		t.Errorf("Expected status code to be %d but got %d", http.StatusGatewayTimeout, rw.Code)
+	}
+	if status := guard.status(); status.InFlightFetches != 1 {
+		t.Errorf("Expected 1 fetch in flight but got %d", status.InFlightFetches)
+	}
+	rw = sendGuardedRequest(t, server, "guarded_provider")
+	if rw.Code != http.StatusGatewayTimeout {
+		t.Errorf("Expected status code to be %d but got %d", http.StatusGatewayTimeout, rw.Code)
+	}
+	if _, code := getErrorResponse(t, rw); code != errorCodeProviderTimeout {
+		t.Errorf("Expected error code %s but got %s", errorCodeProviderTimeout, code)
+	}
+	if p.fetches.Load() != 1 {
+		t.Errorf("Expected second fetch to wait for a slot, got %d fetches", p.fetches.Load())
+	}
+
+	close(p.release)
+	for i := 0; guard.status().InFlightFetches != 0 && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	rw = sendGuardedRequest(t, server, "guarded_provider")
+	if rw.Code != http.StatusOK {
+		t.Errorf("Expected status code to be %d but got %d", http.StatusOK, rw.Code)
+	}
+}
+
+// staleGuardedProvider serves the last secret fetched by guardedProvider
+// while its fetches fail
+type staleGuardedProvider struct {
+	guardedProvider
+	staleIfError *provider.StaleIfError
+}
+
+func (p staleGuardedProvider) SecretFetcher(header http.Header) (provider.SecretFetcher, error) {
+	return p, nil
+}
+
+func (p staleGuardedProvider) FetchSecret() (string, error) {
+	secret, _, err := p.FetchSecretWithCacheStatus()
+	return secret, err
+}
+
+func (p staleGuardedProvider) CachedSecret() (string, bool) {
+	return "", false
+}
+
+func (p staleGuardedProvider) FetchSecretWithCacheStatus() (string, bool, error) {
+	return provider.FetchSecretOrStale(p)
+}
+
+func (p staleGuardedProvider) FetchFreshSecret() (string, bool, error) {
+	secret, err := p.guardedProvider.FetchSecret()
+	if err == nil {
+		p.staleIfError.Add("api-key", secret)
+	}
+	return secret, false, err
+}
+
+func (p staleGuardedProvider) StaleSecret(err error) (string, bool) {
+	return p.staleIfError.Get("api-key", err, func() error { return nil })
+}
+
+func TestProviderGuard_StaleSecretsOpenCircuit(t *testing.T) {
+	p := staleGuardedProvider{
+		guardedProvider: newGuardedProvider(provider.NewError(provider.ErrorKindUnavailable, errors.New("vault returned status 503"))),
+		staleIfError:    provider.NewStaleIfError(time.Minute, time.Minute, 10, zerolog.Nop()),
+	}
+	p.failing.Store(false)
+	guard, _ := ParseProviderGuardFromConfig(map[string]interface{}{
+		"circuit_breaker": map[string]interface{}{"failure_threshold": 2},
+	}, zerolog.Nop())
+	server := getGuardedServer(p, guard, 0)
+	sendGuardedRequest(t, server, "guarded_provider")
+
+	// stale secrets are served while the secret store fails, and its failures
+	// open the circuit
+	p.failing.Store(true)
+	for i := 0; i < 3; i++ {
+		rw := sendGuardedRequest(t, server, "guarded_provider")
+		if rw.Code != http.StatusOK {
+			t.Errorf("Expected stale secret to be served, got status code %d", rw.Code)
+		}
+	}
+	if state, _ := guard.breaker.status(); state != circuitOpen {
+		t.Errorf("Expected circuit to be %s but got %s", circuitOpen, state)
+	}
+	if p.fetches.Load() != 3 {
+		t.Errorf("Expected the stale secret to be served without fetching once the circuit is open, got %d fetches",
+			p.fetches.Load())
+	}
+	if served := p.staleIfError.Served(); served != 3 {
+		t.Errorf("Expected 3 stale secrets served but got %d", served)
+	}
+}
+
+// staleServingProvider has served a stale secret 3 times
+type staleServingProvider struct {
+	mockProvider
+}
+
+func (p staleServingProvider) StaleServed() int64 {
+	return 3
+}
+
+func (p staleServingProvider) CacheStats() cache.Stats {
+	return cache.Stats{Size: 2, Hits: 10, Misses: 4, Loads: 4, LoadErrors: 2}
+}
+
+func TestProviderStatus(t *testing.T) {
+	guard, _ := ParseProviderGuardFromConfig(map[string]interface{}{
+		"max_concurrent_fetches": 5,
+		"circuit_breaker":        map[string]interface{}{},
+	}, zerolog.Nop())
+	handler := ProviderStatus{
+		Guards: map[string]*ProviderGuard{"vault": guard, "aws": nil},
+		Providers: map[string]provider.HttpProvider{
+			"vault": mockProvider{},
+			"azure": staleServingProvider{},
+		},
+	}
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/healthz/providers", nil))
+	statuses := make(map[string]providerStatus)
+	if err := json.Unmarshal(rw.Body.Bytes(), &statuses); err != nil {
+		t.Fatalf("Unable to parse status %s: %s", rw.Body.String(), err)
+	}
+	expected := providerStatus{Circuit: circuitClosed, MaxConcurrentFetches: 5}
+	if len(statuses) != 2 || statuses["vault"] != expected {
+		t.Errorf("Expected status %+v but got %s", expected, rw.Body.String())
+	}
+	if served := statuses["azure"].StaleServed; served == nil || *served != 3 {
+		t.Errorf("Expected 3 stale secrets served but got %s", rw.Body.String())
+	}
+	if stats := statuses["azure"].Cache; stats == nil || stats.Hits != 10 || stats.LoadErrors != 2 {
+		t.Errorf("Expected cache stats of azure but got %s", rw.Body.String())
+	}
+}
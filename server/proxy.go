@@ -1,8 +1,11 @@
 package server
 
 import (
+	"context"
+	"fmt"
 	"net/http"
 	"net/http/httputil"
+	"time"
 
 	"github.com/hasura/hasura-secret-refresh/provider"
 	"github.com/rs/zerolog"
@@ -10,6 +13,39 @@ import (
 
 type Config struct {
 	Providers map[string]provider.HttpProvider
+	// Signers are the providers that sign requests instead of providing a
+	// secret. Requests select them like any other provider.
+	Signers map[string]provider.RequestSigner
+	Routes  []Route
+	// DestinationAllowlist applies to requests of every provider
+	DestinationAllowlist *DestinationAllowlist
+	// ProviderDestinationAllowlists maps provider names to their allowlist
+	ProviderDestinationAllowlists map[string]*DestinationAllowlist
+	// AuthFailureRetry enables replaying requests rejected by the upstream
+	// with a freshly fetched secret
+	AuthFailureRetry *AuthFailureRetry
+	// ProviderTransports maps provider names to the transport used to send
+	// their requests upstream. Routes can override it.
+	ProviderTransports map[string]*http.Transport
+	// ForwardProxy is nil unless requests can be sent with standard forward
+	// proxy semantics
+	ForwardProxy *ForwardProxy
+	// ErrorDetails adds the cause of errors to error responses
+	ErrorDetails bool
+	// AccessLog is nil if the access log is disabled
+	AccessLog *AccessLog
+	// ProviderGuards maps provider names to the guard of their secret store
+	ProviderGuards map[string]*ProviderGuard
+	// ProxyTimeout bounds the time of handling a proxied request. It is not
+	// bounded if 0.
+	ProxyTimeout time.Duration
+	// CacheBypasses maps provider names to the cache bypass of the provider.
+	// Requests cannot bypass the cache of providers that are not in the map.
+	CacheBypasses map[string]*CacheBypass
+	// SecretsApi is nil unless the secrets API is enabled
+	SecretsApi *SecretsApi
+	// CacheAdmin is nil unless the cache admin endpoint is enabled
+	CacheAdmin *CacheAdmin
 }
 
 type rewriteRequest func(*httputil.ProxyRequest)
@@ -18,24 +54,110 @@ type Server struct {
 	reverseProxy func(rewriteRequest) httputil.ReverseProxy
 	config       Config
 	logger       zerolog.Logger
+	transports   *guardedTransports
 }
 
 func (s Server) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
-	requestLogger := s.logger.With().Ctx(r.Context()).Logger()
+	requestId := setRequestId(r)
+	requestLogger := s.logger.With().Ctx(r.Context()).Str("request_id", requestId).Logger()
+	if s.config.ErrorDetails {
+		r = withErrorDetails(r)
+	}
+	accessLogEntry, rw := s.config.AccessLog.start(rw, r)
+	defer s.config.AccessLog.write(accessLogEntry, s.logger)
 	logRequest(r, false, "Received a request", requestLogger)
 
-	url, headerKey, headerVal, providerHeaderDelete, ok := getRequestRewriteDetails(
-		rw, r, s.config.Providers, requestLogger,
-	)
+	if r.Method == http.MethodConnect {
+		if s.config.ForwardProxy == nil {
+			errMsg := "CONNECT is only supported when 'forward_proxy' is configured"
+			requestLogger.Error().Msg(errMsg)
+			writeError(rw, r, http.StatusMethodNotAllowed, errorCodeMethodNotAllowed, errMsg, nil)
+			return
+		}
+		s.config.ForwardProxy.tunnel(rw, r, s.config.DestinationAllowlist, requestLogger)
+		return
+	}
+
+	if s.config.ProxyTimeout > 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), s.config.ProxyTimeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+
+	var body []byte
+	replayable := false
+	if s.config.AuthFailureRetry != nil {
+		var err error
+		body, replayable, err = bufferBody(r, s.config.AuthFailureRetry.MaxBodySize)
+		if err != nil {
+			errMsg := fmt.Sprintf("Unable to read request body: %s", err.Error())
+			requestLogger.Error().Err(err).Msg(errMsg)
+			writeError(rw, r, http.StatusBadRequest, errorCodeInvalidRequest, errMsg, nil)
+			return
+		}
+		if !replayable {
+			requestLogger.Debug().Msg("Request body is larger than 'max_body_size'. The request will not be retried")
+		}
+	}
+
+	details, ok := getRequestRewriteDetails(rw, r, s.config, requestLogger)
+	accessLogEntry.setDetails(details)
 	if !ok {
 		return
 	}
 
-	rewrite := getRequestRewriter(url, headerKey, headerVal, providerHeaderDelete, requestLogger)
+	rewrite := getRequestRewriter(details, requestLogger)
 	reverseProxy := s.reverseProxy(rewrite)
+	if reverseProxy.ErrorHandler == nil {
+		reverseProxy.ErrorHandler = getProxyErrorHandler(requestLogger)
+	}
+	details.transport = s.transports.get(
+		details.transport, details.providerName,
+		s.config.DestinationAllowlist, s.config.ProviderDestinationAllowlists[details.providerName],
+	)
+	if details.transport != nil {
+		reverseProxy.Transport = details.transport
+	}
+	if details.signer != nil {
+		signedTransport := reverseProxy.Transport
+		if signedTransport == nil {
+			signedTransport = http.DefaultTransport
+		}
+		reverseProxy.Transport = signingTransport{
+			transport: signedTransport,
+			signer:    details.signer,
+			logger:    requestLogger,
+		}
+	}
+	if replayable && details.refreshSecret != nil {
+		retryTransport := reverseProxy.Transport
+		if retryTransport == nil {
+			retryTransport = http.DefaultTransport
+		}
+		reverseProxy.Transport = authRetryTransport{
+			transport:     retryTransport,
+			body:          body,
+			refreshSecret: details.refreshSecret,
+			logger:        requestLogger,
+		}
+	}
 	reverseProxy.ServeHTTP(rw, r)
 }
 
+// Handler returns the top level handler of the server. CONNECT requests and,
+// if the forward proxy is enabled, requests with an absolute URL are proxied
+// as they are addressed to the destination. Other requests are routed by
+// path with mux, which is expected to serve the server on "/".
+func (s Server) Handler(mux http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodConnect || (s.config.ForwardProxy != nil && isForwardProxyRequest(r)) {
+			s.ServeHTTP(rw, r)
+			return
+		}
+		mux.ServeHTTP(rw, r)
+	})
+}
+
 func Create(config Config, logger zerolog.Logger) Server {
 	return Server{
 		reverseProxy: func(rewrite rewriteRequest) httputil.ReverseProxy {
@@ -43,7 +165,8 @@ func Create(config Config, logger zerolog.Logger) Server {
 				Rewrite: rewrite,
 			}
 		},
-		config: config,
-		logger: logger,
+		config:     config,
+		logger:     logger,
+		transports: &guardedTransports{},
 	}
 }
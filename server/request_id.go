@@ -0,0 +1,50 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/hasura/hasura-secret-refresh/provider"
+)
+
+const (
+	requestIdHeader = "X-Request-Id"
+	// maxRequestIdLength bounds the length of the ids sent by clients
+	maxRequestIdLength = 128
+)
+
+// setRequestId sets the X-Request-Id header of the request, so that the id is
+// forwarded upstream, and returns the id. The id sent by the client is kept
+// if it is valid, otherwise a new id is generated.
+func setRequestId(r *http.Request) string {
+	requestId := r.Header.Get(requestIdHeader)
+	if !isValidRequestId(requestId) {
+		requestId = uuid.NewString()
+	}
+	r.Header.Set(requestIdHeader, requestId)
+	return requestId
+}
+
+// isValidRequestId accepts ids of printable ASCII characters without spaces,
+// so that they cannot break the lines of the logs
+func isValidRequestId(requestId string) bool {
+	if requestId == "" || len(requestId) > maxRequestIdLength {
+		return false
+	}
+	for i := 0; i < len(requestId); i++ {
+		if requestId[i] <= ' ' || requestId[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// withRequestId passes the id of the request to fetchers that log it
+func withRequestId(fetcher provider.SecretFetcher, r *http.Request) provider.SecretFetcher {
+	requestId := r.Header.Get(requestIdHeader)
+	requestIdFetcher, ok := fetcher.(provider.RequestIdSecretFetcher)
+	if !ok || requestId == "" {
+		return fetcher
+	}
+	return requestIdFetcher.WithRequestId(requestId)
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"strings"
+	"testing"
+
+	"github.com/hasura/hasura-secret-refresh/provider"
+	"github.com/rs/zerolog"
+)
+
+// requestIdProvider records the request ids passed to its fetchers
+type requestIdProvider struct {
+	requestIds *[]string
+}
+
+type requestIdFetcher struct {
+	requestIdProvider
+}
+
+func (f requestIdFetcher) FetchSecret() (string, error) {
+	return "topsecretval", nil
+}
+
+func (f requestIdFetcher) WithRequestId(requestId string) provider.SecretFetcher {
+	*f.requestIds = append(*f.requestIds, requestId)
+	return f
+}
+
+func (p requestIdProvider) SecretFetcher(header http.Header) (provider.SecretFetcher, error) {
+	return requestIdFetcher{requestIdProvider: p}, nil
+}
+
+func (p requestIdProvider) DeleteConfigHeaders(header *http.Header) {}
+
+func TestSetRequestId(t *testing.T) {
+	tests := []struct {
+		name      string
+		requestId string
+		kept      bool
+	}{
+		{"uuid", "0b6c7f1e-3a2d-4c1e-9f2a-5d3e8b7a6c41", true},
+		{"trace id", "Root=1-5759e988-bd862e3fe1be46a994272793;Sampled=1", true},
+		{"missing", "", false},
+		{"spaces", "req 123", false},
+		{"new line", "req-123\nlevel=error", false},
+		{"too long", strings.Repeat("a", maxRequestIdLength+1), false},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, "http://proxyserver/", nil)
+		r.Header.Set(requestIdHeader, test.requestId)
+		requestId := setRequestId(r)
+		if test.kept && requestId != test.requestId {
+			t.Errorf("%s: Expected request id %s to be kept but got %s", test.name, test.requestId, requestId)
+		}
+		if !test.kept && (requestId == test.requestId || !isValidRequestId(requestId)) {
+			t.Errorf("%s: Expected a new request id but got %s", test.name, requestId)
+		}
+		if r.Header.Get(requestIdHeader) != requestId {
+			t.Errorf("%s: Expected header %s to be set to %s", test.name, requestIdHeader, requestId)
+		}
+	}
+}
+
+func TestServeHTTP_RequestId(t *testing.T) {
+	requestIds := make([]string, 0)
+	config := Config{
+		Providers: map[string]provider.HttpProvider{"request_id_provider": requestIdProvider{requestIds: &requestIds}},
+	}
+	var logs bytes.Buffer
+	server := Create(config, zerolog.New(&logs))
+	upstreamRequestIds := make([]string, 0)
+	server.reverseProxy = func(rewrite rewriteRequest) httputil.ReverseProxy {
+		return httputil.ReverseProxy{
+			Transport: mockTransport{requestValidation: func(req *http.Request) {
+				upstreamRequestIds = append(upstreamRequestIds, req.Header.Get(requestIdHeader))
+			}},
+			Rewrite: rewrite,
+		}
+	}
+	headers := map[string]string{
+		forwardToHeader:      "http://somehost",
+		secretProviderHeader: "request_id_provider",
+		templateHeader:       "Authorization: Bearer ##secret##",
+	}
+
+	headers[requestIdHeader] = "req-123"
+	server.ServeHTTP(httptest.NewRecorder(), getMockRequest("http://proxyserver/orders", headers, t))
+	delete(headers, requestIdHeader)
+	server.ServeHTTP(httptest.NewRecorder(), getMockRequest("http://proxyserver/orders", headers, t))
+
+	if len(upstreamRequestIds) != 2 || upstreamRequestIds[0] != "req-123" || upstreamRequestIds[1] == "" {
+		t.Fatalf("Expected request ids to be forwarded upstream but got %v", upstreamRequestIds)
+	}
+	if len(requestIds) != 2 || requestIds[0] != "req-123" || requestIds[1] != upstreamRequestIds[1] {
+		t.Errorf("Expected request ids %v to be passed to the fetcher but got %v", upstreamRequestIds, requestIds)
+	}
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		var entry map[string]interface{}
+		json.Unmarshal([]byte(line), &entry)
+		if entry["log_type"] != accessLogType && entry["request_id"] != "req-123" && entry["request_id"] != requestIds[1] {
+			t.Errorf("Expected request id in log line %s", line)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httputil"
@@ -15,62 +16,148 @@ const (
 	forwardToHeader      = "X-Hasura-Forward-To"
 	secretProviderHeader = "X-Hasura-Secret-Provider"
 	templateHeader       = "X-Hasura-Secret-Header"
+	forwardModeHeader    = "X-Hasura-Forward-Mode"
+)
+
+const (
+	// forwardModeHost only takes the scheme and host from the forward-to URL.
+	// The path and query of the forwarded request are those of the incoming
+	// request.
+	forwardModeHost = "host"
+	// forwardModeJoin joins the path of the forward-to URL with the path of the
+	// incoming request and merges their query parameters.
+	forwardModeJoin = "join"
 )
 
 type requestConf struct {
 	destinationUrl string
 	secretProvider string
-	headerTemplate string
+	injections     []secretInjection
+	forwardMode    string
+	// providerHeaders are the headers from which the provider reads its
+	// configuration. These are the request headers unless a route matched.
+	providerHeaders http.Header
+	// transport is the transport of the matched route, if any
+	transport *http.Transport
+	// stripPrefix is removed from the path of the forwarded request, if set
+	stripPrefix string
+}
+
+// rewriteDetails describe how a request is forwarded to its destination
+type rewriteDetails struct {
+	url                        *url.URL
+	injected                   injectedSecrets
+	providerDeleteConfigHeader func(*http.Header)
+	// stripPrefix is removed from the path of the request before it is
+	// joined with url, if set
+	stripPrefix string
+	// refreshSecret is nil if the provider cannot invalidate its cached secret
+	refreshSecret secretRefresher
+	// transport is nil if the default transport is used
+	transport *http.Transport
+	// signer is set if the provider signs the request instead of providing a
+	// secret
+	signer provider.RequestSigner
+	// providerName and cacheStatus are written to the access log
+	providerName string
+	cacheStatus  string
 }
 
 func getRequestRewriteDetails(
-	rw http.ResponseWriter, r *http.Request, providers map[string]provider.HttpProvider, requestLogger zerolog.Logger,
-) (
-	url *url.URL, headerKey string, headerVal string, providerDeleteConfigHeader func(*http.Header), ok bool,
-) {
-	providerDeleteConfigHeader = func(*http.Header) {}
-	requestConfig, ok := getRequestConfig(rw, r, requestLogger)
+	rw http.ResponseWriter, r *http.Request, config Config, requestLogger zerolog.Logger,
+) (details rewriteDetails, ok bool) {
+	details.providerDeleteConfigHeader = func(*http.Header) {}
+	requestConfig, ok := getRequestConfig(rw, r, config, requestLogger)
 	if !ok {
 		return
 	}
-	url, ok = parseDestinationUrl(rw, r, requestConfig, requestLogger)
+	details.url, ok = parseDestinationUrl(rw, r, requestConfig, requestLogger)
 	if !ok {
 		return
 	}
-	provider, ok := getProvider(rw, r, providers, requestConfig, requestLogger)
+	details.stripPrefix = requestConfig.stripPrefix
+	details.providerName = requestConfig.secretProvider
+	details.transport = requestConfig.transport
+	if details.transport == nil {
+		details.transport = config.ProviderTransports[requestConfig.secretProvider]
+	}
+	if requestConfig.secretProvider == "" {
+		// forward proxy requests that match no rule are sent without a secret
+		ok = checkDestination(rw, r, details.url, config, requestConfig, requestLogger)
+		return
+	}
+	if signer, found := config.Signers[requestConfig.secretProvider]; found {
+		details.signer = signer
+		ok = checkDestination(rw, r, details.url, config, requestConfig, requestLogger)
+		return
+	}
+	provider, ok := getProvider(rw, r, config.Providers, requestConfig, requestLogger)
 	if !ok {
 		return
 	}
-	providerDeleteConfigHeader = provider.DeleteConfigHeaders
-	secret, ok := getSecret(rw, r, requestConfig, provider, requestLogger)
+	ok = checkDestination(rw, r, details.url, config, requestConfig, requestLogger)
 	if !ok {
 		return
 	}
-	headerKey, headerVal, ok = getHeader(rw, r, secret, requestConfig, requestLogger)
+	details.providerDeleteConfigHeader = provider.DeleteConfigHeaders
+	secret, fetcher, cacheStatus, ok := getSecret(
+		rw, r, requestConfig, provider, config.ProviderGuards[requestConfig.secretProvider],
+		config.CacheBypasses[requestConfig.secretProvider], requestLogger,
+	)
+	details.cacheStatus = cacheStatus
 	if !ok {
 		return
 	}
+	details.injected, ok = getInjectedSecrets(rw, r, secret, requestConfig, requestLogger)
+	if !ok {
+		return
+	}
+	details.refreshSecret = getSecretRefresher(
+		fetcher, config.ProviderGuards[requestConfig.secretProvider], requestConfig, requestLogger,
+	)
 	return
 }
 
-func getRequestRewriter(url *url.URL, headerKey string, headerVal string,
-	providerDeleteConfigHeader func(*http.Header), requestLogger zerolog.Logger) func(req *httputil.ProxyRequest) {
+func getRequestRewriter(details rewriteDetails, requestLogger zerolog.Logger) func(req *httputil.ProxyRequest) {
 	return func(req *httputil.ProxyRequest) {
 		req.Out.Header.Del(forwardToHeader)
 		req.Out.Header.Del(secretProviderHeader)
-		req.Out.Header.Del(templateHeader)
-		providerDeleteConfigHeader(&req.Out.Header)
-		req.SetURL(url)
-		req.Out.Header.Set(headerKey, headerVal)
+		req.Out.Header.Del(forwardModeHeader)
+		req.Out.Header.Del(cacheBypassHeader)
+		deleteTemplateHeaders(&req.Out.Header)
+		details.providerDeleteConfigHeader(&req.Out.Header)
+		if details.stripPrefix != "" {
+			stripPathPrefix(req.Out.URL, details.stripPrefix)
+		}
+		req.SetURL(details.url)
+		details.injected.applyToRequest(req.Out)
 		logRequest(req.Out, false, "Sending request to backend service", requestLogger)
 	}
 }
 
 func getRequestConfig(
-	rw http.ResponseWriter, r *http.Request, requestLogger zerolog.Logger,
+	rw http.ResponseWriter, r *http.Request, config Config, requestLogger zerolog.Logger,
 ) (requestConfig requestConf, ok bool) {
 	ok = true
-	requestConfig = requestConf{}
+	if config.ForwardProxy != nil && isForwardProxyRequest(r) {
+		return config.ForwardProxy.getRequestConfig(rw, r, requestLogger)
+	}
+	if route, found := matchRoute(config.Routes, r); found {
+		requestLogger.Debug().Msgf("Request matched route %s", route.name)
+		requestConfig = requestConf{
+			destinationUrl:  route.destinationUrl,
+			secretProvider:  route.secretProvider,
+			injections:      route.injections,
+			forwardMode:     route.forwardMode,
+			providerHeaders: route.providerParams,
+			transport:       route.transport,
+		}
+		if route.stripPrefix {
+			requestConfig.stripPrefix = route.pathPrefix
+		}
+		return
+	}
+	requestConfig = requestConf{providerHeaders: r.Header}
 	missingHeaders := make([]string, 0, 0)
 	forwardTo := r.Header.Get(forwardToHeader)
 	if forwardTo == "" {
@@ -82,17 +169,26 @@ func getRequestConfig(
 		missingHeaders = append(missingHeaders, secretProviderHeader)
 	}
 	requestConfig.secretProvider = provider
-	template := r.Header.Get(templateHeader)
-	if template == "" {
+	injections, err := getInjectionsFromHeaders(r.Header)
+	if err != nil {
+		ok = false
+		errMsg := fmt.Sprintf("Secret template is not valid: %s", err.Error())
+		requestLogger.Error().Err(err).Msg(errMsg)
+		writeError(rw, r, http.StatusBadRequest, errorCodeInvalidRequest, errMsg, nil)
+		return
+	}
+	// signing providers do not need a template as they do not provide a secret
+	if _, isSigner := config.Signers[provider]; len(injections) == 0 && !isSigner {
 		missingHeaders = append(missingHeaders, templateHeader)
 	}
-	requestConfig.headerTemplate = template
+	requestConfig.injections = injections
+	requestConfig.forwardMode = r.Header.Get(forwardModeHeader)
 	if len(missingHeaders) != 0 {
 		missingHeadersS := strings.Join(missingHeaders, ",")
 		err := fmt.Errorf("required headers not found: %s", missingHeadersS)
 		ok = false
-		requestLogger.Error().Err(err).Msgf(err.Error())
-		http.Error(rw, makeHasuraError(err.Error()), http.StatusBadRequest)
+		requestLogger.Error().Err(err).Msg(err.Error())
+		writeError(rw, r, http.StatusBadRequest, errorCodeInvalidRequest, err.Error(), nil)
 		return
 	}
 	return
@@ -106,11 +202,23 @@ func parseDestinationUrl(
 	url, err := parseUrl(requestConfig.destinationUrl)
 	if err != nil {
 		ok = false
-		requestLogger.Error().Msgf(err.Error())
-		http.Error(rw, makeHasuraError(err.Error()), http.StatusBadRequest)
+		requestLogger.Error().Msg(err.Error())
+		writeError(rw, r, http.StatusBadRequest, errorCodeInvalidRequest, err.Error(), nil)
+		return
+	}
+	switch requestConfig.forwardMode {
+	case "", forwardModeHost:
+		url = getUrlWithSchemeAndHost(url)
+	case forwardModeJoin:
+		url = getUrlWithoutFragment(url)
+	default:
+		ok = false
+		errMsg := fmt.Sprintf("Forward mode %s sent in header %s is not valid. Must be one of '%s' or '%s'",
+			requestConfig.forwardMode, forwardModeHeader, forwardModeHost, forwardModeJoin)
+		requestLogger.Error().Msg(errMsg)
+		writeError(rw, r, http.StatusBadRequest, errorCodeInvalidRequest, errMsg, nil)
 		return
 	}
-	url = getUrlWithSchemeAndHost(url)
 	return
 }
 
@@ -122,49 +230,165 @@ func getProvider(
 	if !ok {
 		errMsg := fmt.Sprintf("Provider name %s sent in header %s does not exist",
 			requestConfig.secretProvider, secretProviderHeader)
-		requestLogger.Error().Msgf(errMsg)
-		http.Error(rw, makeHasuraError(errMsg), http.StatusBadRequest)
+		requestLogger.Error().Msg(errMsg)
+		writeError(rw, r, http.StatusBadRequest, errorCodeProviderNotFound, errMsg, nil)
 		return
 	}
 	return
 }
 
+// checkDestination verifies the destination against the global allowlist and
+// the allowlist of the provider. Both must allow the destination.
+func checkDestination(
+	rw http.ResponseWriter, r *http.Request, url *url.URL,
+	config Config, requestConfig requestConf, requestLogger zerolog.Logger,
+) (ok bool) {
+	ok = true
+	allowlists := []*DestinationAllowlist{
+		config.DestinationAllowlist,
+		config.ProviderDestinationAllowlists[requestConfig.secretProvider],
+	}
+	for _, allowlist := range allowlists {
+		err := allowlist.Check(r.Context(), url)
+		if err != nil {
+			ok = false
+			errMsg := fmt.Sprintf("Forwarding to %s is not allowed for provider %s", url.Host, requestConfig.secretProvider)
+			requestLogger.Error().Err(err).Msg(errMsg)
+			writeError(rw, r, http.StatusForbidden, errorCodeDestinationNotAllowed, errMsg, err)
+			return
+		}
+	}
+	return
+}
+
 func getSecret(
 	rw http.ResponseWriter, r *http.Request,
-	requestConfig requestConf, provider provider.HttpProvider, requestLogger zerolog.Logger,
-) (secret string, ok bool) {
+	requestConfig requestConf, secretProvider provider.HttpProvider, guard *ProviderGuard,
+	bypass *CacheBypass, requestLogger zerolog.Logger,
+) (secret string, fetcher provider.SecretFetcher, cacheStatus string, ok bool) {
 	ok = true
-	fetcher, err := provider.SecretFetcher(r.Header)
+	fetcher, err := secretProvider.SecretFetcher(requestConfig.providerHeaders)
 	if err != nil {
 		ok = false
 		errMsg := fmt.Sprintf("Required configurations not found in header")
-		requestLogger.Error().Err(err).Msgf(errMsg)
-		http.Error(rw, makeHasuraError(errMsg), http.StatusBadRequest)
+		requestLogger.Error().Err(err).Msg(errMsg)
+		writeError(rw, r, http.StatusBadRequest, errorCodeInvalidRequest, errMsg, err)
 		return
 	}
-	secret, err = fetcher.FetchSecret()
+	fetcher = withRequestId(fetcher, r)
+	if isCacheBypassRequested(r.Header) {
+		if secret, refetched := refetchSecret(r, fetcher, guard, bypass, requestLogger); refetched {
+			return secret, fetcher, cacheStatusBypass, true
+		}
+	}
+	cachingFetcher, isCaching := fetcher.(provider.CachingSecretFetcher)
+	if isCaching {
+		// cached secrets are served without going through the guard
+		if cached, found := cachingFetcher.CachedSecret(); found {
+			return cached, fetcher, cacheStatusHit, true
+		}
+	}
+	result := guard.fetchSecret(r.Context(), fetcher)
+	secret, err = result.secret, result.err
+	if isCaching {
+		cacheStatus = cacheStatusMiss
+		if result.cacheHit {
+			cacheStatus = cacheStatusHit
+		}
+	}
 	if err != nil {
 		ok = false
 		errMsg := fmt.Sprintf("Unable to fetch secret")
-		requestLogger.Error().Err(err).Msgf(errMsg)
-		http.Error(rw, makeHasuraError(errMsg), http.StatusBadRequest)
+		statusCode, code := getProviderErrorResponse(err)
+		requestLogger.Error().Err(err).Str("error_code", code).Msg(errMsg)
+		writeError(rw, r, statusCode, code, errMsg, err)
 		return
 	}
 	return
 }
 
-func getHeader(
+func getInjectedSecrets(
 	rw http.ResponseWriter, r *http.Request, secret string,
 	requestConfig requestConf, requestLogger zerolog.Logger,
-) (headerKey string, headerVal string, ok bool) {
+) (injected injectedSecrets, ok bool) {
 	ok = true
-	headerKey, headerVal, err := getHeaderFromTemplate(requestConfig.headerTemplate, secret, requestLogger)
+	injected = renderInjections(requestConfig.injections, secret, requestLogger)
+	err := injected.applyToBody(r)
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		ok = false
+		errMsg := fmt.Sprintf("Request body is larger than %d bytes and cannot be read to set the secret", maxBytesErr.Limit)
+		requestLogger.Error().Err(err).Msg(errMsg)
+		writeError(rw, r, http.StatusRequestEntityTooLarge, errorCodeRequestTooLarge, errMsg, nil)
+		return
+	}
 	if err != nil {
 		ok = false
-		errMsg := fmt.Sprintf("Header template %s sent in header %s is not valid", requestConfig.headerTemplate, templateHeader)
-		requestLogger.Error().Err(err).Msgf(errMsg)
-		http.Error(rw, makeHasuraError(errMsg), http.StatusBadRequest)
+		errMsg := fmt.Sprintf("Unable to set secret in request body: %s", err.Error())
+		requestLogger.Error().Err(err).Msg(errMsg)
+		writeError(rw, r, http.StatusBadRequest, errorCodeInvalidRequest, errMsg, nil)
 		return
 	}
 	return
 }
+
+// secretRefresher fetches the secret again, bypassing the cache of the
+// provider, and injects it into the request. The fetch goes through the guard
+// of the provider and is bounded by the context of the request.
+type secretRefresher func(req *http.Request) error
+
+// refetchSecret fetches the secret bypassing the cache of the provider if the
+// provider allows it. Returns false if the secret must be fetched as usual,
+// eg. because bypasses are rate limited.
+func refetchSecret(
+	r *http.Request, fetcher provider.SecretFetcher, guard *ProviderGuard, bypass *CacheBypass,
+	requestLogger zerolog.Logger,
+) (string, bool) {
+	refetchingFetcher, ok := fetcher.(provider.RefetchingSecretFetcher)
+	if !ok || bypass == nil {
+		requestLogger.Debug().Msg("Provider does not allow bypassing its cache. Fetching secret as usual")
+		return "", false
+	}
+	if !bypass.allow() {
+		requestLogger.Warn().Msg("Cache bypasses of provider are rate limited. Fetching secret as usual")
+		return "", false
+	}
+	result := guard.fetch(r.Context(), func() fetchResult {
+		secret, err := refetchingFetcher.RefetchSecret()
+		return fetchResult{secret: secret, err: err}
+	})
+	if result.err != nil {
+		requestLogger.Warn().Err(result.err).Msg("Unable to refetch secret bypassing the cache. Fetching secret as usual")
+		return "", false
+	}
+	requestLogger.Debug().Msg("Refetched secret bypassing the cache")
+	return result.secret, true
+}
+
+// getSecretRefresher returns nil if the fetcher does not cache secrets or
+// cannot invalidate its cache
+func getSecretRefresher(
+	fetcher provider.SecretFetcher, guard *ProviderGuard, requestConfig requestConf, requestLogger zerolog.Logger,
+) secretRefresher {
+	invalidatingFetcher, ok := fetcher.(provider.InvalidatingSecretFetcher)
+	if !ok {
+		return nil
+	}
+	return func(req *http.Request) error {
+		invalidatingFetcher.InvalidateSecret()
+		result := guard.fetch(req.Context(), func() fetchResult {
+			secret, err := invalidatingFetcher.FetchSecret()
+			return fetchResult{secret: secret, err: err}
+		})
+		if result.err != nil {
+			return fmt.Errorf("unable to fetch secret: %w", result.err)
+		}
+		injected := renderInjections(requestConfig.injections, result.secret, requestLogger)
+		err := injected.applyToBody(req)
+		if err != nil {
+			return fmt.Errorf("unable to set secret in request body: %w", err)
+		}
+		injected.applyToRequest(req)
+		return nil
+	}
+}
@@ -33,6 +33,22 @@ func getMockRequest(withUrl string, withHeaders map[string]string, t *testing.T)
 	return mockRequest
 }
 
+func getMockInjectedSecrets(headerKey string, headerVal string) injectedSecrets {
+	headers := make(http.Header)
+	headers.Set(headerKey, headerVal)
+	return injectedSecrets{headers: headers}
+}
+
+func getSingleInjectedHeader(injected injectedSecrets, t *testing.T) (headerKey string, headerVal string) {
+	if len(injected.headers) != 1 {
+		t.Fatalf("Expected exactly 1 injected header but got %v", injected.headers)
+	}
+	for k := range injected.headers {
+		headerKey, headerVal = k, injected.headers.Get(k)
+	}
+	return
+}
+
 type mockProvider struct{}
 type mockFetcher struct {
 	secretId string
@@ -65,7 +81,7 @@ func TestGetRewriteDetails_WithMissingRequestConfig(t *testing.T) {
 	providers := map[string]provider.HttpProvider{
 		"mock_provider": mockProvider{},
 	}
-	_, _, _, _, ok := getRequestRewriteDetails(rw, mockRequest, providers, zerolog.Nop())
+	_, ok := getRequestRewriteDetails(rw, mockRequest, Config{Providers: providers}, zerolog.Nop())
 	if ok != false {
 		t.Errorf("Expected 'ok' to be false")
 	}
@@ -86,7 +102,7 @@ func TestGetRewriteDetails_WithInvalidUrl(t *testing.T) {
 	providers := map[string]provider.HttpProvider{
 		"mock_provider": mockProvider{},
 	}
-	_, _, _, _, ok := getRequestRewriteDetails(rw, mockRequest, providers, zerolog.Nop())
+	_, ok := getRequestRewriteDetails(rw, mockRequest, Config{Providers: providers}, zerolog.Nop())
 	if ok != false {
 		t.Errorf("Expected 'ok' to be false")
 	}
@@ -107,7 +123,7 @@ func TestGetRewriteDetails_WithInvalidProvider(t *testing.T) {
 	providers := map[string]provider.HttpProvider{
 		"mock_provider": mockProvider{},
 	}
-	_, _, _, _, ok := getRequestRewriteDetails(rw, mockRequest, providers, zerolog.Nop())
+	_, ok := getRequestRewriteDetails(rw, mockRequest, Config{Providers: providers}, zerolog.Nop())
 	if ok != false {
 		t.Errorf("Expected 'ok' to be false")
 	}
@@ -128,12 +144,13 @@ func TestGetRewriteDetails_WithInvalidSecret(t *testing.T) {
 	providers := map[string]provider.HttpProvider{
 		"mock_provider": mockProvider{},
 	}
-	_, _, _, _, ok := getRequestRewriteDetails(rw, mockRequest, providers, zerolog.Nop())
+	_, ok := getRequestRewriteDetails(rw, mockRequest, Config{Providers: providers}, zerolog.Nop())
 	if ok != false {
 		t.Errorf("Expected 'ok' to be false")
 	}
-	if rw.Code != http.StatusBadRequest {
-		t.Errorf("Expected status code to be %d but got %d", http.StatusBadRequest, rw.Code)
+	// errors that the provider did not classify are failures of the secret store
+	if rw.Code != http.StatusBadGateway {
+		t.Errorf("Expected status code to be %d but got %d", http.StatusBadGateway, rw.Code)
 	}
 }
 
@@ -148,7 +165,7 @@ func TestGetRewriteDetails_WithMissingProviderConfig(t *testing.T) {
 	providers := map[string]provider.HttpProvider{
 		"mock_provider": mockProvider{},
 	}
-	_, _, _, _, ok := getRequestRewriteDetails(rw, mockRequest, providers, zerolog.Nop())
+	_, ok := getRequestRewriteDetails(rw, mockRequest, Config{Providers: providers}, zerolog.Nop())
 	if ok != false {
 		t.Errorf("Expected 'ok' to be false")
 	}
@@ -169,7 +186,7 @@ func TestGetRewriteDetails_WithInvalidHeaderTemplate(t *testing.T) {
 	providers := map[string]provider.HttpProvider{
 		"mock_provider": mockProvider{},
 	}
-	_, _, _, _, ok := getRequestRewriteDetails(rw, mockRequest, providers, zerolog.Nop())
+	_, ok := getRequestRewriteDetails(rw, mockRequest, Config{Providers: providers}, zerolog.Nop())
 	if ok != false {
 		t.Errorf("Expected 'ok' to be false")
 	}
@@ -190,8 +207,9 @@ func TestGetRewriteDetails_SuccessfulRequest(t *testing.T) {
 	providers := map[string]provider.HttpProvider{
 		"mock_provider": mockProvider{},
 	}
-	url, headerKey, headerVal, _, ok := getRequestRewriteDetails(rw,
-		mockRequest, providers, zerolog.Nop())
+	details, ok := getRequestRewriteDetails(rw,
+		mockRequest, Config{Providers: providers}, zerolog.Nop())
+	url, injected := details.url, details.injected
 	if ok != true {
 		t.Errorf("Expected 'ok' to be true")
 	}
@@ -201,6 +219,7 @@ func TestGetRewriteDetails_SuccessfulRequest(t *testing.T) {
 	if url.String() != withHeaders[forwardToHeader] {
 		t.Errorf("Expected url to be %s but got %s", withHeaders[forwardToHeader], url.String())
 	}
+	headerKey, headerVal := getSingleInjectedHeader(injected, t)
 	if headerKey != "Auth" {
 		t.Errorf("Expected header name to be 'Auth' but got %s", headerKey)
 	}
@@ -227,7 +246,9 @@ func TestRequestRewriter_HeadersAreRemoved(t *testing.T) {
 	providerDeleteHeaders := func(header *http.Header) {
 		header.Del("X-Hasura-Secret-Id")
 	}
-	rewriter := getRequestRewriter(mockUrl, mockHeaderKey, mockHeaderVal, providerDeleteHeaders, zerolog.Nop())
+	rewriter := getRequestRewriter(rewriteDetails{
+		url: mockUrl, injected: getMockInjectedSecrets(mockHeaderKey, mockHeaderVal), providerDeleteConfigHeader: providerDeleteHeaders,
+	}, zerolog.Nop())
 	rewriter(&proxyRequest)
 	numOutHeaders := len(proxyRequest.Out.Header)
 	if numOutHeaders != numInHeaders-3 {
@@ -280,10 +301,83 @@ func TestRequestRewriter_OutGoingUrl(t *testing.T) {
 			In:  mockRequest,
 			Out: mockRequest,
 		}
-		rewriter := getRequestRewriter(mockUrl, mockHeaderKey, mockHeaderVal, providerDeleteHeaders, zerolog.Nop())
+		rewriter := getRequestRewriter(rewriteDetails{
+			url: mockUrl, injected: getMockInjectedSecrets(mockHeaderKey, mockHeaderVal), providerDeleteConfigHeader: providerDeleteHeaders,
+		}, zerolog.Nop())
 		rewriter(&proxyRequest)
 		if proxyRequest.Out.URL.String() != v.outgoingUrl {
 			t.Errorf("Expected URL to be %s but it was %s", v.outgoingUrl, proxyRequest.Out.URL.String())
 		}
 	}
 }
+
+func TestRequestRewriter_OutGoingUrlJoinMode(t *testing.T) {
+	testCases := []struct {
+		incomingUrl  string // the url to which the proxy receives the request
+		forwardToUrl string // the url to received in the X-Hasura-Forward-To header
+		outgoingUrl  string // the url to which the request will be forwarded to
+	}{
+		{"http://localhost:8080", "https://api.example.com/v2/", "https://api.example.com/v2/"},
+		{"http://localhost:8080/users", "https://api.example.com/v2/", "https://api.example.com/v2/users"},
+		{"http://localhost:8080/users", "https://api.example.com/v2", "https://api.example.com/v2/users"},
+		{"http://localhost:8080/users?id=1", "https://api.example.com/v2?key=abc", "https://api.example.com/v2/users?key=abc&id=1"},
+		{"http://localhost:8080/users", "https://api.example.com/v2?key=abc#fragment", "https://api.example.com/v2/users?key=abc"},
+		{"http://localhost:8080/a%2Fb", "https://api.example.com/v2/", "https://api.example.com/v2/a%2Fb"},
+	}
+	providerDeleteHeaders := func(header *http.Header) {}
+	for _, v := range testCases {
+		withHeaders := map[string]string{
+			forwardToHeader:      v.forwardToUrl,
+			forwardModeHeader:    forwardModeJoin,
+			"X-Hasura-Secret-Id": "secret123",
+			secretProviderHeader: "mock_provider",
+			templateHeader:       "Auth: Bearer ##secret##",
+		}
+		mockRequest := getMockRequest(v.incomingUrl, withHeaders, t)
+		rw := httptest.NewRecorder()
+		providers := map[string]provider.HttpProvider{
+			"mock_provider": mockProvider{},
+		}
+		details, ok := getRequestRewriteDetails(rw, mockRequest, Config{Providers: providers}, zerolog.Nop())
+		forwardUrl, injected := details.url, details.injected
+		if !ok {
+			t.Fatalf("Expected 'ok' to be true for %s", v.forwardToUrl)
+		}
+		proxyRequest := httputil.ProxyRequest{
+			In:  mockRequest,
+			Out: mockRequest.Clone(mockRequest.Context()),
+		}
+		rewriter := getRequestRewriter(rewriteDetails{
+			url: forwardUrl, injected: injected, providerDeleteConfigHeader: providerDeleteHeaders,
+		}, zerolog.Nop())
+		rewriter(&proxyRequest)
+		if proxyRequest.Out.URL.String() != v.outgoingUrl {
+			t.Errorf("Expected URL to be %s but it was %s", v.outgoingUrl, proxyRequest.Out.URL.String())
+		}
+		if proxyRequest.Out.Header.Get(forwardModeHeader) != "" {
+			t.Errorf("Header %s should not have been present in the request", forwardModeHeader)
+		}
+	}
+}
+
+func TestGetRewriteDetails_WithInvalidForwardMode(t *testing.T) {
+	withHeaders := map[string]string{
+		forwardToHeader:      "http://somehost/v2",
+		forwardModeHeader:    "append",
+		"X-Hasura-Secret-Id": "secret123",
+		secretProviderHeader: "mock_provider",
+		templateHeader:       "Auth: Bearer ##secret##",
+	}
+	mockRequest := getMockRequest("http://somehost", withHeaders, t)
+	rw := httptest.NewRecorder()
+	providers := map[string]provider.HttpProvider{
+		"mock_provider": mockProvider{},
+	}
+	_, ok := getRequestRewriteDetails(rw, mockRequest, Config{Providers: providers}, zerolog.Nop())
+	if ok != false {
+		t.Errorf("Expected 'ok' to be false")
+	}
+	if rw.Code != http.StatusBadRequest {
+		t.Errorf("Expected status code to be %d but got %d", http.StatusBadRequest, rw.Code)
+	}
+}
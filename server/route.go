@@ -0,0 +1,355 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/hasura/hasura-secret-refresh/provider"
+	"github.com/rs/zerolog"
+)
+
+// Route binds requests received by the proxy to a destination, a provider and
+// a header template defined in the config file. Requests matching a route do
+// not have to send the X-Hasura-* configuration headers.
+type Route struct {
+	name       string
+	pathPrefix string
+	host       string
+	// stripPrefix removes the path prefix from the path of forwarded
+	// requests. The full path is forwarded otherwise.
+	stripPrefix bool
+
+	destinationUrl string
+	secretProvider string
+	injections     []secretInjection
+	forwardMode    string
+	// providerParams are passed to the provider in place of the provider
+	// specific request headers, eg. X-Hasura-Secret-Id
+	providerParams http.Header
+	// transport is used instead of the transport of the provider if set
+	transport *http.Transport
+}
+
+func (route Route) Name() string {
+	return route.name
+}
+
+// matches reports whether the request is bound to the route. A route matches
+// if the request has the configured host (ignoring the port) and its path
+// starts with the configured path prefix at a path segment boundary.
+func (route Route) matches(r *http.Request) bool {
+	if route.host != "" {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if !strings.EqualFold(host, route.host) {
+			return false
+		}
+	}
+	if route.pathPrefix != "" {
+		path := r.URL.Path
+		if !strings.HasPrefix(path, route.pathPrefix) {
+			return false
+		}
+		rest := path[len(route.pathPrefix):]
+		if rest != "" && !strings.HasSuffix(route.pathPrefix, "/") && !strings.HasPrefix(rest, "/") {
+			return false
+		}
+	}
+	return true
+}
+
+// stripPathPrefix removes the path prefix of a route from the path of a
+// forwarded request. The remaining path keeps its leading '/'.
+func stripPathPrefix(u *url.URL, prefix string) {
+	u.Path = strings.TrimPrefix(u.Path, prefix)
+	if !strings.HasPrefix(u.Path, "/") {
+		u.Path = "/" + u.Path
+	}
+	if u.RawPath == "" {
+		return
+	}
+	escapedPrefix := (&url.URL{Path: prefix}).EscapedPath()
+	if !strings.HasPrefix(u.RawPath, escapedPrefix) {
+		// the path is escaped from the stripped Path instead
+		u.RawPath = ""
+		return
+	}
+	u.RawPath = strings.TrimPrefix(u.RawPath, escapedPrefix)
+	if !strings.HasPrefix(u.RawPath, "/") {
+		u.RawPath = "/" + u.RawPath
+	}
+}
+
+// matchRoute returns the first route, in config order, that matches the request.
+func matchRoute(routes []Route, r *http.Request) (route Route, found bool) {
+	for _, route := range routes {
+		if route.matches(r) {
+			return route, true
+		}
+	}
+	return Route{}, false
+}
+
+// ParseRoutesFromConfig parses the 'routes' section of the config file. Every
+// route must reference a provider that exists in providers or signers. Routes
+// of signers do not have secret templates.
+//
+//	routes:
+//	  - name: payments
+//	    match:
+//	      path_prefix: /payments
+//	      host: actions.local
+//	    strip_prefix: true
+//	    forward_to: https://payments.example.com
+//	    provider: aws_sm_prod
+//	    provider_params:
+//	      X-Hasura-Secret-Id: prod/payments/api-key
+//	    header: "Authorization: Bearer ##secret.token##"
+//	    transport:
+//	      response_header_timeout: 30
+func ParseRoutesFromConfig(
+	config interface{}, providers map[string]provider.HttpProvider,
+	signers map[string]provider.RequestSigner, logger zerolog.Logger,
+) ([]Route, error) {
+	routes := make([]Route, 0)
+	if config == nil {
+		return routes, nil
+	}
+	routesList, ok := config.([]interface{})
+	if !ok {
+		logger.Error().Msg("routes: 'routes' must be a list")
+		return nil, fmt.Errorf("config not valid: 'routes' must be a list")
+	}
+	for i, routeI := range routesList {
+		routeConfig, ok := routeI.(map[string]interface{})
+		if !ok {
+			logger.Error().Msgf("routes: route %d must be an object", i)
+			return nil, fmt.Errorf("config not valid: route %d must be an object", i)
+		}
+		route, err := parseRoute(i, routeConfig, providers, signers, logger)
+		if err != nil {
+			return nil, err
+		}
+		logger.Info().
+			Str("route", route.name).
+			Str("path_prefix", route.pathPrefix).
+			Str("host", route.host).
+			Bool("strip_prefix", route.stripPrefix).
+			Str("forward_to", route.destinationUrl).
+			Str("provider", route.secretProvider).
+			Msg("Route configured")
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+
+func parseRoute(
+	index int, config map[string]interface{}, providers map[string]provider.HttpProvider,
+	signers map[string]provider.RequestSigner, logger zerolog.Logger,
+) (route Route, err error) {
+	route.name = fmt.Sprintf("route_%d", index)
+	if nameI, found := config["name"]; found {
+		name, ok := nameI.(string)
+		if !ok || name == "" {
+			logger.Error().Msgf("routes: 'name' of route %d must be a non-empty string", index)
+			return route, fmt.Errorf("config not valid: 'name' of route %d must be a non-empty string", index)
+		}
+		route.name = name
+	}
+
+	matchI, found := config["match"]
+	if !found {
+		logger.Error().Msgf("routes: Config 'match' not found for route %s", route.name)
+		return route, fmt.Errorf("required configs not found: 'match' of route %s", route.name)
+	}
+	match, ok := matchI.(map[string]interface{})
+	if !ok {
+		logger.Error().Msgf("routes: 'match' of route %s must be an object", route.name)
+		return route, fmt.Errorf("config not valid: 'match' of route %s must be an object", route.name)
+	}
+	if route.pathPrefix, err = getOptionalString(match, "path_prefix", route.name, logger); err != nil {
+		return
+	}
+	if route.pathPrefix != "" && !strings.HasPrefix(route.pathPrefix, "/") {
+		logger.Error().Msgf("routes: 'match.path_prefix' of route %s must start with '/'", route.name)
+		return route, fmt.Errorf("config not valid: 'match.path_prefix' of route %s must start with '/'", route.name)
+	}
+	if route.host, err = getOptionalString(match, "host", route.name, logger); err != nil {
+		return
+	}
+	if route.pathPrefix == "" && route.host == "" {
+		logger.Error().Msgf("routes: One of 'match.path_prefix' or 'match.host' must be configured for route %s", route.name)
+		return route, fmt.Errorf("config not valid: One of 'match.path_prefix' or 'match.host' must be configured for route %s", route.name)
+	}
+	if stripPrefixI, found := config["strip_prefix"]; found {
+		stripPrefix, ok := stripPrefixI.(bool)
+		if !ok {
+			logger.Error().Msgf("routes: 'strip_prefix' of route %s must be a boolean", route.name)
+			return route, fmt.Errorf("config not valid: 'strip_prefix' of route %s must be a boolean", route.name)
+		}
+		if stripPrefix && route.pathPrefix == "" {
+			logger.Error().Msgf("routes: 'strip_prefix' of route %s requires 'match.path_prefix'", route.name)
+			return route, fmt.Errorf("config not valid: 'strip_prefix' of route %s requires 'match.path_prefix'", route.name)
+		}
+		route.stripPrefix = stripPrefix
+	}
+
+	if route.destinationUrl, err = getRequiredString(config, "forward_to", route.name, logger); err != nil {
+		return
+	}
+	if _, err = parseUrl(route.destinationUrl); err != nil {
+		logger.Err(err).Msgf("routes: 'forward_to' of route %s is not valid", route.name)
+		return route, fmt.Errorf("config not valid: 'forward_to' of route %s is not valid: %w", route.name, err)
+	}
+
+	if route.forwardMode, err = getOptionalString(config, "forward_mode", route.name, logger); err != nil {
+		return
+	}
+	if route.forwardMode != "" && route.forwardMode != forwardModeHost && route.forwardMode != forwardModeJoin {
+		logger.Error().Msgf("routes: 'forward_mode' of route %s must be one of '%s' or '%s'", route.name, forwardModeHost, forwardModeJoin)
+		return route, fmt.Errorf("config not valid: 'forward_mode' of route %s must be one of '%s' or '%s'", route.name, forwardModeHost, forwardModeJoin)
+	}
+
+	if route.secretProvider, err = getRequiredString(config, "provider", route.name, logger); err != nil {
+		return
+	}
+	_, isProvider := providers[route.secretProvider]
+	_, isSigner := signers[route.secretProvider]
+	if !isProvider && !isSigner {
+		logger.Error().Msgf("routes: Provider %s of route %s does not exist", route.secretProvider, route.name)
+		return route, fmt.Errorf("config not valid: Provider %s of route %s does not exist", route.secretProvider, route.name)
+	}
+
+	owner := "route " + route.name
+	if isSigner {
+		if err = checkNoInjections(config, owner, route.secretProvider, logger); err != nil {
+			return
+		}
+	} else if route.injections, err = parseInjectionsFromConfig(config, owner, logger); err != nil {
+		return
+	}
+	if route.providerParams, err = parseProviderParams(config, owner, logger); err != nil {
+		return
+	}
+
+	route.transport, err = ParseTransportFromConfig(config, providers, logger.With().Str("route", route.name).Logger())
+	if err != nil {
+		return
+	}
+	return route, nil
+}
+
+// parseInjectionsFromConfig parses the secret templates of a route or a
+// forward proxy rule. Every placement accepts a single template or a list of
+// templates.
+func parseInjectionsFromConfig(config map[string]interface{}, owner string, logger zerolog.Logger) ([]secretInjection, error) {
+	injections := make([]secretInjection, 0)
+	for _, placement := range []injectionPlacement{
+		placementHeader, placementQuery, placementBasicAuth, placementCookie, placementBodyField,
+	} {
+		templatesI, found := config[string(placement)]
+		if !found {
+			continue
+		}
+		templates := make([]string, 0)
+		switch t := templatesI.(type) {
+		case string:
+			templates = append(templates, t)
+		case []interface{}:
+			for _, templateI := range t {
+				template, ok := templateI.(string)
+				if !ok {
+					logger.Error().Msgf("'%s' of %s must be a string or a list of strings", placement, owner)
+					return nil, fmt.Errorf("config not valid: '%s' of %s must be a string or a list of strings", placement, owner)
+				}
+				templates = append(templates, template)
+			}
+		default:
+			logger.Error().Msgf("'%s' of %s must be a string or a list of strings", placement, owner)
+			return nil, fmt.Errorf("config not valid: '%s' of %s must be a string or a list of strings", placement, owner)
+		}
+		for _, template := range templates {
+			injection, err := parseInjection(placement, template)
+			if err != nil {
+				logger.Err(err).Msgf("'%s' of %s is not valid", placement, owner)
+				return nil, fmt.Errorf("config not valid: '%s' of %s: %w", placement, owner, err)
+			}
+			injections = append(injections, injection)
+		}
+	}
+	if len(injections) == 0 {
+		logger.Error().Msgf("One of 'header', 'query', 'basic_auth', 'cookie' or 'body_field' must be configured for %s", owner)
+		return nil, fmt.Errorf("required configs not found: One of 'header', 'query', 'basic_auth', 'cookie' or 'body_field' must be configured for %s", owner)
+	}
+	return injections, nil
+}
+
+// checkNoInjections returns an error if secret templates are configured for a
+// route or a forward proxy rule of a signing provider
+func checkNoInjections(config map[string]interface{}, owner string, providerName string, logger zerolog.Logger) error {
+	for _, placement := range []injectionPlacement{
+		placementHeader, placementQuery, placementBasicAuth, placementCookie, placementBodyField,
+	} {
+		if _, found := config[string(placement)]; found {
+			logger.Error().Msgf("'%s' is not supported for %s as provider %s signs requests", placement, owner, providerName)
+			return fmt.Errorf("config not valid: '%s' is not supported for %s as provider %s signs requests", placement, owner, providerName)
+		}
+	}
+	return nil
+}
+
+// parseProviderParams parses the 'provider_params' that are passed to the
+// provider in place of the provider specific request headers
+func parseProviderParams(config map[string]interface{}, owner string, logger zerolog.Logger) (http.Header, error) {
+	providerParams := make(http.Header)
+	paramsI, found := config["provider_params"]
+	if !found {
+		return providerParams, nil
+	}
+	params, ok := paramsI.(map[string]interface{})
+	if !ok {
+		logger.Error().Msgf("'provider_params' of %s must be an object", owner)
+		return nil, fmt.Errorf("config not valid: 'provider_params' of %s must be an object", owner)
+	}
+	for k, v := range params {
+		value, ok := v.(string)
+		if !ok {
+			logger.Error().Msgf("'provider_params.%s' of %s must be a string", k, owner)
+			return nil, fmt.Errorf("config not valid: 'provider_params.%s' of %s must be a string", k, owner)
+		}
+		providerParams.Set(k, value)
+	}
+	return providerParams, nil
+}
+
+func getRequiredString(config map[string]interface{}, key string, routeName string, logger zerolog.Logger) (string, error) {
+	valueI, found := config[key]
+	if !found {
+		logger.Error().Msgf("routes: Config '%s' not found for route %s", key, routeName)
+		return "", fmt.Errorf("required configs not found: '%s' of route %s", key, routeName)
+	}
+	value, ok := valueI.(string)
+	if !ok || value == "" {
+		logger.Error().Msgf("routes: '%s' of route %s must be a non-empty string", key, routeName)
+		return "", fmt.Errorf("config not valid: '%s' of route %s must be a non-empty string", key, routeName)
+	}
+	return value, nil
+}
+
+func getOptionalString(config map[string]interface{}, key string, routeName string, logger zerolog.Logger) (string, error) {
+	valueI, found := config[key]
+	if !found {
+		return "", nil
+	}
+	value, ok := valueI.(string)
+	if !ok {
+		logger.Error().Msgf("routes: '%s' of route %s must be a string", key, routeName)
+		return "", fmt.Errorf("config not valid: '%s' of route %s must be a string", key, routeName)
+	}
+	return value, nil
+}
@@ -0,0 +1,263 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"testing"
+
+	"github.com/hasura/hasura-secret-refresh/provider"
+	"github.com/rs/zerolog"
+)
+
+func getMockRoutes(t *testing.T) []Route {
+	providers := map[string]provider.HttpProvider{
+		"mock_provider": mockProvider{},
+	}
+	config := []interface{}{
+		map[string]interface{}{
+			"name": "payments",
+			"match": map[string]interface{}{
+				"path_prefix": "/payments",
+			},
+			"forward_to": "https://payments.example.com",
+			"provider":   "mock_provider",
+			"provider_params": map[string]interface{}{
+				"x-hasura-secret-id": "payments_secret",
+			},
+			"header": "Authorization: Bearer ##secret##",
+		},
+		map[string]interface{}{
+			"name": "orders",
+			"match": map[string]interface{}{
+				"host": "orders.local",
+			},
+			"forward_to": "http://orders.example.com:8080",
+			"provider":   "mock_provider",
+			"provider_params": map[string]interface{}{
+				"x-hasura-secret-id": "orders_secret",
+			},
+			"header": "X-Api-Key: ##secret##",
+		},
+	}
+	routes, err := ParseRoutesFromConfig(config, providers, nil, zerolog.Nop())
+	if err != nil {
+		t.Fatalf("Unable to parse routes: %s", err)
+	}
+	return routes
+}
+
+func TestRoute_Match(t *testing.T) {
+	routes := getMockRoutes(t)
+	testCases := []struct {
+		url   string
+		route string
+	}{
+		{"http://localhost:5353/payments", "payments"},
+		{"http://localhost:5353/payments/create?id=1", "payments"},
+		{"http://localhost:5353/paymentsfoo", ""},
+		{"http://orders.local:5353/anything", "orders"},
+		{"http://ORDERS.local/payments", "payments"},
+		{"http://localhost:5353/orders", ""},
+	}
+	for _, v := range testCases {
+		mockRequest := getMockRequest(v.url, nil, t)
+		route, found := matchRoute(routes, mockRequest)
+		if v.route == "" {
+			if found {
+				t.Errorf("Expected %s to not match any route but it matched %s", v.url, route.Name())
+			}
+			continue
+		}
+		if !found || route.Name() != v.route {
+			t.Errorf("Expected %s to match route %s but it matched %s", v.url, v.route, route.Name())
+		}
+	}
+}
+
+func TestGetRewriteDetails_WithRoute(t *testing.T) {
+	routes := getMockRoutes(t)
+	// configuration headers sent by the caller must be ignored for routed requests
+	withHeaders := map[string]string{
+		forwardToHeader:      "http://attacker.example.com",
+		"X-Hasura-Secret-Id": "make_error",
+		secretProviderHeader: "mock_provider",
+		templateHeader:       "Auth: ##secret##",
+	}
+	mockRequest := getMockRequest("http://localhost:5353/payments/create", withHeaders, t)
+	rw := httptest.NewRecorder()
+	providers := map[string]provider.HttpProvider{
+		"mock_provider": mockProvider{},
+	}
+	details, ok := getRequestRewriteDetails(rw, mockRequest, Config{Providers: providers, Routes: routes}, zerolog.Nop())
+	url, injected := details.url, details.injected
+	if ok != true {
+		t.Fatalf("Expected 'ok' to be true")
+	}
+	if url.String() != "https://payments.example.com" {
+		t.Errorf("Expected url to be %s but got %s", "https://payments.example.com", url.String())
+	}
+	headerKey, headerVal := getSingleInjectedHeader(injected, t)
+	if headerKey != "Authorization" {
+		t.Errorf("Expected header name to be 'Authorization' but got %s", headerKey)
+	}
+	if headerVal != "Bearer topsecretval" {
+		t.Errorf("Expected header value to be 'Bearer topsecretval' but got %s", headerVal)
+	}
+}
+
+func TestGetRewriteDetails_WithoutMatchingRoute(t *testing.T) {
+	routes := getMockRoutes(t)
+	mockRequest := getMockRequest("http://localhost:5353/other", nil, t)
+	rw := httptest.NewRecorder()
+	providers := map[string]provider.HttpProvider{
+		"mock_provider": mockProvider{},
+	}
+	_, ok := getRequestRewriteDetails(rw, mockRequest, Config{Providers: providers, Routes: routes}, zerolog.Nop())
+	if ok != false {
+		t.Errorf("Expected 'ok' to be false")
+	}
+	if rw.Code != http.StatusBadRequest {
+		t.Errorf("Expected status code to be %d but got %d", http.StatusBadRequest, rw.Code)
+	}
+}
+
+func TestEndpoint_WithRoute(t *testing.T) {
+	config := Config{}
+	config.Providers = map[string]provider.HttpProvider{
+		"mock_provider": mockProvider{},
+	}
+	config.Routes = getMockRoutes(t)
+	server := Create(config, zerolog.Nop())
+	server.reverseProxy = func(rewrite rewriteRequest) httputil.ReverseProxy {
+		return httputil.ReverseProxy{
+			Transport: mockTransport{
+				requestValidation: func(req *http.Request) {
+					if req.URL.String() != "http://orders.example.com:8080/v1/orders" {
+						t.Errorf("Host is invalid. Received %s", req.URL.String())
+					}
+					if req.Header.Get("X-Api-Key") != "topsecretval" {
+						t.Errorf("Expected header X-Api-Key not found. Found '%s'", req.Header.Get("X-Api-Key"))
+					}
+				},
+			},
+			Rewrite: rewrite,
+		}
+	}
+	mockRequest := getMockRequest("http://orders.local:5353/v1/orders", nil, t)
+	rw := httptest.NewRecorder()
+	server.ServeHTTP(rw, mockRequest)
+	if rw.Code != http.StatusOK {
+		t.Errorf("Expected status code to be %d but got %d", http.StatusOK, rw.Code)
+	}
+}
+
+func TestEndpoint_WithPathPrefixRoute(t *testing.T) {
+	testCases := map[string]struct {
+		stripPrefix bool
+		requestUrl  string
+		expectedUrl string
+	}{
+		"full path is forwarded":   {false, "http://localhost/payments/charge?id=1", "https://payments.example.com/api/payments/charge?id=1"},
+		"prefix is stripped":       {true, "http://localhost/payments/charge?id=1", "https://payments.example.com/api/charge?id=1"},
+		"prefix only is stripped":  {true, "http://localhost/payments", "https://payments.example.com/api/"},
+		"escaped path is stripped": {true, "http://localhost/payments/a%2Fb", "https://payments.example.com/api/a%2Fb"},
+	}
+	for name, testCase := range testCases {
+		providers := map[string]provider.HttpProvider{
+			"mock_provider": mockProvider{},
+		}
+		routes, err := ParseRoutesFromConfig([]interface{}{
+			map[string]interface{}{
+				"name":         "payments",
+				"match":        map[string]interface{}{"path_prefix": "/payments"},
+				"strip_prefix": testCase.stripPrefix,
+				"forward_to":   "https://payments.example.com/api",
+				"forward_mode": "join",
+				"provider":     "mock_provider",
+				"provider_params": map[string]interface{}{
+					"x-hasura-secret-id": "payments_secret",
+				},
+				"header": "Authorization: Bearer ##secret##",
+			},
+		}, providers, nil, zerolog.Nop())
+		if err != nil {
+			t.Fatalf("%s: unable to parse routes: %s", name, err)
+		}
+		server := Create(Config{Providers: providers, Routes: routes}, zerolog.Nop())
+		server.reverseProxy = func(rewrite rewriteRequest) httputil.ReverseProxy {
+			return httputil.ReverseProxy{
+				Transport: mockTransport{
+					requestValidation: func(req *http.Request) {
+						if req.URL.String() != testCase.expectedUrl {
+							t.Errorf("%s: expected url %s but got %s", name, testCase.expectedUrl, req.URL.String())
+						}
+					},
+				},
+				Rewrite: rewrite,
+			}
+		}
+		mockRequest := getMockRequest(testCase.requestUrl, nil, t)
+		rw := httptest.NewRecorder()
+		server.ServeHTTP(rw, mockRequest)
+		if rw.Code != http.StatusOK {
+			t.Errorf("%s: expected status code to be %d but got %d", name, http.StatusOK, rw.Code)
+		}
+	}
+}
+
+func TestParseRoutesFromConfig_Invalid(t *testing.T) {
+	providers := map[string]provider.HttpProvider{
+		"mock_provider": mockProvider{},
+	}
+	validRoute := func() map[string]interface{} {
+		return map[string]interface{}{
+			"match":      map[string]interface{}{"path_prefix": "/payments"},
+			"forward_to": "https://payments.example.com",
+			"provider":   "mock_provider",
+			"header":     "Authorization: Bearer ##secret##",
+		}
+	}
+	testCases := map[string]func(map[string]interface{}){
+		"missing match":        func(r map[string]interface{}) { delete(r, "match") },
+		"empty match":          func(r map[string]interface{}) { r["match"] = map[string]interface{}{} },
+		"relative path prefix": func(r map[string]interface{}) { r["match"] = map[string]interface{}{"path_prefix": "payments"} },
+		"missing forward_to":   func(r map[string]interface{}) { delete(r, "forward_to") },
+		"invalid forward_to":   func(r map[string]interface{}) { r["forward_to"] = "payments.example.com" },
+		"unknown provider":     func(r map[string]interface{}) { r["provider"] = "unknown" },
+		"invalid header":       func(r map[string]interface{}) { r["header"] = "Bearer ##secret##" },
+		"invalid params":       func(r map[string]interface{}) { r["provider_params"] = map[string]interface{}{"x-hasura-secret-id": 1} },
+		"invalid forward_mode": func(r map[string]interface{}) { r["forward_mode"] = "append" },
+		"no secret templates":  func(r map[string]interface{}) { delete(r, "header") },
+		"invalid query":        func(r map[string]interface{}) { r["query"] = []interface{}{"api_key"} },
+		"invalid cookie type":  func(r map[string]interface{}) { r["cookie"] = 1 },
+		"invalid strip_prefix": func(r map[string]interface{}) { r["strip_prefix"] = "true" },
+		"strip_prefix without path_prefix": func(r map[string]interface{}) {
+			r["match"] = map[string]interface{}{"host": "payments.local"}
+			r["strip_prefix"] = true
+		},
+	}
+	for name, modify := range testCases {
+		route := validRoute()
+		modify(route)
+		_, err := ParseRoutesFromConfig([]interface{}{route}, providers, nil, zerolog.Nop())
+		if err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+	_, err := ParseRoutesFromConfig([]interface{}{validRoute()}, providers, nil, zerolog.Nop())
+	if err != nil {
+		t.Errorf("Expected valid route to be parsed. Received error %s", err)
+	}
+	route := validRoute()
+	route["header"] = []interface{}{"Authorization: Bearer ##secret##", "X-Api-Key: ##secret##"}
+	route["query"] = "api_key=##secret##"
+	route["basic_auth"] = "##secret.username##:##secret.password##"
+	routes, err := ParseRoutesFromConfig([]interface{}{route}, providers, nil, zerolog.Nop())
+	if err != nil {
+		t.Fatalf("Expected valid route to be parsed. Received error %s", err)
+	}
+	if len(routes[0].injections) != 4 {
+		t.Errorf("Expected 4 secret templates but got %d", len(routes[0].injections))
+	}
+}
@@ -0,0 +1,247 @@
+package server
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/hasura/hasura-secret-refresh/provider"
+	"github.com/hasura/hasura-secret-refresh/template"
+	"github.com/hasura/hasura-secret-refresh/transform"
+	"github.com/rs/zerolog"
+)
+
+const defaultSecretsApiEndpoint = "/v1/secrets"
+
+// SecretsApi serves secrets of the providers to applications running next to
+// the proxy, eg. other containers of the pod:
+//
+//	GET <endpoint>/<provider>?id=<id>
+//
+// Only the ids configured for a provider can be retrieved. Requests must come
+// from a loopback address and send the token of the API as a bearer token.
+type SecretsApi struct {
+	Endpoint string
+	token    string
+	// secrets maps provider names to the secrets that can be retrieved by id
+	secrets       map[string]map[string]apiSecret
+	Providers     map[string]provider.HttpProvider
+	Guards        map[string]*ProviderGuard
+	CacheBypasses map[string]*CacheBypass
+	Logger        zerolog.Logger
+}
+
+// apiSecret is a secret that can be retrieved from the secrets API
+type apiSecret struct {
+	// providerParams are passed to the provider in place of the provider
+	// specific request headers, eg. X-Hasura-Secret-Id
+	providerParams http.Header
+	transform      *transform.SecretTransform
+	template       string
+}
+
+// ParseSecretsApiFromConfig parses the 'secrets_api' config. Every provider
+// must exist in providers. Returns nil if it is not configured.
+//
+//	secrets_api:
+//	  endpoint: /v1/secrets
+//	  token: some-token
+//	  providers:
+//	    aws_sm_prod:
+//	      - id: db-url
+//	        provider_params:
+//	          X-Hasura-Secret-Id: prod/db
+//	        template: "postgres://##secret.username##:##secret.password##@db/app"
+//
+// The secrets of a provider are a list rather than an object keyed by id, as
+// keys of objects are lowercased when the config is read.
+func ParseSecretsApiFromConfig(
+	config map[string]interface{}, providers map[string]provider.HttpProvider, logger zerolog.Logger,
+) (*SecretsApi, error) {
+	secretsApiI, found := config["secrets_api"]
+	if !found {
+		return nil, nil
+	}
+	secretsApiConfig, ok := secretsApiI.(map[string]interface{})
+	if !ok {
+		logger.Error().Msg("'secrets_api' must be an object")
+		return nil, fmt.Errorf("config not valid: 'secrets_api' must be an object")
+	}
+	secretsApi := &SecretsApi{
+		Endpoint: defaultSecretsApiEndpoint,
+		secrets:  make(map[string]map[string]apiSecret),
+		Logger:   logger,
+	}
+	if endpointI, found := secretsApiConfig["endpoint"]; found {
+		endpoint, ok := endpointI.(string)
+		if !ok || !strings.HasPrefix(endpoint, "/") || endpoint == "/" {
+			logger.Error().Msg("'secrets_api.endpoint' must be a path other than '/'")
+			return nil, fmt.Errorf("config not valid: 'secrets_api.endpoint' must be a path other than '/'")
+		}
+		secretsApi.Endpoint = strings.TrimSuffix(endpoint, "/")
+	}
+	token, ok := secretsApiConfig["token"].(string)
+	if !ok || token == "" {
+		logger.Error().Msg("'secrets_api.token' must be a non-empty string")
+		return nil, fmt.Errorf("config not valid: 'secrets_api.token' must be a non-empty string")
+	}
+	secretsApi.token = token
+	providersConfig, ok := secretsApiConfig["providers"].(map[string]interface{})
+	if !ok {
+		logger.Error().Msg("'secrets_api.providers' must be an object")
+		return nil, fmt.Errorf("config not valid: 'secrets_api.providers' must be an object")
+	}
+	for providerName, secretsI := range providersConfig {
+		if _, found := providers[providerName]; !found {
+			logger.Error().Msgf("secrets_api: Provider %s does not exist", providerName)
+			return nil, fmt.Errorf("config not valid: Provider %s of 'secrets_api' does not exist", providerName)
+		}
+		secretsConfig, ok := secretsI.([]interface{})
+		if !ok {
+			logger.Error().Msgf("secrets_api: Secrets of provider %s must be a list", providerName)
+			return nil, fmt.Errorf("config not valid: Secrets of provider %s of 'secrets_api' must be a list", providerName)
+		}
+		secretsApi.secrets[providerName] = make(map[string]apiSecret, len(secretsConfig))
+		for i, secretI := range secretsConfig {
+			id, secret, err := parseApiSecret(providerName, i, secretI, logger)
+			if err != nil {
+				return nil, err
+			}
+			if _, duplicate := secretsApi.secrets[providerName][id]; duplicate {
+				logger.Error().Msgf("secrets_api: Secret %s of provider %s is configured more than once", id, providerName)
+				return nil, fmt.Errorf("config not valid: Secret %s of provider %s of 'secrets_api' is configured more than once", id, providerName)
+			}
+			secretsApi.secrets[providerName][id] = secret
+		}
+		logger.Info().Str("provider_name", providerName).Int("secrets", len(secretsConfig)).
+			Msg("Secrets of provider can be retrieved from the secrets API")
+	}
+	logger.Info().Str("endpoint", secretsApi.Endpoint).Msg("Secrets API enabled")
+	return secretsApi, nil
+}
+
+// parseApiSecret parses the secret at index i of the secrets of a provider
+// and returns it with its id
+func parseApiSecret(providerName string, i int, config interface{}, logger zerolog.Logger) (string, apiSecret, error) {
+	owner := fmt.Sprintf("secret %d of provider %s", i, providerName)
+	secretConfig, ok := config.(map[string]interface{})
+	if !ok {
+		logger.Error().Msgf("secrets_api: %s must be an object", owner)
+		return "", apiSecret{}, fmt.Errorf("config not valid: %s must be an object", owner)
+	}
+	id, ok := secretConfig["id"].(string)
+	if !ok || id == "" {
+		logger.Error().Msgf("secrets_api: 'id' of %s must be a non-empty string", owner)
+		return "", apiSecret{}, fmt.Errorf("config not valid: 'id' of %s must be a non-empty string", owner)
+	}
+	owner = fmt.Sprintf("secret %s of provider %s", id, providerName)
+	var secret apiSecret
+	var err error
+	if secret.providerParams, err = parseProviderParams(secretConfig, owner, logger); err != nil {
+		return "", apiSecret{}, err
+	}
+	if templateI, found := secretConfig["template"]; found {
+		secret.template, ok = templateI.(string)
+		if !ok {
+			logger.Error().Msgf("secrets_api: 'template' of %s must be a string", owner)
+			return "", apiSecret{}, fmt.Errorf("config not valid: 'template' of %s must be a string", owner)
+		}
+	}
+	if secret.transform, err = transform.ParseSecretTransformFromConfig(secretConfig, logger); err != nil {
+		return "", apiSecret{}, err
+	}
+	if secret.template != "" && secret.transform.HasTransformations() {
+		logger.Error().Msgf("secrets_api: Only one of 'template' or 'transform' can be configured for %s, not both", owner)
+		return "", apiSecret{}, fmt.Errorf("config not valid: Only one of 'template' or 'transform' can be configured for %s, not both", owner)
+	}
+	return id, secret, nil
+}
+
+func (s *SecretsApi) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	providerName := strings.Trim(strings.TrimPrefix(r.URL.Path, s.Endpoint), "/")
+	id := r.URL.Query().Get("id")
+	requestId := setRequestId(r)
+	requestLogger := s.Logger.With().Str("request_id", requestId).
+		Str("provider_name", providerName).Str("secret_id", id).Logger()
+	if !isLoopback(r.RemoteAddr) {
+		errMsg := "The secrets API only accepts requests from a loopback address"
+		requestLogger.Error().Str("remote_addr", r.RemoteAddr).Msg(errMsg)
+		writeError(rw, r, http.StatusForbidden, errorCodeUnauthorized, errMsg, nil)
+		return
+	}
+	if !hasBearerToken(r, s.token) {
+		errMsg := "Secrets API requests require a valid bearer token"
+		requestLogger.Error().Msg(errMsg)
+		writeError(rw, r, http.StatusUnauthorized, errorCodeUnauthorized, errMsg, nil)
+		return
+	}
+	if r.Method != http.MethodGet {
+		errMsg := fmt.Sprintf("Method %s is not allowed on %s", r.Method, r.URL.Path)
+		requestLogger.Error().Msg(errMsg)
+		writeError(rw, r, http.StatusMethodNotAllowed, errorCodeMethodNotAllowed, errMsg, nil)
+		return
+	}
+	secretProvider, found := s.Providers[providerName]
+	secrets, allowed := s.secrets[providerName]
+	if !found || !allowed {
+		errMsg := fmt.Sprintf("Provider %s not found", providerName)
+		requestLogger.Error().Msg(errMsg)
+		writeError(rw, r, http.StatusNotFound, errorCodeProviderNotFound, errMsg, nil)
+		return
+	}
+	secret, allowed := secrets[id]
+	if !allowed {
+		// ids that are not allowed are not distinguished from missing secrets
+		errMsg := fmt.Sprintf("Secret %s not found for provider %s", id, providerName)
+		requestLogger.Error().Msg(errMsg)
+		writeError(rw, r, http.StatusNotFound, errorCodeSecretNotFound, errMsg, nil)
+		return
+	}
+	value, _, cacheStatus, ok := getSecret(
+		rw, r, requestConf{providerHeaders: secret.providerParams}, secretProvider,
+		s.Guards[providerName], s.CacheBypasses[providerName], requestLogger,
+	)
+	if !ok {
+		return
+	}
+	value, err := secret.render(value, requestLogger)
+	if err != nil {
+		errMsg := "Unable to transform secret"
+		requestLogger.Error().Err(err).Msg(errMsg)
+		writeError(rw, r, http.StatusInternalServerError, errorCodeInternalError, errMsg, err)
+		return
+	}
+	requestLogger.Info().Str("cache", cacheStatus).Msg("Served secret from the secrets API")
+	rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.Write([]byte(value))
+}
+
+// render applies the transform or the template of the secret
+func (secret apiSecret) render(value string, logger zerolog.Logger) (string, error) {
+	if secret.transform.HasTransformations() {
+		return secret.transform.Transform(value)
+	}
+	if secret.template != "" {
+		templ := template.Template{Templ: secret.template, Logger: logger}
+		return templ.Substitute(value), nil
+	}
+	return value, nil
+}
+
+func isLoopback(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// hasBearerToken reports whether the request sends token as a bearer token
+func hasBearerToken(r *http.Request, token string) bool {
+	sent, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return found && subtle.ConstantTimeCompare([]byte(sent), []byte(token)) == 1
+}
@@ -0,0 +1,160 @@
+package server
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/hasura/hasura-secret-refresh/provider"
+	"github.com/rs/zerolog"
+	"github.com/spf13/viper"
+)
+
+var secretsApiProviders = map[string]provider.HttpProvider{"mock_provider": mockProvider{}}
+
+func getSecretsApi(t *testing.T) *SecretsApi {
+	secretsApi, err := ParseSecretsApiFromConfig(map[string]interface{}{
+		"secrets_api": map[string]interface{}{
+			"token": "apitoken",
+			"providers": map[string]interface{}{
+				"mock_provider": []interface{}{
+					map[string]interface{}{
+						"id":              "api-key",
+						"provider_params": map[string]interface{}{"X-Hasura-Secret-Id": "api-key"},
+					},
+					map[string]interface{}{
+						"id":              "auth-header",
+						"provider_params": map[string]interface{}{"X-Hasura-Secret-Id": "api-key"},
+						"template":        "Bearer ##secret##",
+					},
+					map[string]interface{}{
+						"id":              "broken",
+						"provider_params": map[string]interface{}{"X-Hasura-Secret-Id": "make_error"},
+					},
+				},
+			},
+		},
+	}, secretsApiProviders, zerolog.Nop())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	secretsApi.Providers = secretsApiProviders
+	return secretsApi
+}
+
+func sendSecretsApiRequest(secretsApi *SecretsApi, url string, remoteAddr string, token string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, url, nil)
+	r.RemoteAddr = remoteAddr
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	rw := httptest.NewRecorder()
+	secretsApi.ServeHTTP(rw, r)
+	return rw
+}
+
+func TestParseSecretsApiFromConfig(t *testing.T) {
+	secretsApi, err := ParseSecretsApiFromConfig(map[string]interface{}{}, secretsApiProviders, zerolog.Nop())
+	if err != nil || secretsApi != nil {
+		t.Errorf("Expected secrets API to be disabled but got %v, %v", secretsApi, err)
+	}
+	invalidConfigs := []interface{}{
+		true,
+		map[string]interface{}{"providers": map[string]interface{}{}},
+		map[string]interface{}{"token": "apitoken"},
+		map[string]interface{}{"token": "apitoken", "providers": map[string]interface{}{
+			"unknown_provider": []interface{}{},
+		}},
+		map[string]interface{}{"token": "apitoken", "providers": map[string]interface{}{
+			"mock_provider": map[string]interface{}{"api-key": map[string]interface{}{}},
+		}},
+		map[string]interface{}{"token": "apitoken", "providers": map[string]interface{}{
+			"mock_provider": []interface{}{"api-key"},
+		}},
+		map[string]interface{}{"token": "apitoken", "providers": map[string]interface{}{
+			"mock_provider": []interface{}{map[string]interface{}{"template": "##secret##"}},
+		}},
+		map[string]interface{}{"token": "apitoken", "providers": map[string]interface{}{
+			"mock_provider": []interface{}{map[string]interface{}{"id": "api-key"}, map[string]interface{}{"id": "api-key"}},
+		}},
+		map[string]interface{}{"token": "apitoken", "providers": map[string]interface{}{
+			"mock_provider": []interface{}{map[string]interface{}{
+				"id":        "api-key",
+				"template":  "##secret.key##",
+				"transform": map[string]interface{}{"key_mappings": []interface{}{map[string]interface{}{"from": "a", "to": "b"}}},
+			}},
+		}},
+	}
+	for _, config := range invalidConfigs {
+		if _, err := ParseSecretsApiFromConfig(map[string]interface{}{"secrets_api": config}, secretsApiProviders, zerolog.Nop()); err == nil {
+			t.Errorf("Expected error for config %v", config)
+		}
+	}
+}
+
+func TestSecretsApi(t *testing.T) {
+	secretsApi := getSecretsApi(t)
+	rw := sendSecretsApiRequest(secretsApi, "/v1/secrets/mock_provider?id=api-key", "127.0.0.1:40000", "apitoken")
+	if rw.Code != http.StatusOK || rw.Body.String() != "topsecretval" {
+		t.Errorf("Expected secret but got status code %d, %s", rw.Code, rw.Body.String())
+	}
+	if rw.Header().Get("Cache-Control") != "no-store" {
+		t.Errorf("Expected secret not to be cached by clients")
+	}
+	rw = sendSecretsApiRequest(secretsApi, "/v1/secrets/mock_provider?id=auth-header", "[::1]:40000", "apitoken")
+	if rw.Code != http.StatusOK || rw.Body.String() != "Bearer topsecretval" {
+		t.Errorf("Expected templated secret but got status code %d, %s", rw.Code, rw.Body.String())
+	}
+}
+
+func TestSecretsApi_IdsThroughViper(t *testing.T) {
+	v := viper.New()
+	v.SetConfigType("yaml")
+	err := v.ReadConfig(bytes.NewBufferString(`
+secrets_api:
+  token: apitoken
+  providers:
+    mock_provider:
+      - id: Prod/API-Key
+        provider_params:
+          X-Hasura-Secret-Id: api-key
+`))
+	if err != nil {
+		t.Fatalf("Unable to read config: %s", err)
+	}
+	secretsApi, err := ParseSecretsApiFromConfig(v.AllSettings(), secretsApiProviders, zerolog.Nop())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	secretsApi.Providers = secretsApiProviders
+	rw := sendSecretsApiRequest(secretsApi, "/v1/secrets/mock_provider?id=Prod/API-Key", "127.0.0.1:40000", "apitoken")
+	if rw.Code != http.StatusOK || rw.Body.String() != "topsecretval" {
+		t.Errorf("Expected secret but got status code %d, %s", rw.Code, rw.Body.String())
+	}
+}
+
+func TestSecretsApi_Errors(t *testing.T) {
+	secretsApi := getSecretsApi(t)
+	tests := []struct {
+		name       string
+		url        string
+		remoteAddr string
+		token      string
+		statusCode int
+		code       string
+	}{
+		{"remote address", "/v1/secrets/mock_provider?id=api-key", "10.0.0.5:40000", "apitoken", http.StatusForbidden, errorCodeUnauthorized},
+		{"missing token", "/v1/secrets/mock_provider?id=api-key", "127.0.0.1:40000", "", http.StatusUnauthorized, errorCodeUnauthorized},
+		{"wrong token", "/v1/secrets/mock_provider?id=api-key", "127.0.0.1:40000", "wrongtoken", http.StatusUnauthorized, errorCodeUnauthorized},
+		{"unknown provider", "/v1/secrets/other_provider?id=api-key", "127.0.0.1:40000", "apitoken", http.StatusNotFound, errorCodeProviderNotFound},
+		{"id not allowed", "/v1/secrets/mock_provider?id=db-password", "127.0.0.1:40000", "apitoken", http.StatusNotFound, errorCodeSecretNotFound},
+		{"fetch error", "/v1/secrets/mock_provider?id=broken", "127.0.0.1:40000", "apitoken", http.StatusBadGateway, errorCodeProviderUnavailable},
+	}
+	for _, test := range tests {
+		rw := sendSecretsApiRequest(secretsApi, test.url, test.remoteAddr, test.token)
+		if _, code := getErrorResponse(t, rw); rw.Code != test.statusCode || code != test.code {
+			t.Errorf("%s: Expected status code %d, %s but got %d, %s", test.name, test.statusCode, test.code, rw.Code, code)
+		}
+	}
+}
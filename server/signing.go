@@ -0,0 +1,43 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/hasura/hasura-secret-refresh/provider"
+	"github.com/rs/zerolog"
+)
+
+// signingTransport signs requests right before they are sent, after all
+// other changes to the request have been made
+type signingTransport struct {
+	transport http.RoundTripper
+	signer    provider.RequestSigner
+	logger    zerolog.Logger
+}
+
+func (t signingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	signedReq := req.Clone(req.Context())
+	err := t.signer.SignRequest(signedReq)
+	if err != nil {
+		t.logger.Error().Err(err).Msg("Unable to sign request")
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, signingError{err}
+	}
+	return t.transport.RoundTrip(signedReq)
+}
+
+// signingError is returned by signingTransport if the request could not be
+// signed, to tell it apart from errors of sending the request
+type signingError struct {
+	err error
+}
+
+func (e signingError) Error() string {
+	return e.err.Error()
+}
+
+func (e signingError) Unwrap() error {
+	return e.err
+}
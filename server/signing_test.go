@@ -0,0 +1,135 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"strings"
+	"testing"
+
+	"github.com/hasura/hasura-secret-refresh/provider"
+	"github.com/rs/zerolog"
+)
+
+// mockSigner signs the request with the URL and the body it is sent with
+type mockSigner struct {
+	err error
+}
+
+func (s mockSigner) SignRequest(req *http.Request) error {
+	if s.err != nil {
+		return s.err
+	}
+	body := []byte{}
+	if req.Body != nil {
+		body, _ = io.ReadAll(req.Body)
+		req.Body = io.NopCloser(strings.NewReader(string(body)))
+	}
+	req.Header.Set("X-Signature", req.Method+" "+req.URL.String()+" "+string(body))
+	return nil
+}
+
+func getSigningServer(signer provider.RequestSigner, validate func(*http.Request)) Server {
+	config := Config{
+		Providers: map[string]provider.HttpProvider{"mock_provider": mockProvider{}},
+		Signers:   map[string]provider.RequestSigner{"mock_signer": signer},
+	}
+	server := Create(config, zerolog.Nop())
+	server.reverseProxy = func(rewrite rewriteRequest) httputil.ReverseProxy {
+		return httputil.ReverseProxy{
+			Transport: mockTransport{requestValidation: validate},
+			Rewrite:   rewrite,
+		}
+	}
+	return server
+}
+
+func TestEndpoint_WithSigner(t *testing.T) {
+	received := false
+	server := getSigningServer(mockSigner{}, func(req *http.Request) {
+		received = true
+		expected := `POST http://somehost/test {"action":"create"}`
+		if req.Header.Get("X-Signature") != expected {
+			t.Errorf("Expected signature %s but got %s", expected, req.Header.Get("X-Signature"))
+		}
+		if req.Header.Get(secretProviderHeader) != "" || req.Header.Get(forwardToHeader) != "" {
+			t.Errorf("Expected configuration headers to be removed")
+		}
+		body, _ := io.ReadAll(req.Body)
+		if string(body) != `{"action":"create"}` {
+			t.Errorf("Expected body to be forwarded but got %s", string(body))
+		}
+	})
+	// no template header is required for signing providers
+	mockRequest := getMockRequest("http://proxyserver/test", map[string]string{
+		forwardToHeader:      "http://somehost",
+		secretProviderHeader: "mock_signer",
+	}, t)
+	mockRequest.Method = http.MethodPost
+	mockRequest.Body = io.NopCloser(strings.NewReader(`{"action":"create"}`))
+	mockRequest.ContentLength = int64(len(`{"action":"create"}`))
+	rw := httptest.NewRecorder()
+	server.ServeHTTP(rw, mockRequest)
+	if rw.Code != http.StatusOK {
+		t.Errorf("Expected status code to be %d but got %d", http.StatusOK, rw.Code)
+	}
+	if !received {
+		t.Errorf("Expected request to be sent upstream")
+	}
+}
+
+func TestEndpoint_WithSignerError(t *testing.T) {
+	server := getSigningServer(mockSigner{err: errors.New("no credentials")}, func(req *http.Request) {
+		t.Errorf("Expected request to not be sent upstream")
+	})
+	mockRequest := getMockRequest("http://proxyserver/test", map[string]string{
+		forwardToHeader:      "http://somehost",
+		secretProviderHeader: "mock_signer",
+	}, t)
+	rw := httptest.NewRecorder()
+	server.ServeHTTP(rw, mockRequest)
+	if rw.Code != http.StatusBadGateway {
+		t.Errorf("Expected status code to be %d but got %d", http.StatusBadGateway, rw.Code)
+	}
+}
+
+func TestEndpoint_WithSignerBodyTooLarge(t *testing.T) {
+	server := getSigningServer(mockSigner{err: &http.MaxBytesError{Limit: 1024}}, func(req *http.Request) {
+		t.Errorf("Expected request to not be sent upstream")
+	})
+	mockRequest := getMockRequest("http://proxyserver/test", map[string]string{
+		forwardToHeader:      "http://somehost",
+		secretProviderHeader: "mock_signer",
+	}, t)
+	rw := httptest.NewRecorder()
+	server.ServeHTTP(rw, mockRequest)
+	if rw.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected status code to be %d but got %d", http.StatusRequestEntityTooLarge, rw.Code)
+	}
+	if _, code := getErrorResponse(t, rw); code != errorCodeRequestTooLarge {
+		t.Errorf("Expected error code %s but got %s", errorCodeRequestTooLarge, code)
+	}
+}
+
+func TestParseRoutesFromConfig_WithSigner(t *testing.T) {
+	signers := map[string]provider.RequestSigner{"mock_signer": mockSigner{}}
+	route := map[string]interface{}{
+		"match":      map[string]interface{}{"path_prefix": "/orders"},
+		"forward_to": "https://abc123.execute-api.us-east-1.amazonaws.com",
+		"provider":   "mock_signer",
+	}
+	routes, err := ParseRoutesFromConfig([]interface{}{route}, nil, signers, zerolog.Nop())
+	if err != nil {
+		t.Fatalf("Expected route without secret templates to be parsed. Received error %s", err)
+	}
+	if len(routes) != 1 || len(routes[0].injections) != 0 {
+		t.Errorf("Unexpected routes %v", routes)
+	}
+	route["header"] = "Authorization: ##secret##"
+	_, err = ParseRoutesFromConfig([]interface{}{route}, nil, signers, zerolog.Nop())
+	if err == nil {
+		t.Errorf("Expected an error for a secret template on a route of a signing provider")
+	}
+}
@@ -17,13 +17,12 @@ func getHeaderFromTemplate(
 ) (
 	headerKey string, headerVal string, err error,
 ) {
-	split := strings.Split(headerTemplate, ":")
-	if len(split) != 2 {
-		return headerKey, headerVal, errors.New(fmt.Sprintf("Header template %s is not valid", headerTemplate))
-	}
-	headerKey = split[0]
+	// only the first colon separates the key, the value may contain colons
+	headerKey, headerValTemplate, found := strings.Cut(headerTemplate, ":")
 	headerKey = strings.TrimSpace(headerKey)
-	headerValTemplate := split[1]
+	if !found || headerKey == "" {
+		return "", "", errors.New(fmt.Sprintf("Header template %s is not valid", headerTemplate))
+	}
 	headerValTemplate = strings.TrimSpace(headerValTemplate)
 	templ := template.Template{Templ: headerValTemplate, Logger: logger}
 	headerVal = templ.Substitute(substituteWith)
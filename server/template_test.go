@@ -32,6 +32,22 @@ var testCases = []testCase{
 		expectedHeaderVal: "Bearer some_secret",
 		expectedIsErr:     false,
 	},
+	{
+		name:              "value with colons",
+		template:          "X-Api-Key: key:##secret1##:suffix",
+		substituteWith:    "some_secret",
+		expectedHeaderKey: "X-Api-Key",
+		expectedHeaderVal: "key:some_secret:suffix",
+		expectedIsErr:     false,
+	},
+	{
+		name:              "missing header key",
+		template:          ": Bearer ##secret1##",
+		substituteWith:    "some_secret",
+		expectedHeaderKey: "",
+		expectedHeaderVal: "",
+		expectedIsErr:     true,
+	},
 	{
 		name:              "invalid template",
 		template:          "some string",
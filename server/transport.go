@@ -0,0 +1,310 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/hasura/hasura-secret-refresh/provider"
+	"github.com/rs/zerolog"
+)
+
+// ParseTransportFromConfig parses the 'transport' config of a provider or a
+// route. Returns nil if it is not configured, in which case requests are sent
+// with the default transport. Timeouts are in seconds.
+//
+//	transport:
+//	  dial_timeout: 10
+//	  tls_handshake_timeout: 10
+//	  response_header_timeout: 30
+//	  idle_conn_timeout: 90
+//	  http2: true
+//	  ca_bundle:
+//	    file: /etc/ssl/private-ca.pem
+//	  system_ca_certificates: true
+//	  client_certificate:
+//	    certificate:
+//	      provider: vault
+//	      provider_params:
+//	        X-Hasura-Vault-Path: tls/client
+//	      template: "##secret.certificate##"
+//	    private_key:
+//	      provider: vault
+//	      provider_params:
+//	        X-Hasura-Vault-Path: tls/client
+//	      template: "##secret.private_key##"
+func ParseTransportFromConfig(
+	config map[string]interface{}, providers map[string]provider.HttpProvider, logger zerolog.Logger,
+) (*http.Transport, error) {
+	transportI, found := config["transport"]
+	if !found {
+		return nil, nil
+	}
+	transportConfig, ok := transportI.(map[string]interface{})
+	if !ok {
+		logger.Error().Msg("transport: 'transport' must be an object")
+		return nil, fmt.Errorf("config not valid: 'transport' must be an object")
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	dialTimeout, err := getTimeout(transportConfig, "dial_timeout", logger)
+	if err != nil {
+		return nil, err
+	}
+	if dialTimeout != 0 {
+		dialer := &net.Dialer{Timeout: dialTimeout, KeepAlive: 30 * time.Second}
+		transport.DialContext = dialer.DialContext
+	}
+	timeouts := map[string]*time.Duration{
+		"tls_handshake_timeout":   &transport.TLSHandshakeTimeout,
+		"response_header_timeout": &transport.ResponseHeaderTimeout,
+		"idle_conn_timeout":       &transport.IdleConnTimeout,
+	}
+	for key, timeout := range timeouts {
+		value, err := getTimeout(transportConfig, key, logger)
+		if err != nil {
+			return nil, err
+		}
+		if value != 0 {
+			*timeout = value
+		}
+	}
+
+	if http2I, found := transportConfig["http2"]; found {
+		http2, ok := http2I.(bool)
+		if !ok {
+			logger.Error().Msg("transport: 'http2' must be a boolean")
+			return nil, fmt.Errorf("config not valid: 'http2' of 'transport' must be a boolean")
+		}
+		transport.ForceAttemptHTTP2 = http2
+		if !http2 {
+			// a non-nil empty map disables HTTP/2
+			transport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+		}
+	}
+
+	tlsMaterial := &rotatingTLS{systemRoots: true, logger: logger}
+	if caBundleI, found := transportConfig["ca_bundle"]; found {
+		tlsMaterial.caBundle, err = provider.ParseSecretSource(caBundleI, "transport.ca_bundle", providers, logger)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if systemRootsI, found := transportConfig["system_ca_certificates"]; found {
+		systemRoots, ok := systemRootsI.(bool)
+		if !ok {
+			logger.Error().Msg("transport: 'system_ca_certificates' must be a boolean")
+			return nil, fmt.Errorf("config not valid: 'system_ca_certificates' of 'transport' must be a boolean")
+		}
+		if !systemRoots && tlsMaterial.caBundle == nil {
+			logger.Error().Msg("transport: 'system_ca_certificates' can only be disabled with a 'ca_bundle'")
+			return nil, fmt.Errorf("config not valid: 'system_ca_certificates' of 'transport' can only be disabled with a 'ca_bundle'")
+		}
+		tlsMaterial.systemRoots = systemRoots
+	}
+	if clientCertI, found := transportConfig["client_certificate"]; found {
+		clientCert, ok := clientCertI.(map[string]interface{})
+		if !ok {
+			logger.Error().Msg("transport: 'client_certificate' must be an object")
+			return nil, fmt.Errorf("config not valid: 'client_certificate' of 'transport' must be an object")
+		}
+		certificateI, certFound := clientCert["certificate"]
+		privateKeyI, keyFound := clientCert["private_key"]
+		if !certFound || !keyFound {
+			logger.Error().Msg("transport: 'client_certificate' requires 'certificate' and 'private_key'")
+			return nil, fmt.Errorf("required configs not found: 'certificate' and 'private_key' of 'client_certificate'")
+		}
+		tlsMaterial.certificate, err = provider.ParseSecretSource(certificateI, "transport.client_certificate.certificate", providers, logger)
+		if err != nil {
+			return nil, err
+		}
+		tlsMaterial.privateKey, err = provider.ParseSecretSource(privateKeyI, "transport.client_certificate.private_key", providers, logger)
+		if err != nil {
+			return nil, err
+		}
+	}
+	transport.TLSClientConfig = tlsMaterial.tlsConfig()
+	if tlsMaterial.caBundle != nil {
+		if transport.ForceAttemptHTTP2 {
+			// the transport does not negotiate HTTP/2 on connections it
+			// did not establish itself
+			transport.TLSClientConfig.NextProtos = []string{"h2", "http/1.1"}
+		}
+		transport.DialTLSContext = tlsMaterial.dialTLSContext(transport)
+	}
+
+	logger.Info().
+		Bool("http2", transport.ForceAttemptHTTP2).
+		Bool("ca_bundle", tlsMaterial.caBundle != nil).
+		Bool("system_ca_certificates", tlsMaterial.systemRoots).
+		Bool("client_certificate", tlsMaterial.certificate != nil).
+		Msg("Upstream transport configured")
+	return transport, nil
+}
+
+func getTimeout(config map[string]interface{}, key string, logger zerolog.Logger) (time.Duration, error) {
+	timeoutI, found := config[key]
+	if !found {
+		return 0, nil
+	}
+	timeout, ok := timeoutI.(int)
+	if !ok || timeout <= 0 {
+		logger.Error().Msgf("transport: '%s' must be a positive number of seconds", key)
+		return 0, fmt.Errorf("config not valid: '%s' of 'transport' must be a positive number of seconds", key)
+	}
+	return time.Duration(timeout) * time.Second, nil
+}
+
+// rotatingTLS provides the CA bundle and the client certificate of a
+// transport. The parsed values are cached until the source changes.
+type rotatingTLS struct {
+	caBundle *provider.SecretSource
+	// systemRoots adds the system CA certificates to the CA bundle
+	systemRoots bool
+	certificate *provider.SecretSource
+	privateKey  *provider.SecretSource
+	logger      zerolog.Logger
+
+	mu            sync.Mutex
+	caBundlePem   string
+	rootCAs       *x509.CertPool
+	certPem       string
+	privateKeyPem string
+	clientCert    *tls.Certificate
+}
+
+func (r *rotatingTLS) tlsConfig() *tls.Config {
+	config := &tls.Config{}
+	if r.caBundle != nil {
+		// the certificate chain is verified in VerifyConnection against the
+		// current CA bundle instead of a pool fixed at startup. Connections
+		// dialed by dialTLSContext verify the dialed host, others, eg.
+		// through an HTTP proxy, verify the server name sent in SNI and fail
+		// for IP addresses.
+		config.InsecureSkipVerify = true
+		config.VerifyConnection = func(state tls.ConnectionState) error {
+			return r.verifyConnection(state, state.ServerName)
+		}
+	}
+	if r.certificate != nil {
+		config.GetClientCertificate = r.getClientCertificate
+	}
+	return config
+}
+
+func (r *rotatingTLS) getRootCAs() (*x509.CertPool, error) {
+	caBundle, err := r.caBundle.Read()
+	if err != nil {
+		return nil, fmt.Errorf("ca_bundle: %w", err)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.rootCAs != nil && caBundle == r.caBundlePem {
+		return r.rootCAs, nil
+	}
+	rootCAs := x509.NewCertPool()
+	if r.systemRoots {
+		if systemRoots, err := x509.SystemCertPool(); err == nil {
+			rootCAs = systemRoots
+		}
+	}
+	if !rootCAs.AppendCertsFromPEM([]byte(caBundle)) {
+		return nil, errors.New("ca_bundle: no PEM encoded certificates found")
+	}
+	r.logger.Info().Msg("transport: Loaded CA bundle")
+	r.caBundlePem, r.rootCAs = caBundle, rootCAs
+	return rootCAs, nil
+}
+
+// dialTLSContext establishes the TLS connections of the transport, verifying
+// the certificate of the server against the host that is dialed. The server
+// name of the connection is empty if the host is an IP address.
+func (r *rotatingTLS) dialTLSContext(transport *http.Transport) func(ctx context.Context, network, address string) (net.Conn, error) {
+	dial := transport.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	tlsConfig := transport.TLSClientConfig
+	handshakeTimeout := transport.TLSHandshakeTimeout
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := dial(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		host := dialHost(ctx, address)
+		config := tlsConfig.Clone()
+		if config.ServerName == "" {
+			config.ServerName = host
+		}
+		config.VerifyConnection = func(state tls.ConnectionState) error {
+			return r.verifyConnection(state, host)
+		}
+		if handshakeTimeout != 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, handshakeTimeout)
+			defer cancel()
+		}
+		tlsConn := tls.Client(conn, config)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tlsConn, nil
+	}
+}
+
+func (r *rotatingTLS) verifyConnection(state tls.ConnectionState, host string) error {
+	if len(state.PeerCertificates) == 0 {
+		return errors.New("server did not present a certificate")
+	}
+	if host == "" {
+		return errors.New("server name is not known, the certificate cannot be verified")
+	}
+	rootCAs, err := r.getRootCAs()
+	if err != nil {
+		r.logger.Err(err).Msg("transport: Unable to load CA bundle")
+		return err
+	}
+	options := x509.VerifyOptions{
+		DNSName:       host,
+		Roots:         rootCAs,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range state.PeerCertificates[1:] {
+		options.Intermediates.AddCert(cert)
+	}
+	_, err = state.PeerCertificates[0].Verify(options)
+	return err
+}
+
+func (r *rotatingTLS) getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	certPem, err := r.certificate.Read()
+	if err != nil {
+		r.logger.Err(err).Msg("transport: Unable to load client certificate")
+		return nil, fmt.Errorf("client_certificate.certificate: %w", err)
+	}
+	privateKeyPem, err := r.privateKey.Read()
+	if err != nil {
+		r.logger.Err(err).Msg("transport: Unable to load client certificate private key")
+		return nil, fmt.Errorf("client_certificate.private_key: %w", err)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.clientCert != nil && certPem == r.certPem && privateKeyPem == r.privateKeyPem {
+		return r.clientCert, nil
+	}
+	clientCert, err := tls.X509KeyPair([]byte(certPem), []byte(privateKeyPem))
+	if err != nil {
+		r.logger.Err(err).Msg("transport: Client certificate is not valid")
+		return nil, fmt.Errorf("client_certificate: %w", err)
+	}
+	r.logger.Info().Msg("transport: Loaded client certificate")
+	r.certPem, r.privateKeyPem, r.clientCert = certPem, privateKeyPem, &clientCert
+	return &clientCert, nil
+}
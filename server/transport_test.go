@@ -0,0 +1,347 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hasura/hasura-secret-refresh/provider"
+	"github.com/rs/zerolog"
+)
+
+type testCertificate struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPem string
+	keyPem  string
+}
+
+// newTestCertificate creates a CA certificate if parent is nil and a leaf
+// certificate signed by parent otherwise
+func newTestCertificate(t *testing.T, serial int64, parent *testCertificate) testCertificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Unable to generate key: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: fmt.Sprintf("test-%d", serial)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		template.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("Unable to create certificate: %s", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	return testCertificate{
+		cert:    cert,
+		key:     key,
+		certPem: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		keyPem:  string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})),
+	}
+}
+
+// pemProvider returns the values of secrets set by the test
+type pemProvider struct {
+	secrets map[string]string
+}
+
+type pemFetcher struct {
+	pemProvider
+	secretId string
+}
+
+func (f pemFetcher) FetchSecret() (string, error) {
+	secret, found := f.secrets[f.secretId]
+	if !found {
+		return "", errors.New("secret not found")
+	}
+	return secret, nil
+}
+
+func (p pemProvider) SecretFetcher(header http.Header) (provider.SecretFetcher, error) {
+	return pemFetcher{pemProvider: p, secretId: header.Get("X-Hasura-Secret-Id")}, nil
+}
+
+func (p pemProvider) DeleteConfigHeaders(header *http.Header) {}
+
+// startMutualTLSServer starts a server with a certificate signed by serverCA
+// that requires a client certificate signed by clientCA. It responds with the
+// serial number of the client certificate.
+func startMutualTLSServer(t *testing.T, serverCA, clientCA testCertificate) *httptest.Server {
+	serverCert := newTestCertificate(t, 100, &serverCA)
+	tlsCert, err := tls.X509KeyPair([]byte(serverCert.certPem), []byte(serverCert.keyPem))
+	if err != nil {
+		t.Fatalf("Unable to load server certificate: %s", err)
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCA.cert)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte(r.TLS.PeerCertificates[0].SerialNumber.String()))
+	}))
+	server.EnableHTTP2 = true
+	server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{tlsCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server
+}
+
+func getWithTransport(transport *http.Transport, url string) (*http.Response, string, error) {
+	response, err := (&http.Client{Transport: transport}).Get(url)
+	if err != nil {
+		return nil, "", err
+	}
+	defer response.Body.Close()
+	body := make([]byte, 64)
+	n, _ := response.Body.Read(body)
+	return response, string(body[:n]), nil
+}
+
+func TestParseTransportFromConfig_MutualTLS(t *testing.T) {
+	serverCA := newTestCertificate(t, 1, nil)
+	clientCA := newTestCertificate(t, 2, nil)
+	otherCA := newTestCertificate(t, 3, nil)
+	server := startMutualTLSServer(t, serverCA, clientCA)
+
+	caBundleFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caBundleFile, []byte(otherCA.certPem), 0600); err != nil {
+		t.Fatalf("Unable to write CA bundle: %s", err)
+	}
+	clientCert := newTestCertificate(t, 10, &clientCA)
+	certProvider := pemProvider{secrets: map[string]string{
+		"client": fmt.Sprintf(`{"certificate": %q, "private_key": %q}`, clientCert.certPem, clientCert.keyPem),
+	}}
+	providers := map[string]provider.HttpProvider{"pem_provider": certProvider}
+	clientCertSource := func(field string) map[string]interface{} {
+		return map[string]interface{}{
+			"provider":        "pem_provider",
+			"provider_params": map[string]interface{}{"X-Hasura-Secret-Id": "client"},
+			"template":        fmt.Sprintf("##secret.%s##", field),
+		}
+	}
+	config := map[string]interface{}{
+		"transport": map[string]interface{}{
+			"tls_handshake_timeout": 5,
+			"ca_bundle":             map[string]interface{}{"file": caBundleFile},
+			"client_certificate": map[string]interface{}{
+				"certificate": clientCertSource("certificate"),
+				"private_key": clientCertSource("private_key"),
+			},
+		},
+	}
+	transport, err := ParseTransportFromConfig(config, providers, zerolog.Nop())
+	if err != nil {
+		t.Fatalf("Unable to parse transport: %s", err)
+	}
+
+	// the server certificate is not signed by the CA in the bundle
+	if _, _, err := getWithTransport(transport, server.URL); err == nil {
+		t.Errorf("Expected request to fail with a CA bundle that does not trust the server")
+	}
+
+	if err := os.WriteFile(caBundleFile, []byte(otherCA.certPem+serverCA.certPem), 0600); err != nil {
+		t.Fatalf("Unable to write CA bundle: %s", err)
+	}
+	response, serial, err := getWithTransport(transport, server.URL)
+	if err != nil {
+		t.Fatalf("Expected request to succeed after the CA bundle was rotated: %s", err)
+	}
+	if serial != "10" {
+		t.Errorf("Expected server to receive client certificate 10 but got %s", serial)
+	}
+	if response.ProtoMajor != 2 {
+		t.Errorf("Expected HTTP/2 to be used but got %s", response.Proto)
+	}
+
+	rotatedCert := newTestCertificate(t, 11, &clientCA)
+	certProvider.secrets["client"] = fmt.Sprintf(`{"certificate": %q, "private_key": %q}`, rotatedCert.certPem, rotatedCert.keyPem)
+	transport.CloseIdleConnections()
+	_, serial, err = getWithTransport(transport, server.URL)
+	if err != nil {
+		t.Fatalf("Expected request to succeed after the client certificate was rotated: %s", err)
+	}
+	if serial != "11" {
+		t.Errorf("Expected server to receive rotated client certificate 11 but got %s", serial)
+	}
+}
+
+func TestParseTransportFromConfig_HTTP2Disabled(t *testing.T) {
+	serverCA := newTestCertificate(t, 1, nil)
+	clientCA := newTestCertificate(t, 2, nil)
+	server := startMutualTLSServer(t, serverCA, clientCA)
+	dir := t.TempDir()
+	clientCert := newTestCertificate(t, 10, &clientCA)
+	files := map[string]string{"ca.pem": serverCA.certPem, "cert.pem": clientCert.certPem, "key.pem": clientCert.keyPem}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatalf("Unable to write %s: %s", name, err)
+		}
+	}
+	config := map[string]interface{}{
+		"transport": map[string]interface{}{
+			"http2":     false,
+			"ca_bundle": map[string]interface{}{"file": filepath.Join(dir, "ca.pem")},
+			"client_certificate": map[string]interface{}{
+				"certificate": map[string]interface{}{"file": filepath.Join(dir, "cert.pem")},
+				"private_key": map[string]interface{}{"file": filepath.Join(dir, "key.pem")},
+			},
+		},
+	}
+	transport, err := ParseTransportFromConfig(config, nil, zerolog.Nop())
+	if err != nil {
+		t.Fatalf("Unable to parse transport: %s", err)
+	}
+	response, _, err := getWithTransport(transport, server.URL)
+	if err != nil {
+		t.Fatalf("Expected request to succeed: %s", err)
+	}
+	if response.ProtoMajor != 1 {
+		t.Errorf("Expected HTTP/1.1 to be used but got %s", response.Proto)
+	}
+}
+
+func TestParseTransportFromConfig_VerifiesDialedHost(t *testing.T) {
+	serverCA := newTestCertificate(t, 1, nil)
+	// the certificate is signed by the CA in the bundle but is not valid for
+	// the address of the server
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(100),
+		DNSNames:     []string{"other.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, serverCA.cert, &key.PublicKey, serverCA.key)
+	if err != nil {
+		t.Fatalf("Unable to create certificate: %s", err)
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {}))
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	server.StartTLS()
+	defer server.Close()
+
+	caBundleFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caBundleFile, []byte(serverCA.certPem), 0600); err != nil {
+		t.Fatalf("Unable to write CA bundle: %s", err)
+	}
+	config := map[string]interface{}{
+		"transport": map[string]interface{}{
+			"ca_bundle":              map[string]interface{}{"file": caBundleFile},
+			"system_ca_certificates": false,
+		},
+	}
+	transport, err := ParseTransportFromConfig(config, nil, zerolog.Nop())
+	if err != nil {
+		t.Fatalf("Unable to parse transport: %s", err)
+	}
+	if _, _, err := getWithTransport(transport, server.URL); err == nil {
+		t.Errorf("Expected request to fail with a certificate that is not valid for the IP address of the server")
+	}
+}
+
+func TestParseTransportFromConfig_Invalid(t *testing.T) {
+	transport, err := ParseTransportFromConfig(map[string]interface{}{}, nil, zerolog.Nop())
+	if err != nil || transport != nil {
+		t.Errorf("Expected no transport when it is not configured")
+	}
+	providers := map[string]provider.HttpProvider{"mock_provider": mockProvider{}}
+	invalidConfigs := map[string]interface{}{
+		"not an object":             "default",
+		"negative timeout":          map[string]interface{}{"dial_timeout": -1},
+		"timeout not a number":      map[string]interface{}{"idle_conn_timeout": "90s"},
+		"http2 not a boolean":       map[string]interface{}{"http2": "yes"},
+		"file and provider":         map[string]interface{}{"ca_bundle": map[string]interface{}{"file": "ca.pem", "provider": "mock_provider"}},
+		"no file or provider":       map[string]interface{}{"ca_bundle": map[string]interface{}{}},
+		"unknown provider":          map[string]interface{}{"ca_bundle": map[string]interface{}{"provider": "unknown"}},
+		"invalid provider params":   map[string]interface{}{"ca_bundle": map[string]interface{}{"provider": "mock_provider"}},
+		"system CAs not a boolean":  map[string]interface{}{"ca_bundle": map[string]interface{}{"file": "ca.pem"}, "system_ca_certificates": "no"},
+		"system CAs without bundle": map[string]interface{}{"system_ca_certificates": false},
+		"missing private key":       map[string]interface{}{"client_certificate": map[string]interface{}{"certificate": map[string]interface{}{"file": "cert.pem"}}},
+		"client certificate value":  map[string]interface{}{"client_certificate": "cert.pem"},
+	}
+	for name, transportConfig := range invalidConfigs {
+		config := map[string]interface{}{"transport": transportConfig}
+		_, err := ParseTransportFromConfig(config, providers, zerolog.Nop())
+		if err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestEndpoint_WithRouteTransport(t *testing.T) {
+	providers := map[string]provider.HttpProvider{"mock_provider": mockProvider{}}
+	routes, err := ParseRoutesFromConfig([]interface{}{
+		map[string]interface{}{
+			"match":           map[string]interface{}{"path_prefix": "/payments"},
+			"forward_to":      "http://payments.example.com",
+			"provider":        "mock_provider",
+			"provider_params": map[string]interface{}{"x-hasura-secret-id": "payments_secret"},
+			"header":          "Authorization: Bearer ##secret##",
+			"transport":       map[string]interface{}{"response_header_timeout": 30},
+		},
+	}, providers, nil, zerolog.Nop())
+	if err != nil {
+		t.Fatalf("Unable to parse routes: %s", err)
+	}
+	if routes[0].transport == nil || routes[0].transport.ResponseHeaderTimeout != 30*time.Second {
+		t.Fatalf("Expected route transport to be configured")
+	}
+	providerTransport := http.DefaultTransport.(*http.Transport).Clone()
+	config := Config{
+		Providers:          providers,
+		Routes:             routes,
+		ProviderTransports: map[string]*http.Transport{"mock_provider": providerTransport},
+	}
+	testCases := map[string]*http.Transport{
+		"http://localhost:5353/payments": routes[0].transport,
+		"http://localhost:5353/other":    providerTransport,
+	}
+	for requestUrl, expected := range testCases {
+		withHeaders := map[string]string{
+			forwardToHeader:      "http://somehost",
+			"X-Hasura-Secret-Id": "secret123",
+			secretProviderHeader: "mock_provider",
+			templateHeader:       "Auth: Bearer ##secret##",
+		}
+		mockRequest := getMockRequest(requestUrl, withHeaders, t)
+		rw := httptest.NewRecorder()
+		details, ok := getRequestRewriteDetails(rw, mockRequest, config, zerolog.Nop())
+		transport := details.transport
+		if !ok {
+			t.Fatalf("%s: Expected 'ok' to be true", requestUrl)
+		}
+		if transport != expected {
+			t.Errorf("%s: Unexpected transport", requestUrl)
+		}
+	}
+}
@@ -10,11 +10,11 @@ import (
 	Generates an error in the format supported by Hasura actions.
 	Refer: https://hasura.io/docs/latest/actions/action-handlers/#returning-an-error-response
 */
-func makeHasuraError(errorMsg string) string {
+func makeHasuraError(errorMsg string, code string) string {
 	jsonMap := map[string]interface{}{
 		"message": errorMsg,
 		"extensions": map[string]string{
-			"code": "hasura-error",
+			"code": code,
 		},
 	}
 	json, _ := json.Marshal(jsonMap)
@@ -29,6 +29,17 @@ func getUrlWithSchemeAndHost(inpUrl *url.URL) (newUrl *url.URL) {
 	return
 }
 
+func getUrlWithoutFragment(inpUrl *url.URL) (newUrl *url.URL) {
+	newUrl = &url.URL{
+		Scheme:   inpUrl.Scheme,
+		Host:     inpUrl.Host,
+		Path:     inpUrl.Path,
+		RawPath:  inpUrl.RawPath,
+		RawQuery: inpUrl.RawQuery,
+	}
+	return
+}
+
 func parseUrl(input string) (parsedUrl *url.URL, err error) {
 	parsedUrl, err = url.Parse(input)
 	if err != nil {
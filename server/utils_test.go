@@ -11,11 +11,11 @@ func TestServerUtils_MakeHasuraError(t *testing.T) {
 	expectedResultMap := map[string]interface{}{
 		"message": mockErrorMessage,
 		"extensions": map[string]string{
-			"code": "hasura-error",
+			"code": errorCodeSecretNotFound,
 		},
 	}
 	expectedResult, _ := json.Marshal(expectedResultMap)
-	actualResult := makeHasuraError(mockErrorMessage)
+	actualResult := makeHasuraError(mockErrorMessage, errorCodeSecretNotFound)
 	if string(expectedResult) != actualResult {
 		t.Fail()
 	}